@@ -1,12 +1,115 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
+	"fmt"
 	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/MORpheusSoftware/NFA/BaseImage/proxy"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(runReplay(os.Args[2:]))
+	}
+
+	configPath := flag.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML, TOML or JSON config file")
+	printConfig := flag.Bool("print-config", false, "print the effective configuration with the source of each value and exit")
+	flag.Parse()
+
 	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
-	proxy.StartProxyServer()
-}
\ No newline at end of file
+
+	if *printConfig {
+		cfg, err := proxy.LoadConfig(*configPath)
+		if err != nil {
+			log.Fatalf("Invalid configuration: %v", err)
+		}
+		cfg.Print(os.Stdout)
+		if err := cfg.Validate(); err != nil {
+			fmt.Fprintf(os.Stderr, "\nInvalid configuration:\n%v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	proxy.StartProxyServer(*configPath)
+}
+
+// headerFlags collects repeated -header "Name: value" flags
+type headerFlags http.Header
+
+func (h headerFlags) String() string { return "" }
+
+func (h headerFlags) Set(v string) error {
+	name, value, ok := strings.Cut(v, ":")
+	if !ok {
+		return fmt.Errorf("expected \"Name: value\", got %q", v)
+	}
+	http.Header(h).Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	return nil
+}
+
+// defaultReplayTarget is the local proxy at the port and scheme configured by
+// CONFIG_FILE and the environment, or the default port 8081
+func defaultReplayTarget() string {
+	cfg, err := proxy.LoadConfig(os.Getenv("CONFIG_FILE"))
+	if err != nil {
+		return "http://localhost:8081"
+	}
+	scheme := "http"
+	if cfg.Server.TLS.Enabled() {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://localhost:%s", scheme, cfg.Server.Port)
+}
+
+// runReplay re-sends requests from an audit log and prints one JSON result per
+// request. It exits with 1 when a request fails or its output differs.
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	file := fs.String("file", os.Getenv("AUDIT_LOG_FILE"), "audit log to replay")
+	target := fs.String("target", defaultReplayTarget(), "base URL of the proxy or mock to send requests to")
+	ids := fs.String("request-id", "", "comma-separated request IDs to replay (default all)")
+	timeout := fs.Duration("timeout", 5*time.Minute, "timeout per request")
+	headers := headerFlags{}
+	fs.Var(headers, "header", "header to send with every request, e.g. \"Authorization: Bearer sk-...\" (repeatable)")
+	fs.Parse(args)
+
+	f, err := os.Open(*file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open audit log: %v\n", err)
+		return 1
+	}
+	defer f.Close()
+	records, err := proxy.ReadAuditLog(f)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read audit log: %v\n", err)
+		return 1
+	}
+
+	opts := proxy.ReplayOptions{Target: *target, Headers: http.Header(headers), Timeout: *timeout}
+	if *ids != "" {
+		opts.RequestIDs = strings.Split(*ids, ",")
+	}
+	results := proxy.Replay(records, opts)
+
+	enc := json.NewEncoder(os.Stdout)
+	mismatched := 0
+	for _, result := range results {
+		enc.Encode(result)
+		if !result.Match {
+			mismatched++
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Replayed %d requests against %s, %d matched, %d differed or failed\n",
+		len(results), *target, len(results)-mismatched, mismatched)
+	if mismatched > 0 {
+		return 1
+	}
+	return 0
+}
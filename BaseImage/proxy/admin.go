@@ -0,0 +1,242 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// requireAdmin checks the request was authenticated with the admin scope, or
+// carries admin_api_key as a bearer token when inbound auth is not configured,
+// and writes an error response when it does not.
+func (p *Proxy) requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if id := IdentityFromContext(r.Context()); id != nil {
+		if !id.HasScope(ScopeAdmin) {
+			respondWithAPIError(w, http.StatusForbidden, newAPIError("permission_error", "insufficient_scope", "", "Admin scope required"))
+			return false
+		}
+		return true
+	}
+
+	adminKey := p.cfg().AdminAPIKey
+	if adminKey == "" {
+		respondWithAPIError(w, http.StatusForbidden, newAPIError("permission_error", "", "", "Admin API is disabled; set ADMIN_API_KEY to enable it"))
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(bearerToken(r)), []byte(adminKey)) != 1 {
+		respondWithAPIError(w, http.StatusUnauthorized, newAPIError("invalid_request_error", "invalid_api_key", "", "Invalid admin API key"))
+		return false
+	}
+	return true
+}
+
+func writeAdminJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// AdminSession describes a session held by the proxy
+type AdminSession struct {
+	SessionID        string    `json:"session_id"`
+	ModelID          string    `json:"model_id"`
+	Model            string    `json:"model,omitempty"`
+	Node             string    `json:"node,omitempty"`
+	CreatedAt        time.Time `json:"created_at"`
+	ExpiresAt        time.Time `json:"expires_at"`
+	AgeSeconds       int64     `json:"age_seconds"`
+	ExpiresInSeconds int64     `json:"expires_in_seconds"`
+	Requests         int       `json:"requests"`
+}
+
+// activeAdminSessions lists unexpired sessions, oldest first
+func (p *Proxy) activeAdminSessions(now time.Time) []AdminSession {
+	p.sessions.RLock()
+	defer p.sessions.RUnlock()
+	sessions := []AdminSession{}
+	for _, s := range p.sessions.m {
+		if !now.Before(s.ExpiresAt) {
+			continue
+		}
+		sessions = append(sessions, AdminSession{
+			SessionID:        s.SessionID,
+			ModelID:          s.ModelID,
+			Model:            s.ModelName,
+			Node:             s.Node,
+			CreatedAt:        s.Created,
+			ExpiresAt:        s.ExpiresAt,
+			AgeSeconds:       int64(now.Sub(s.Created).Seconds()),
+			ExpiresInSeconds: int64(s.ExpiresAt.Sub(now).Seconds()),
+			Requests:         s.Requests,
+		})
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].CreatedAt.Before(sessions[j].CreatedAt) })
+	return sessions
+}
+
+// handleAdminSessions lists sessions on GET /admin/sessions and closes one on
+// chain on DELETE /admin/sessions/{id}.
+func (p *Proxy) handleAdminSessions(w http.ResponseWriter, r *http.Request) {
+	if !p.requireAdmin(w, r) {
+		return
+	}
+	sessionID := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/sessions"), "/")
+
+	switch {
+	case r.Method == http.MethodGet && sessionID == "":
+		writeAdminJSON(w, map[string]interface{}{"sessions": p.activeAdminSessions(time.Now())})
+	case r.Method == http.MethodDelete && sessionID != "":
+		p.sessions.RLock()
+		_, exists := p.sessions.m[sessionID]
+		p.sessions.RUnlock()
+		if !exists {
+			respondWithAPIError(w, http.StatusNotFound, newAPIError("invalid_request_error", "", "", fmt.Sprintf("Session %s is not held by this proxy", sessionID)))
+			return
+		}
+		if err := p.closeSession(sessionID); err != nil {
+			p.logger.Printf("Error closing session %s: %v", sessionID, err)
+			respondWithAPIError(w, http.StatusBadGateway, newAPIError("server_error", "", "", fmt.Sprintf("Failed to close session: %v", err)))
+			return
+		}
+		p.sessions.Lock()
+		delete(p.sessions.m, sessionID)
+		p.sessions.Unlock()
+		p.logger.Printf("Closed session %s from the admin API", sessionID)
+		writeAdminJSON(w, map[string]interface{}{"session_id": sessionID, "closed": true})
+	default:
+		respondWithAPIError(w, http.StatusMethodNotAllowed, newAPIError("invalid_request_error", "", "", "Method not allowed"))
+	}
+}
+
+// closeSession closes a session on chain through the consumer node. The
+// close is a transaction from the node's wallet, so it waits for the
+// wallet's other transactions.
+func (p *Proxy) closeSession(sessionID string) error {
+	node := p.sessionNode(sessionID)
+	endpoint := fmt.Sprintf("%s/blockchain/sessions/%s/close", node.URL, sessionID)
+	client := p.httpClient(p.cfg().Marketplace.RequestTimeout.Duration)
+	return p.sendTx(node.URL, func() error {
+		req, err := http.NewRequest(http.MethodPost, endpoint, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			body, _ := io.ReadAll(resp.Body)
+			return chainError("close session", resp.StatusCode, body)
+		}
+		return nil
+	})
+}
+
+// handleAdminModelCache lists the cached model lookups on GET and flushes them
+// on DELETE, so the next request re-reads the marketplace model list.
+func (p *Proxy) handleAdminModelCache(w http.ResponseWriter, r *http.Request) {
+	if !p.requireAdmin(w, r) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		type cachedModel struct {
+			Handle    string    `json:"handle"`
+			ModelID   string    `json:"model_id"`
+			ModelName string    `json:"model_name,omitempty"`
+			CachedAt  time.Time `json:"cached_at"`
+		}
+		p.models.RLock()
+		models := []cachedModel{}
+		for handle, m := range p.models.m {
+			models = append(models, cachedModel{Handle: handle, ModelID: m.ModelID, ModelName: m.ModelName, CachedAt: m.Created})
+		}
+		p.models.RUnlock()
+		sort.Slice(models, func(i, j int) bool { return models[i].Handle < models[j].Handle })
+		writeAdminJSON(w, map[string]interface{}{"models": models})
+	case http.MethodDelete:
+		p.models.Lock()
+		flushed := len(p.models.m)
+		p.models.m = make(map[string]CachedModel)
+		p.models.Unlock()
+		p.logger.Printf("Flushed %d cached models from the admin API", flushed)
+		writeAdminJSON(w, map[string]interface{}{"flushed": flushed})
+	default:
+		respondWithAPIError(w, http.StatusMethodNotAllowed, newAPIError("invalid_request_error", "", "", "Method not allowed"))
+	}
+}
+
+// handleAdminCircuitBreaker reports the marketplace circuit breaker state
+func (p *Proxy) handleAdminCircuitBreaker(w http.ResponseWriter, r *http.Request) {
+	if !p.requireAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		respondWithAPIError(w, http.StatusMethodNotAllowed, newAPIError("invalid_request_error", "", "", "Method not allowed"))
+		return
+	}
+	counts := p.breaker.Counts()
+	cfg := p.cfg().CircuitBreaker
+	writeAdminJSON(w, map[string]interface{}{
+		"name":  p.breaker.Name(),
+		"state": p.breaker.State().String(),
+		"counts": map[string]uint32{
+			"requests":              counts.Requests,
+			"total_successes":       counts.TotalSuccesses,
+			"total_failures":        counts.TotalFailures,
+			"consecutive_successes": counts.ConsecutiveSuccesses,
+			"consecutive_failures":  counts.ConsecutiveFailures,
+		},
+		"settings": cfg,
+	})
+}
+
+// handleAdminLogLevel reports the log level on GET and changes it on PUT with
+// a body of {"level": "debug"}. The change lasts until the next restart or
+// config reload.
+func (p *Proxy) handleAdminLogLevel(w http.ResponseWriter, r *http.Request) {
+	if !p.requireAdmin(w, r) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		var body struct {
+			Level string `json:"level"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			respondWithAPIError(w, http.StatusBadRequest, newAPIError("invalid_request_error", "", "", "Invalid JSON body"))
+			return
+		}
+		level := strings.ToLower(body.Level)
+		if level != "debug" && level != "info" {
+			respondWithAPIError(w, http.StatusBadRequest, newAPIError("invalid_request_error", "", "", "level must be debug or info"))
+			return
+		}
+		p.setRuntimeLogLevel(level)
+		p.logger.Printf("Log level set to %s from the admin API", level)
+	default:
+		respondWithAPIError(w, http.StatusMethodNotAllowed, newAPIError("invalid_request_error", "", "", "Method not allowed"))
+		return
+	}
+	cfg := p.cfg()
+	writeAdminJSON(w, map[string]string{"level": cfg.LogLevel, "source": cfg.Source("log_level")})
+}
+
+// setRuntimeLogLevel installs a copy of the active config with a new log level
+func (p *Proxy) setRuntimeLogLevel(level string) {
+	current := p.cfg()
+	next := *current
+	next.LogLevel = level
+	next.sources = make(map[string]string, len(current.sources)+1)
+	for path, source := range current.sources {
+		next.sources[path] = source
+	}
+	next.sources["log_level"] = "admin API"
+	p.setConfig(&next)
+}
@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func adminRequest(t *testing.T, handler http.HandlerFunc, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	w := httptest.NewRecorder()
+	handler(w, req)
+	return w
+}
+
+func TestAdminSessions(t *testing.T) {
+	var closed []string
+	marketplace := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/close") {
+			closed = append(closed, r.URL.Path)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer marketplace.Close()
+	t.Setenv("MARKETPLACE_URL", marketplace.URL)
+	t.Setenv("ADMIN_API_KEY", "admin-secret")
+
+	now := time.Now()
+	sessionCache.Lock()
+	sessionCache.m["0xabc"] = CachedSession{SessionID: "0xabc", ModelID: "0x1", ModelName: "llama", Created: now.Add(-time.Minute), ExpiresAt: now.Add(time.Hour), Requests: 4}
+	sessionCache.m["0xold"] = CachedSession{SessionID: "0xold", ModelID: "0x1", Created: now.Add(-2 * time.Hour), ExpiresAt: now.Add(-time.Hour)}
+	sessionCache.Unlock()
+	defer func() {
+		sessionCache.Lock()
+		sessionCache.m = make(map[string]CachedSession)
+		sessionCache.Unlock()
+	}()
+
+	p := NewProxy()
+	w := adminRequest(t, p.handleAdminSessions, http.MethodGet, "/admin/sessions", "")
+	var list struct {
+		Sessions []AdminSession `json:"sessions"`
+	}
+	json.NewDecoder(w.Body).Decode(&list)
+	if len(list.Sessions) != 1 {
+		t.Fatalf("sessions = %+v, want only the unexpired one", list.Sessions)
+	}
+	s := list.Sessions[0]
+	if s.SessionID != "0xabc" || s.Model != "llama" || s.Requests != 4 || s.AgeSeconds < 59 || s.ExpiresInSeconds < 3590 {
+		t.Errorf("unexpected session: %+v", s)
+	}
+
+	if w := adminRequest(t, p.handleAdminSessions, http.MethodDelete, "/admin/sessions/0xmissing", ""); w.Code != http.StatusNotFound {
+		t.Errorf("unknown session status = %d, want 404", w.Code)
+	}
+	if w := adminRequest(t, p.handleAdminSessions, http.MethodDelete, "/admin/sessions/0xabc", ""); w.Code != http.StatusOK {
+		t.Fatalf("close status = %d: %s", w.Code, w.Body.String())
+	}
+	if len(closed) != 1 || closed[0] != "/blockchain/sessions/0xabc/close" {
+		t.Errorf("close calls = %v", closed)
+	}
+	sessionCache.RLock()
+	_, exists := sessionCache.m["0xabc"]
+	sessionCache.RUnlock()
+	if exists {
+		t.Error("closed session should be removed from the cache")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/sessions", nil)
+	w = httptest.NewRecorder()
+	p.handleAdminSessions(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status without admin key = %d, want 401", w.Code)
+	}
+}
+
+func TestAdminModelCacheFlush(t *testing.T) {
+	t.Setenv("ADMIN_API_KEY", "admin-secret")
+	// Other tests leave models in the shared cache
+	modelCache.Lock()
+	modelCache.m = map[string]CachedModel{"llama": {ModelID: "0x1", ModelName: "llama-3", Created: time.Now()}}
+	modelCache.Unlock()
+
+	p := NewProxy()
+	w := adminRequest(t, p.handleAdminModelCache, http.MethodGet, "/admin/models/cache", "")
+	if !strings.Contains(w.Body.String(), `"handle":"llama"`) {
+		t.Errorf("cache listing missing entry: %s", w.Body.String())
+	}
+
+	w = adminRequest(t, p.handleAdminModelCache, http.MethodDelete, "/admin/models/cache", "")
+	if strings.TrimSpace(w.Body.String()) != `{"flushed":1}` {
+		t.Errorf("flush response = %s", w.Body.String())
+	}
+	modelCache.RLock()
+	defer modelCache.RUnlock()
+	if len(modelCache.m) != 0 {
+		t.Errorf("model cache still holds %d entries", len(modelCache.m))
+	}
+}
+
+func TestAdminCircuitBreaker(t *testing.T) {
+	t.Setenv("ADMIN_API_KEY", "admin-secret")
+	w := adminRequest(t, NewProxy().handleAdminCircuitBreaker, http.MethodGet, "/admin/circuit-breaker", "")
+	var resp struct {
+		Name   string            `json:"name"`
+		State  string            `json:"state"`
+		Counts map[string]uint32 `json:"counts"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Name != "marketplace" || resp.State != "closed" {
+		t.Errorf("unexpected breaker status: %+v", resp)
+	}
+}
+
+func TestAdminLogLevel(t *testing.T) {
+	t.Setenv("ADMIN_API_KEY", "admin-secret")
+	cfg, _ := LoadConfig("")
+	setConfig(cfg)
+	defer setConfig(nil)
+	defer setLogLevel("info")
+
+	p := NewProxy()
+	if w := adminRequest(t, p.handleAdminLogLevel, http.MethodPut, "/admin/log-level", `{"level":"loud"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid level status = %d, want 400", w.Code)
+	}
+	w := adminRequest(t, p.handleAdminLogLevel, http.MethodPut, "/admin/log-level", `{"level":"debug"}`)
+	if strings.TrimSpace(w.Body.String()) != `{"level":"debug","source":"admin API"}` {
+		t.Errorf("response = %s", w.Body.String())
+	}
+	if !debugLogging.Load() || currentConfig().LogLevel != "debug" {
+		t.Error("debug logging not enabled")
+	}
+}
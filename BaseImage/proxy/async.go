@@ -0,0 +1,588 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AsyncConfig configures asynchronous chat jobs and their webhooks
+type AsyncConfig struct {
+	// MaxPending caps the jobs that are queued or running at once
+	MaxPending int `json:"max_pending" env:"ASYNC_MAX_PENDING"`
+	// JobTTL is how long a finished job can still be fetched
+	JobTTL Duration `json:"job_ttl"`
+	// WebhookSecret signs webhook deliveries. Jobs with a webhook are refused
+	// without it.
+	WebhookSecret  string   `json:"webhook_secret" env:"ASYNC_WEBHOOK_SECRET" secret:"true"`
+	WebhookTimeout Duration `json:"webhook_timeout"`
+	// WebhookAllowedHosts lists webhook hosts that may resolve to loopback,
+	// private or link-local addresses, which are refused otherwise
+	WebhookAllowedHosts []string `json:"webhook_allowed_hosts" env:"ASYNC_WEBHOOK_ALLOWED_HOSTS"`
+	// WebhookRetries is how many times a failed delivery is repeated before
+	// it is dead-lettered
+	WebhookRetries        int      `json:"webhook_retries" env:"ASYNC_WEBHOOK_RETRIES"`
+	WebhookRetryBaseDelay Duration `json:"webhook_retry_base_delay"`
+	WebhookRetryMaxDelay  Duration `json:"webhook_retry_max_delay"`
+	// DeadLetterFile, if set, receives a JSON line for every dead-lettered
+	// delivery, with its payload
+	DeadLetterFile string `json:"dead_letter_file" env:"ASYNC_DEAD_LETTER_FILE"`
+}
+
+func (c AsyncConfig) validate() error {
+	var errs []error
+	if c.MaxPending < 1 {
+		errs = append(errs, errors.New("max_pending must be at least 1"))
+	}
+	if c.JobTTL.Duration <= 0 {
+		errs = append(errs, errors.New("job_ttl must be positive"))
+	}
+	if c.WebhookTimeout.Duration <= 0 {
+		errs = append(errs, errors.New("webhook_timeout must be positive"))
+	}
+	if c.WebhookRetries < 0 {
+		errs = append(errs, errors.New("webhook_retries must not be negative"))
+	}
+	if c.WebhookRetryBaseDelay.Duration < 0 || c.WebhookRetryMaxDelay.Duration < c.WebhookRetryBaseDelay.Duration {
+		errs = append(errs, errors.New("webhook_retry_max_delay must be at least webhook_retry_base_delay, which must not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+// Async job statuses
+const (
+	AsyncQueued    = "queued"
+	AsyncRunning   = "running"
+	AsyncSucceeded = "succeeded"
+	AsyncFailed    = "failed"
+)
+
+// Webhook delivery statuses
+const (
+	WebhookPending      = "pending"
+	WebhookDelivered    = "delivered"
+	WebhookDeadLettered = "dead_lettered"
+)
+
+// asyncSweepInterval is how often expired async jobs are dropped
+const asyncSweepInterval = time.Minute
+
+// AsyncJob is a chat completion that runs after its request has returned
+type AsyncJob struct {
+	ID          string            `json:"id"`
+	Object      string            `json:"object"`
+	Status      string            `json:"status"`
+	Model       string            `json:"model"`
+	SessionID   string            `json:"session_id,omitempty"`
+	CreatedAt   int64             `json:"created_at"`
+	StartedAt   *int64            `json:"started_at"`
+	CompletedAt *int64            `json:"completed_at"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	// StatusCode is the status /v1/chat/completions would have answered with
+	StatusCode int `json:"status_code,omitempty"`
+	// Result is the chat.completion of a succeeded job
+	Result json.RawMessage `json:"result,omitempty"`
+	// Error is the error object of a failed job
+	Error   *APIError        `json:"error,omitempty"`
+	Webhook *WebhookDelivery `json:"webhook,omitempty"`
+
+	owner string
+}
+
+// WebhookDelivery tracks the callback of a finished job
+type WebhookDelivery struct {
+	URL         string `json:"url"`
+	Status      string `json:"status"`
+	Attempts    int    `json:"attempts"`
+	LastError   string `json:"last_error,omitempty"`
+	DeliveredAt *int64 `json:"delivered_at,omitempty"`
+}
+
+// copy returns a snapshot of the job that is safe to read without the lock
+func (j *AsyncJob) copy() *AsyncJob {
+	c := *j
+	if j.Webhook != nil {
+		webhook := *j.Webhook
+		c.Webhook = &webhook
+	}
+	return &c
+}
+
+// asyncJobs holds async jobs in memory until they expire
+type asyncJobs struct {
+	ctx context.Context
+	wg  sync.WaitGroup
+
+	mu      sync.Mutex
+	jobs    map[string]*AsyncJob
+	pending int
+
+	// deadLetterMu serializes appends to the dead letter file
+	deadLetterMu sync.Mutex
+}
+
+func newAsyncJobs(ctx context.Context) *asyncJobs {
+	return &asyncJobs{ctx: ctx, jobs: make(map[string]*AsyncJob)}
+}
+
+// add stores a queued job unless limit jobs are already pending
+func (a *asyncJobs) add(job *AsyncJob, limit int) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.pending >= limit {
+		return false
+	}
+	a.pending++
+	a.jobs[job.ID] = job
+	return true
+}
+
+// get returns a snapshot of the job, or nil
+func (a *asyncJobs) get(id string) *AsyncJob {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if job, ok := a.jobs[id]; ok {
+		return job.copy()
+	}
+	return nil
+}
+
+// list returns snapshots of the jobs that match, newest first
+func (a *asyncJobs) list(match func(*AsyncJob) bool) []*AsyncJob {
+	a.mu.Lock()
+	jobs := []*AsyncJob{}
+	for _, job := range a.jobs {
+		if match(job) {
+			jobs = append(jobs, job.copy())
+		}
+	}
+	a.mu.Unlock()
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].CreatedAt > jobs[j].CreatedAt })
+	return jobs
+}
+
+// update changes a job under the lock
+func (a *asyncJobs) update(id string, change func(*AsyncJob)) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if job, ok := a.jobs[id]; ok {
+		change(job)
+	}
+}
+
+// run calls fn in the background. Close waits for it to return.
+func (a *asyncJobs) run(fn func()) {
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		fn()
+	}()
+}
+
+func (a *asyncJobs) wait() {
+	a.wg.Wait()
+}
+
+// sweep drops finished jobs older than the TTL whose webhook is not pending
+func (a *asyncJobs) sweep(ctx context.Context, interval time.Duration, ttl func() time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			cutoff := now.Add(-ttl()).Unix()
+			a.mu.Lock()
+			for id, job := range a.jobs {
+				if job.CompletedAt != nil && *job.CompletedAt < cutoff && (job.Webhook == nil || job.Webhook.Status != WebhookPending) {
+					delete(a.jobs, id)
+				}
+			}
+			a.mu.Unlock()
+		}
+	}
+}
+
+// asyncChatRequest is a chat request with where to send its result
+type asyncChatRequest struct {
+	ChatCompletionRequest
+	WebhookURL string            `json:"webhook_url"`
+	Metadata   map[string]string `json:"metadata"`
+}
+
+// handleAsyncChatCompletions accepts a chat request and runs it in the
+// background, answering at once with the job to poll
+func (p *Proxy) handleAsyncChatCompletions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		respondWithAPIError(w, http.StatusMethodNotAllowed, newAPIError("invalid_request_error", "", "", "Method not allowed"))
+		return
+	}
+	var req asyncChatRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithAPIError(w, http.StatusBadRequest, newAPIError("invalid_request_error", "", "", fmt.Sprintf("Error parsing request body: %v", err)))
+		return
+	}
+	if req.Model == "" || len(req.Messages) == 0 {
+		respondWithAPIError(w, http.StatusBadRequest, newAPIError("invalid_request_error", "", "", "model and messages are required"))
+		return
+	}
+	if _, err := req.ResponseFormat.outputFormat(); err != nil {
+		respondWithAPIError(w, http.StatusBadRequest, newAPIError("invalid_request_error", "", "response_format", err.Error()))
+		return
+	}
+	cfg := p.cfg().Async
+	job := &AsyncJob{
+		ID:        newObjectID("job_"),
+		Object:    "async.job",
+		Status:    AsyncQueued,
+		Model:     req.Model,
+		CreatedAt: time.Now().Unix(),
+		Metadata:  req.Metadata,
+		owner:     HashAPIKey(callerID(r)),
+	}
+	if req.WebhookURL != "" {
+		if !validHTTPURL(req.WebhookURL) {
+			respondWithAPIError(w, http.StatusBadRequest, newAPIError("invalid_request_error", "", "webhook_url", "webhook_url must be an http or https URL"))
+			return
+		}
+		if cfg.WebhookSecret == "" {
+			respondWithAPIError(w, http.StatusBadRequest, newAPIError("invalid_request_error", "", "webhook_url", "Webhooks are disabled; set ASYNC_WEBHOOK_SECRET to enable them"))
+			return
+		}
+		if err := checkWebhookHost(r.Context(), req.WebhookURL, cfg.WebhookAllowedHosts); err != nil {
+			respondWithAPIError(w, http.StatusBadRequest, newAPIError("invalid_request_error", "", "webhook_url", err.Error()))
+			return
+		}
+		job.Webhook = &WebhookDelivery{URL: req.WebhookURL, Status: WebhookPending}
+	}
+	if !p.async.add(job, cfg.MaxPending) {
+		respondWithAPIError(w, http.StatusTooManyRequests, newAPIError("rate_limit_error", "too_many_pending_jobs", "", fmt.Sprintf("The proxy already has %d async jobs pending, try again later", cfg.MaxPending)))
+		return
+	}
+
+	// The job runs as the caller, so their limits and budgets apply
+	id := IdentityFromContext(r.Context())
+	if id == nil {
+		id = &Identity{Subject: callerID(r), Scopes: []string{ScopeChat}, Method: "async"}
+	}
+	sessionID := r.Header.Get("session_id")
+	p.logger.Printf("Queued async job %s for model %s", job.ID, job.Model)
+	p.async.run(func() { p.runAsyncJob(job.ID, id, req.ChatCompletionRequest, sessionID) })
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/v1/async/jobs/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(p.async.get(job.ID))
+}
+
+func (p *Proxy) runAsyncJob(jobID string, id *Identity, chat ChatCompletionRequest, sessionID string) {
+	started := time.Now().Unix()
+	p.async.update(jobID, func(job *AsyncJob) { job.Status, job.StartedAt = AsyncRunning, &started })
+
+	attempt, status, body := p.backgroundChat(p.async.ctx, id, chat, sessionID)
+	if p.async.ctx.Err() != nil {
+		status, body = http.StatusServiceUnavailable, errorBody(newAPIError("server_error", "", "", "The proxy shut down before the job finished"))
+	}
+
+	completed := time.Now().Unix()
+	var webhook bool
+	p.async.update(jobID, func(job *AsyncJob) {
+		p.async.pending--
+		job.CompletedAt, job.StatusCode = &completed, status
+		if attempt != nil {
+			job.SessionID = attempt.sessionID
+		}
+		if status == http.StatusOK {
+			job.Status, job.Result = AsyncSucceeded, body
+		} else {
+			var wrapped struct {
+				Error APIError `json:"error"`
+			}
+			json.Unmarshal(body, &wrapped)
+			job.Status, job.Error = AsyncFailed, &wrapped.Error
+		}
+		webhook = job.Webhook != nil
+	})
+	p.logger.Printf("Async job %s finished with status %d", jobID, status)
+	if webhook && p.async.ctx.Err() == nil {
+		p.deliverWebhook(jobID)
+	}
+}
+
+// errorBody returns the JSON error response for apiErr
+func errorBody(apiErr APIError) json.RawMessage {
+	body, _ := json.Marshal(map[string]APIError{"error": apiErr})
+	return body
+}
+
+// backgroundChat runs a chat request that has no client connection, as the
+// identity id. It returns the attempt that answered, if any, with the status
+// and the chat.completion or error object a client would have received.
+func (p *Proxy) backgroundChat(ctx context.Context, id *Identity, chat ChatCompletionRequest, sessionID string) (*chatAttempt, int, json.RawMessage) {
+	r, _ := http.NewRequestWithContext(WithIdentity(ctx, id), http.MethodPost, "/v1/chat/completions", nil)
+	r.RemoteAddr = id.Method
+	buf := &responseBuffer{header: make(http.Header)}
+	attempt, err := p.serveChat(buf, r, chat, sessionID)
+	switch {
+	case buf.status >= 400:
+		// Answered with an error object before streaming
+		return attempt, buf.status, json.RawMessage(bytes.TrimSpace(buf.body.Bytes()))
+	case err != nil:
+		status, apiErr := forwardAPIError("Stream interrupted", err)
+		return attempt, status, errorBody(apiErr)
+	}
+	body, _ := json.Marshal(chatCompletionFromStream(attempt.model, chat.Messages, buf.body.Bytes()))
+	return attempt, http.StatusOK, body
+}
+
+// WebhookSignature returns the X-NFA-Signature header for a webhook body sent
+// at timestamp: "t=<unix seconds>,v1=<hex HMAC-SHA256 of "<t>.<body>">"
+func WebhookSignature(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return fmt.Sprintf("t=%d,v1=%s", timestamp, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// VerifyWebhookSignature checks an X-NFA-Signature header against body, and
+// that it was made within tolerance of now
+func VerifyWebhookSignature(secret, header string, body []byte, tolerance time.Duration) error {
+	var timestamp int64
+	var signature string
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(part, "=")
+		switch key {
+		case "t":
+			timestamp, _ = strconv.ParseInt(value, 10, 64)
+		case "v1":
+			signature = value
+		}
+	}
+	if timestamp == 0 || signature == "" {
+		return errors.New("malformed signature header")
+	}
+	if age := time.Since(time.Unix(timestamp, 0)); age > tolerance || age < -tolerance {
+		return errors.New("signature timestamp is outside the tolerance")
+	}
+	_, expected, _ := strings.Cut(WebhookSignature(secret, timestamp, body), ",v1=")
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return errors.New("signature does not match")
+	}
+	return nil
+}
+
+// deliverWebhook posts the finished job to its webhook, retrying with backoff.
+// A delivery that fails every retry is dead-lettered.
+func (p *Proxy) deliverWebhook(jobID string) {
+	job := p.async.get(jobID)
+	if job == nil || job.Webhook == nil {
+		return
+	}
+	url := job.Webhook.URL
+	job.Webhook = nil
+	payload, _ := json.Marshal(job)
+
+	for attempt := 1; ; attempt++ {
+		cfg := p.cfg().Async
+		err := p.postWebhook(cfg, url, jobID, payload, attempt)
+		now := time.Now().Unix()
+		p.async.update(jobID, func(job *AsyncJob) {
+			job.Webhook.Attempts++
+			if err == nil {
+				job.Webhook.Status, job.Webhook.DeliveredAt, job.Webhook.LastError = WebhookDelivered, &now, ""
+			} else {
+				job.Webhook.LastError = err.Error()
+			}
+		})
+		if err == nil {
+			p.logger.Printf("Delivered webhook of async job %s", jobID)
+			return
+		}
+		if attempt > cfg.WebhookRetries {
+			p.deadLetter(jobID, url, attempt, err, payload)
+			return
+		}
+		delay := chatRetryDelay(cfg.WebhookRetryBaseDelay.Duration, cfg.WebhookRetryMaxDelay.Duration, attempt)
+		p.logger.Printf("Webhook of async job %s failed (attempt %d/%d), retrying in %v: %v", jobID, attempt, cfg.WebhookRetries+1, delay, err)
+		select {
+		case <-p.async.ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (p *Proxy) postWebhook(cfg AsyncConfig, url, jobID string, payload []byte, attempt int) error {
+	// The host is checked again in case its DNS changed since the job was
+	// submitted, and on redirects
+	if err := checkWebhookHost(p.async.ctx, url, cfg.WebhookAllowedHosts); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(p.async.ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-NFA-Job-ID", jobID)
+	req.Header.Set("X-NFA-Delivery-Attempt", strconv.Itoa(attempt))
+	req.Header.Set("X-NFA-Signature", WebhookSignature(cfg.WebhookSecret, time.Now().Unix(), payload))
+	client := p.httpClient(cfg.WebhookTimeout.Duration)
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		return checkWebhookHost(req.Context(), req.URL.String(), cfg.WebhookAllowedHosts)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// checkWebhookHost refuses webhook URLs whose host resolves to a loopback,
+// private, link-local or unspecified address, so callers cannot make the
+// proxy post to services on its own network. Hosts in allowed are not
+// checked.
+func checkWebhookHost(ctx context.Context, rawURL string, allowed []string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	host := u.Hostname()
+	for _, h := range allowed {
+		if strings.EqualFold(h, host) {
+			return nil
+		}
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return fmt.Errorf("cannot resolve webhook host %s: %v", host, err)
+	}
+	for _, addr := range addrs {
+		ip := addr.IP
+		if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+			return fmt.Errorf("webhook host %s resolves to %s, which is not a public address; add it to async.webhook_allowed_hosts to allow it", host, ip)
+		}
+	}
+	return nil
+}
+
+// deadLetter gives up on a webhook and records the delivery for later
+// inspection or redelivery
+func (p *Proxy) deadLetter(jobID, url string, attempts int, err error, payload []byte) {
+	p.logger.Printf("Dead-lettering webhook of async job %s after %d attempts: %v", jobID, attempts, err)
+	p.async.update(jobID, func(job *AsyncJob) { job.Webhook.Status = WebhookDeadLettered })
+
+	file := p.cfg().Async.DeadLetterFile
+	if file == "" {
+		return
+	}
+	line, _ := json.Marshal(map[string]interface{}{
+		"job_id":     jobID,
+		"url":        url,
+		"attempts":   attempts,
+		"last_error": err.Error(),
+		"failed_at":  time.Now().UTC(),
+		"payload":    json.RawMessage(payload),
+	})
+	p.async.deadLetterMu.Lock()
+	defer p.async.deadLetterMu.Unlock()
+	f, openErr := os.OpenFile(file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if openErr != nil {
+		p.logger.Printf("Error opening dead letter file: %v", openErr)
+		return
+	}
+	defer f.Close()
+	if _, writeErr := f.Write(append(line, '\n')); writeErr != nil {
+		p.logger.Printf("Error writing dead letter file: %v", writeErr)
+	}
+}
+
+// handleAsyncJobs serves the jobs of the caller:
+//
+//	GET  /v1/async/jobs                  list jobs
+//	GET  /v1/async/jobs/{id}             get a job, with its result once finished
+//	POST /v1/async/jobs/{id}/redeliver   send a finished job's webhook again
+func (p *Proxy) handleAsyncJobs(w http.ResponseWriter, r *http.Request) {
+	owner := HashAPIKey(callerID(r))
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/async/jobs"), "/"), "/")
+
+	if parts[0] == "" {
+		if r.Method != http.MethodGet {
+			respondWithAPIError(w, http.StatusMethodNotAllowed, newAPIError("invalid_request_error", "", "", "Method not allowed"))
+			return
+		}
+		jobs := p.async.list(func(job *AsyncJob) bool { return job.owner == owner })
+		writeJSON(w, map[string]interface{}{"object": "list", "data": jobs})
+		return
+	}
+
+	job := p.async.get(parts[0])
+	if job == nil || job.owner != owner {
+		respondWithAPIError(w, http.StatusNotFound, newAPIError("invalid_request_error", "job_not_found", "job_id", fmt.Sprintf("No async job found with id %s", parts[0])))
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		writeJSON(w, job)
+	case len(parts) == 2 && parts[1] == "redeliver" && r.Method == http.MethodPost:
+		p.redeliverWebhook(w, job)
+	case len(parts) == 1 || (len(parts) == 2 && parts[1] == "redeliver"):
+		respondWithAPIError(w, http.StatusMethodNotAllowed, newAPIError("invalid_request_error", "", "", "Method not allowed"))
+	default:
+		respondWithAPIError(w, http.StatusNotFound, newAPIError("not_found_error", "", "", "Unknown async jobs endpoint"))
+	}
+}
+
+func (p *Proxy) redeliverWebhook(w http.ResponseWriter, job *AsyncJob) {
+	if job.Webhook == nil || job.CompletedAt == nil || job.Webhook.Status == WebhookPending {
+		respondWithAPIError(w, http.StatusConflict, newAPIError("invalid_request_error", "", "job_id", fmt.Sprintf("Async job %s has no finished webhook delivery to repeat", job.ID)))
+		return
+	}
+	p.async.update(job.ID, func(job *AsyncJob) {
+		job.Webhook.Status, job.Webhook.Attempts, job.Webhook.DeliveredAt = WebhookPending, 0, nil
+	})
+	p.logger.Printf("Redelivering webhook of async job %s", job.ID)
+	p.async.run(func() { p.deliverWebhook(job.ID) })
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(p.async.get(job.ID))
+}
+
+// handleAdminDeadLetters lists the async jobs whose webhook was dead-lettered
+func (p *Proxy) handleAdminDeadLetters(w http.ResponseWriter, r *http.Request) {
+	if !p.requireAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		respondWithAPIError(w, http.StatusMethodNotAllowed, newAPIError("invalid_request_error", "", "", "Method not allowed"))
+		return
+	}
+	jobs := p.async.list(func(job *AsyncJob) bool {
+		return job.Webhook != nil && job.Webhook.Status == WebhookDeadLettered
+	})
+	writeAdminJSON(w, map[string]interface{}{"jobs": jobs})
+}
@@ -0,0 +1,223 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newAsyncServer(t *testing.T, configure func(*Config)) *Server {
+	t.Helper()
+	m := newBatchMarketplace(t)
+	cfg, err := LoadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Marketplace.URL = m.URL
+	cfg.Async.WebhookSecret = "whsec"
+	cfg.Async.WebhookAllowedHosts = []string{"127.0.0.1"}
+	cfg.Async.WebhookRetryBaseDelay = Duration{time.Millisecond}
+	cfg.Async.WebhookRetryMaxDelay = Duration{time.Millisecond}
+	if configure != nil {
+		configure(cfg)
+	}
+	s, err := New(cfg, WithLogger(log.New(io.Discard, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func submitAsyncJob(t *testing.T, s *Server, webhookURL string) AsyncJob {
+	t.Helper()
+	body := `{"model":"Llama","messages":[{"role":"user","content":"hi"}],"webhook_url":"` + webhookURL + `","metadata":{"run":"7"}}`
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/v1/async/chat/completions", strings.NewReader(body)))
+	var job AsyncJob
+	if err := json.Unmarshal(w.Body.Bytes(), &job); w.Code != http.StatusAccepted || err != nil {
+		t.Fatalf("submit: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Location") != "/v1/async/jobs/"+job.ID {
+		t.Errorf("Location = %q", w.Header().Get("Location"))
+	}
+	return job
+}
+
+// waitForJob polls a job until done reports true
+func waitForJob(t *testing.T, s *Server, id string, done func(AsyncJob) bool) AsyncJob {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", "/v1/async/jobs/"+id, nil))
+		var job AsyncJob
+		json.Unmarshal(w.Body.Bytes(), &job)
+		if done(job) {
+			return job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %s did not finish: %s", id, w.Body.String())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestAsyncJobDeliversSignedWebhook(t *testing.T) {
+	deliveries := make(chan AsyncJob, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if err := VerifyWebhookSignature("whsec", r.Header.Get("X-NFA-Signature"), body, time.Minute); err != nil {
+			t.Errorf("signature: %v", err)
+		}
+		if err := VerifyWebhookSignature("other", r.Header.Get("X-NFA-Signature"), body, time.Minute); err == nil {
+			t.Error("signature verified with the wrong secret")
+		}
+		var job AsyncJob
+		json.Unmarshal(body, &job)
+		deliveries <- job
+	}))
+	defer hook.Close()
+	s := newAsyncServer(t, nil)
+
+	job := submitAsyncJob(t, s, hook.URL)
+	if job.Status != AsyncQueued && job.Status != AsyncRunning {
+		t.Errorf("status = %s", job.Status)
+	}
+	var delivered AsyncJob
+	select {
+	case delivered = <-deliveries:
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was not delivered")
+	}
+	if delivered.ID != job.ID || delivered.Status != AsyncSucceeded || delivered.Metadata["run"] != "7" {
+		t.Errorf("delivered = %+v", delivered)
+	}
+	var result struct {
+		Choices []struct {
+			Message Message `json:"message"`
+		} `json:"choices"`
+	}
+	if json.Unmarshal(delivered.Result, &result); len(result.Choices) != 1 || result.Choices[0].Message.Content != "echo hi" {
+		t.Errorf("result = %s", delivered.Result)
+	}
+
+	got := waitForJob(t, s, job.ID, func(j AsyncJob) bool { return j.Webhook != nil && j.Webhook.Status == WebhookDelivered })
+	if got.Webhook.Attempts != 1 || got.SessionID != "s" {
+		t.Errorf("job = %+v, webhook = %+v", got, got.Webhook)
+	}
+}
+
+func TestAsyncWebhookDeadLetterAndRedeliver(t *testing.T) {
+	var healthy atomic.Bool
+	var calls atomic.Int32
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if !healthy.Load() {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+		}
+	}))
+	defer hook.Close()
+	deadLetters := filepath.Join(t.TempDir(), "dead.jsonl")
+	s := newAsyncServer(t, func(cfg *Config) {
+		cfg.AdminAPIKey = "admin"
+		cfg.Async.WebhookRetries = 2
+		cfg.Async.DeadLetterFile = deadLetters
+	})
+
+	job := submitAsyncJob(t, s, hook.URL)
+	got := waitForJob(t, s, job.ID, func(j AsyncJob) bool { return j.Webhook != nil && j.Webhook.Status == WebhookDeadLettered })
+	if got.Webhook.Attempts != 3 || calls.Load() != 3 || !strings.Contains(got.Webhook.LastError, "503") {
+		t.Errorf("webhook = %+v, calls = %d", got.Webhook, calls.Load())
+	}
+
+	data, err := os.ReadFile(deadLetters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var letter struct {
+		JobID    string   `json:"job_id"`
+		Attempts int      `json:"attempts"`
+		Payload  AsyncJob `json:"payload"`
+	}
+	if err := json.Unmarshal(data, &letter); err != nil || letter.JobID != job.ID || letter.Attempts != 3 || letter.Payload.Status != AsyncSucceeded {
+		t.Errorf("dead letter = %s", data)
+	}
+
+	req := httptest.NewRequest("GET", "/admin/async/dead-letters", nil)
+	req.Header.Set("Authorization", "Bearer admin")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	if !strings.Contains(w.Body.String(), job.ID) {
+		t.Errorf("dead letters = %s", w.Body.String())
+	}
+
+	healthy.Store(true)
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/v1/async/jobs/"+job.ID+"/redeliver", nil))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("redeliver: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	got = waitForJob(t, s, job.ID, func(j AsyncJob) bool { return j.Webhook.Status == WebhookDelivered })
+	if got.Webhook.Attempts != 1 {
+		t.Errorf("attempts after redelivery = %d", got.Webhook.Attempts)
+	}
+}
+
+func TestAsyncJobsAreScopedToOwner(t *testing.T) {
+	s := newAsyncServer(t, nil)
+	job := submitAsyncJob(t, s, "")
+	if job.Webhook != nil {
+		t.Errorf("webhook = %+v", job.Webhook)
+	}
+	waitForJob(t, s, job.ID, func(j AsyncJob) bool { return j.Status == AsyncSucceeded })
+
+	req := httptest.NewRequest("GET", "/v1/async/jobs/"+job.ID, nil)
+	req.RemoteAddr = "198.51.100.7:1234"
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("other caller: status = %d", w.Code)
+	}
+}
+
+func TestAsyncRejectsWebhookWithoutSecret(t *testing.T) {
+	s := newAsyncServer(t, func(cfg *Config) { cfg.Async.WebhookSecret = "" })
+	body := `{"model":"Llama","messages":[{"role":"user","content":"hi"}],"webhook_url":"http://example.com/hook"}`
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/v1/async/chat/completions", strings.NewReader(body)))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"param":"webhook_url"`) {
+		t.Errorf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+}
+
+func TestAsyncRejectsPrivateWebhookHosts(t *testing.T) {
+	s := newAsyncServer(t, nil)
+	for _, hook := range []string{"http://127.0.0.2/hook", "http://10.1.2.3/hook", "http://169.254.169.254/latest/meta-data", "http://[::1]:8081/admin/sessions"} {
+		body := `{"model":"Llama","messages":[{"role":"user","content":"hi"}],"webhook_url":"` + hook + `"}`
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("POST", "/v1/async/chat/completions", strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"param":"webhook_url"`) {
+			t.Errorf("%s: status = %d, body = %s", hook, w.Code, w.Body.String())
+		}
+	}
+
+	// Allowed hosts are not checked, but redirects from them are
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://10.1.2.3/hook", http.StatusTemporaryRedirect)
+	}))
+	defer target.Close()
+	p := s.Proxy
+	err := p.postWebhook(p.cfg().Async, target.URL, "job_1", []byte("{}"), 1)
+	if err == nil || !strings.Contains(err.Error(), "10.1.2.3") {
+		t.Errorf("redirect to a private host: err = %v", err)
+	}
+}
@@ -0,0 +1,374 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditConfig enables the request/response audit log
+type AuditConfig struct {
+	File string `json:"file" env:"AUDIT_LOG_FILE"`
+	// RedactHeaders adds to the credential headers that are always redacted
+	RedactHeaders []string `json:"redact_headers"`
+	// RedactMessages replaces message content in recorded requests. Such
+	// records cannot be replayed.
+	RedactMessages bool `json:"redact_messages" env:"AUDIT_REDACT_MESSAGES"`
+}
+
+// redactedHeaders are never written to the audit log in clear
+var redactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "X-Api-Key", "X-NFA-Signature"}
+
+const redactedValue = "[REDACTED]"
+
+// AuditRecord is one audited request and the response sent back for it
+type AuditRecord struct {
+	RequestID string        `json:"request_id"`
+	Timestamp time.Time     `json:"timestamp"`
+	Caller    string        `json:"caller"`
+	Model     string        `json:"model,omitempty"`
+	ModelID   string        `json:"model_id,omitempty"`
+	SessionID string        `json:"session_id,omitempty"`
+	Request   AuditRequest  `json:"request"`
+	Response  AuditResponse `json:"response"`
+	Timings   AuditTimings  `json:"timings"`
+}
+
+// AuditRequest is the inbound request with credentials redacted
+type AuditRequest struct {
+	Method  string            `json:"method"`
+	Path    string            `json:"path"`
+	Headers map[string]string `json:"headers"`
+	Body    json.RawMessage   `json:"body"`
+	// Redacted is set when message content was removed from Body
+	Redacted bool `json:"redacted,omitempty"`
+}
+
+// AuditResponse is the full response body as streamed to the caller, plus the
+// completion text assembled from its chunks
+type AuditResponse struct {
+	Status     int    `json:"status"`
+	Body       string `json:"body"`
+	Completion string `json:"completion"`
+}
+
+// AuditTimings are measured from when the request was received
+type AuditTimings struct {
+	ReceivedAt  time.Time `json:"received_at"`
+	FirstByteMs int64     `json:"first_byte_ms"`
+	TotalMs     int64     `json:"total_ms"`
+}
+
+// AuditLog appends audit records to a JSONL file
+type AuditLog struct {
+	mu             sync.Mutex
+	file           string
+	redactHeaders  map[string]bool
+	redactMessages bool
+	logger         *log.Logger
+}
+
+// NewAuditLog creates an audit log from cfg
+func NewAuditLog(cfg AuditConfig) *AuditLog {
+	a := &AuditLog{file: cfg.File, redactHeaders: make(map[string]bool), redactMessages: cfg.RedactMessages, logger: log.Default()}
+	for _, h := range append(redactedHeaders, cfg.RedactHeaders...) {
+		a.redactHeaders[http.CanonicalHeaderKey(h)] = true
+	}
+	return a
+}
+
+// Record appends rec to the audit log
+func (a *AuditLog) Record(rec AuditRecord) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		a.logger.Printf("Failed to encode audit record: %v", err)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	f, err := os.OpenFile(a.file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		a.logger.Printf("Failed to open audit log: %v", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		a.logger.Printf("Failed to write audit record: %v", err)
+	}
+}
+
+func (a *AuditLog) redactRequest(r *http.Request, body []byte) AuditRequest {
+	req := AuditRequest{Method: r.Method, Path: r.URL.RequestURI(), Headers: make(map[string]string)}
+	for name, values := range r.Header {
+		if a.redactHeaders[http.CanonicalHeaderKey(name)] {
+			req.Headers[name] = redactedValue
+		} else {
+			req.Headers[name] = strings.Join(values, ", ")
+		}
+	}
+
+	if !json.Valid(body) {
+		req.Body, _ = json.Marshal(string(body))
+		return req
+	}
+	req.Body = body
+	if a.redactMessages {
+		var parsed map[string]interface{}
+		if err := json.Unmarshal(body, &parsed); err == nil {
+			if messages, ok := parsed["messages"].([]interface{}); ok {
+				for _, m := range messages {
+					if msg, ok := m.(map[string]interface{}); ok {
+						msg["content"] = redactedValue
+					}
+				}
+			}
+			req.Body, _ = json.Marshal(parsed)
+			req.Redacted = true
+		}
+	}
+	return req
+}
+
+// auditEntry collects what handlers learn about an audited request
+type auditEntry struct {
+	mu        sync.Mutex
+	model     string
+	modelID   string
+	sessionID string
+}
+
+type auditContextKey struct{}
+
+// annotateAudit records the resolved model and session of an audited request
+func annotateAudit(ctx context.Context, model, modelID, sessionID string) {
+	entry, ok := ctx.Value(auditContextKey{}).(*auditEntry)
+	if !ok {
+		return
+	}
+	entry.mu.Lock()
+	entry.model, entry.modelID, entry.sessionID = model, modelID, sessionID
+	entry.mu.Unlock()
+}
+
+// requestID returns the caller's X-Request-ID when it is usable, or a new one
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-ID"); id != "" && len(id) <= 128 && !strings.ContainsAny(id, "\r\n") {
+		return id
+	}
+	b := make([]byte, 12)
+	rand.Read(b)
+	return "req_" + hex.EncodeToString(b)
+}
+
+// auditWriter captures the status and body written to the caller
+type auditWriter struct {
+	http.ResponseWriter
+	status    int
+	body      bytes.Buffer
+	firstByte time.Time
+}
+
+func (w *auditWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *auditWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.firstByte.IsZero() {
+		w.firstByte = time.Now()
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *auditWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// withAudit tags the request with an X-Request-ID and, when the audit log is
+// enabled, records the request and everything written back for it.
+func (p *Proxy) withAudit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := requestID(r)
+		w.Header().Set("X-Request-ID", id)
+		if p.audit == nil {
+			next(w, r)
+			return
+		}
+
+		received := time.Now()
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			respondWithAPIError(w, http.StatusBadRequest, newAPIError("invalid_request_error", "", "", "Error reading request body"))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		entry := &auditEntry{}
+		aw := &auditWriter{ResponseWriter: w}
+		next(aw, r.WithContext(context.WithValue(r.Context(), auditContextKey{}, entry)))
+
+		rec := AuditRecord{
+			RequestID: id,
+			Timestamp: received.UTC(),
+			Caller:    callerID(r),
+			Request:   p.audit.redactRequest(r, body),
+			Response: AuditResponse{
+				Status:     aw.status,
+				Body:       aw.body.String(),
+				Completion: StreamCompletion(aw.body.Bytes()),
+			},
+			Timings: AuditTimings{ReceivedAt: received.UTC(), TotalMs: time.Since(received).Milliseconds()},
+		}
+		if !aw.firstByte.IsZero() {
+			rec.Timings.FirstByteMs = aw.firstByte.Sub(received).Milliseconds()
+		}
+		entry.mu.Lock()
+		rec.Model, rec.ModelID, rec.SessionID = entry.model, entry.modelID, entry.sessionID
+		entry.mu.Unlock()
+		p.audit.Record(rec)
+	}
+}
+
+// StreamCompletion assembles the completion text from an SSE stream or a
+// single JSON completion body
+func StreamCompletion(body []byte) string {
+	c := &usageCollector{}
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		c.observe(scanner.Bytes())
+	}
+	return c.completion.String()
+}
+
+// ReplayOptions configures Replay
+type ReplayOptions struct {
+	// Target is the base URL of the proxy or mock that receives the requests
+	Target string
+	// RequestIDs limits the replay to these records; empty replays them all
+	RequestIDs []string
+	// Headers override recorded headers, for example to supply credentials
+	Headers http.Header
+	Timeout time.Duration
+}
+
+// ReplayResult compares a replayed request with its recorded response
+type ReplayResult struct {
+	RequestID          string `json:"request_id"`
+	RecordedStatus     int    `json:"recorded_status"`
+	Status             int    `json:"status"`
+	DurationMs         int64  `json:"duration_ms"`
+	Match              bool   `json:"match"`
+	Completion         string `json:"completion"`
+	RecordedCompletion string `json:"recorded_completion,omitempty"`
+	Error              string `json:"error,omitempty"`
+}
+
+// ReadAuditLog reads the records in an audit log file
+func ReadAuditLog(r io.Reader) ([]AuditRecord, error) {
+	var records []AuditRecord
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var rec AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		records = append(records, rec)
+	}
+	return records, scanner.Err()
+}
+
+// Replay re-sends recorded requests to opts.Target and compares the status
+// and assembled completion text with what was recorded
+func Replay(records []AuditRecord, opts ReplayOptions) []ReplayResult {
+	wanted := make(map[string]bool)
+	for _, id := range opts.RequestIDs {
+		wanted[id] = true
+	}
+	client := &http.Client{Timeout: opts.Timeout}
+
+	var results []ReplayResult
+	for _, rec := range records {
+		if len(wanted) > 0 && !wanted[rec.RequestID] {
+			continue
+		}
+		result := ReplayResult{RequestID: rec.RequestID, RecordedStatus: rec.Response.Status}
+		start := time.Now()
+		status, body, err := replayRequest(client, opts, rec)
+		result.DurationMs = time.Since(start).Milliseconds()
+		if err != nil {
+			result.Error = err.Error()
+		} else {
+			result.Status = status
+			result.Completion = StreamCompletion(body)
+			result.Match = status == rec.Response.Status && result.Completion == rec.Response.Completion
+		}
+		if !result.Match {
+			result.RecordedCompletion = rec.Response.Completion
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+func replayRequest(client *http.Client, opts ReplayOptions, rec AuditRecord) (int, []byte, error) {
+	if rec.Request.Redacted {
+		return 0, nil, fmt.Errorf("request messages were redacted and cannot be replayed")
+	}
+	body := []byte(rec.Request.Body)
+	// Bodies that were not JSON are recorded as a JSON string
+	var raw string
+	if json.Unmarshal(rec.Request.Body, &raw) == nil {
+		body = []byte(raw)
+	}
+
+	req, err := http.NewRequest(rec.Request.Method, strings.TrimRight(opts.Target, "/")+rec.Request.Path, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	for name, value := range rec.Request.Headers {
+		if value == redactedValue || strings.EqualFold(name, "Content-Length") || strings.EqualFold(name, "X-Request-ID") {
+			continue
+		}
+		req.Header.Set(name, value)
+	}
+	for name, values := range opts.Headers {
+		req.Header[name] = values
+	}
+	req.Header.Set("X-Replay-Of", rec.RequestID)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, nil, err
+	}
+	return resp.StatusCode, respBody, nil
+}
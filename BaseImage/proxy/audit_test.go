@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditLogAndReplay(t *testing.T) {
+	reply := "Hi"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprintf(w, "data: {\"choices\":[{\"delta\":{\"content\":%q}}]}\n\n", reply)
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\" there\"}}]}\n\n")
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer server.Close()
+	t.Setenv("MARKETPLACE_URL", server.URL)
+
+	sessionCache.Lock()
+	sessionCache.m["audit-session"] = CachedSession{SessionID: "audit-session", ModelID: "audit-model", ExpiresAt: time.Now().Add(time.Hour)}
+	sessionCache.Unlock()
+	defer func() {
+		sessionCache.Lock()
+		delete(sessionCache.m, "audit-session")
+		sessionCache.Unlock()
+	}()
+
+	file := filepath.Join(t.TempDir(), "audit.jsonl")
+	p := NewProxy()
+	p.audit = NewAuditLog(AuditConfig{File: file})
+	handler := p.withAudit(p.handleChatCompletions)
+
+	body := `{"model":"Audit Model","messages":[{"role":"user","content":"Hello"}]}`
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+	req.Header.Set("session_id", "audit-session")
+	req.Header.Set("Authorization", "Bearer team-a")
+	req.Header.Set("X-Request-ID", "req-1")
+	w := httptest.NewRecorder()
+	handler(w, req)
+	if w.Code != http.StatusOK || w.Header().Get("X-Request-ID") != "req-1" {
+		t.Fatalf("status = %d, request ID = %q", w.Code, w.Header().Get("X-Request-ID"))
+	}
+
+	data, _ := os.ReadFile(file)
+	if bytes.Contains(data, []byte("team-a")) {
+		t.Error("the bearer token should not be logged")
+	}
+	records, err := ReadAuditLog(bytes.NewReader(data))
+	if err != nil || len(records) != 1 {
+		t.Fatalf("ReadAuditLog() = %d records, %v", len(records), err)
+	}
+	rec := records[0]
+	if rec.RequestID != "req-1" || rec.Caller != tokenFingerprint("team-a") || rec.ModelID != "audit-model" || rec.SessionID != "audit-session" {
+		t.Errorf("unexpected record: %+v", rec)
+	}
+	if rec.Request.Headers["Authorization"] != redactedValue || string(rec.Request.Body) != body {
+		t.Errorf("unexpected request: %+v", rec.Request)
+	}
+	if rec.Response.Status != http.StatusOK || rec.Response.Completion != "Hi there" || !strings.Contains(rec.Response.Body, "[DONE]") {
+		t.Errorf("unexpected response: %+v", rec.Response)
+	}
+
+	// Replay against a proxy that serves the same upstream
+	target := httptest.NewServer(handler)
+	defer target.Close()
+	results := Replay(records, ReplayOptions{Target: target.URL, Headers: http.Header{"Authorization": {"Bearer team-a"}}})
+	if len(results) != 1 || !results[0].Match {
+		t.Fatalf("replay results = %+v, want a match", results)
+	}
+
+	reply = "Bye"
+	results = Replay(records, ReplayOptions{Target: target.URL, RequestIDs: []string{"req-1"}})
+	if len(results) != 1 || results[0].Match || results[0].Completion != "Bye there" || results[0].RecordedCompletion != "Hi there" {
+		t.Errorf("replay results = %+v, want a mismatch", results)
+	}
+	if results := Replay(records, ReplayOptions{Target: target.URL, RequestIDs: []string{"other"}}); len(results) != 0 {
+		t.Errorf("filtered replay = %+v, want none", results)
+	}
+}
+
+func TestAuditRedactMessages(t *testing.T) {
+	a := NewAuditLog(AuditConfig{RedactMessages: true, RedactHeaders: []string{"X-Team"}})
+	req := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+	req.Header.Set("X-Team", "secret")
+	rec := a.redactRequest(req, []byte(`{"model":"m","messages":[{"role":"user","content":"my SSN"}]}`))
+	if rec.Headers["X-Team"] != redactedValue {
+		t.Errorf("custom header not redacted: %v", rec.Headers)
+	}
+	if bytes.Contains(rec.Body, []byte("SSN")) || !rec.Redacted {
+		t.Errorf("message content not redacted: %s", rec.Body)
+	}
+
+	results := Replay([]AuditRecord{{RequestID: "r", Request: rec}}, ReplayOptions{Target: "http://127.0.0.1:1"})
+	if len(results) != 1 || results[0].Error == "" {
+		t.Errorf("redacted records should not be replayed: %+v", results)
+	}
+}
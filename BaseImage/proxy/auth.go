@@ -0,0 +1,506 @@
+package proxy
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	_ "crypto/sha512" // registers SHA-384/512 for JWT verification
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Scopes that can be granted to API keys and tokens. Admin implies all others.
+const (
+	ScopeChat     = "chat"
+	ScopeSessions = "sessions"
+	ScopeAdmin    = "admin"
+)
+
+// Identity is the authenticated caller of a request
+type Identity struct {
+	Subject string
+	Scopes  []string
+	Method  string
+}
+
+// HasScope reports whether the identity was granted scope
+func (id *Identity) HasScope(scope string) bool {
+	for _, s := range id.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+type contextKey string
+
+const identityContextKey contextKey = "identity"
+
+// IdentityFromContext returns the authenticated caller, or nil when the
+// request was not authenticated
+func IdentityFromContext(ctx context.Context) *Identity {
+	id, _ := ctx.Value(identityContextKey).(*Identity)
+	return id
+}
+
+// WithIdentity returns a copy of ctx carrying id
+func WithIdentity(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, identityContextKey, id)
+}
+
+// Authenticator verifies the credentials on a request. It returns a nil
+// identity and nil error when the request carries no credentials it handles.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+// AuthenticatorFunc adapts a function to the Authenticator interface
+type AuthenticatorFunc func(r *http.Request) (*Identity, error)
+
+// Authenticate calls f(r)
+func (f AuthenticatorFunc) Authenticate(r *http.Request) (*Identity, error) {
+	return f(r)
+}
+
+// bearerToken returns the bearer token from the Authorization header
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(auth[7:])
+}
+
+// callerID identifies the client a request is attributed to for limits,
+// budgets and usage. Authenticated requests use their identity; otherwise a
+// fingerprint of the bearer token is used, and anonymous requests are grouped
+// by address. The token itself never leaves the request.
+func callerID(r *http.Request) string {
+	if id := IdentityFromContext(r.Context()); id != nil {
+		return id.Subject
+	}
+	if key := bearerToken(r); key != "" {
+		return tokenFingerprint(key)
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// tokenFingerprint identifies an unverified bearer token without revealing it
+func tokenFingerprint(token string) string {
+	return "token:" + strings.TrimPrefix(HashAPIKey(token), "sha256:")[:16]
+}
+
+// configuredCaller returns the key of keys that caller stands for. Rate limit
+// and budget files may list raw bearer tokens, which callers are only known
+// by as fingerprints.
+func configuredCaller[T any](keys map[string]T, caller string) string {
+	if _, ok := keys[caller]; ok || !strings.HasPrefix(caller, "token:") {
+		return caller
+	}
+	for key := range keys {
+		if tokenFingerprint(key) == caller {
+			return key
+		}
+	}
+	return caller
+}
+
+// AuthConfig configures inbound authentication
+type AuthConfig struct {
+	APIKeys []APIKeyConfig    `json:"api_keys"`
+	JWT     *JWTConfig        `json:"jwt"`
+	Wallet  *WalletAuthConfig `json:"wallet"`
+	NFTGate *NFTGateConfig    `json:"nft_gate"`
+
+	ClientCert *ClientCertConfig `json:"client_cert"`
+}
+
+// APIKeyConfig is a static API key stored as a SHA-256 hash
+type APIKeyConfig struct {
+	Name   string   `json:"name"`
+	Hash   string   `json:"hash"`
+	Scopes []string `json:"scopes"`
+}
+
+// newAuthenticators builds the authenticator chain for cfg. adminKey, when
+// set, is accepted as an API key with the admin scope. An nft_gate enables
+// wallet authentication and admits only NFA token holders; ethNode is its
+// RPC endpoint when the gate does not name one.
+func newAuthenticators(cfg AuthConfig, adminKey, ethNode string) ([]Authenticator, error) {
+	keys := cfg.APIKeys
+	if adminKey != "" {
+		keys = append(keys, APIKeyConfig{Name: "admin", Hash: HashAPIKey(adminKey), Scopes: []string{ScopeAdmin}})
+	}
+
+	var authenticators []Authenticator
+	if len(keys) > 0 {
+		a, err := NewAPIKeyAuthenticator(keys)
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, a)
+	}
+	if cfg.JWT != nil {
+		a, err := NewJWTAuthenticator(*cfg.JWT)
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, a)
+	}
+	if cfg.Wallet != nil || cfg.NFTGate != nil {
+		var walletCfg WalletAuthConfig
+		if cfg.Wallet != nil {
+			walletCfg = *cfg.Wallet
+		}
+		a, err := NewWalletAuthenticator(walletCfg)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.NFTGate == nil {
+			authenticators = append(authenticators, a)
+		} else {
+			gate, err := dialNFTGate(*cfg.NFTGate, ethNode)
+			if err != nil {
+				return nil, err
+			}
+			authenticators = append(authenticators, NewNFTGateAuthenticator(a, gate))
+		}
+	}
+	if cfg.ClientCert != nil {
+		authenticators = append(authenticators, NewClientCertAuthenticator(*cfg.ClientCert))
+	}
+	return authenticators, nil
+}
+
+// HashAPIKey returns the at-rest form of an API key
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// APIKeyAuthenticator accepts bearer tokens matching a configured key hash
+type APIKeyAuthenticator struct {
+	keys map[[sha256.Size]byte]APIKeyConfig
+}
+
+// NewAPIKeyAuthenticator creates an authenticator for the given hashed keys
+func NewAPIKeyAuthenticator(keys []APIKeyConfig) (*APIKeyAuthenticator, error) {
+	a := &APIKeyAuthenticator{keys: make(map[[sha256.Size]byte]APIKeyConfig)}
+	for _, k := range keys {
+		if k.Name == "" {
+			return nil, fmt.Errorf("API key is missing a name")
+		}
+		raw, err := hex.DecodeString(strings.TrimPrefix(k.Hash, "sha256:"))
+		if err != nil || len(raw) != sha256.Size {
+			return nil, fmt.Errorf("API key %s: hash must be a hex SHA-256 digest", k.Name)
+		}
+		var digest [sha256.Size]byte
+		copy(digest[:], raw)
+		if len(k.Scopes) == 0 {
+			k.Scopes = []string{ScopeChat}
+		}
+		a.keys[digest] = k
+	}
+	return a, nil
+}
+
+// Authenticate implements Authenticator
+func (a *APIKeyAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	token := bearerToken(r)
+	if token == "" {
+		return nil, nil
+	}
+	digest := sha256.Sum256([]byte(token))
+	for stored, k := range a.keys {
+		if subtle.ConstantTimeCompare(digest[:], stored[:]) == 1 {
+			return &Identity{Subject: k.Name, Scopes: k.Scopes, Method: "api_key"}, nil
+		}
+	}
+	return nil, nil
+}
+
+// JWTConfig configures bearer JWT verification
+type JWTConfig struct {
+	Algorithm      string            `json:"algorithm"`
+	Secret         string            `json:"secret" secret:"true"`
+	PublicKeyFile  string            `json:"public_key_file"`
+	Issuer         string            `json:"issuer"`
+	Audience       string            `json:"audience"`
+	SubjectClaim   string            `json:"subject_claim"`
+	ScopesClaim    string            `json:"scopes_claim"`
+	RequiredClaims map[string]string `json:"required_claims"`
+	LeewaySeconds  int               `json:"leeway_seconds"`
+}
+
+// JWTAuthenticator accepts HS256/384/512 or RS256/384/512 signed tokens
+type JWTAuthenticator struct {
+	cfg       JWTConfig
+	hash      crypto.Hash
+	secret    []byte
+	publicKey *rsa.PublicKey
+	now       func() time.Time
+}
+
+// NewJWTAuthenticator creates a JWT authenticator from cfg
+func NewJWTAuthenticator(cfg JWTConfig) (*JWTAuthenticator, error) {
+	a := &JWTAuthenticator{cfg: cfg, now: time.Now}
+	if a.cfg.SubjectClaim == "" {
+		a.cfg.SubjectClaim = "sub"
+	}
+	if a.cfg.ScopesClaim == "" {
+		a.cfg.ScopesClaim = "scope"
+	}
+	if a.cfg.LeewaySeconds == 0 {
+		a.cfg.LeewaySeconds = 60
+	}
+
+	alg := strings.ToUpper(cfg.Algorithm)
+	a.cfg.Algorithm = alg
+	if len(alg) != 5 {
+		return nil, fmt.Errorf("unsupported JWT algorithm: %q", cfg.Algorithm)
+	}
+	switch alg[2:] {
+	case "256":
+		a.hash = crypto.SHA256
+	case "384":
+		a.hash = crypto.SHA384
+	case "512":
+		a.hash = crypto.SHA512
+	default:
+		return nil, fmt.Errorf("unsupported JWT algorithm: %q", cfg.Algorithm)
+	}
+
+	switch {
+	case strings.HasPrefix(alg, "HS"):
+		if cfg.Secret == "" {
+			return nil, fmt.Errorf("JWT algorithm %s requires a secret", alg)
+		}
+		a.secret = []byte(cfg.Secret)
+	case strings.HasPrefix(alg, "RS"):
+		key, err := loadRSAPublicKey(cfg.PublicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		a.publicKey = key
+	default:
+		return nil, fmt.Errorf("unsupported JWT algorithm: %q", cfg.Algorithm)
+	}
+	return a, nil
+}
+
+func loadRSAPublicKey(path string) (*rsa.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read JWT public key: %v", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("JWT public key %s is not PEM encoded", path)
+	}
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse JWT certificate: %v", err)
+		}
+		if key, ok := cert.PublicKey.(*rsa.PublicKey); ok {
+			return key, nil
+		}
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse JWT public key: %v", err)
+		}
+		if rsaKey, ok := key.(*rsa.PublicKey); ok {
+			return rsaKey, nil
+		}
+	}
+	return nil, fmt.Errorf("JWT public key %s is not an RSA key", path)
+}
+
+// Authenticate implements Authenticator
+func (a *JWTAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	token := bearerToken(r)
+	if strings.Count(token, ".") != 2 {
+		return nil, nil
+	}
+	claims, err := a.verify(token)
+	if err != nil {
+		return nil, err
+	}
+
+	subject, _ := claims[a.cfg.SubjectClaim].(string)
+	if subject == "" {
+		return nil, fmt.Errorf("token is missing the %s claim", a.cfg.SubjectClaim)
+	}
+	var scopes []string
+	switch v := claims[a.cfg.ScopesClaim].(type) {
+	case string:
+		scopes = strings.Fields(v)
+	case []interface{}:
+		for _, s := range v {
+			if str, ok := s.(string); ok {
+				scopes = append(scopes, str)
+			}
+		}
+	}
+	if len(scopes) == 0 {
+		scopes = []string{ScopeChat}
+	}
+	return &Identity{Subject: subject, Scopes: scopes, Method: "jwt"}, nil
+}
+
+func (a *JWTAuthenticator) verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.New("malformed token header")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, errors.New("malformed token header")
+	}
+	// Only the configured algorithm is accepted, to rule out alg confusion
+	if header.Alg != a.cfg.Algorithm {
+		return nil, fmt.Errorf("unexpected token algorithm %q", header.Alg)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+	signed := parts[0] + "." + parts[1]
+	if a.secret != nil {
+		mac := hmac.New(a.hash.New, a.secret)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return nil, errors.New("invalid token signature")
+		}
+	} else {
+		h := a.hash.New()
+		h.Write([]byte(signed))
+		if err := rsa.VerifyPKCS1v15(a.publicKey, a.hash, h.Sum(nil), signature); err != nil {
+			return nil, errors.New("invalid token signature")
+		}
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("malformed token payload")
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, errors.New("malformed token payload")
+	}
+	if err := a.validateClaims(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (a *JWTAuthenticator) validateClaims(claims map[string]interface{}) error {
+	now := a.now()
+	leeway := time.Duration(a.cfg.LeewaySeconds) * time.Second
+	if exp, ok := claims["exp"].(float64); ok && now.After(time.Unix(int64(exp), 0).Add(leeway)) {
+		return errors.New("token has expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(leeway).Before(time.Unix(int64(nbf), 0)) {
+		return errors.New("token is not valid yet")
+	}
+	if a.cfg.Issuer != "" && claims["iss"] != a.cfg.Issuer {
+		return errors.New("token issuer is not trusted")
+	}
+	if a.cfg.Audience != "" && !audienceContains(claims["aud"], a.cfg.Audience) {
+		return errors.New("token audience does not match")
+	}
+	for name, want := range a.cfg.RequiredClaims {
+		if got := fmt.Sprint(claims[name]); claims[name] == nil || got != want {
+			return fmt.Errorf("token claim %s does not match", name)
+		}
+	}
+	return nil
+}
+
+func audienceContains(aud interface{}, want string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == want
+	case []interface{}:
+		for _, a := range v {
+			if a == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// requireScope wraps a handler with authentication. When no authenticators
+// are configured requests pass through unauthenticated.
+func (p *Proxy) requireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(p.authenticators) == 0 {
+			next(w, r)
+			return
+		}
+
+		var authErr error
+		for _, a := range p.authenticators {
+			id, err := a.Authenticate(r)
+			if err != nil {
+				authErr = err
+				continue
+			}
+			if id == nil {
+				continue
+			}
+			if !id.HasScope(scope) {
+				p.logger.Printf("Caller %s lacks scope %s for %s", id.Subject, scope, r.URL.Path)
+				respondWithAPIError(w, http.StatusForbidden, newAPIError("permission_error", "insufficient_scope", "",
+					fmt.Sprintf("This credential does not have the %q scope required for %s", scope, r.URL.Path)))
+				return
+			}
+			next(w, r.WithContext(WithIdentity(r.Context(), id)))
+			return
+		}
+
+		w.Header().Set("WWW-Authenticate", `Bearer realm="nfa-proxy"`)
+		switch {
+		case errors.Is(authErr, ErrNotTokenHolder):
+			respondWithAPIError(w, http.StatusForbidden, newAPIError("permission_error", "nft_required", "",
+				"This proxy is restricted to holders of an NFA token."))
+		case authErr != nil:
+			p.logger.Printf("Authentication failed for %s: %v", r.URL.Path, authErr)
+			respondWithAPIError(w, http.StatusUnauthorized, newAPIError("invalid_request_error", "invalid_api_key", "",
+				fmt.Sprintf("Invalid authentication token: %v", authErr)))
+		case bearerToken(r) == "":
+			respondWithAPIError(w, http.StatusUnauthorized, newAPIError("invalid_request_error", "", "",
+				"You didn't provide an API key. You need to provide your API key in an Authorization header using Bearer auth (i.e. Authorization: Bearer YOUR_KEY)."))
+		default:
+			respondWithAPIError(w, http.StatusUnauthorized, newAPIError("invalid_request_error", "invalid_api_key", "",
+				"Incorrect API key provided."))
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package proxy
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func signTestJWT(t *testing.T, alg string, claims map[string]interface{}, hsSecret []byte, rsKey *rsa.PrivateKey) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	var sig []byte
+	if rsKey != nil {
+		digest := sha256.Sum256([]byte(signed))
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, rsKey, crypto.SHA256, digest[:]); err != nil {
+			t.Fatalf("failed to sign token: %v", err)
+		}
+	} else {
+		mac := hmac.New(sha256.New, hsSecret)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func authRequest(token string) *http.Request {
+	req := httptest.NewRequest("GET", "/v1/chat/completions", nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req
+}
+
+func TestAPIKeyAuthenticator(t *testing.T) {
+	a, err := NewAPIKeyAuthenticator([]APIKeyConfig{
+		{Name: "team-a", Hash: HashAPIKey("sk-team-a")},
+		{Name: "ops", Hash: HashAPIKey("sk-ops"), Scopes: []string{ScopeAdmin}},
+	})
+	if err != nil {
+		t.Fatalf("NewAPIKeyAuthenticator() error = %v", err)
+	}
+
+	id, err := a.Authenticate(authRequest("sk-team-a"))
+	if err != nil || id == nil || id.Subject != "team-a" {
+		t.Fatalf("valid key not accepted: %+v, %v", id, err)
+	}
+	if !id.HasScope(ScopeChat) || id.HasScope(ScopeAdmin) {
+		t.Errorf("keys without scopes should be chat-only, got %v", id.Scopes)
+	}
+
+	id, _ = a.Authenticate(authRequest("sk-ops"))
+	if id == nil || !id.HasScope(ScopeSessions) {
+		t.Errorf("admin scope should imply all scopes, got %+v", id)
+	}
+
+	if id, err := a.Authenticate(authRequest("sk-unknown")); id != nil || err != nil {
+		t.Errorf("unknown key should not authenticate, got %+v, %v", id, err)
+	}
+
+	if _, err := NewAPIKeyAuthenticator([]APIKeyConfig{{Name: "bad", Hash: "plaintext"}}); err == nil {
+		t.Error("keys that are not SHA-256 hashes should be rejected")
+	}
+}
+
+func TestJWTAuthenticatorHS256(t *testing.T) {
+	secret := []byte("test-secret")
+	a, err := NewJWTAuthenticator(JWTConfig{
+		Algorithm:      "HS256",
+		Secret:         string(secret),
+		Issuer:         "https://issuer.example",
+		Audience:       "nfa-proxy",
+		RequiredClaims: map[string]string{"org": "acme"},
+	})
+	if err != nil {
+		t.Fatalf("NewJWTAuthenticator() error = %v", err)
+	}
+
+	valid := map[string]interface{}{
+		"sub":   "agent-7",
+		"iss":   "https://issuer.example",
+		"aud":   []string{"other", "nfa-proxy"},
+		"org":   "acme",
+		"scope": "chat sessions",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+	}
+	id, err := a.Authenticate(authRequest(signTestJWT(t, "HS256", valid, secret, nil)))
+	if err != nil || id == nil {
+		t.Fatalf("valid token rejected: %v", err)
+	}
+	if id.Subject != "agent-7" || !id.HasScope(ScopeSessions) || id.HasScope(ScopeAdmin) {
+		t.Errorf("unexpected identity: %+v", id)
+	}
+
+	tests := []struct {
+		name   string
+		mutate func(map[string]interface{})
+		alg    string
+		secret []byte
+	}{
+		{"expired", func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Hour).Unix() }, "HS256", secret},
+		{"wrong issuer", func(c map[string]interface{}) { c["iss"] = "https://evil.example" }, "HS256", secret},
+		{"wrong audience", func(c map[string]interface{}) { c["aud"] = "someone-else" }, "HS256", secret},
+		{"missing claim", func(c map[string]interface{}) { delete(c, "org") }, "HS256", secret},
+		{"bad signature", func(c map[string]interface{}) {}, "HS256", []byte("other-secret")},
+		{"wrong algorithm", func(c map[string]interface{}) {}, "HS384", secret},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := make(map[string]interface{})
+			for k, v := range valid {
+				claims[k] = v
+			}
+			tt.mutate(claims)
+			if _, err := a.Authenticate(authRequest(signTestJWT(t, tt.alg, claims, tt.secret, nil))); err == nil {
+				t.Error("token should be rejected")
+			}
+		})
+	}
+
+	if id, err := a.Authenticate(authRequest("sk-not-a-jwt")); id != nil || err != nil {
+		t.Errorf("non-JWT tokens should be left to other authenticators, got %+v, %v", id, err)
+	}
+}
+
+func TestJWTAuthenticatorRS256(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	keyFile := filepath.Join(t.TempDir(), "jwt.pub")
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600)
+
+	a, err := NewJWTAuthenticator(JWTConfig{Algorithm: "RS256", PublicKeyFile: keyFile, ScopesClaim: "roles"})
+	if err != nil {
+		t.Fatalf("NewJWTAuthenticator() error = %v", err)
+	}
+
+	token := signTestJWT(t, "RS256", map[string]interface{}{"sub": "svc", "roles": []string{"admin"}}, nil, key)
+	id, err := a.Authenticate(authRequest(token))
+	if err != nil || id == nil || !id.HasScope(ScopeAdmin) {
+		t.Fatalf("valid RS256 token rejected: %+v, %v", id, err)
+	}
+
+	// A token HMAC-signed with the public key must not pass as RS256
+	forged := signTestJWT(t, "RS256", map[string]interface{}{"sub": "svc"}, der, nil)
+	if _, err := a.Authenticate(authRequest(forged)); err == nil {
+		t.Error("forged token should be rejected")
+	}
+}
+
+func TestRequireScope(t *testing.T) {
+	p := NewProxy()
+	var gotCaller string
+	handler := p.requireScope(ScopeAdmin, func(w http.ResponseWriter, r *http.Request) {
+		gotCaller = callerID(r)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	// Without authenticators requests pass through
+	w := httptest.NewRecorder()
+	handler(w, authRequest(""))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("unauthenticated proxy should pass requests, got %d", w.Code)
+	}
+
+	a, _ := NewAPIKeyAuthenticator([]APIKeyConfig{
+		{Name: "chat-only", Hash: HashAPIKey("sk-chat")},
+		{Name: "ops", Hash: HashAPIKey("sk-ops"), Scopes: []string{ScopeAdmin}},
+	})
+	p.authenticators = []Authenticator{a}
+
+	tests := []struct {
+		name     string
+		token    string
+		wantCode int
+		wantType string
+	}{
+		{"missing key", "", http.StatusUnauthorized, "invalid_request_error"},
+		{"invalid key", "sk-wrong", http.StatusUnauthorized, "invalid_request_error"},
+		{"insufficient scope", "sk-chat", http.StatusForbidden, "permission_error"},
+		{"admin key", "sk-ops", http.StatusNoContent, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler(w, authRequest(tt.token))
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantCode)
+			}
+			if tt.wantType == "" {
+				return
+			}
+			var payload struct {
+				Error APIError `json:"error"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&payload); err != nil {
+				t.Fatalf("error body is not OpenAI-compatible: %v", err)
+			}
+			if payload.Error.Type != tt.wantType || payload.Error.Message == "" {
+				t.Errorf("unexpected error: %+v", payload.Error)
+			}
+		})
+	}
+	if gotCaller != "ops" {
+		t.Errorf("caller = %q, want the key name", gotCaller)
+	}
+}
+
+func TestCallerIDFingerprintsTokens(t *testing.T) {
+	caller := callerID(authRequest("sk-team-a"))
+	if caller == "sk-team-a" || !strings.HasPrefix(caller, "token:") || caller != tokenFingerprint("sk-team-a") {
+		t.Errorf("callerID = %q", caller)
+	}
+
+	// Limits configured for the raw token still apply to its fingerprint
+	rl := NewRateLimiter(RateLimitConfig{Keys: map[string]RateLimit{"sk-team-a": {MaxConcurrent: 3}}})
+	if keyLimit, _, _ := rl.limits(caller, "m"); keyLimit.MaxConcurrent != 3 {
+		t.Errorf("key limit = %+v", keyLimit)
+	}
+	bt, _ := NewBudgetTracker(BudgetConfig{Keys: map[string]SpendLimit{"sk-team-a": {DailyMOR: "1"}}})
+	if scopes := bt.scopes(caller, "m", ""); scopes[0].name != "key:sk-team-a" || scopes[0].limit.daily == nil {
+		t.Errorf("budget scopes = %+v", scopes)
+	}
+}
+
+func TestNewAuthenticatorsAdminKey(t *testing.T) {
+	authenticators, err := newAuthenticators(AuthConfig{}, "sk-admin", "")
+	if err != nil {
+		t.Fatalf("newAuthenticators() error = %v", err)
+	}
+	if len(authenticators) != 1 {
+		t.Fatalf("got %d authenticators, want 1", len(authenticators))
+	}
+	id, _ := authenticators[0].Authenticate(authRequest("sk-admin"))
+	if id == nil || !id.HasScope(ScopeAdmin) {
+		t.Errorf("ADMIN_API_KEY should authenticate with admin scope, got %+v", id)
+	}
+}
@@ -0,0 +1,726 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BatchConfig configures the batch and files APIs
+type BatchConfig struct {
+	// Dir stores uploaded files, batch state and results. Empty disables the
+	// batch API.
+	Dir string `json:"dir" env:"BATCH_DIR"`
+	// Concurrency is how many batch requests run at once across all batches
+	Concurrency int `json:"concurrency" env:"BATCH_CONCURRENCY"`
+	// MaxFileBytes caps uploaded files
+	MaxFileBytes int64 `json:"max_file_bytes"`
+}
+
+// Batch statuses, as in the OpenAI Batch API
+const (
+	BatchValidating = "validating"
+	BatchFailed     = "failed"
+	BatchInProgress = "in_progress"
+	BatchFinalizing = "finalizing"
+	BatchCompleted  = "completed"
+	BatchCancelling = "cancelling"
+	BatchCancelled  = "cancelled"
+)
+
+// Batch is a bulk job over an uploaded JSONL file of chat requests
+type Batch struct {
+	ID               string            `json:"id"`
+	Object           string            `json:"object"`
+	Endpoint         string            `json:"endpoint"`
+	Errors           *BatchErrors      `json:"errors"`
+	InputFileID      string            `json:"input_file_id"`
+	CompletionWindow string            `json:"completion_window"`
+	Status           string            `json:"status"`
+	OutputFileID     *string           `json:"output_file_id"`
+	ErrorFileID      *string           `json:"error_file_id"`
+	CreatedAt        int64             `json:"created_at"`
+	InProgressAt     *int64            `json:"in_progress_at"`
+	FinalizingAt     *int64            `json:"finalizing_at"`
+	CompletedAt      *int64            `json:"completed_at"`
+	FailedAt         *int64            `json:"failed_at"`
+	CancellingAt     *int64            `json:"cancelling_at"`
+	CancelledAt      *int64            `json:"cancelled_at"`
+	RequestCounts    BatchCounts       `json:"request_counts"`
+	Metadata         map[string]string `json:"metadata"`
+}
+
+// BatchCounts tracks a batch's progress
+type BatchCounts struct {
+	Total     int `json:"total"`
+	Completed int `json:"completed"`
+	Failed    int `json:"failed"`
+}
+
+// BatchErrors lists why a batch's input file was rejected
+type BatchErrors struct {
+	Object string       `json:"object"`
+	Data   []BatchError `json:"data"`
+}
+
+// BatchError is one problem with a batch input file
+type BatchError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Param   string `json:"param,omitempty"`
+	Line    int    `json:"line,omitempty"`
+}
+
+// batchRecord is how a batch is stored: the API object plus who it runs for
+type batchRecord struct {
+	Batch
+	Owner string `json:"owner"`
+	// Caller is the identity batch requests are attributed to for limits,
+	// budgets and usage
+	Caller string `json:"caller"`
+}
+
+// batchRequest is one line of a batch input file
+type batchRequest struct {
+	CustomID string          `json:"custom_id"`
+	Method   string          `json:"method"`
+	URL      string          `json:"url"`
+	Body     json.RawMessage `json:"body"`
+
+	chat ChatCompletionRequest
+}
+
+// batchResult is one line of a batch output or error file
+type batchResult struct {
+	ID       string         `json:"id"`
+	CustomID string         `json:"custom_id"`
+	Response *batchResponse `json:"response"`
+	Error    *BatchError    `json:"error"`
+}
+
+type batchResponse struct {
+	StatusCode int             `json:"status_code"`
+	RequestID  string          `json:"request_id"`
+	Body       json.RawMessage `json:"body"`
+}
+
+var batchIDPattern = regexp.MustCompile(`^batch_[0-9a-f]{24}$`)
+
+// errBatchCancelled is the cause of a batch context cancelled by its owner
+var errBatchCancelled = errors.New("batch cancelled")
+
+// maxBatchErrors caps the input problems reported for a rejected batch
+const maxBatchErrors = 10
+
+// batchManager stores batches and works through them in the background.
+// Results are appended to partial files as items finish, so a restarted
+// proxy resumes where it stopped.
+type batchManager struct {
+	dir    string
+	files  *fileStore
+	logger *log.Logger
+
+	// slots caps the batch requests in flight across all batches
+	slots chan struct{}
+
+	mu      sync.Mutex
+	running map[string]context.CancelCauseFunc
+	ctx     context.Context
+	wg      sync.WaitGroup
+}
+
+func newBatchManager(ctx context.Context, cfg BatchConfig, logger *log.Logger) (*batchManager, error) {
+	files, err := newFileStore(filepath.Join(cfg.Dir, "files"))
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(cfg.Dir, "batches")
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &batchManager{
+		dir:     dir,
+		files:   files,
+		logger:  logger,
+		slots:   make(chan struct{}, cfg.Concurrency),
+		running: make(map[string]context.CancelCauseFunc),
+		ctx:     ctx,
+	}, nil
+}
+
+func (m *batchManager) statePath(id string) string {
+	return filepath.Join(m.dir, id+".json")
+}
+
+// partialPath is where results are appended until the batch is finalized
+func (m *batchManager) partialPath(id, kind string) string {
+	return filepath.Join(m.dir, id+"."+kind+".jsonl")
+}
+
+func (m *batchManager) load(id string) (*batchRecord, error) {
+	if !batchIDPattern.MatchString(id) {
+		return nil, os.ErrNotExist
+	}
+	data, err := os.ReadFile(m.statePath(id))
+	if err != nil {
+		return nil, err
+	}
+	var rec batchRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, fmt.Errorf("failed to parse batch %s: %v", id, err)
+	}
+	return &rec, nil
+}
+
+func (m *batchManager) save(rec *batchRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(m.statePath(rec.ID), data)
+}
+
+func (m *batchManager) list(owner string) ([]Batch, error) {
+	entries, err := os.ReadDir(m.dir)
+	if err != nil {
+		return nil, err
+	}
+	batches := []Batch{}
+	for _, e := range entries {
+		id := strings.TrimSuffix(e.Name(), ".json")
+		if !batchIDPattern.MatchString(id) {
+			continue
+		}
+		if rec, err := m.load(id); err == nil && rec.Owner == owner {
+			batches = append(batches, rec.Batch)
+		}
+	}
+	sort.Slice(batches, func(i, j int) bool { return batches[i].CreatedAt > batches[j].CreatedAt })
+	return batches, nil
+}
+
+// resume restarts batches that were running when the proxy stopped
+func (m *batchManager) resume(p *Proxy) {
+	entries, err := os.ReadDir(m.dir)
+	if err != nil {
+		m.logger.Printf("Error listing batches: %v", err)
+		return
+	}
+	for _, e := range entries {
+		id := strings.TrimSuffix(e.Name(), ".json")
+		if !batchIDPattern.MatchString(id) {
+			continue
+		}
+		rec, err := m.load(id)
+		if err != nil {
+			m.logger.Printf("Error loading batch %s: %v", id, err)
+			continue
+		}
+		switch rec.Status {
+		case BatchValidating, BatchInProgress, BatchFinalizing, BatchCancelling:
+			m.logger.Printf("Resuming batch %s (%s)", id, rec.Status)
+			m.start(p, rec)
+		}
+	}
+}
+
+// start runs the batch in the background until it finishes or the proxy
+// closes
+func (m *batchManager) start(p *Proxy, rec *batchRecord) {
+	ctx, cancel := context.WithCancelCause(m.ctx)
+	m.mu.Lock()
+	m.running[rec.ID] = cancel
+	m.mu.Unlock()
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		defer func() {
+			m.mu.Lock()
+			delete(m.running, rec.ID)
+			m.mu.Unlock()
+			cancel(nil)
+		}()
+		m.run(ctx, p, rec)
+	}()
+}
+
+// cancel stops a running batch from starting more requests. It reports
+// false if the batch is not running.
+func (m *batchManager) cancel(id string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cancel, ok := m.running[id]
+	if ok {
+		cancel(errBatchCancelled)
+	}
+	return ok
+}
+
+// wait blocks until every batch goroutine has stopped
+func (m *batchManager) wait() {
+	m.wg.Wait()
+}
+
+func (m *batchManager) run(ctx context.Context, p *Proxy, rec *batchRecord) {
+	if rec.Status == BatchValidating {
+		items, problems, err := m.readInput(rec.InputFileID)
+		if err != nil {
+			problems = []BatchError{{Code: "invalid_file", Message: err.Error()}}
+		}
+		now := time.Now().Unix()
+		if len(problems) > 0 {
+			rec.Status, rec.FailedAt = BatchFailed, &now
+			rec.Errors = &BatchErrors{Object: "list", Data: problems}
+			m.logger.Printf("Batch %s failed validation: %s", rec.ID, problems[0].Message)
+			m.saveOrLog(rec)
+			return
+		}
+		rec.Status, rec.InProgressAt = BatchInProgress, &now
+		rec.RequestCounts.Total = len(items)
+		m.saveOrLog(rec)
+	}
+
+	if rec.Status == BatchInProgress {
+		if !m.process(ctx, p, rec) {
+			// The proxy is closing; the batch resumes on the next start
+			return
+		}
+		if rec.Status == BatchInProgress {
+			now := time.Now().Unix()
+			rec.Status, rec.FinalizingAt = BatchFinalizing, &now
+			m.saveOrLog(rec)
+		}
+	}
+
+	m.finalize(rec)
+}
+
+func (m *batchManager) saveOrLog(rec *batchRecord) {
+	if err := m.save(rec); err != nil {
+		m.logger.Printf("Error saving batch %s: %v", rec.ID, err)
+	}
+}
+
+// readInput parses and checks a batch input file
+func (m *batchManager) readInput(fileID string) ([]*batchRequest, []BatchError, error) {
+	f, err := m.files.open(fileID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("input file %s could not be read", fileID)
+	}
+	defer f.Close()
+
+	var items []*batchRequest
+	var problems []BatchError
+	seen := make(map[string]bool)
+	problem := func(line int, code, format string, args ...interface{}) {
+		if len(problems) < maxBatchErrors {
+			problems = append(problems, BatchError{Code: code, Line: line, Message: fmt.Sprintf(format, args...)})
+		}
+	}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		item := &batchRequest{}
+		if err := json.Unmarshal(scanner.Bytes(), item); err != nil {
+			problem(line, "invalid_json_line", "Line %d is not valid JSON: %v", line, err)
+			continue
+		}
+		switch {
+		case item.CustomID == "":
+			problem(line, "missing_required_parameter", "Line %d has no custom_id", line)
+		case seen[item.CustomID]:
+			problem(line, "duplicate_custom_id", "custom_id %q is used more than once", item.CustomID)
+		case item.Method != http.MethodPost:
+			problem(line, "invalid_method", "Line %d: method must be POST", line)
+		case item.URL != "/v1/chat/completions":
+			problem(line, "invalid_url", "Line %d: url must be /v1/chat/completions", line)
+		case json.Unmarshal(item.Body, &item.chat) != nil || item.chat.Model == "" || len(item.chat.Messages) == 0:
+			problem(line, "invalid_request", "Line %d: body must be a chat request with model and messages", line)
+		}
+		seen[item.CustomID] = true
+		items = append(items, item)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, fmt.Errorf("input file %s could not be read: %v", fileID, err)
+	}
+	if len(items) == 0 && len(problems) == 0 {
+		problem(0, "empty_file", "The input file has no requests")
+	}
+	return items, problems, nil
+}
+
+// finishedIDs returns the custom IDs that already have a result
+func (m *batchManager) finishedIDs(id string) map[string]bool {
+	done := make(map[string]bool)
+	for _, kind := range []string{"output", "errors"} {
+		f, err := os.Open(m.partialPath(id, kind))
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			var res batchResult
+			if json.Unmarshal(scanner.Bytes(), &res) == nil {
+				done[res.CustomID] = true
+			}
+		}
+		f.Close()
+	}
+	return done
+}
+
+// process runs the batch's remaining requests. It reports false when it
+// stopped because the proxy is closing.
+func (m *batchManager) process(ctx context.Context, p *Proxy, rec *batchRecord) bool {
+	items, _, err := m.readInput(rec.InputFileID)
+	if err != nil {
+		m.logger.Printf("Error reading input of batch %s: %v", rec.ID, err)
+		return true
+	}
+	done := m.finishedIDs(rec.ID)
+
+	var outMu sync.Mutex
+	output, err := os.OpenFile(m.partialPath(rec.ID, "output"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		m.logger.Printf("Error opening output of batch %s: %v", rec.ID, err)
+		return true
+	}
+	defer output.Close()
+	errorsFile, err := os.OpenFile(m.partialPath(rec.ID, "errors"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		m.logger.Printf("Error opening errors of batch %s: %v", rec.ID, err)
+		return true
+	}
+	defer errorsFile.Close()
+
+	sessions := &batchSessions{ids: make(map[string]string), locks: make(map[string]*sync.Mutex)}
+	var wg sync.WaitGroup
+	for _, item := range items {
+		if done[item.CustomID] {
+			continue
+		}
+		if !m.acquireSlot(ctx) {
+			break
+		}
+		wg.Add(1)
+		go func(item *batchRequest) {
+			defer wg.Done()
+			defer func() { <-m.slots }()
+			res, ok := p.runBatchItem(m.ctx, rec.Caller, item, sessions)
+			if !ok {
+				return
+			}
+			data, _ := json.Marshal(res)
+			outMu.Lock()
+			defer outMu.Unlock()
+			target := output
+			if res.Error != nil || res.Response.StatusCode != http.StatusOK {
+				target = errorsFile
+				rec.RequestCounts.Failed++
+			} else {
+				rec.RequestCounts.Completed++
+			}
+			if _, err := target.Write(append(data, '\n')); err != nil {
+				m.logger.Printf("Error writing result of batch %s: %v", rec.ID, err)
+			}
+			m.saveOrLog(rec)
+		}(item)
+	}
+	wg.Wait()
+
+	if context.Cause(ctx) == errBatchCancelled {
+		// Cancelled by its owner; publish what finished
+		now := time.Now().Unix()
+		rec.Status, rec.CancellingAt = BatchCancelling, &now
+		m.saveOrLog(rec)
+		return true
+	}
+	return ctx.Err() == nil
+}
+
+// acquireSlot waits for room to start another request. It reports false once
+// ctx is done.
+func (m *batchManager) acquireSlot(ctx context.Context) bool {
+	select {
+	case m.slots <- struct{}{}:
+		if ctx.Err() != nil {
+			<-m.slots
+			return false
+		}
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// finalize publishes the result files and records the final status
+func (m *batchManager) finalize(rec *batchRecord) {
+	for _, kind := range []string{"output", "errors"} {
+		path := m.partialPath(rec.ID, kind)
+		info, err := os.Stat(path)
+		if err != nil || info.Size() == 0 {
+			os.Remove(path)
+			continue
+		}
+		f, err := m.files.adopt(rec.Owner, fmt.Sprintf("%s_%s.jsonl", rec.ID, kind), "batch_output", path)
+		if err != nil {
+			m.logger.Printf("Error publishing %s of batch %s: %v", kind, rec.ID, err)
+			continue
+		}
+		if kind == "output" {
+			rec.OutputFileID = &f.ID
+		} else {
+			rec.ErrorFileID = &f.ID
+		}
+	}
+	now := time.Now().Unix()
+	if rec.Status == BatchCancelling {
+		rec.Status, rec.CancelledAt = BatchCancelled, &now
+	} else {
+		rec.Status, rec.CompletedAt = BatchCompleted, &now
+	}
+	m.logger.Printf("Batch %s %s: %d completed, %d failed of %d", rec.ID, rec.Status, rec.RequestCounts.Completed, rec.RequestCounts.Failed, rec.RequestCounts.Total)
+	m.saveOrLog(rec)
+}
+
+// batchSessions shares one session per model across a batch's requests. The
+// first request for a model runs alone so that only it opens a session.
+type batchSessions struct {
+	mu    sync.Mutex
+	ids   map[string]string
+	locks map[string]*sync.Mutex
+}
+
+// acquire returns the session for model, if there is one yet. done must be
+// called with the session the request ended up using.
+func (s *batchSessions) acquire(model string) (string, func(sessionID string)) {
+	s.mu.Lock()
+	if id, ok := s.ids[model]; ok {
+		s.mu.Unlock()
+		return id, func(sessionID string) { s.update(model, sessionID) }
+	}
+	lock, ok := s.locks[model]
+	if !ok {
+		lock = &sync.Mutex{}
+		s.locks[model] = lock
+	}
+	s.mu.Unlock()
+
+	lock.Lock()
+	s.mu.Lock()
+	id := s.ids[model]
+	s.mu.Unlock()
+	return id, func(sessionID string) {
+		s.update(model, sessionID)
+		lock.Unlock()
+	}
+}
+
+func (s *batchSessions) update(model, sessionID string) {
+	if sessionID == "" {
+		return
+	}
+	s.mu.Lock()
+	s.ids[model] = sessionID
+	s.mu.Unlock()
+}
+
+// runBatchItem sends one batch request through the chat path as caller. It
+// reports false when the proxy closed before the request finished.
+func (p *Proxy) runBatchItem(ctx context.Context, caller string, item *batchRequest, sessions *batchSessions) (*batchResult, bool) {
+	model := item.chat.Model
+	sessionID, done := sessions.acquire(model)
+	id := &Identity{Subject: caller, Scopes: []string{ScopeChat}, Method: "batch"}
+	attempt, status, body := p.backgroundChat(ctx, id, item.chat, sessionID)
+	if attempt != nil && attempt.index == 0 {
+		done(attempt.sessionID)
+	} else {
+		done("")
+	}
+	if ctx.Err() != nil {
+		return nil, false
+	}
+	return &batchResult{
+		ID:       newObjectID("batch_req_"),
+		CustomID: item.CustomID,
+		Response: &batchResponse{StatusCode: status, RequestID: newObjectID("req_"), Body: body},
+	}, true
+}
+
+// chatCompletionFromStream assembles a chat.completion object from a
+// streamed response
+func chatCompletionFromStream(model string, messages []Message, stream []byte) map[string]interface{} {
+	usage := newUsageCollector(messages)
+	scanner := bufio.NewScanner(bytes.NewReader(stream))
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		usage.observe(scanner.Bytes())
+	}
+	rec := usage.record()
+	return map[string]interface{}{
+		"id":      newObjectID("chatcmpl-"),
+		"object":  "chat.completion",
+		"created": time.Now().Unix(),
+		"model":   model,
+		"choices": []map[string]interface{}{{
+			"index":         0,
+			"message":       map[string]string{"role": "assistant", "content": usage.completion.String()},
+			"finish_reason": "stop",
+		}},
+		"usage": map[string]int{
+			"prompt_tokens":     rec.PromptTokens,
+			"completion_tokens": rec.CompletionTokens,
+			"total_tokens":      rec.TotalTokens,
+		},
+	}
+}
+
+func respondWithBatchDisabled(w http.ResponseWriter) {
+	respondWithAPIError(w, http.StatusNotFound, newAPIError("not_found_error", "", "", "The batch API is not enabled on this proxy; set BATCH_DIR"))
+}
+
+// handleBatches serves the batch API:
+//
+//	POST /v1/batches              create a batch
+//	GET  /v1/batches              list batches
+//	GET  /v1/batches/{id}         get a batch
+//	POST /v1/batches/{id}/cancel  cancel a batch
+func (p *Proxy) handleBatches(w http.ResponseWriter, r *http.Request) {
+	if p.batches == nil {
+		respondWithBatchDisabled(w)
+		return
+	}
+	owner := HashAPIKey(callerID(r))
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/batches"), "/"), "/")
+
+	if parts[0] == "" {
+		switch r.Method {
+		case http.MethodPost:
+			p.createBatch(w, r, owner)
+		case http.MethodGet:
+			batches, err := p.batches.list(owner)
+			if err != nil {
+				p.logger.Printf("Error listing batches: %v", err)
+				respondWithAPIError(w, http.StatusInternalServerError, newAPIError("server_error", "", "", "Failed to list batches"))
+				return
+			}
+			writeJSON(w, map[string]interface{}{"object": "list", "data": batches})
+		default:
+			respondWithAPIError(w, http.StatusMethodNotAllowed, newAPIError("invalid_request_error", "", "", "Method not allowed"))
+		}
+		return
+	}
+
+	rec, err := p.batches.load(parts[0])
+	if err == nil && rec.Owner != owner {
+		err = os.ErrNotExist
+	}
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			respondWithAPIError(w, http.StatusNotFound, newAPIError("invalid_request_error", "batch_not_found", "batch_id", fmt.Sprintf("No batch found with id %s", parts[0])))
+		} else {
+			p.logger.Printf("Error loading batch %s: %v", parts[0], err)
+			respondWithAPIError(w, http.StatusInternalServerError, newAPIError("server_error", "", "", "Failed to load batch"))
+		}
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		writeJSON(w, rec.Batch)
+	case len(parts) == 2 && parts[1] == "cancel" && r.Method == http.MethodPost:
+		p.cancelBatch(w, rec)
+	case len(parts) == 1 || (len(parts) == 2 && parts[1] == "cancel"):
+		respondWithAPIError(w, http.StatusMethodNotAllowed, newAPIError("invalid_request_error", "", "", "Method not allowed"))
+	default:
+		respondWithAPIError(w, http.StatusNotFound, newAPIError("not_found_error", "", "", "Unknown batches endpoint"))
+	}
+}
+
+func (p *Proxy) createBatch(w http.ResponseWriter, r *http.Request, owner string) {
+	var req struct {
+		InputFileID      string            `json:"input_file_id"`
+		Endpoint         string            `json:"endpoint"`
+		CompletionWindow string            `json:"completion_window"`
+		Metadata         map[string]string `json:"metadata"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil {
+		respondWithAPIError(w, http.StatusBadRequest, newAPIError("invalid_request_error", "", "", fmt.Sprintf("Error parsing request body: %v", err)))
+		return
+	}
+	if req.Endpoint != "/v1/chat/completions" {
+		respondWithAPIError(w, http.StatusBadRequest, newAPIError("invalid_request_error", "", "endpoint", "endpoint must be /v1/chat/completions"))
+		return
+	}
+	if req.CompletionWindow != "24h" {
+		respondWithAPIError(w, http.StatusBadRequest, newAPIError("invalid_request_error", "", "completion_window", "completion_window must be 24h"))
+		return
+	}
+	input, err := p.batches.files.get(req.InputFileID)
+	if err != nil || input.Owner != owner || input.Purpose != "batch" {
+		respondWithAPIError(w, http.StatusBadRequest, newAPIError("invalid_request_error", "", "input_file_id", fmt.Sprintf("No batch input file found with id %s", req.InputFileID)))
+		return
+	}
+
+	rec := &batchRecord{
+		Batch: Batch{
+			ID:               newObjectID("batch_"),
+			Object:           "batch",
+			Endpoint:         req.Endpoint,
+			InputFileID:      input.ID,
+			CompletionWindow: req.CompletionWindow,
+			Status:           BatchValidating,
+			CreatedAt:        time.Now().Unix(),
+			Metadata:         req.Metadata,
+		},
+		Owner: owner,
+		// Items run as the caller, like interactive and async requests, so
+		// its rate limits and budgets apply
+		Caller: callerID(r),
+	}
+	if err := p.batches.save(rec); err != nil {
+		p.logger.Printf("Error saving batch: %v", err)
+		respondWithAPIError(w, http.StatusInternalServerError, newAPIError("server_error", "", "", "Failed to save batch"))
+		return
+	}
+	p.logger.Printf("Created batch %s for file %s", rec.ID, input.ID)
+	// The batch goroutine owns rec once started
+	batch := rec.Batch
+	p.batches.start(p, rec)
+	writeJSON(w, batch)
+}
+
+func (p *Proxy) cancelBatch(w http.ResponseWriter, rec *batchRecord) {
+	switch rec.Status {
+	case BatchValidating, BatchInProgress:
+	case BatchCancelling, BatchCancelled:
+		writeJSON(w, rec.Batch)
+		return
+	default:
+		respondWithAPIError(w, http.StatusConflict, newAPIError("invalid_request_error", "", "batch_id", fmt.Sprintf("Batch %s is %s and cannot be cancelled", rec.ID, rec.Status)))
+		return
+	}
+	if p.batches.cancel(rec.ID) {
+		// The batch saves its own state once in-flight requests finish
+		now := time.Now().Unix()
+		rec.Status, rec.CancellingAt = BatchCancelling, &now
+	}
+	writeJSON(w, rec.Batch)
+}
@@ -0,0 +1,257 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// batchMarketplace echoes the last message of each chat and counts the
+// sessions opened and the chats received
+type batchMarketplace struct {
+	*httptest.Server
+	sessions atomic.Int32
+	chats    atomic.Int32
+}
+
+func newBatchMarketplace(t *testing.T) *batchMarketplace {
+	t.Helper()
+	m := &batchMarketplace{}
+	m.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/blockchain/models":
+			fmt.Fprint(w, `{"models":[{"Id":"0xllama","Name":"Llama"}]}`)
+		case "/blockchain/models/0xllama/session":
+			m.sessions.Add(1)
+			fmt.Fprint(w, `{"sessionId":"s"}`)
+		case "/v1/chat/completions":
+			m.chats.Add(1)
+			var req ChatCompletionRequest
+			json.NewDecoder(r.Body).Decode(&req)
+			content, _ := json.Marshal("echo " + req.Messages[len(req.Messages)-1].Content)
+			fmt.Fprintf(w, "data: {\"choices\":[{\"delta\":{\"content\":%s}}]}\n\ndata: [DONE]\n\n", content)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(m.Close)
+	return m
+}
+
+func newBatchServer(t *testing.T, marketplaceURL, dir string) *Server {
+	t.Helper()
+	cfg, err := LoadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Marketplace.URL = marketplaceURL
+	cfg.Batches.Dir = dir
+	s, err := New(cfg, WithLogger(log.New(io.Discard, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func batchInput(ids ...string) string {
+	var b strings.Builder
+	for _, id := range ids {
+		fmt.Fprintf(&b, `{"custom_id":%q,"method":"POST","url":"/v1/chat/completions","body":{"model":"Llama","messages":[{"role":"user","content":%q}]}}`+"\n", id, id)
+	}
+	return b.String()
+}
+
+func uploadBatchFile(t *testing.T, s *Server, content string) File {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("purpose", "batch")
+	part, _ := mw.CreateFormFile("file", "input.jsonl")
+	io.WriteString(part, content)
+	mw.Close()
+
+	req := httptest.NewRequest("POST", "/v1/files", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	var f File
+	if err := json.Unmarshal(w.Body.Bytes(), &f); w.Code != http.StatusOK || err != nil {
+		t.Fatalf("upload: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	return f
+}
+
+func createBatch(t *testing.T, s *Server, fileID string) Batch {
+	t.Helper()
+	w := httptest.NewRecorder()
+	body := fmt.Sprintf(`{"input_file_id":%q,"endpoint":"/v1/chat/completions","completion_window":"24h"}`, fileID)
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/v1/batches", strings.NewReader(body)))
+	var b Batch
+	if err := json.Unmarshal(w.Body.Bytes(), &b); w.Code != http.StatusOK || err != nil {
+		t.Fatalf("create: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	return b
+}
+
+// waitForBatch polls a batch until it reaches a final status
+func waitForBatch(t *testing.T, s *Server, id string) Batch {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", "/v1/batches/"+id, nil))
+		var b Batch
+		json.Unmarshal(w.Body.Bytes(), &b)
+		switch b.Status {
+		case BatchCompleted, BatchFailed, BatchCancelled:
+			return b
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("batch %s is still %s: %s", id, b.Status, w.Body.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func downloadResults(t *testing.T, s *Server, fileID string) map[string]string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/v1/files/"+fileID+"/content", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("download: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	results := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(w.Body.String()), "\n") {
+		var res struct {
+			CustomID string `json:"custom_id"`
+			Response struct {
+				Body struct {
+					Choices []struct {
+						Message Message `json:"message"`
+					} `json:"choices"`
+				} `json:"body"`
+			} `json:"response"`
+		}
+		if err := json.Unmarshal([]byte(line), &res); err != nil || len(res.Response.Body.Choices) == 0 {
+			t.Fatalf("bad result line %s", line)
+		}
+		results[res.CustomID] = res.Response.Body.Choices[0].Message.Content
+	}
+	return results
+}
+
+func TestBatchLifecycle(t *testing.T) {
+	m := newBatchMarketplace(t)
+	s := newBatchServer(t, m.URL, t.TempDir())
+
+	input := uploadBatchFile(t, s, batchInput("a", "b", "c", "d", "e"))
+	b := waitForBatch(t, s, createBatch(t, s, input.ID).ID)
+	if b.Status != BatchCompleted || b.RequestCounts != (BatchCounts{Total: 5, Completed: 5}) {
+		t.Fatalf("batch = %+v", b)
+	}
+	if b.OutputFileID == nil || b.ErrorFileID != nil {
+		t.Fatalf("output = %v, errors = %v", b.OutputFileID, b.ErrorFileID)
+	}
+	results := downloadResults(t, s, *b.OutputFileID)
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		if results[id] != "echo "+id {
+			t.Errorf("result %s = %q", id, results[id])
+		}
+	}
+	if n := m.sessions.Load(); n != 1 {
+		t.Errorf("sessions opened = %d, want 1", n)
+	}
+	// Items are attributed to the same caller as interactive requests
+	if rec, err := s.batches.load(b.ID); err != nil || rec.Caller != callerID(httptest.NewRequest("POST", "/v1/batches", nil)) {
+		t.Errorf("batch caller = %+v, %v", rec, err)
+	}
+}
+
+func TestBatchRejectsInvalidInput(t *testing.T) {
+	m := newBatchMarketplace(t)
+	s := newBatchServer(t, m.URL, t.TempDir())
+
+	input := uploadBatchFile(t, s, batchInput("a", "a")+"not json\n")
+	b := waitForBatch(t, s, createBatch(t, s, input.ID).ID)
+	if b.Status != BatchFailed || b.Errors == nil || len(b.Errors.Data) != 2 {
+		t.Fatalf("batch = %+v", b)
+	}
+	if b.Errors.Data[0].Code != "duplicate_custom_id" || b.Errors.Data[1].Code != "invalid_json_line" || b.Errors.Data[1].Line != 3 {
+		t.Errorf("errors = %+v", b.Errors.Data)
+	}
+	if n := m.chats.Load(); n != 0 {
+		t.Errorf("chats sent = %d, want 0", n)
+	}
+}
+
+func TestBatchesAreScopedToOwner(t *testing.T) {
+	m := newBatchMarketplace(t)
+	s := newBatchServer(t, m.URL, t.TempDir())
+
+	input := uploadBatchFile(t, s, batchInput("a"))
+	b := createBatch(t, s, input.ID)
+	for _, path := range []string{"/v1/files/" + input.ID, "/v1/files/" + input.ID + "/content", "/v1/batches/" + b.ID} {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = "198.51.100.7:1234"
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s: status = %d, want 404", path, w.Code)
+		}
+	}
+	waitForBatch(t, s, b.ID)
+}
+
+func TestBatchResumesAfterRestart(t *testing.T) {
+	m := newBatchMarketplace(t)
+	dir := t.TempDir()
+
+	// Leave a batch in progress with one result written, as a proxy that
+	// stopped part way through would
+	files, err := newFileStore(filepath.Join(dir, "files"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner := HashAPIKey("192.0.2.1")
+	input, err := files.create(owner, "input.jsonl", "batch", strings.NewReader(batchInput("a", "b", "c")), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batches := filepath.Join(dir, "batches")
+	os.MkdirAll(batches, 0o700)
+	id := newObjectID("batch_")
+	rec := batchRecord{
+		Batch: Batch{ID: id, Object: "batch", Endpoint: "/v1/chat/completions", InputFileID: input.ID,
+			CompletionWindow: "24h", Status: BatchInProgress, RequestCounts: BatchCounts{Total: 3, Completed: 1}},
+		Owner:  owner,
+		Caller: owner,
+	}
+	data, _ := json.Marshal(rec)
+	os.WriteFile(filepath.Join(batches, id+".json"), data, 0o600)
+	done := `{"id":"batch_req_1","custom_id":"a","response":{"status_code":200,"request_id":"req_1","body":{"choices":[{"message":{"role":"assistant","content":"echo a"}}]}},"error":null}`
+	os.WriteFile(filepath.Join(batches, id+".output.jsonl"), []byte(done+"\n"), 0o600)
+
+	s := newBatchServer(t, m.URL, dir)
+	b := waitForBatch(t, s, id)
+	if b.Status != BatchCompleted || b.RequestCounts.Completed != 3 {
+		t.Fatalf("batch = %+v", b)
+	}
+	if n := m.chats.Load(); n != 2 {
+		t.Errorf("chats sent = %d, want 2", n)
+	}
+	if results := downloadResults(t, s, *b.OutputFileID); len(results) != 3 || results["c"] != "echo c" {
+		t.Errorf("results = %v", results)
+	}
+}
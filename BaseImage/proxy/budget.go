@@ -0,0 +1,499 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// weiPerMOR is the number of wei in one MOR token (18 decimals)
+var weiPerMOR = new(big.Int).Exp(big.NewInt(10), big.NewInt(18), nil)
+
+// SpendLimit caps MOR spend per UTC day and calendar month. Amounts are
+// decimal MOR strings such as "2.5"; empty means no cap.
+type SpendLimit struct {
+	DailyMOR   string `json:"daily_mor"`
+	MonthlyMOR string `json:"monthly_mor"`
+}
+
+// BudgetConfig holds the default per key spend limit plus per API key and per
+// model overrides. Model limits cap the wallet's total spend on that model.
+type BudgetConfig struct {
+	Default   SpendLimit            `json:"default"`
+	Keys      map[string]SpendLimit `json:"keys"`
+	Models    map[string]SpendLimit `json:"models"`
+	StateFile string                `json:"state_file"`
+}
+
+// parseMOR converts a decimal MOR amount into wei
+func parseMOR(amount string) (*big.Int, error) {
+	amount = strings.TrimSpace(amount)
+	if amount == "" {
+		return nil, nil
+	}
+	r, ok := new(big.Rat).SetString(amount)
+	if !ok || r.Sign() < 0 {
+		return nil, fmt.Errorf("invalid MOR amount: %q", amount)
+	}
+	r.Mul(r, new(big.Rat).SetInt(weiPerMOR))
+	return new(big.Int).Quo(r.Num(), r.Denom()), nil
+}
+
+// formatMOR renders a wei amount as a decimal MOR string
+func formatMOR(wei *big.Int) string {
+	if wei == nil {
+		return ""
+	}
+	s := new(big.Rat).SetFrac(wei, weiPerMOR).FloatString(18)
+	s = strings.TrimRight(s, "0")
+	return strings.TrimSuffix(s, ".")
+}
+
+type spendLimit struct {
+	daily   *big.Int
+	monthly *big.Int
+}
+
+func parseSpendLimit(l SpendLimit) (spendLimit, error) {
+	daily, err := parseMOR(l.DailyMOR)
+	if err != nil {
+		return spendLimit{}, err
+	}
+	monthly, err := parseMOR(l.MonthlyMOR)
+	if err != nil {
+		return spendLimit{}, err
+	}
+	return spendLimit{daily: daily, monthly: monthly}, nil
+}
+
+// spendRecord is the spend of one scope in the current day and month
+type spendRecord struct {
+	Day        string   `json:"day"`
+	DaySpent   *big.Int `json:"day_spent"`
+	Month      string   `json:"month"`
+	MonthSpent *big.Int `json:"month_spent"`
+}
+
+func (r *spendRecord) roll(now time.Time) {
+	day, month := now.UTC().Format("2006-01-02"), now.UTC().Format("2006-01")
+	if r.Day != day || r.DaySpent == nil {
+		r.Day, r.DaySpent = day, new(big.Int)
+	}
+	if r.Month != month || r.MonthSpent == nil {
+		r.Month, r.MonthSpent = month, new(big.Int)
+	}
+}
+
+// BudgetExceededError is returned when a session would exceed a spend cap
+type BudgetExceededError struct {
+	Scope     string
+	Period    string
+	Remaining *big.Int
+	Cost      *big.Int
+}
+
+func (e *BudgetExceededError) Error() string {
+	return fmt.Sprintf("%s MOR budget exhausted for %s: session costs %s MOR, %s MOR remaining",
+		e.Period, e.Scope, formatMOR(e.Cost), formatMOR(e.Remaining))
+}
+
+// budgetLimits holds the parsed spend caps of a BudgetConfig
+type budgetLimits struct {
+	def    spendLimit
+	keys   map[string]spendLimit
+	models map[string]spendLimit
+}
+
+func newBudgetLimits(cfg BudgetConfig) (budgetLimits, error) {
+	def, err := parseSpendLimit(cfg.Default)
+	if err != nil {
+		return budgetLimits{}, fmt.Errorf("default budget: %v", err)
+	}
+	limits := budgetLimits{
+		def:    def,
+		keys:   make(map[string]spendLimit),
+		models: make(map[string]spendLimit),
+	}
+	for key, l := range cfg.Keys {
+		if limits.keys[key], err = parseSpendLimit(l); err != nil {
+			return budgetLimits{}, fmt.Errorf("budget for key %s: %v", key, err)
+		}
+	}
+	for model, l := range cfg.Models {
+		if limits.models[strings.ToLower(model)], err = parseSpendLimit(l); err != nil {
+			return budgetLimits{}, fmt.Errorf("budget for model %s: %v", model, err)
+		}
+	}
+	return limits, nil
+}
+
+// BudgetTracker records estimated MOR spend per API key and per model and
+// enforces the configured daily and monthly caps.
+type BudgetTracker struct {
+	mu sync.Mutex
+	budgetLimits
+	spend     map[string]*spendRecord
+	stateFile string
+	now       func() time.Time
+	logger    *log.Logger
+}
+
+// NewBudgetTracker creates a tracker from the given configuration, restoring
+// previous spend from the state file when one is configured.
+func NewBudgetTracker(cfg BudgetConfig) (*BudgetTracker, error) {
+	limits, err := newBudgetLimits(cfg)
+	if err != nil {
+		return nil, err
+	}
+	bt := &BudgetTracker{
+		budgetLimits: limits,
+		spend:        make(map[string]*spendRecord),
+		stateFile:    cfg.StateFile,
+		now:          time.Now,
+		logger:       log.Default(),
+	}
+	if bt.stateFile != "" {
+		if data, err := os.ReadFile(bt.stateFile); err == nil {
+			if err := json.Unmarshal(data, &bt.spend); err != nil {
+				return nil, fmt.Errorf("failed to parse budget state file: %v", err)
+			}
+		} else if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to read budget state file: %v", err)
+		}
+	}
+	return bt, nil
+}
+
+// UpdateLimits replaces the spend caps while keeping the spend recorded so
+// far. The state file is only read at startup and is not changed.
+func (bt *BudgetTracker) UpdateLimits(cfg BudgetConfig) error {
+	limits, err := newBudgetLimits(cfg)
+	if err != nil {
+		return err
+	}
+	bt.mu.Lock()
+	bt.budgetLimits = limits
+	bt.mu.Unlock()
+	return nil
+}
+
+type budgetScope struct {
+	name  string
+	limit spendLimit
+}
+
+func (bt *BudgetTracker) scopes(caller, modelID, modelName string) []budgetScope {
+	caller = configuredCaller(bt.keys, caller)
+	keyLimit, ok := bt.keys[caller]
+	if !ok {
+		keyLimit = bt.def
+	}
+	// Spend is recorded under whichever model key the limit was configured by
+	modelScope := strings.ToLower(modelID)
+	modelLimit, ok := bt.models[modelScope]
+	if !ok {
+		if l, ok := bt.models[strings.ToLower(modelName)]; ok {
+			modelScope, modelLimit = strings.ToLower(modelName), l
+		}
+	}
+	return []budgetScope{
+		{name: "key:" + caller, limit: keyLimit},
+		{name: "model:" + modelScope, limit: modelLimit},
+	}
+}
+
+func (bt *BudgetTracker) record(name string) *spendRecord {
+	rec, ok := bt.spend[name]
+	if !ok {
+		rec = &spendRecord{}
+		bt.spend[name] = rec
+	}
+	rec.roll(bt.now())
+	return rec
+}
+
+// Reserve charges cost wei to the caller and model if that keeps both within
+// their daily and monthly caps.
+func (bt *BudgetTracker) Reserve(caller, modelID, modelName string, cost *big.Int) error {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+
+	scopes := bt.scopes(caller, modelID, modelName)
+	for _, s := range scopes {
+		rec := bt.record(s.name)
+		if err := checkSpend(s.name, "daily", s.limit.daily, rec.DaySpent, cost); err != nil {
+			return err
+		}
+		if err := checkSpend(s.name, "monthly", s.limit.monthly, rec.MonthSpent, cost); err != nil {
+			return err
+		}
+	}
+	for _, s := range scopes {
+		rec := bt.record(s.name)
+		rec.DaySpent.Add(rec.DaySpent, cost)
+		rec.MonthSpent.Add(rec.MonthSpent, cost)
+	}
+	bt.save()
+	return nil
+}
+
+// Refund returns a reservation, e.g. when the session could not be opened
+func (bt *BudgetTracker) Refund(caller, modelID, modelName string, cost *big.Int) {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+
+	for _, s := range bt.scopes(caller, modelID, modelName) {
+		rec := bt.record(s.name)
+		rec.DaySpent.Sub(rec.DaySpent, cost)
+		rec.MonthSpent.Sub(rec.MonthSpent, cost)
+		if rec.DaySpent.Sign() < 0 {
+			rec.DaySpent.SetInt64(0)
+		}
+		if rec.MonthSpent.Sign() < 0 {
+			rec.MonthSpent.SetInt64(0)
+		}
+	}
+	bt.save()
+}
+
+func checkSpend(scope, period string, limit, spent, cost *big.Int) error {
+	if limit == nil {
+		return nil
+	}
+	remaining := new(big.Int).Sub(limit, spent)
+	if remaining.Sign() < 0 {
+		remaining.SetInt64(0)
+	}
+	if cost.Cmp(remaining) > 0 {
+		return &BudgetExceededError{Scope: scope, Period: period, Remaining: remaining, Cost: new(big.Int).Set(cost)}
+	}
+	return nil
+}
+
+// save persists spend to the state file. Callers must hold bt.mu.
+func (bt *BudgetTracker) save() {
+	if bt.stateFile == "" {
+		return
+	}
+	data, err := json.Marshal(bt.spend)
+	if err != nil {
+		bt.logger.Printf("Failed to encode budget state: %v", err)
+		return
+	}
+	tmp := bt.stateFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		bt.logger.Printf("Failed to write budget state: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, bt.stateFile); err != nil {
+		bt.logger.Printf("Failed to write budget state: %v", err)
+	}
+}
+
+// BudgetStatus reports spend and remaining budget for one scope
+type BudgetStatus struct {
+	Scope            string `json:"scope"`
+	Day              string `json:"day"`
+	DailySpent       string `json:"daily_spent_mor"`
+	DailyLimit       string `json:"daily_limit_mor,omitempty"`
+	DailyRemaining   string `json:"daily_remaining_mor,omitempty"`
+	Month            string `json:"month"`
+	MonthlySpent     string `json:"monthly_spent_mor"`
+	MonthlyLimit     string `json:"monthly_limit_mor,omitempty"`
+	MonthlyRemaining string `json:"monthly_remaining_mor,omitempty"`
+}
+
+// Status returns the spend of every configured or active scope
+func (bt *BudgetTracker) Status() []BudgetStatus {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+
+	limits := make(map[string]spendLimit)
+	for key, l := range bt.keys {
+		limits["key:"+key] = l
+	}
+	for model, l := range bt.models {
+		limits["model:"+model] = l
+	}
+	for name := range bt.spend {
+		if _, ok := limits[name]; !ok {
+			if strings.HasPrefix(name, "key:") {
+				limits[name] = bt.def
+			} else {
+				limits[name] = bt.models[strings.ToLower(strings.TrimPrefix(name, "model:"))]
+			}
+		}
+	}
+
+	var statuses []BudgetStatus
+	for name, l := range limits {
+		rec := bt.record(name)
+		statuses = append(statuses, BudgetStatus{
+			Scope:            name,
+			Day:              rec.Day,
+			DailySpent:       formatMOR(rec.DaySpent),
+			DailyLimit:       formatMOR(l.daily),
+			DailyRemaining:   formatMOR(remainingSpend(l.daily, rec.DaySpent)),
+			Month:            rec.Month,
+			MonthlySpent:     formatMOR(rec.MonthSpent),
+			MonthlyLimit:     formatMOR(l.monthly),
+			MonthlyRemaining: formatMOR(remainingSpend(l.monthly, rec.MonthSpent)),
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Scope < statuses[j].Scope })
+	return statuses
+}
+
+func remainingSpend(limit, spent *big.Int) *big.Int {
+	if limit == nil {
+		return nil
+	}
+	remaining := new(big.Int).Sub(limit, spent)
+	if remaining.Sign() < 0 {
+		remaining.SetInt64(0)
+	}
+	return remaining
+}
+
+// parseWei decodes a wei amount that the node may encode as a string or number
+func parseWei(raw json.RawMessage) (*big.Int, bool) {
+	s := strings.Trim(strings.TrimSpace(string(raw)), `"`)
+	return new(big.Int).SetString(s, 10)
+}
+
+// getModelPricePerSecond returns the highest pricePerSecond among the model's
+// active bids on the consumer node at baseURL, so budget estimates never
+// undercount.
+func (p *Proxy) getModelPricePerSecond(baseURL, modelID string) (*big.Int, error) {
+	endpoint := fmt.Sprintf("%s/blockchain/models/%s/bids/active", baseURL, modelID)
+	resp, err := p.client.Get(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch bids: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bids response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch bids, status: %d, body: %s", resp.StatusCode, string(body))
+	}
+
+	var result struct {
+		Bids []struct {
+			PricePerSecond json.RawMessage `json:"pricePerSecond"`
+		} `json:"bids"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("failed to decode bids response: %v", err)
+	}
+
+	var price *big.Int
+	for _, bid := range result.Bids {
+		if v, ok := parseWei(bid.PricePerSecond); ok && (price == nil || v.Cmp(price) > 0) {
+			price = v
+		}
+	}
+	if price == nil {
+		return nil, fmt.Errorf("no active bids for model %s", modelID)
+	}
+	return price, nil
+}
+
+// getNodeSessionBudget returns the session budget in wei of the consumer node
+// at baseURL
+func (p *Proxy) getNodeSessionBudget(baseURL string) (*big.Int, error) {
+	resp, err := p.client.Get(fmt.Sprintf("%s/blockchain/sessions/budget", baseURL))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch session budget: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read session budget: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch session budget, status: %d", resp.StatusCode)
+	}
+
+	var result struct {
+		Budget json.RawMessage `json:"budget"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("failed to decode session budget: %v", err)
+	}
+	budget, ok := parseWei(result.Budget)
+	if !ok {
+		return nil, fmt.Errorf("invalid session budget: %s", string(result.Budget))
+	}
+	return budget, nil
+}
+
+// reserveSessionBudget estimates the cost of a session of the given duration
+// on the consumer node at baseURL, which must be the node the session is
+// opened on, and charges it to the caller and model budgets. The returned cost
+// must be refunded if the session is not opened.
+func (p *Proxy) reserveSessionBudget(baseURL, caller, modelID, modelName string, durationSeconds int) (*big.Int, error) {
+	price, err := p.getModelPricePerSecond(baseURL, modelID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to price session for budget enforcement: %v", err)
+	}
+	cost := new(big.Int).Mul(price, big.NewInt(int64(durationSeconds)))
+
+	if nodeBudget, err := p.getNodeSessionBudget(baseURL); err != nil {
+		p.logger.Printf("Skipping node session budget check: %v", err)
+	} else if cost.Cmp(nodeBudget) > 0 {
+		return nil, &BudgetExceededError{Scope: "wallet", Period: "session", Remaining: nodeBudget, Cost: cost}
+	}
+
+	if err := p.budgets.Reserve(caller, modelID, modelName, cost); err != nil {
+		return nil, err
+	}
+	p.logger.Printf("Reserved %s MOR for session on model %s", formatMOR(cost), modelID)
+	return cost, nil
+}
+
+// respondWithBudgetError reports a refused session to the client
+func respondWithBudgetError(w http.ResponseWriter, err error) {
+	if _, ok := err.(*BudgetExceededError); ok {
+		respondWithAPIError(w, http.StatusTooManyRequests, newAPIError("insufficient_quota", "insufficient_quota", "", err.Error()))
+		return
+	}
+	respondWithAPIError(w, http.StatusServiceUnavailable, newAPIError("server_error", "", "", err.Error()))
+}
+
+// handleAdminBudgets reports remaining budget per key and model along with the
+// node's own session budget
+func (p *Proxy) handleAdminBudgets(w http.ResponseWriter, r *http.Request) {
+	if !p.requireAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		respondWithAPIError(w, http.StatusMethodNotAllowed, newAPIError("invalid_request_error", "", "", "Method not allowed"))
+		return
+	}
+	if p.budgets == nil {
+		respondWithAPIError(w, http.StatusNotFound, newAPIError("invalid_request_error", "", "", "Budgets are not configured"))
+		return
+	}
+
+	response := map[string]interface{}{"budgets": p.budgets.Status()}
+	if nodeBudget, err := p.getNodeSessionBudget(p.getMarketplaceBaseURL()); err != nil {
+		response["node_budget_error"] = err.Error()
+	} else {
+		response["node_budget_mor"] = formatMOR(nodeBudget)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
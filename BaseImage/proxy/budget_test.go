@@ -0,0 +1,255 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseAndFormatMOR(t *testing.T) {
+	tests := []struct {
+		in   string
+		wei  string
+		back string
+	}{
+		{"1", "1000000000000000000", "1"},
+		{"2.5", "2500000000000000000", "2.5"},
+		{"0.000000000000000001", "1", "0.000000000000000001"},
+	}
+	for _, tt := range tests {
+		wei, err := parseMOR(tt.in)
+		if err != nil {
+			t.Fatalf("parseMOR(%q) error = %v", tt.in, err)
+		}
+		if wei.String() != tt.wei {
+			t.Errorf("parseMOR(%q) = %s, want %s", tt.in, wei, tt.wei)
+		}
+		if got := formatMOR(wei); got != tt.back {
+			t.Errorf("formatMOR(%s) = %q, want %q", wei, got, tt.back)
+		}
+	}
+	if _, err := parseMOR("-1"); err == nil {
+		t.Error("negative amounts should be rejected")
+	}
+	if wei, err := parseMOR(""); wei != nil || err != nil {
+		t.Errorf("empty amount should mean no limit, got %v, %v", wei, err)
+	}
+}
+
+func TestBudgetTrackerReserve(t *testing.T) {
+	bt, err := NewBudgetTracker(BudgetConfig{
+		Default: SpendLimit{DailyMOR: "1"},
+		Keys:    map[string]SpendLimit{"team-a": {DailyMOR: "5", MonthlyMOR: "6"}},
+		Models:  map[string]SpendLimit{"Llama": {DailyMOR: "3"}},
+	})
+	if err != nil {
+		t.Fatalf("NewBudgetTracker() error = %v", err)
+	}
+	now := time.Date(2024, 5, 15, 12, 0, 0, 0, time.UTC)
+	bt.now = func() time.Time { return now }
+	mor := func(s string) *big.Int { v, _ := parseMOR(s); return v }
+
+	if err := bt.Reserve("anon", "0xabc", "other", mor("1")); err != nil {
+		t.Fatalf("reserve within default budget failed: %v", err)
+	}
+	if err := bt.Reserve("anon", "0xabc", "other", mor("0.1")); err == nil {
+		t.Error("default daily budget should be exhausted")
+	}
+
+	if err := bt.Reserve("team-a", "0xdef", "llama", mor("2")); err != nil {
+		t.Fatalf("reserve within key budget failed: %v", err)
+	}
+	err = bt.Reserve("team-a", "0xdef", "llama", mor("2"))
+	budgetErr, ok := err.(*BudgetExceededError)
+	if !ok {
+		t.Fatalf("model daily budget should be exhausted, got %v", err)
+	}
+	if budgetErr.Scope != "model:llama" || budgetErr.Period != "daily" || formatMOR(budgetErr.Remaining) != "1" {
+		t.Errorf("unexpected error: %+v", budgetErr)
+	}
+
+	bt.Refund("team-a", "0xdef", "llama", mor("2"))
+	if err := bt.Reserve("team-a", "0xdef", "llama", mor("3")); err != nil {
+		t.Errorf("refund should restore budget: %v", err)
+	}
+
+	// A new day resets the daily cap but not the monthly one
+	now = now.Add(24 * time.Hour)
+	if err := bt.Reserve("team-a", "0xother", "other", mor("3")); err != nil {
+		t.Fatalf("new day should reset the daily budget: %v", err)
+	}
+	if err := bt.Reserve("team-a", "0xother", "other", mor("0.5")); err == nil {
+		t.Error("monthly key budget should be exhausted")
+	}
+
+	// A new month resets both
+	now = now.AddDate(0, 1, 0)
+	if err := bt.Reserve("team-a", "0xother", "other", mor("5")); err != nil {
+		t.Errorf("new month should reset budgets: %v", err)
+	}
+}
+
+func TestBudgetTrackerStateFile(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "budget-state.json")
+	cfg := BudgetConfig{Default: SpendLimit{DailyMOR: "1"}, StateFile: stateFile}
+
+	bt, err := NewBudgetTracker(cfg)
+	if err != nil {
+		t.Fatalf("NewBudgetTracker() error = %v", err)
+	}
+	cost, _ := parseMOR("0.75")
+	if err := bt.Reserve("key", "model", "", cost); err != nil {
+		t.Fatalf("Reserve() error = %v", err)
+	}
+
+	restored, err := NewBudgetTracker(cfg)
+	if err != nil {
+		t.Fatalf("NewBudgetTracker() with state error = %v", err)
+	}
+	if err := restored.Reserve("key", "model", "", cost); err == nil {
+		t.Error("spend should survive a restart")
+	}
+}
+
+func newBudgetMarketplace(t *testing.T, price, nodeBudget string) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/blockchain/models":
+			json.NewEncoder(w).Encode(map[string][]ModelInfo{
+				"models": {{Id: "budget-model", Name: "Budget Model"}},
+			})
+		case "/blockchain/models/budget-model/bids/active":
+			fmt.Fprintf(w, `{"bids":[{"pricePerSecond":"%s"},{"pricePerSecond":1}]}`, price)
+		case "/blockchain/sessions/budget":
+			fmt.Fprintf(w, `{"budget":"%s"}`, nodeBudget)
+		default:
+			t.Errorf("unexpected request to %s", r.URL.Path)
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestReserveSessionBudget(t *testing.T) {
+	server := newBudgetMarketplace(t, "1000000000000000", "1000000000000000000")
+	defer server.Close()
+	os.Setenv("MARKETPLACE_URL", server.URL)
+	defer os.Unsetenv("MARKETPLACE_URL")
+
+	p := NewProxy()
+	p.budgets, _ = NewBudgetTracker(BudgetConfig{Default: SpendLimit{DailyMOR: "10"}})
+
+	// The session is priced on the node passed in, not the default one
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("session priced on the default node: %s", r.URL.Path)
+		http.NotFound(w, r)
+	}))
+	defer other.Close()
+	os.Setenv("MARKETPLACE_URL", other.URL)
+
+	cost, err := p.reserveSessionBudget(server.URL, "key", "budget-model", "", 600)
+	if err != nil {
+		t.Fatalf("reserveSessionBudget() error = %v", err)
+	}
+	if formatMOR(cost) != "0.6" {
+		t.Errorf("cost = %s MOR, want 0.6", formatMOR(cost))
+	}
+
+	// Longer sessions than the node can fund are refused
+	_, err = p.reserveSessionBudget(server.URL, "key", "budget-model", "", 3600)
+	if budgetErr, ok := err.(*BudgetExceededError); !ok || budgetErr.Scope != "wallet" {
+		t.Errorf("expected wallet budget error, got %v", err)
+	}
+}
+
+func TestHandleChatCompletionsBudgetExhausted(t *testing.T) {
+	server := newBudgetMarketplace(t, "1000000000000000", "1000000000000000000000")
+	defer server.Close()
+	os.Setenv("MARKETPLACE_URL", server.URL)
+	defer os.Unsetenv("MARKETPLACE_URL")
+
+	p := NewProxy()
+	p.budgets, _ = NewBudgetTracker(BudgetConfig{Models: map[string]SpendLimit{"Budget Model": {DailyMOR: "1"}}})
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"model":    "Budget Model",
+		"messages": []map[string]string{{"role": "user", "content": "Hello"}},
+	})
+	req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewBuffer(body))
+	w := httptest.NewRecorder()
+
+	p.handleChatCompletions(w, req)
+
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want 429", w.Code)
+	}
+	var payload struct {
+		Error APIError `json:"error"`
+	}
+	json.NewDecoder(w.Body).Decode(&payload)
+	if payload.Error.Type != "insufficient_quota" {
+		t.Errorf("unexpected error: %+v", payload.Error)
+	}
+}
+
+func TestHandleAdminBudgets(t *testing.T) {
+	server := newBudgetMarketplace(t, "1", "2000000000000000000")
+	defer server.Close()
+	os.Setenv("MARKETPLACE_URL", server.URL)
+	defer os.Unsetenv("MARKETPLACE_URL")
+
+	p := NewProxy()
+	p.budgets, _ = NewBudgetTracker(BudgetConfig{Keys: map[string]SpendLimit{"team-a": {DailyMOR: "4"}}})
+	cost, _ := parseMOR("1.5")
+	p.budgets.Reserve("team-a", "m", "", cost)
+
+	req := httptest.NewRequest("GET", "/admin/budgets", nil)
+	w := httptest.NewRecorder()
+	os.Unsetenv("ADMIN_API_KEY")
+	p.handleAdminBudgets(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("admin API should be disabled without ADMIN_API_KEY, got %d", w.Code)
+	}
+
+	os.Setenv("ADMIN_API_KEY", "secret")
+	defer os.Unsetenv("ADMIN_API_KEY")
+	w = httptest.NewRecorder()
+	p.handleAdminBudgets(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("missing admin key should be rejected, got %d", w.Code)
+	}
+
+	req.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	p.handleAdminBudgets(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+	var payload struct {
+		Budgets    []BudgetStatus `json:"budgets"`
+		NodeBudget string         `json:"node_budget_mor"`
+	}
+	json.NewDecoder(w.Body).Decode(&payload)
+	if payload.NodeBudget != "2" {
+		t.Errorf("node budget = %q, want 2", payload.NodeBudget)
+	}
+	found := false
+	for _, b := range payload.Budgets {
+		if b.Scope == "key:team-a" {
+			found = true
+			if b.DailyRemaining != "2.5" {
+				t.Errorf("daily remaining = %q, want 2.5", b.DailyRemaining)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("team-a budget missing from %+v", payload.Budgets)
+	}
+}
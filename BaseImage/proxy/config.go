@@ -0,0 +1,751 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the complete proxy configuration. Values are resolved from
+// built-in defaults, then the config file, then environment variables named by
+// the env tags. Fields loaded from a JSON file named by an environment
+// variable are marked with envfile.
+type Config struct {
+	Server         ServerConfig         `json:"server"`
+	Marketplace    MarketplaceConfig    `json:"marketplace"`
+	Session        SessionConfig        `json:"session"`
+	CircuitBreaker CircuitBreakerConfig `json:"circuit_breaker"`
+	Models         ModelsConfig         `json:"models"`
+	Health         HealthConfig         `json:"health"`
+	Audit          AuditConfig          `json:"audit"`
+	Threads        ThreadsConfig        `json:"threads"`
+	Batches        BatchConfig          `json:"batches"`
+	Async          AsyncConfig          `json:"async"`
+	Wallets        WalletsConfig        `json:"wallets"`
+
+	StructuredOutput StructuredOutputConfig `json:"structured_output"`
+
+	// Middleware maps model names, or "*" for every model, to middleware chains
+	Middleware map[string][]MiddlewareConfig `json:"middleware"`
+
+	LogLevel        string `json:"log_level" env:"LOG_LEVEL"`
+	AdminAPIKey     string `json:"admin_api_key" env:"ADMIN_API_KEY" secret:"true"`
+	UsageLedgerFile string `json:"usage_ledger_file" env:"USAGE_LEDGER_FILE"`
+	EthNodeAddress  string `json:"eth_node_address" env:"ETH_NODE_ADDRESS"`
+
+	RateLimits *RateLimitConfig `json:"rate_limits" env:"RATE_LIMITS_FILE" envfile:"true"`
+	Budgets    *BudgetConfig    `json:"budgets" env:"BUDGETS_FILE" envfile:"true"`
+	Auth       *AuthConfig      `json:"auth" env:"AUTH_FILE" envfile:"true"`
+
+	path    string
+	sources map[string]string
+}
+
+// ServerConfig configures the listeners
+type ServerConfig struct {
+	Port       string          `json:"port" env:"PORT,DEFAULT_PORT"`
+	UnixSocket string          `json:"unix_socket" env:"UNIX_SOCKET"`
+	TLS        ServerTLSConfig `json:"tls"`
+}
+
+// MarketplaceConfig configures the upstream consumer node
+type MarketplaceConfig struct {
+	URL string `json:"url" env:"MARKETPLACE_URL"`
+	// ConsumerNodeURL is used for model listings; it defaults to URL
+	ConsumerNodeURL string   `json:"consumer_node_url" env:"CONSUMER_NODE_URL"`
+	RequestTimeout  Duration `json:"request_timeout"`
+	ModelsTimeout   Duration `json:"models_timeout"`
+	ChatTimeout     Duration `json:"chat_timeout"`
+	// ChatRetries is how many times a chat request is retried before any
+	// bytes reach the client
+	ChatRetries        int      `json:"chat_retries" env:"CHAT_RETRIES"`
+	ChatRetryBaseDelay Duration `json:"chat_retry_base_delay"`
+	ChatRetryMaxDelay  Duration `json:"chat_retry_max_delay"`
+
+	// Nodes lists consumer node URLs to balance sessions across, each with its
+	// own wallet. Empty uses URL alone.
+	Nodes []string `json:"nodes" env:"MARKETPLACE_NODES"`
+	// Balancing is round_robin, least_outstanding or health_weighted
+	Balancing string `json:"balancing" env:"MARKETPLACE_BALANCING"`
+	// EjectAfter consecutive failures take a node out of rotation for EjectFor,
+	// doubling while it keeps failing
+	EjectAfter          int      `json:"eject_after"`
+	EjectFor            Duration `json:"eject_for"`
+	HealthCheckInterval Duration `json:"health_check_interval"`
+}
+
+// SessionConfig configures blockchain session handling
+type SessionConfig struct {
+	ExpirationSeconds int      `json:"expiration_seconds" env:"SESSION_EXPIRATION_SECONDS"`
+	CreateRetries     int      `json:"create_retries"`
+	RetryBaseDelay    Duration `json:"retry_base_delay"`
+	ModelCacheTTL     Duration `json:"model_cache_ttl"`
+}
+
+// CircuitBreakerConfig configures the marketplace circuit breaker
+type CircuitBreakerConfig struct {
+	MaxRequests uint32   `json:"max_requests"`
+	Interval    Duration `json:"interval"`
+	Timeout     Duration `json:"timeout"`
+}
+
+// HealthConfig configures the /readyz dependency checks. Balance minimums
+// are decimal amounts; empty disables the balance check.
+type HealthConfig struct {
+	MinMOR        string   `json:"min_mor" env:"READY_MIN_MOR"`
+	MinETH        string   `json:"min_eth" env:"READY_MIN_ETH"`
+	CatalogMaxAge Duration `json:"catalog_max_age"`
+	CacheTTL      Duration `json:"cache_ttl"`
+}
+
+// ModelsConfig holds model name aliases, applied before model lookup, and
+// fallback chains
+type ModelsConfig struct {
+	Aliases map[string]string `json:"aliases"`
+	// Fallbacks lists the models tried, in order, when a model fails before
+	// its stream starts
+	Fallbacks map[string][]string `json:"fallbacks"`
+	// HedgeAfter starts the next model in the chain when the current one has
+	// not streamed anything after this long; zero disables hedging
+	HedgeAfter Duration `json:"hedge_after"`
+	// ContextWindows sets the context length in tokens of models by name,
+	// overriding the catalog
+	ContextWindows map[string]int `json:"context_windows"`
+	Context        ContextConfig  `json:"context"`
+}
+
+// Duration is a time.Duration that reads from "30s" style strings or from a
+// number of seconds.
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case float64:
+		d.Duration = time.Duration(v * float64(time.Second))
+	case string:
+		parsed, err := parseDuration(v)
+		if err != nil {
+			return err
+		}
+		d.Duration = parsed
+	default:
+		return fmt.Errorf("invalid duration %s", data)
+	}
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func parseDuration(s string) (time.Duration, error) {
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return d, nil
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Server: ServerConfig{Port: "8081"},
+		Marketplace: MarketplaceConfig{
+			URL:            "http://marketplace:9000",
+			RequestTimeout: Duration{30 * time.Second},
+			ModelsTimeout:  Duration{10 * time.Second},
+			ChatTimeout:    Duration{5 * time.Minute},
+
+			ChatRetries:        2,
+			ChatRetryBaseDelay: Duration{250 * time.Millisecond},
+			ChatRetryMaxDelay:  Duration{5 * time.Second},
+
+			Balancing:           BalanceRoundRobin,
+			EjectAfter:          3,
+			EjectFor:            Duration{30 * time.Second},
+			HealthCheckInterval: Duration{10 * time.Second},
+		},
+		Session: SessionConfig{
+			ExpirationSeconds: 1800,
+			CreateRetries:     3,
+			RetryBaseDelay:    Duration{time.Second},
+			ModelCacheTTL:     Duration{time.Hour},
+		},
+		CircuitBreaker: CircuitBreakerConfig{
+			MaxRequests: 3,
+			Interval:    Duration{10 * time.Second},
+			Timeout:     Duration{60 * time.Second},
+		},
+		Models: ModelsConfig{
+			Context: ContextConfig{Strategy: ContextReject, KeepLast: 8, ReserveTokens: 512},
+		},
+		StructuredOutput: StructuredOutputConfig{Retries: 2},
+		Batches:          BatchConfig{Concurrency: 4, MaxFileBytes: 200 << 20},
+		Async: AsyncConfig{
+			MaxPending:            100,
+			JobTTL:                Duration{24 * time.Hour},
+			WebhookTimeout:        Duration{10 * time.Second},
+			WebhookRetries:        5,
+			WebhookRetryBaseDelay: Duration{time.Second},
+			WebhookRetryMaxDelay:  Duration{5 * time.Minute},
+		},
+		Wallets: WalletsConfig{TopUp: TopUpConfig{Cooldown: Duration{time.Hour}}},
+		Health: HealthConfig{
+			CatalogMaxAge: Duration{5 * time.Minute},
+			CacheTTL:      Duration{5 * time.Second},
+		},
+		LogLevel: "info",
+	}
+}
+
+// LoadConfig resolves the configuration from defaults, the YAML, TOML or JSON
+// file at path (optional) and the environment. Call Validate before use.
+func LoadConfig(path string) (*Config, error) {
+	cfg := defaultConfig()
+	cfg.path = path
+	cfg.sources = make(map[string]string)
+
+	if path != "" {
+		raw, err := readConfigFile(path)
+		if err != nil {
+			return nil, err
+		}
+		data, err := json.Marshal(raw)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse config file %s: %v", path, err)
+		}
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(cfg); err != nil {
+			return nil, fmt.Errorf("invalid config file %s: %v", path, err)
+		}
+		recordFileSources(cfg.sources, "", raw, "file "+path)
+	}
+
+	if err := cfg.applyEnv(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func readConfigFile(path string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %v", err)
+	}
+	raw := make(map[string]interface{})
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &raw)
+	case ".toml":
+		err = toml.Unmarshal(data, &raw)
+	case ".json":
+		err = json.Unmarshal(data, &raw)
+	default:
+		return nil, fmt.Errorf("unsupported config file type %q, expected .yaml, .toml or .json", filepath.Ext(path))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+	return raw, nil
+}
+
+func recordFileSources(sources map[string]string, prefix string, raw map[string]interface{}, source string) {
+	for key, value := range raw {
+		path := joinConfigPath(prefix, key)
+		sources[path] = source
+		if nested, ok := value.(map[string]interface{}); ok {
+			recordFileSources(sources, path, nested, source)
+		}
+	}
+}
+
+func joinConfigPath(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "." + name
+}
+
+func configFieldName(f reflect.StructField) string {
+	name := strings.Split(f.Tag.Get("json"), ",")[0]
+	if name == "" {
+		name = strings.ToLower(f.Name)
+	}
+	return name
+}
+
+var durationType = reflect.TypeOf(Duration{})
+
+// walkConfig calls fn for every setting in v. Nested structs are descended
+// into; Durations, maps, slices and nil pointers are reported as settings.
+func walkConfig(v reflect.Value, prefix string, fn func(path string, f reflect.StructField, v reflect.Value)) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() || f.Tag.Get("json") == "-" {
+			continue
+		}
+		path := joinConfigPath(prefix, configFieldName(f))
+		fv := v.Field(i)
+		fn(path, f, fv)
+		if fv.Kind() == reflect.Ptr && !fv.IsNil() {
+			fv = fv.Elem()
+		}
+		if fv.Kind() == reflect.Struct && fv.Type() != durationType {
+			walkConfig(fv, path, fn)
+		}
+	}
+}
+
+func (c *Config) applyEnv() error {
+	var errs []error
+	walkConfig(reflect.ValueOf(c).Elem(), "", func(path string, f reflect.StructField, v reflect.Value) {
+		tag := f.Tag.Get("env")
+		if tag == "" {
+			return
+		}
+		for _, name := range strings.Split(tag, ",") {
+			value := os.Getenv(name)
+			if value == "" {
+				continue
+			}
+			if f.Tag.Get("envfile") == "true" {
+				if err := loadEnvFile(v, value); err != nil {
+					errs = append(errs, fmt.Errorf("%s: %v", name, err))
+					return
+				}
+				c.sources[path] = fmt.Sprintf("env %s=%s", name, value)
+				return
+			}
+			if err := setConfigValue(v, value); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", name, err))
+				return
+			}
+			c.sources[path] = "env " + name
+			return
+		}
+	})
+	return errors.Join(errs...)
+}
+
+// loadEnvFile decodes the JSON file at path into the pointer field v
+func loadEnvFile(v reflect.Value, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	section := reflect.New(v.Type().Elem())
+	if err := json.Unmarshal(data, section.Interface()); err != nil {
+		return fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	v.Set(section)
+	return nil
+}
+
+func setConfigValue(v reflect.Value, s string) error {
+	if v.Type() == durationType {
+		d, err := parseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(Duration{d}))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", s)
+		}
+		v.SetInt(n)
+	case reflect.Uint32:
+		n, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", s)
+		}
+		v.SetUint(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", s)
+		}
+		v.SetBool(b)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("cannot be set from the environment")
+		}
+		var items []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("cannot be set from the environment")
+	}
+	return nil
+}
+
+// Validate reports every invalid setting at once
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	port, err := strconv.Atoi(c.Server.Port)
+	check(err == nil && port > 0 && port < 65536, "server.port: invalid port %q", c.Server.Port)
+	if err := c.Server.TLS.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("server.tls: %v", err))
+	}
+
+	check(validHTTPURL(c.Marketplace.URL), "marketplace.url: invalid URL %q", c.Marketplace.URL)
+	if c.Marketplace.ConsumerNodeURL != "" {
+		check(validHTTPURL(c.Marketplace.ConsumerNodeURL), "marketplace.consumer_node_url: invalid URL %q", c.Marketplace.ConsumerNodeURL)
+	}
+	check(c.Marketplace.RequestTimeout.Duration > 0, "marketplace.request_timeout must be positive")
+	check(c.Marketplace.ModelsTimeout.Duration > 0, "marketplace.models_timeout must be positive")
+	check(c.Marketplace.ChatTimeout.Duration > 0, "marketplace.chat_timeout must be positive")
+	for i, node := range c.Marketplace.Nodes {
+		check(validHTTPURL(node), "marketplace.nodes[%d]: invalid URL %q", i, node)
+	}
+	switch c.Marketplace.Balancing {
+	case BalanceRoundRobin, BalanceLeastOutstanding, BalanceHealthWeighted:
+	default:
+		errs = append(errs, fmt.Errorf("marketplace.balancing: expected round_robin, least_outstanding or health_weighted, got %q", c.Marketplace.Balancing))
+	}
+	check(c.Marketplace.EjectAfter >= 1, "marketplace.eject_after must be at least 1")
+	check(c.Marketplace.EjectFor.Duration > 0, "marketplace.eject_for must be positive")
+	check(c.Marketplace.HealthCheckInterval.Duration >= 0, "marketplace.health_check_interval must not be negative")
+	check(c.Marketplace.ChatRetries >= 0, "marketplace.chat_retries must not be negative")
+	check(c.Marketplace.ChatRetryBaseDelay.Duration >= 0, "marketplace.chat_retry_base_delay must not be negative")
+	check(c.Marketplace.ChatRetryMaxDelay.Duration >= c.Marketplace.ChatRetryBaseDelay.Duration, "marketplace.chat_retry_max_delay must be at least chat_retry_base_delay")
+
+	check(c.Models.HedgeAfter.Duration >= 0, "models.hedge_after must not be negative")
+	for model, fallbacks := range c.Models.Fallbacks {
+		for _, fallback := range fallbacks {
+			check(fallback != "" && !strings.Contains(fallback, "|"), "models.fallbacks.%s: invalid model %q", model, fallback)
+		}
+	}
+	for model, window := range c.Models.ContextWindows {
+		check(window > 0, "models.context_windows.%s must be positive", model)
+	}
+	if err := c.Models.Context.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("models.context: %v", err))
+	}
+	check(c.StructuredOutput.Retries >= 0, "structured_output.retries must not be negative")
+	check(c.Batches.Concurrency >= 1, "batches.concurrency must be at least 1")
+	check(c.Batches.MaxFileBytes > 0, "batches.max_file_bytes must be positive")
+	if err := c.Async.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("async: %v", err))
+	}
+	if err := c.Wallets.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("wallets: %v", err))
+	}
+
+	check(c.Session.ExpirationSeconds >= 60, "session.expiration_seconds must be at least 60, got %d", c.Session.ExpirationSeconds)
+	check(c.Session.CreateRetries >= 1, "session.create_retries must be at least 1")
+	check(c.Session.RetryBaseDelay.Duration >= 0, "session.retry_base_delay must not be negative")
+	check(c.Session.ModelCacheTTL.Duration >= 0, "session.model_cache_ttl must not be negative")
+
+	check(c.CircuitBreaker.Interval.Duration >= 0, "circuit_breaker.interval must not be negative")
+	check(c.CircuitBreaker.Timeout.Duration >= 0, "circuit_breaker.timeout must not be negative")
+
+	if _, err := parseMOR(c.Health.MinMOR); err != nil {
+		errs = append(errs, fmt.Errorf("health.min_mor: %v", err))
+	}
+	if _, err := parseMOR(c.Health.MinETH); err != nil {
+		errs = append(errs, fmt.Errorf("health.min_eth: %v", err))
+	}
+	check(c.Health.CatalogMaxAge.Duration > 0, "health.catalog_max_age must be positive")
+	check(c.Health.CacheTTL.Duration >= 0, "health.cache_ttl must not be negative")
+
+	check(c.LogLevel == "debug" || c.LogLevel == "info", "log_level: expected debug or info, got %q", c.LogLevel)
+
+	if _, err := newMiddlewareChains(c.Middleware); err != nil {
+		errs = append(errs, fmt.Errorf("middleware: %v", err))
+	}
+
+	if c.Budgets != nil {
+		if _, err := newBudgetLimits(*c.Budgets); err != nil {
+			errs = append(errs, fmt.Errorf("budgets: %v", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func validHTTPURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// ModelsURL returns the base URL used for model listings
+func (m MarketplaceConfig) ModelsURL() string {
+	if m.ConsumerNodeURL != "" {
+		return m.ConsumerNodeURL
+	}
+	return m.URL
+}
+
+// Source reports where the setting at path came from
+func (c *Config) Source(path string) string {
+	if source, ok := c.sources[path]; ok {
+		return source
+	}
+	// Settings inside a section loaded from an env file share its source
+	for p := path; strings.Contains(p, "."); {
+		p = p[:strings.LastIndex(p, ".")]
+		if source, ok := c.sources[p]; ok && strings.HasPrefix(source, "env ") {
+			return source
+		}
+	}
+	return "default"
+}
+
+// Print writes every setting with its value and source, masking secrets
+func (c *Config) Print(w io.Writer) {
+	if c.path != "" {
+		fmt.Fprintf(w, "# config file: %s\n", c.path)
+	}
+	for _, line := range c.settings() {
+		fmt.Fprintf(w, "%s = %s  # %s\n", line.path, line.value, c.Source(line.path))
+	}
+}
+
+type configSetting struct {
+	path  string
+	value string
+}
+
+func (c *Config) settings() []configSetting {
+	var out []configSetting
+	walkConfig(reflect.ValueOf(c).Elem(), "", func(path string, f reflect.StructField, v reflect.Value) {
+		if v.Kind() == reflect.Struct && v.Type() != durationType {
+			return
+		}
+		if v.Kind() == reflect.Ptr && !v.IsNil() && v.Elem().Kind() == reflect.Struct {
+			return
+		}
+		value := formatConfigValue(v)
+		if f.Tag.Get("secret") == "true" && !v.IsZero() {
+			value = `"********"`
+		}
+		out = append(out, configSetting{path: path, value: value})
+	})
+	return out
+}
+
+func formatConfigValue(v reflect.Value) string {
+	data, err := json.Marshal(v.Interface())
+	if err != nil {
+		return fmt.Sprintf("%v", v.Interface())
+	}
+	return string(data)
+}
+
+// hotReloadable lists the settings that take effect without a restart
+var hotReloadable = []string{"log_level", "models", "session.model_cache_ttl", "rate_limits", "budgets", "middleware"}
+
+func isHotReloadable(path string) bool {
+	for _, prefix := range hotReloadable {
+		if path == prefix || strings.HasPrefix(path, prefix+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// restartRequired lists settings that differ between c and next but only take
+// effect after a restart.
+func (c *Config) restartRequired(next *Config) []string {
+	current := make(map[string]string)
+	for _, s := range c.settings() {
+		current[s.path] = s.value
+	}
+	var changed []string
+	for _, s := range next.settings() {
+		if !isHotReloadable(s.path) && current[s.path] != s.value {
+			changed = append(changed, s.path)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// withReloadable returns a copy of c with the hot-reloadable settings of next
+func (c *Config) withReloadable(next *Config) *Config {
+	merged := *c
+	merged.LogLevel = next.LogLevel
+	merged.Models = next.Models
+	merged.Session.ModelCacheTTL = next.Session.ModelCacheTTL
+	merged.RateLimits = next.RateLimits
+	merged.Budgets = next.Budgets
+	merged.Middleware = next.Middleware
+	merged.sources = make(map[string]string, len(next.sources))
+	for path, source := range c.sources {
+		if !isHotReloadable(path) {
+			merged.sources[path] = source
+		}
+	}
+	for path, source := range next.sources {
+		if isHotReloadable(path) {
+			merged.sources[path] = source
+		}
+	}
+	return &merged
+}
+
+var activeConfig atomic.Pointer[Config]
+
+// currentConfig returns the configuration installed by setConfig. Before one
+// is installed, as in tests, it is resolved from defaults and the environment.
+func currentConfig() *Config {
+	if cfg := activeConfig.Load(); cfg != nil {
+		return cfg
+	}
+	cfg, err := LoadConfig("")
+	if err != nil {
+		return defaultConfig()
+	}
+	return cfg
+}
+
+func setConfig(cfg *Config) {
+	activeConfig.Store(cfg)
+	if cfg != nil {
+		setLogLevel(cfg.LogLevel)
+	}
+}
+
+var debugLogging atomic.Bool
+
+func setLogLevel(level string) {
+	debugLogging.Store(level == "debug")
+}
+
+// debugf logs only when log_level is debug. Request and response bodies are
+// logged this way since they can contain prompts and session details.
+func debugf(format string, args ...interface{}) {
+	if debugLogging.Load() {
+		log.Printf(format, args...)
+	}
+}
+
+// watchConfig reloads the config file on SIGHUP or when it changes on disk and
+// passes each valid result to apply. It returns a func that stops watching.
+func watchConfig(path string, interval time.Duration, apply func(*Config)) func() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	stop := make(chan struct{})
+
+	modTime := func() time.Time {
+		if path == "" {
+			return time.Time{}
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}
+		}
+		return info.ModTime()
+	}
+	last := modTime()
+
+	reload := func(reason string) {
+		cfg, err := LoadConfig(path)
+		if err == nil {
+			err = cfg.Validate()
+		}
+		if err != nil {
+			log.Printf("Ignoring config reload (%s): %v", reason, err)
+			return
+		}
+		log.Printf("Reloading config (%s)", reason)
+		apply(cfg)
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-hup:
+				last = modTime()
+				reload("SIGHUP")
+			case <-ticker.C:
+				if m := modTime(); !m.Equal(last) {
+					last = m
+					reload("file changed")
+				}
+			}
+		}
+	}()
+	return func() { close(stop) }
+}
+
+// reloadConfig applies the hot-reloadable settings of next to the running
+// proxy and logs the settings that need a restart.
+func (p *Proxy) reloadConfig(next *Config) {
+	current := p.cfg()
+	if changed := current.restartRequired(next); len(changed) > 0 {
+		p.logger.Printf("Config changes to %s take effect after a restart", strings.Join(changed, ", "))
+	}
+
+	if next.RateLimits != nil && p.limiter != nil {
+		if !reflect.DeepEqual(current.RateLimits, next.RateLimits) {
+			p.limiter.UpdateConfig(*next.RateLimits)
+		}
+	} else if (next.RateLimits != nil) != (p.limiter != nil) {
+		p.logger.Printf("Enabling or disabling rate_limits takes effect after a restart")
+	}
+	if next.Budgets != nil && p.budgets != nil {
+		if err := p.budgets.UpdateLimits(*next.Budgets); err != nil {
+			p.logger.Printf("Ignoring budget reload: %v", err)
+		}
+	} else if (next.Budgets != nil) != (p.budgets != nil) {
+		p.logger.Printf("Enabling or disabling budgets takes effect after a restart")
+	}
+
+	if chains, err := newMiddlewareChains(next.Middleware); err != nil {
+		p.logger.Printf("Ignoring middleware reload: %v", err)
+	} else {
+		p.setMiddlewareConfig(chains)
+	}
+
+	p.setConfig(current.withReloadable(next))
+}
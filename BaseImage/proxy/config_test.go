@@ -0,0 +1,246 @@
+package proxy
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigFormats(t *testing.T) {
+	t.Setenv("MARKETPLACE_URL", "")
+	t.Setenv("PORT", "")
+	t.Setenv("DEFAULT_PORT", "")
+
+	files := map[string]string{
+		"nfa.yaml": `
+server:
+  port: "9090"
+marketplace:
+  url: http://node:9000
+  chat_timeout: 2m
+session:
+  expiration_seconds: 600
+models:
+  aliases:
+    fast: llama-3-8b
+`,
+		"nfa.toml": `
+[server]
+port = "9090"
+
+[marketplace]
+url = "http://node:9000"
+chat_timeout = "2m"
+
+[session]
+expiration_seconds = 600
+
+[models.aliases]
+fast = "llama-3-8b"
+`,
+		"nfa.json": `{
+  "server": {"port": "9090"},
+  "marketplace": {"url": "http://node:9000", "chat_timeout": 120},
+  "session": {"expiration_seconds": 600},
+  "models": {"aliases": {"fast": "llama-3-8b"}}
+}`,
+	}
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			cfg, err := LoadConfig(writeConfigFile(t, name, content))
+			if err != nil {
+				t.Fatalf("LoadConfig() error = %v", err)
+			}
+			if err := cfg.Validate(); err != nil {
+				t.Fatalf("Validate() error = %v", err)
+			}
+			if cfg.Server.Port != "9090" || cfg.Marketplace.URL != "http://node:9000" {
+				t.Errorf("unexpected server/marketplace: %+v %+v", cfg.Server, cfg.Marketplace)
+			}
+			if cfg.Marketplace.ChatTimeout.Duration != 2*time.Minute {
+				t.Errorf("chat_timeout = %v, want 2m", cfg.Marketplace.ChatTimeout)
+			}
+			if cfg.Session.ExpirationSeconds != 600 || cfg.Models.Aliases["fast"] != "llama-3-8b" {
+				t.Errorf("unexpected session/models: %+v %+v", cfg.Session, cfg.Models)
+			}
+			// Unset values keep their defaults
+			if cfg.Session.CreateRetries != 3 || cfg.Marketplace.RequestTimeout.Duration != 30*time.Second {
+				t.Errorf("defaults not kept: %+v", cfg.Session)
+			}
+		})
+	}
+}
+
+func TestLoadConfigEnvOverridesFile(t *testing.T) {
+	path := writeConfigFile(t, "nfa.yaml", "marketplace:\n  url: http://file:9000\nadmin_api_key: from-file\n")
+	t.Setenv("MARKETPLACE_URL", "http://env:9000")
+	t.Setenv("ADMIN_API_KEY", "")
+	t.Setenv("PORT", "")
+	t.Setenv("DEFAULT_PORT", "7000")
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	if cfg.Marketplace.URL != "http://env:9000" {
+		t.Errorf("url = %q, want the env value", cfg.Marketplace.URL)
+	}
+	if cfg.Server.Port != "7000" {
+		t.Errorf("port = %q, want the DEFAULT_PORT fallback", cfg.Server.Port)
+	}
+
+	sources := map[string]string{
+		"marketplace.url":            "env MARKETPLACE_URL",
+		"admin_api_key":              "file " + path,
+		"session.expiration_seconds": "default",
+	}
+	for setting, want := range sources {
+		if got := cfg.Source(setting); got != want {
+			t.Errorf("Source(%q) = %q, want %q", setting, got, want)
+		}
+	}
+
+	var out bytes.Buffer
+	cfg.Print(&out)
+	if strings.Contains(out.String(), "from-file") {
+		t.Error("Print() should mask secrets")
+	}
+	if !strings.Contains(out.String(), `marketplace.url = "http://env:9000"  # env MARKETPLACE_URL`) {
+		t.Errorf("Print() output missing marketplace.url:\n%s", out.String())
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+	}{
+		{"unknown field", "nfa.yaml", "marketplace:\n  uri: http://node:9000\n"},
+		{"wrong type", "nfa.json", `{"session": {"expiration_seconds": "soon"}}`},
+		{"bad duration", "nfa.yaml", "marketplace:\n  chat_timeout: forever\n"},
+		{"unsupported extension", "nfa.ini", "port=1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := LoadConfig(writeConfigFile(t, tt.file, tt.content)); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+	if _, err := LoadConfig(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("missing file should be an error")
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	cfg := defaultConfig()
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("default config should be valid: %v", err)
+	}
+
+	cfg.Server.Port = "http"
+	cfg.Marketplace.URL = "marketplace:9000"
+	cfg.Session.ExpirationSeconds = 30
+	cfg.LogLevel = "trace"
+	cfg.Budgets = &BudgetConfig{Default: SpendLimit{DailyMOR: "lots"}}
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("expected validation errors")
+	}
+	// Every problem is reported, not just the first
+	for _, setting := range []string{"server.port", "marketplace.url", "session.expiration_seconds", "log_level", "budgets"} {
+		if !strings.Contains(err.Error(), setting) {
+			t.Errorf("error does not mention %s: %v", setting, err)
+		}
+	}
+}
+
+func TestConfigRestartRequired(t *testing.T) {
+	current := defaultConfig()
+	next := defaultConfig()
+	next.LogLevel = "debug"
+	next.Models.Aliases = map[string]string{"fast": "llama-3-8b"}
+	next.Server.Port = "9090"
+	next.Marketplace.ChatTimeout = Duration{time.Minute}
+
+	changed := current.restartRequired(next)
+	want := []string{"marketplace.chat_timeout", "server.port"}
+	if strings.Join(changed, ",") != strings.Join(want, ",") {
+		t.Errorf("restartRequired() = %v, want %v", changed, want)
+	}
+
+	merged := current.withReloadable(next)
+	if merged.LogLevel != "debug" || merged.Models.Aliases["fast"] != "llama-3-8b" {
+		t.Errorf("hot-reloadable settings not applied: %+v", merged)
+	}
+	if merged.Server.Port != "8081" || merged.Marketplace.ChatTimeout.Duration != 5*time.Minute {
+		t.Errorf("restart-only settings should keep their running values: %+v", merged)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	defer setConfig(nil)
+	setConfig(defaultConfig())
+
+	p := NewProxy()
+	p.limiter = NewRateLimiter(RateLimitConfig{Default: RateLimit{RequestsPerSecond: 1}})
+	p.budgets, _ = NewBudgetTracker(BudgetConfig{})
+
+	next := defaultConfig()
+	next.Models.Aliases = map[string]string{"fast": "llama-3-8b"}
+	next.RateLimits = &RateLimitConfig{Default: RateLimit{RequestsPerSecond: 5}}
+	next.Budgets = &BudgetConfig{Default: SpendLimit{DailyMOR: "2"}}
+	p.reloadConfig(next)
+
+	if currentConfig().Models.Aliases["fast"] != "llama-3-8b" {
+		t.Error("aliases not reloaded")
+	}
+	if limit, _, _ := p.limiter.limits("caller", "model"); limit.RequestsPerSecond != 5 {
+		t.Errorf("rate limit = %v, want 5", limit.RequestsPerSecond)
+	}
+	if p.budgets.def.daily == nil {
+		t.Error("budget limits not reloaded")
+	}
+}
+
+func TestWatchConfig(t *testing.T) {
+	path := writeConfigFile(t, "nfa.yaml", "log_level: info\n")
+	reloaded := make(chan *Config, 1)
+	stop := watchConfig(path, 10*time.Millisecond, func(cfg *Config) { reloaded <- cfg })
+	defer stop()
+
+	// An invalid file is ignored and the next valid one is applied
+	future := time.Now().Add(time.Minute)
+	os.WriteFile(path, []byte("log_level: loud\n"), 0600)
+	os.Chtimes(path, future, future)
+	select {
+	case cfg := <-reloaded:
+		t.Fatalf("invalid config applied: %+v", cfg)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	os.WriteFile(path, []byte("log_level: debug\n"), 0600)
+	future = future.Add(time.Minute)
+	os.Chtimes(path, future, future)
+	select {
+	case cfg := <-reloaded:
+		if cfg.LogLevel != "debug" {
+			t.Errorf("log_level = %q, want debug", cfg.LogLevel)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("config change was not picked up")
+	}
+}
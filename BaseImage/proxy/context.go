@@ -0,0 +1,197 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Context strategies for prompts that do not fit the model's context window
+const (
+	ContextReject     = "reject"
+	ContextDropOldest = "drop_oldest"
+	ContextKeepLast   = "keep_last"
+	ContextSummarize  = "summarize"
+)
+
+// ContextConfig decides what happens to a chat request that does not fit the
+// model's context window. Leading system messages and the last message are
+// always kept.
+type ContextConfig struct {
+	// Strategy is reject, drop_oldest, keep_last or summarize
+	Strategy string `json:"strategy" env:"CONTEXT_STRATEGY"`
+	// KeepLast is how many of the latest messages keep_last and summarize keep
+	// as they are
+	KeepLast int `json:"keep_last" env:"CONTEXT_KEEP_LAST"`
+	// SummaryModel summarizes older turns for the summarize strategy
+	SummaryModel string `json:"summary_model" env:"CONTEXT_SUMMARY_MODEL"`
+	// ReserveTokens of the window are left for the completion
+	ReserveTokens int `json:"reserve_tokens"`
+}
+
+func (c ContextConfig) validate() error {
+	var errs []string
+	switch c.Strategy {
+	case ContextReject, ContextDropOldest, ContextKeepLast, ContextSummarize:
+	default:
+		errs = append(errs, fmt.Sprintf("strategy: expected reject, drop_oldest, keep_last or summarize, got %q", c.Strategy))
+	}
+	if c.Strategy == ContextSummarize && c.SummaryModel == "" {
+		errs = append(errs, "summary_model is required by the summarize strategy")
+	}
+	if c.KeepLast < 1 {
+		errs = append(errs, "keep_last must be at least 1")
+	}
+	if c.ReserveTokens < 0 {
+		errs = append(errs, "reserve_tokens must not be negative")
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// contextTrim reports what was removed to fit a request into the window
+type contextTrim struct {
+	strategy string
+	messages int
+	tokens   int
+}
+
+// header formats the trim for the X-NFA-Context-Trimmed response header
+func (t *contextTrim) header() string {
+	return fmt.Sprintf("strategy=%s; messages=%d; tokens=%d", t.strategy, t.messages, t.tokens)
+}
+
+// ContextLengthError rejects a request that still does not fit the window
+type ContextLengthError struct {
+	Model  string
+	Window int
+	Tokens int
+}
+
+func (e *ContextLengthError) Error() string {
+	return fmt.Sprintf("This model's maximum context length is %d tokens, but the messages need about %d tokens", e.Window, e.Tokens)
+}
+
+// contextWindow returns the context length of model in tokens from the config
+// or else the catalog, or 0 when it is unknown
+func (p *Proxy) contextWindow(model string) int {
+	if n := p.cfg().Models.ContextWindows[model]; n > 0 {
+		return n
+	}
+	if _, err := p.resolveModelID(model); err != nil {
+		return 0
+	}
+	p.models.RLock()
+	defer p.models.RUnlock()
+	return p.models.m[strings.TrimSpace(model)].ContextLength
+}
+
+// fitContext makes req fit the context window of its model with the
+// configured strategy. It returns nil when nothing was removed, and a
+// *ContextLengthError when the request cannot be made to fit.
+func (p *Proxy) fitContext(r *http.Request, req *ChatCompletionRequest) (*contextTrim, error) {
+	window := p.contextWindow(req.Model)
+	if window == 0 {
+		return nil, nil
+	}
+	cfg := p.cfg().Models.Context
+	budget := window - cfg.ReserveTokens
+	before := estimatePromptTokens(req.Messages)
+	if before <= budget {
+		return nil, nil
+	}
+
+	// Leading system messages and the last message are never dropped
+	head := 0
+	for head < len(req.Messages)-1 && req.Messages[head].Role == "system" {
+		head++
+	}
+	system := req.Messages[:head:head]
+	turns := req.Messages[head:]
+
+	strategy := cfg.Strategy
+	switch strategy {
+	case ContextKeepLast:
+		if len(turns) > cfg.KeepLast {
+			turns = turns[len(turns)-cfg.KeepLast:]
+		}
+	case ContextSummarize:
+		if older := len(turns) - cfg.KeepLast; older > 0 {
+			summary, err := p.summarizeTurns(r, turns[:older])
+			if err != nil {
+				p.logger.Printf("Summarizing %d messages for model %s failed, dropping them instead: %v", older, req.Model, err)
+				strategy = ContextDropOldest
+			} else {
+				system = append(system, Message{Role: "system", Content: "Summary of the earlier conversation: " + summary})
+			}
+			turns = turns[older:]
+		}
+	}
+	if strategy != ContextReject {
+		for len(turns) > 1 && estimatePromptTokens(system)+estimatePromptTokens(turns) > budget {
+			turns = turns[1:]
+		}
+	}
+
+	messages := append(system, turns...)
+	after := estimatePromptTokens(messages)
+	if after > budget {
+		return nil, &ContextLengthError{Model: req.Model, Window: window, Tokens: after + cfg.ReserveTokens}
+	}
+	trim := &contextTrim{strategy: strategy, messages: len(req.Messages) - len(turns) - head, tokens: before - after}
+	p.logger.Printf("Trimmed request for model %s to fit %d tokens: %s", req.Model, window, trim.header())
+	req.Messages = messages
+	return trim, nil
+}
+
+const summaryPrompt = "Summarize the following conversation in a few sentences. Keep names, facts, decisions and open questions. Reply with the summary only."
+
+// summarizeTurns asks the configured summary model for a summary of messages
+func (p *Proxy) summarizeTurns(r *http.Request, messages []Message) (string, error) {
+	model := p.cfg().Models.Context.SummaryModel
+	var transcript strings.Builder
+	for _, m := range messages {
+		fmt.Fprintf(&transcript, "%s: %s\n", m.Role, m.Content)
+	}
+	req := ChatCompletionRequest{
+		Model:    model,
+		Messages: []Message{{Role: "system", Content: summaryPrompt}, {Role: "user", Content: transcript.String()}},
+		Stream:   true,
+	}
+
+	// Summaries share one session per model instead of opening one each time
+	var sessionID string
+	if id, ok := p.summarySessions.Load(model); ok {
+		sessionID = id.(string)
+	}
+	attempt := p.openChat(r, req, model, sessionID)
+	if attempt.err != nil {
+		return "", attempt.err
+	}
+	p.summarySessions.Store(model, attempt.upstream.sessionID)
+
+	usage := newUsageCollector(req.Messages)
+	data, err := io.ReadAll(attempt.upstream.reader)
+	attempt.upstream.close(err == nil)
+	if err != nil {
+		return "", fmt.Errorf("error reading summary: %w", err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		usage.observe([]byte(line))
+	}
+	rec := usage.record()
+	rec.Caller = callerID(r)
+	rec.Model = model
+	rec.ModelID = attempt.modelID
+	rec.SessionID = attempt.upstream.sessionID
+	p.usage.Record(rec)
+
+	summary := strings.TrimSpace(usage.completion.String())
+	if summary == "" {
+		return "", fmt.Errorf("summary model %s returned no text", model)
+	}
+	return summary, nil
+}
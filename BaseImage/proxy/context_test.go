@@ -0,0 +1,215 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// conversation returns a system prompt followed by n user and assistant turns
+// of about 27 tokens each
+func conversation(n int) []Message {
+	messages := []Message{{Role: "system", Content: "Be brief"}}
+	for i := 0; i < n; i++ {
+		role := "user"
+		if i%2 == 1 {
+			role = "assistant"
+		}
+		messages = append(messages, Message{Role: role, Content: fmt.Sprintf("turn %d %s", i, strings.Repeat("x", 80))})
+	}
+	return messages
+}
+
+func newContextProxy(t *testing.T, context ContextConfig, marketplaceURL string) *Server {
+	t.Helper()
+	cfg, err := LoadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if marketplaceURL != "" {
+		cfg.Marketplace.URL = marketplaceURL
+	}
+	cfg.Models.ContextWindows = map[string]int{"small": 200}
+	cfg.Models.Context = context
+	s, err := New(cfg, WithLogger(log.New(io.Discard, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestFitContextStrategies(t *testing.T) {
+	tests := []struct {
+		context  ContextConfig
+		wantLast int // messages kept after the system prompt
+		wantErr  bool
+	}{
+		{context: ContextConfig{Strategy: ContextReject, KeepLast: 8, ReserveTokens: 50}, wantErr: true},
+		{context: ContextConfig{Strategy: ContextDropOldest, KeepLast: 8, ReserveTokens: 50}, wantLast: 5},
+		{context: ContextConfig{Strategy: ContextKeepLast, KeepLast: 2, ReserveTokens: 50}, wantLast: 2},
+		// keep_last still drops older messages when the last N do not fit
+		{context: ContextConfig{Strategy: ContextKeepLast, KeepLast: 6, ReserveTokens: 50}, wantLast: 5},
+	}
+	for _, tt := range tests {
+		s := newContextProxy(t, tt.context, "")
+		req := ChatCompletionRequest{Model: "small", Messages: conversation(10)}
+		trim, err := s.fitContext(httptest.NewRequest("POST", "/", nil), &req)
+		if tt.wantErr {
+			if _, ok := err.(*ContextLengthError); !ok {
+				t.Errorf("%s: error = %v, want a ContextLengthError", tt.context.Strategy, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tt.context.Strategy, err)
+		}
+		if len(req.Messages) != tt.wantLast+1 || req.Messages[0].Role != "system" || req.Messages[len(req.Messages)-1].Content[:7] != "turn 9 " {
+			t.Errorf("%s: messages = %+v", tt.context.Strategy, req.Messages)
+		}
+		if trim == nil || trim.messages != 10-tt.wantLast || trim.strategy != tt.context.Strategy {
+			t.Errorf("%s: trim = %+v", tt.context.Strategy, trim)
+		}
+	}
+}
+
+func TestFitContextLeavesShortAndUnknownRequests(t *testing.T) {
+	s := newContextProxy(t, ContextConfig{Strategy: ContextDropOldest, KeepLast: 8}, "")
+	for _, req := range []ChatCompletionRequest{
+		{Model: "small", Messages: conversation(2)},
+		{Model: "unlisted", Messages: conversation(100)},
+	} {
+		before := len(req.Messages)
+		if trim, err := s.fitContext(httptest.NewRequest("POST", "/", nil), &req); trim != nil || err != nil || len(req.Messages) != before {
+			t.Errorf("%s: trim = %+v, err = %v, messages = %d", req.Model, trim, err, len(req.Messages))
+		}
+	}
+}
+
+// contextMarketplace lists a model with a context window and records the
+// messages of each chat. Requests with the summary prompt get a summary.
+type contextMarketplace struct {
+	mu    sync.Mutex
+	chats [][]Message
+}
+
+func (m *contextMarketplace) serve(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/blockchain/models":
+			fmt.Fprint(w, `{"models":[{"Id":"0xtiny","Name":"Tiny","ContextLength":200},{"Id":"0xcheap","Name":"Cheap"}]}`)
+		case strings.HasSuffix(r.URL.Path, "/session"):
+			fmt.Fprint(w, `{"sessionId":"s"}`)
+		case r.URL.Path == "/v1/chat/completions":
+			var req ChatCompletionRequest
+			json.NewDecoder(r.Body).Decode(&req)
+			m.mu.Lock()
+			m.chats = append(m.chats, req.Messages)
+			m.mu.Unlock()
+			reply := "ok"
+			if req.Messages[0].Content == summaryPrompt {
+				reply = "they talked about x"
+			}
+			fmt.Fprintf(w, "data: {\"choices\":[{\"delta\":{\"content\":\"%s\"}}]}\n\ndata: [DONE]\n\n", reply)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func chatBody(model string, messages []Message) string {
+	body, _ := json.Marshal(ChatCompletionRequest{Model: model, Messages: messages})
+	return string(body)
+}
+
+func TestChatUsesCatalogContextLength(t *testing.T) {
+	m := &contextMarketplace{}
+	s := newContextProxy(t, ContextConfig{Strategy: ContextDropOldest, KeepLast: 8, ReserveTokens: 50}, m.serve(t).URL)
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(chatBody("Tiny", conversation(10)))))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("X-NFA-Context-Trimmed"); !strings.HasPrefix(got, "strategy=drop_oldest; messages=5; tokens=") {
+		t.Errorf("X-NFA-Context-Trimmed = %q", got)
+	}
+	if len(m.chats) != 1 || len(m.chats[0]) != 6 {
+		t.Errorf("forwarded chats = %+v", m.chats)
+	}
+}
+
+func TestChatRejectsOverlongPrompt(t *testing.T) {
+	m := &contextMarketplace{}
+	s := newContextProxy(t, ContextConfig{Strategy: ContextReject, KeepLast: 8}, m.serve(t).URL)
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(chatBody("Tiny", conversation(10)))))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"code":"context_length_exceeded"`) {
+		t.Errorf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if len(m.chats) != 0 {
+		t.Errorf("overlong prompt was forwarded")
+	}
+}
+
+func TestChatSummarizesOlderTurns(t *testing.T) {
+	m := &contextMarketplace{}
+	s := newContextProxy(t, ContextConfig{Strategy: ContextSummarize, KeepLast: 2, SummaryModel: "Cheap", ReserveTokens: 50}, m.serve(t).URL)
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(chatBody("Tiny", conversation(10)))))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("X-NFA-Context-Trimmed"); !strings.HasPrefix(got, "strategy=summarize; messages=8;") {
+		t.Errorf("X-NFA-Context-Trimmed = %q", got)
+	}
+	if len(m.chats) != 2 || !strings.Contains(m.chats[0][1].Content, "turn 7") || strings.Contains(m.chats[0][1].Content, "turn 8") {
+		t.Fatalf("summary request = %+v", m.chats)
+	}
+	forwarded := m.chats[1]
+	if len(forwarded) != 4 || forwarded[1].Content != "Summary of the earlier conversation: they talked about x" {
+		t.Errorf("forwarded messages = %+v", forwarded)
+	}
+}
+
+func TestRateLimitedChatDoesNotSummarize(t *testing.T) {
+	m := &contextMarketplace{}
+	s := newContextProxy(t, ContextConfig{Strategy: ContextSummarize, KeepLast: 2, SummaryModel: "Cheap", ReserveTokens: 50}, m.serve(t).URL)
+	s.limiter = NewRateLimiter(RateLimitConfig{Default: RateLimit{RequestsPerSecond: 0.01, Burst: 1}})
+
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(chatBody("Tiny", conversation(10)))))
+		if w.Code != want {
+			t.Fatalf("request %d: status = %d, body = %s", i, w.Code, w.Body.String())
+		}
+	}
+	if len(m.chats) != 2 {
+		t.Errorf("upstream chats = %d, want the first request and its summary only", len(m.chats))
+	}
+}
+
+func TestContextConfigValidation(t *testing.T) {
+	cfg, err := LoadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Models.Context.Strategy = ContextSummarize
+	cfg.Models.ContextWindows = map[string]int{"m": 0}
+	err = cfg.Validate()
+	for _, want := range []string{"summary_model is required", "models.context_windows.m must be positive"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Validate() error = %v, want %q", err, want)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/sony/gobreaker"
+)
+
+// errorTypeForStatus returns the OpenAI error type for an HTTP status
+func errorTypeForStatus(status int) string {
+	switch {
+	case status == http.StatusUnauthorized:
+		return "authentication_error"
+	case status == http.StatusForbidden:
+		return "permission_error"
+	case status == http.StatusNotFound:
+		return "not_found_error"
+	case status == http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case status >= 500:
+		return "server_error"
+	default:
+		return "invalid_request_error"
+	}
+}
+
+// respondWithAPIError sends apiErr in the OpenAI error envelope. Build it
+// with newAPIError.
+func respondWithAPIError(w http.ResponseWriter, statusCode int, apiErr APIError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Del("Content-Length")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(map[string]APIError{"error": apiErr})
+}
+
+// newAPIError builds an error object, leaving empty code and param null
+func newAPIError(errType, code, param, message string) APIError {
+	apiErr := APIError{Message: message, Type: errType}
+	if code != "" {
+		apiErr.Code = &code
+	}
+	if param != "" {
+		apiErr.Param = &param
+	}
+	return apiErr
+}
+
+// upstreamError is a non-success response from the consumer node
+type upstreamError struct {
+	op     string
+	status int
+	body   []byte
+}
+
+func (e *upstreamError) Error() string {
+	return fmt.Sprintf("%s failed, status: %d, response: %s", e.op, e.status, string(e.body))
+}
+
+// upstreamMessage extracts the error message from a consumer node or
+// provider error body
+func upstreamMessage(body []byte) string {
+	var parsed struct {
+		Error   json.RawMessage `json:"error"`
+		Message string          `json:"message"`
+	}
+	if json.Unmarshal(body, &parsed) == nil {
+		var text string
+		var nested struct {
+			Message string `json:"message"`
+		}
+		switch {
+		case json.Unmarshal(parsed.Error, &text) == nil && text != "":
+			return text
+		case json.Unmarshal(parsed.Error, &nested) == nil && nested.Message != "":
+			return nested.Message
+		case parsed.Message != "":
+			return parsed.Message
+		}
+	}
+	msg := strings.TrimSpace(string(body))
+	if len(msg) > 512 {
+		msg = msg[:512] + "..."
+	}
+	return msg
+}
+
+// upstreamAPIError maps a consumer node error response to the status and
+// error object returned to the caller. Problems with the request itself keep
+// their status; anything the caller cannot fix becomes a gateway error.
+func upstreamAPIError(status int, body []byte) (int, APIError) {
+	msg := upstreamMessage(body)
+	if msg == "" {
+		msg = http.StatusText(status)
+	}
+	switch status {
+	case http.StatusBadRequest, http.StatusNotFound, http.StatusConflict, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+		return status, newAPIError(errorTypeForStatus(status), "", "", msg)
+	case http.StatusTooManyRequests:
+		return status, newAPIError("rate_limit_error", "rate_limit_exceeded", "", "Upstream rate limit: "+msg)
+	case http.StatusServiceUnavailable:
+		return status, newAPIError("server_error", "upstream_unavailable", "", "Upstream unavailable: "+msg)
+	case http.StatusGatewayTimeout:
+		return status, newAPIError("server_error", "upstream_timeout", "", "Upstream timed out: "+msg)
+	default:
+		return http.StatusBadGateway, newAPIError("server_error", "upstream_error", "", fmt.Sprintf("Upstream error (status %d): %s", status, msg))
+	}
+}
+
+// respondWithUpstreamError reports a consumer node error response
+func respondWithUpstreamError(w http.ResponseWriter, status int, body []byte) {
+	status, apiErr := upstreamAPIError(status, body)
+	respondWithAPIError(w, status, apiErr)
+}
+
+// forwardAPIError maps a failure to reach or use the consumer node to the
+// status and error object returned to the caller
+func forwardAPIError(prefix string, err error) (int, APIError) {
+	var upErr *upstreamError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &upErr):
+		status, apiErr := upstreamAPIError(upErr.status, upErr.body)
+		apiErr.Message = prefix + ": " + apiErr.Message
+		return status, apiErr
+	case errors.Is(err, gobreaker.ErrOpenState), errors.Is(err, gobreaker.ErrTooManyRequests):
+		return http.StatusServiceUnavailable, newAPIError("server_error", "marketplace_unavailable", "", prefix+": the marketplace is unavailable, try again later")
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return http.StatusGatewayTimeout, newAPIError("server_error", "upstream_timeout", "", fmt.Sprintf("%s: %v", prefix, err))
+	default:
+		return http.StatusBadGateway, newAPIError("server_error", "upstream_error", "", fmt.Sprintf("%s: %v", prefix, err))
+	}
+}
+
+// respondWithForwardError reports a failed upstream call
+func respondWithForwardError(w http.ResponseWriter, prefix string, err error) {
+	status, apiErr := forwardAPIError(prefix, err)
+	respondWithAPIError(w, status, apiErr)
+}
+
+// writeStreamError reports an error after an SSE stream has started, as a
+// data event carrying the OpenAI error object. OpenAI SDKs raise it as an
+// API error. No [DONE] follows.
+func writeStreamError(w http.ResponseWriter, err error) {
+	var apiErr APIError
+	var mwErr *MiddlewareError
+	if errors.As(err, &mwErr) {
+		apiErr = newAPIError(errorTypeForStatus(mwErr.Status), mwErr.Code, "", mwErr.Message)
+	} else {
+		_, apiErr = forwardAPIError("Stream interrupted", err)
+	}
+	data, _ := json.Marshal(map[string]APIError{"error": apiErr})
+	fmt.Fprintf(w, "data: %s\n\n", data)
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
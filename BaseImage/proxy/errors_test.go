@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sony/gobreaker"
+)
+
+func decodeAPIError(t *testing.T, body []byte) APIError {
+	t.Helper()
+	var envelope struct {
+		Error *APIError `json:"error"`
+	}
+	if err := json.Unmarshal(body, &envelope); err != nil || envelope.Error == nil {
+		t.Fatalf("not an error envelope: %s", body)
+	}
+	return *envelope.Error
+}
+
+func TestUpstreamAPIError(t *testing.T) {
+	tests := []struct {
+		status     int
+		body       string
+		wantStatus int
+		wantType   string
+		wantCode   string
+		wantMsg    string
+	}{
+		{http.StatusBadRequest, `{"error":"messages must not be empty"}`, http.StatusBadRequest, "invalid_request_error", "", "messages must not be empty"},
+		{http.StatusNotFound, `{"error":{"message":"no such model"}}`, http.StatusNotFound, "not_found_error", "", "no such model"},
+		{http.StatusTooManyRequests, `{"message":"slow down"}`, http.StatusTooManyRequests, "rate_limit_error", "rate_limit_exceeded", "Upstream rate limit: slow down"},
+		{http.StatusServiceUnavailable, "provider offline\n", http.StatusServiceUnavailable, "server_error", "upstream_unavailable", "Upstream unavailable: provider offline"},
+		{http.StatusInternalServerError, "", http.StatusBadGateway, "server_error", "upstream_error", "Upstream error (status 500): Internal Server Error"},
+		{http.StatusUnauthorized, `{"error":"bad key"}`, http.StatusBadGateway, "server_error", "upstream_error", "Upstream error (status 401): bad key"},
+	}
+	for _, tt := range tests {
+		status, apiErr := upstreamAPIError(tt.status, []byte(tt.body))
+		code := ""
+		if apiErr.Code != nil {
+			code = *apiErr.Code
+		}
+		if status != tt.wantStatus || apiErr.Type != tt.wantType || code != tt.wantCode || apiErr.Message != tt.wantMsg {
+			t.Errorf("upstreamAPIError(%d, %q) = %d %+v (code %q)", tt.status, tt.body, status, apiErr, code)
+		}
+	}
+}
+
+func TestForwardAPIError(t *testing.T) {
+	tests := []struct {
+		err        error
+		wantStatus int
+		wantCode   string
+	}{
+		{fmt.Errorf("wrapped: %w", &upstreamError{op: "create session", status: http.StatusTooManyRequests, body: []byte("busy")}), http.StatusTooManyRequests, "rate_limit_exceeded"},
+		{gobreaker.ErrOpenState, http.StatusServiceUnavailable, "marketplace_unavailable"},
+		{fmt.Errorf("error sending request: %w", context.DeadlineExceeded), http.StatusGatewayTimeout, "upstream_timeout"},
+		{errors.New("connection refused"), http.StatusBadGateway, "upstream_error"},
+	}
+	for _, tt := range tests {
+		status, apiErr := forwardAPIError("Error forwarding request", tt.err)
+		if status != tt.wantStatus || apiErr.Code == nil || *apiErr.Code != tt.wantCode {
+			t.Errorf("forwardAPIError(%v) = %d %+v", tt.err, status, apiErr)
+		}
+		if !strings.HasPrefix(apiErr.Message, "Error forwarding request: ") {
+			t.Errorf("message %q is missing its prefix", apiErr.Message)
+		}
+	}
+}
+
+func TestRespondWithChatFailure(t *testing.T) {
+	w := httptest.NewRecorder()
+	respondWithChatFailure(w, &chatFailure{step: "model", err: errors.New("model not found: nope")})
+	apiErr := decodeAPIError(t, w.Body.Bytes())
+	if w.Code != http.StatusNotFound || apiErr.Param == nil || *apiErr.Param != "model" || apiErr.Code == nil || *apiErr.Code != "model_not_found" {
+		t.Errorf("model failure: status = %d, error = %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	respondWithChatFailure(w, &chatFailure{step: "session", err: &upstreamError{op: "create session", status: http.StatusBadRequest, body: []byte(`{"error":"insufficient MOR balance"}`)}})
+	apiErr = decodeAPIError(t, w.Body.Bytes())
+	if w.Code != http.StatusBadRequest || apiErr.Type != "invalid_request_error" || apiErr.Message != "Error creating session: insufficient MOR balance" {
+		t.Errorf("session failure: status = %d, error = %s", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+}
+
+func TestRespondWithError(t *testing.T) {
+	w := httptest.NewRecorder()
+	respondWithError(w, http.StatusUnauthorized, "Invalid API key")
+	apiErr := decodeAPIError(t, w.Body.Bytes())
+	if apiErr.Type != "authentication_error" || apiErr.Message != "Invalid API key" || apiErr.Code != nil || apiErr.Param != nil {
+		t.Errorf("respondWithError wrote %s", w.Body.String())
+	}
+	if !strings.Contains(w.Body.String(), `"param":null`) {
+		t.Errorf("param should be present and null: %s", w.Body.String())
+	}
+}
+
+func TestWriteStreamError(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeStreamError(w, fmt.Errorf("middleware error: %w", &MiddlewareError{Status: http.StatusBadRequest, Code: "pii_detected", Message: "blocked"}))
+	body := w.Body.String()
+	if !strings.HasPrefix(body, "data: ") || !strings.HasSuffix(body, "\n\n") {
+		t.Fatalf("not an SSE event: %q", body)
+	}
+	apiErr := decodeAPIError(t, []byte(strings.TrimPrefix(strings.TrimSpace(body), "data: ")))
+	if apiErr.Code == nil || *apiErr.Code != "pii_detected" || apiErr.Type != "invalid_request_error" {
+		t.Errorf("stream error = %+v", apiErr)
+	}
+}
+
+func TestStreamInterruptedMidway(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "4096")
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"partial\"}}]}\n\n")
+	}))
+	defer server.Close()
+	setRetryConfig(t, server.URL, 0)
+
+	p := NewProxy()
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+	upstream, err := p.openChatStream(r, "m", ChatCompletionRequest{Model: "m"}, "s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.streamChat(w, r, "m", ChatCompletionRequest{Model: "m"}, "s", upstream)
+	if err == nil {
+		t.Fatal("expected the truncated stream to fail")
+	}
+	writeStreamError(w, err)
+
+	events := strings.Split(strings.TrimSpace(w.Body.String()), "\n\n")
+	if len(events) != 2 || !strings.Contains(events[0], "partial") {
+		t.Fatalf("events = %q", events)
+	}
+	apiErr := decodeAPIError(t, []byte(strings.TrimPrefix(events[1], "data: ")))
+	if apiErr.Type != "server_error" || !strings.HasPrefix(apiErr.Message, "Stream interrupted: ") {
+		t.Errorf("stream error = %+v", apiErr)
+	}
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %d, the stream had already started", w.Code)
+	}
+}
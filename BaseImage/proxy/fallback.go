@@ -0,0 +1,223 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// chatCandidates expands the requested model into the models to try, in
+// order. "a|b" lists them explicitly; a single model is followed by its
+// configured fallbacks. Aliases are resolved for every entry.
+func chatCandidates(model string, cfg ModelsConfig) []string {
+	resolve := func(name string) string {
+		name = strings.TrimSpace(name)
+		if target, ok := cfg.Aliases[name]; ok {
+			log.Printf("Resolved model alias %s to %s", name, target)
+			return target
+		}
+		return name
+	}
+
+	var names []string
+	if strings.Contains(model, "|") {
+		names = strings.Split(model, "|")
+	} else {
+		fallbacks, ok := cfg.Fallbacks[resolve(model)]
+		if !ok {
+			fallbacks = cfg.Fallbacks[model]
+		}
+		names = append([]string{model}, fallbacks...)
+	}
+
+	var candidates []string
+	seen := make(map[string]bool)
+	for _, name := range names {
+		name = resolve(name)
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		candidates = append(candidates, name)
+	}
+	if len(candidates) == 0 {
+		return []string{model}
+	}
+	return candidates
+}
+
+// chatFailure records which step of a chat attempt failed, so the caller can
+// be answered the same way with or without fallbacks
+type chatFailure struct {
+	step string // "model", "budget", "session" or "forward"
+	err  error
+}
+
+func (e *chatFailure) Error() string {
+	return fmt.Sprintf("%s: %v", e.step, e.err)
+}
+
+// respondWithChatFailure reports the failure of the last model tried
+func respondWithChatFailure(w http.ResponseWriter, f *chatFailure) {
+	switch f.step {
+	case "model":
+		respondWithAPIError(w, http.StatusNotFound, newAPIError("invalid_request_error", "model_not_found", "model", fmt.Sprintf("Error finding model ID: %v", f.err)))
+	case "budget":
+		respondWithBudgetError(w, f.err)
+	case "session":
+		respondWithForwardError(w, "Error creating session", f.err)
+	default:
+		respondWithForwardError(w, "Error forwarding request", f.err)
+	}
+}
+
+// chatAttempt is one model tried for a chat request. On success its upstream
+// stream is open and has data, but nothing has been sent to the client.
+type chatAttempt struct {
+	index     int
+	model     string
+	modelID   string
+	sessionID string
+	upstream  *chatUpstream
+	err       *chatFailure
+}
+
+// openChat resolves model, opens a session for it unless sessionID names a
+// live one, and sends the request until the upstream stream starts
+func (p *Proxy) openChat(r *http.Request, req ChatCompletionRequest, model, sessionID string) *chatAttempt {
+	a := &chatAttempt{model: model, sessionID: sessionID}
+	req.Model = model
+
+	if sessionID != "" {
+		p.sessions.RLock()
+		session, exists := p.sessions.m[sessionID]
+		p.sessions.RUnlock()
+		if exists && time.Now().Before(session.ExpiresAt) {
+			p.logger.Printf("Using existing session: %s for model %s", sessionID, session.ModelID)
+			a.modelID = session.ModelID
+		} else {
+			p.logger.Printf("Session %s not found or expired", sessionID)
+			a.sessionID = ""
+		}
+	}
+
+	if a.sessionID == "" {
+		// Get model ID from request
+		modelID, err := p.validateModelHandle(model)
+		if err != nil {
+			p.logger.Printf("Error validating model handle: %v", err)
+			a.err = &chatFailure{step: "model", err: err}
+			return a
+		}
+		p.logger.Printf("Validated model ID: %s", modelID)
+		a.modelID = modelID
+
+		// Charge the session against MOR budgets before opening it on chain,
+		// priced on the node that will open it
+		caller := callerID(r)
+		node := p.pickSessionNode()
+		var sessionCost *big.Int
+		if p.budgets != nil {
+			sessionCost, err = p.reserveSessionBudget(node.URL, caller, modelID, model, p.cfg().Session.ExpirationSeconds)
+			if err != nil {
+				p.logger.Printf("Refusing session for model %s: %v", modelID, err)
+				a.err = &chatFailure{step: "budget", err: err}
+				return a
+			}
+		}
+
+		// Create new session
+		a.sessionID, err = p.createSessionOn(node, modelID)
+		if err != nil {
+			p.logger.Printf("Error creating session: %v", err)
+			if sessionCost != nil {
+				p.budgets.Refund(caller, modelID, model, sessionCost)
+			}
+			a.err = &chatFailure{step: "session", err: err}
+			return a
+		}
+		p.logger.Printf("Created new session: %s", a.sessionID)
+	}
+
+	upstream, err := p.openChatStream(r, a.modelID, req, a.sessionID)
+	if err != nil {
+		p.logger.Printf("Error forwarding chat request: %v", err)
+		a.err = &chatFailure{step: "forward", err: err}
+		return a
+	}
+	a.upstream = upstream
+	return a
+}
+
+// openChatCandidates tries the candidate models in order until one starts
+// streaming. sessionID, if set, is used for the first candidate. With
+// models.hedge_after set, the next candidate is also started when the current
+// one is slow, and whichever streams first wins; the others are cancelled.
+func (p *Proxy) openChatCandidates(r *http.Request, req ChatCompletionRequest, candidates []string, sessionID string) (*chatAttempt, *chatFailure) {
+	hedgeAfter := p.cfg().Models.HedgeAfter.Duration
+	results := make(chan *chatAttempt, len(candidates))
+	cancels := make([]context.CancelFunc, 0, len(candidates))
+	next, running := 0, 0
+	var hedge <-chan time.Time
+
+	launch := func() {
+		index, model, sid := next, candidates[next], ""
+		if index == 0 {
+			sid = sessionID
+		}
+		ctx, cancel := context.WithCancel(r.Context())
+		cancels = append(cancels, cancel)
+		next++
+		running++
+		go func() {
+			a := p.openChat(r.WithContext(ctx), req, model, sid)
+			a.index = index
+			results <- a
+		}()
+		if hedgeAfter > 0 && running == 1 && next < len(candidates) {
+			hedge = time.After(hedgeAfter)
+		}
+	}
+
+	launch()
+	var failure *chatFailure
+	for running > 0 {
+		select {
+		case a := <-results:
+			running--
+			if a.err == nil {
+				for i, cancel := range cancels {
+					if i != a.index {
+						cancel()
+					}
+				}
+				// Close streams that opened after the winner
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if late := <-results; late.err == nil {
+							late.upstream.close(true)
+						}
+					}
+				}(running)
+				return a, nil
+			}
+			cancels[a.index]()
+			failure = a.err
+			if running == 0 && next < len(candidates) {
+				p.logger.Printf("Model %s failed, falling back to %s", a.model, candidates[next])
+				launch()
+			}
+		case <-hedge:
+			hedge = nil
+			if next < len(candidates) {
+				p.logger.Printf("No response from %s after %v, hedging with %s", candidates[next-1], hedgeAfter, candidates[next])
+				launch()
+			}
+		}
+	}
+	return nil, failure
+}
@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChatCandidates(t *testing.T) {
+	cfg := ModelsConfig{
+		Aliases:   map[string]string{"fast": "llama3-8b", "big": "llama3-70b"},
+		Fallbacks: map[string][]string{"llama3-70b": {"fast", "mistral-7b"}},
+	}
+	tests := map[string][]string{
+		"llama3-70b":           {"llama3-70b", "llama3-8b", "mistral-7b"},
+		"big":                  {"llama3-70b", "llama3-8b", "mistral-7b"},
+		"fast":                 {"llama3-8b"},
+		"big|fast":             {"llama3-70b", "llama3-8b"},
+		"mistral-7b | big|big": {"mistral-7b", "llama3-70b"},
+		"":                     {""},
+	}
+	for model, want := range tests {
+		if got := chatCandidates(model, cfg); !reflect.DeepEqual(got, want) {
+			t.Errorf("chatCandidates(%q) = %v, want %v", model, got, want)
+		}
+	}
+}
+
+// newFallbackMarketplace serves two models. Chat requests on the big model's
+// session are handled by big; the small model answers at once.
+func newFallbackMarketplace(t *testing.T, big http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/blockchain/models":
+			json.NewEncoder(w).Encode(map[string][]ModelInfo{
+				"models": {{Id: "fb-big", Name: "Fallback Big"}, {Id: "fb-small", Name: "Fallback Small"}},
+			})
+		case "/blockchain/models/fb-big/session":
+			fmt.Fprint(w, `{"sessionId":"fb-big-session"}`)
+		case "/blockchain/models/fb-small/session":
+			fmt.Fprint(w, `{"sessionId":"fb-small-session"}`)
+		case "/v1/chat/completions":
+			if r.Header.Get("session_id") == "fb-big-session" {
+				big(w, r)
+				return
+			}
+			fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"small\"}}]}\n\ndata: [DONE]\n\n")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(func() {
+		server.Close()
+		sessionCache.Lock()
+		delete(sessionCache.m, "fb-big-session")
+		delete(sessionCache.m, "fb-small-session")
+		sessionCache.Unlock()
+	})
+	return server
+}
+
+func TestChatFallback(t *testing.T) {
+	server := newFallbackMarketplace(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error":"no provider available"}`, http.StatusServiceUnavailable)
+	})
+	setRetryConfig(t, server.URL, 0)
+
+	body := `{"model":"Fallback Big|Fallback Small","messages":[{"role":"user","content":"Hi"}]}`
+	w := httptest.NewRecorder()
+	NewProxy().handleChatCompletions(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body)))
+	if w.Code != http.StatusOK || w.Header().Get("X-NFA-Model") != "Fallback Small" || StreamCompletion(w.Body.Bytes()) != "small" {
+		t.Errorf("status = %d, model = %q, body = %s", w.Code, w.Header().Get("X-NFA-Model"), w.Body.String())
+	}
+
+	// When every model fails, the last failure is reported
+	body = `{"model":"Fallback Big|Missing Model","messages":[{"role":"user","content":"Hi"}]}`
+	w = httptest.NewRecorder()
+	NewProxy().handleChatCompletions(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body)))
+	if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), `"code":"model_not_found"`) {
+		t.Errorf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+}
+
+func TestChatHedging(t *testing.T) {
+	cancelled := make(chan struct{})
+	server := newFallbackMarketplace(t, func(w http.ResponseWriter, r *http.Request) {
+		// The server only notices the client going away once the body is read
+		io.ReadAll(r.Body)
+		select {
+		case <-r.Context().Done():
+			close(cancelled)
+		case <-time.After(5 * time.Second):
+			fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"big\"}}]}\n\ndata: [DONE]\n\n")
+		}
+	})
+	cfg := setRetryConfig(t, server.URL, 0)
+	cfg.Models.Fallbacks = map[string][]string{"Fallback Big": {"Fallback Small"}}
+	cfg.Models.HedgeAfter = Duration{20 * time.Millisecond}
+
+	body := `{"model":"Fallback Big","messages":[{"role":"user","content":"Hi"}]}`
+	w := httptest.NewRecorder()
+	start := time.Now()
+	NewProxy().handleChatCompletions(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body)))
+	if w.Code != http.StatusOK || StreamCompletion(w.Body.Bytes()) != "small" || time.Since(start) > 2*time.Second {
+		t.Errorf("status = %d, body = %s, took %v", w.Code, w.Body.String(), time.Since(start))
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(2 * time.Second):
+		t.Error("slow model request was not cancelled")
+	}
+}
@@ -0,0 +1,302 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// File is an uploaded batch input or a batch result, as returned by /v1/files
+type File struct {
+	ID        string `json:"id"`
+	Object    string `json:"object"`
+	Bytes     int64  `json:"bytes"`
+	CreatedAt int64  `json:"created_at"`
+	Filename  string `json:"filename"`
+	// Purpose is batch for uploads, batch_output for results
+	Purpose string `json:"purpose"`
+
+	Owner string `json:"-"`
+}
+
+// fileRecord is how a File's metadata is stored, including its owner
+type fileRecord struct {
+	File
+	Owner string `json:"owner"`
+}
+
+// ErrFileNotFound is returned for unknown file IDs
+var ErrFileNotFound = errors.New("file not found")
+
+var fileIDPattern = regexp.MustCompile(`^file-[0-9a-f]{24}$`)
+
+// fileStore keeps file content and metadata side by side in a directory
+type fileStore struct {
+	dir string
+}
+
+func newFileStore(dir string) (*fileStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &fileStore{dir: dir}, nil
+}
+
+func (s *fileStore) contentPath(id string) string {
+	return filepath.Join(s.dir, id)
+}
+
+func (s *fileStore) metaPath(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+// create stores content read from r. It fails once more than limit bytes
+// have been read.
+func (s *fileStore) create(owner, filename, purpose string, r io.Reader, limit int64) (*File, error) {
+	f := &File{ID: newObjectID("file-"), Object: "file", CreatedAt: time.Now().Unix(), Filename: filename, Purpose: purpose, Owner: owner}
+	out, err := os.OpenFile(s.contentPath(f.ID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	n, err := io.Copy(out, io.LimitReader(r, limit+1))
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && n > limit {
+		err = fmt.Errorf("file is larger than %d bytes", limit)
+	}
+	if err != nil {
+		os.Remove(s.contentPath(f.ID))
+		return nil, err
+	}
+	f.Bytes = n
+	if err := s.saveMeta(f); err != nil {
+		os.Remove(s.contentPath(f.ID))
+		return nil, err
+	}
+	return f, nil
+}
+
+// adopt moves an existing file at path into the store
+func (s *fileStore) adopt(owner, filename, purpose, path string) (*File, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	f := &File{ID: newObjectID("file-"), Object: "file", Bytes: info.Size(), CreatedAt: time.Now().Unix(), Filename: filename, Purpose: purpose, Owner: owner}
+	if err := os.Rename(path, s.contentPath(f.ID)); err != nil {
+		return nil, err
+	}
+	if err := s.saveMeta(f); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (s *fileStore) saveMeta(f *File) error {
+	data, err := json.Marshal(fileRecord{File: *f, Owner: f.Owner})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.metaPath(f.ID), data)
+}
+
+func (s *fileStore) get(id string) (*File, error) {
+	if !fileIDPattern.MatchString(id) {
+		return nil, ErrFileNotFound
+	}
+	data, err := os.ReadFile(s.metaPath(id))
+	if os.IsNotExist(err) {
+		return nil, ErrFileNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	var rec fileRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, fmt.Errorf("failed to parse file %s: %v", id, err)
+	}
+	rec.File.Owner = rec.Owner
+	return &rec.File, nil
+}
+
+func (s *fileStore) open(id string) (*os.File, error) {
+	if !fileIDPattern.MatchString(id) {
+		return nil, ErrFileNotFound
+	}
+	return os.Open(s.contentPath(id))
+}
+
+func (s *fileStore) list(owner string) ([]*File, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	files := []*File{}
+	for _, e := range entries {
+		id := strings.TrimSuffix(e.Name(), ".json")
+		if id == e.Name() || !fileIDPattern.MatchString(id) {
+			continue
+		}
+		if f, err := s.get(id); err == nil && f.Owner == owner {
+			files = append(files, f)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].CreatedAt > files[j].CreatedAt })
+	return files, nil
+}
+
+func (s *fileStore) delete(id string) error {
+	if !fileIDPattern.MatchString(id) {
+		return ErrFileNotFound
+	}
+	if err := os.Remove(s.metaPath(id)); os.IsNotExist(err) {
+		return ErrFileNotFound
+	} else if err != nil {
+		return err
+	}
+	os.Remove(s.contentPath(id))
+	return nil
+}
+
+// writeFileAtomic replaces path with data through a temporary file
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// handleFiles serves the files API:
+//
+//	POST   /v1/files               upload a file (multipart: file, purpose=batch)
+//	GET    /v1/files               list files
+//	GET    /v1/files/{id}          get a file
+//	GET    /v1/files/{id}/content  download a file
+//	DELETE /v1/files/{id}          delete a file
+func (p *Proxy) handleFiles(w http.ResponseWriter, r *http.Request) {
+	if p.batches == nil {
+		respondWithBatchDisabled(w)
+		return
+	}
+	files := p.batches.files
+	owner := HashAPIKey(callerID(r))
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/files"), "/"), "/")
+
+	if parts[0] == "" {
+		switch r.Method {
+		case http.MethodPost:
+			p.uploadFile(w, r, owner)
+		case http.MethodGet:
+			list, err := files.list(owner)
+			if err != nil {
+				p.logger.Printf("Error listing files: %v", err)
+				respondWithAPIError(w, http.StatusInternalServerError, newAPIError("server_error", "", "", "Failed to list files"))
+				return
+			}
+			writeJSON(w, map[string]interface{}{"object": "list", "data": list})
+		default:
+			respondWithAPIError(w, http.StatusMethodNotAllowed, newAPIError("invalid_request_error", "", "", "Method not allowed"))
+		}
+		return
+	}
+
+	f, err := files.get(parts[0])
+	if err == nil && f.Owner != owner {
+		err = ErrFileNotFound
+	}
+	if err != nil {
+		if errors.Is(err, ErrFileNotFound) {
+			respondWithAPIError(w, http.StatusNotFound, newAPIError("invalid_request_error", "file_not_found", "file_id", fmt.Sprintf("No file found with id %s", parts[0])))
+		} else {
+			p.logger.Printf("Error loading file %s: %v", parts[0], err)
+			respondWithAPIError(w, http.StatusInternalServerError, newAPIError("server_error", "", "", "Failed to load file"))
+		}
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		writeJSON(w, f)
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		if err := files.delete(f.ID); err != nil {
+			p.logger.Printf("Error deleting file %s: %v", f.ID, err)
+			respondWithAPIError(w, http.StatusInternalServerError, newAPIError("server_error", "", "", "Failed to delete file"))
+			return
+		}
+		writeJSON(w, map[string]interface{}{"id": f.ID, "object": "file", "deleted": true})
+	case len(parts) == 2 && parts[1] == "content" && r.Method == http.MethodGet:
+		content, err := files.open(f.ID)
+		if err != nil {
+			p.logger.Printf("Error opening file %s: %v", f.ID, err)
+			respondWithAPIError(w, http.StatusInternalServerError, newAPIError("server_error", "", "", "Failed to read file"))
+			return
+		}
+		defer content.Close()
+		w.Header().Set("Content-Type", "application/jsonl")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", f.Filename))
+		io.Copy(w, content)
+	case len(parts) <= 2:
+		respondWithAPIError(w, http.StatusMethodNotAllowed, newAPIError("invalid_request_error", "", "", "Method not allowed"))
+	default:
+		respondWithAPIError(w, http.StatusNotFound, newAPIError("not_found_error", "", "", "Unknown files endpoint"))
+	}
+}
+
+func (p *Proxy) uploadFile(w http.ResponseWriter, r *http.Request, owner string) {
+	limit := p.cfg().Batches.MaxFileBytes
+	r.Body = http.MaxBytesReader(w, r.Body, limit+1<<20)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		respondWithAPIError(w, http.StatusBadRequest, newAPIError("invalid_request_error", "", "", "Upload the file as multipart/form-data with file and purpose fields"))
+		return
+	}
+
+	// purpose must come before file so the upload can be streamed to disk
+	purpose := ""
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			respondWithAPIError(w, http.StatusBadRequest, newAPIError("invalid_request_error", "", "", fmt.Sprintf("Error reading upload: %v", err)))
+			return
+		}
+		switch part.FormName() {
+		case "purpose":
+			value, _ := io.ReadAll(io.LimitReader(part, 64))
+			purpose = strings.TrimSpace(string(value))
+		case "file":
+			if purpose != "batch" {
+				respondWithAPIError(w, http.StatusBadRequest, newAPIError("invalid_request_error", "", "purpose", "purpose must be batch and sent before file"))
+				return
+			}
+			f, err := p.batches.files.create(owner, part.FileName(), purpose, part, limit)
+			if err != nil {
+				p.logger.Printf("Error storing upload: %v", err)
+				respondWithAPIError(w, http.StatusBadRequest, newAPIError("invalid_request_error", "", "file", fmt.Sprintf("Error storing file: %v", err)))
+				return
+			}
+			p.logger.Printf("Stored file %s (%d bytes)", f.ID, f.Bytes)
+			writeJSON(w, f)
+			return
+		}
+	}
+	respondWithAPIError(w, http.StatusBadRequest, newAPIError("invalid_request_error", "", "file", "file is required"))
+}
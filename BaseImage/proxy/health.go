@@ -0,0 +1,246 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sony/gobreaker"
+)
+
+// catalog tracks the last successful model listing from the consumer node for
+// proxies created with NewProxy
+var catalog = &catalogState{}
+
+// catalogState records when the model catalog was last listed
+type catalogState struct {
+	mu        sync.Mutex
+	fetchedAt time.Time
+	models    int
+}
+
+func (c *catalogState) record(models int) {
+	c.mu.Lock()
+	c.fetchedAt = time.Now()
+	c.models = models
+	c.mu.Unlock()
+}
+
+func (c *catalogState) snapshot() (time.Time, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.fetchedAt, c.models
+}
+
+// HealthCheck is the result of one readiness check
+type HealthCheck struct {
+	Status  string                 `json:"status"`
+	Error   string                 `json:"error,omitempty"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// ReadinessReport is the /readyz response body
+type ReadinessReport struct {
+	Status    string                 `json:"status"`
+	CheckedAt time.Time              `json:"checked_at"`
+	Checks    map[string]HealthCheck `json:"checks"`
+}
+
+// Ready reports whether every check passed
+func (r *ReadinessReport) Ready() bool {
+	return r.Status == "ready"
+}
+
+func passed(details map[string]interface{}) HealthCheck {
+	return HealthCheck{Status: "ok", Details: details}
+}
+
+func failed(err string, details map[string]interface{}) HealthCheck {
+	return HealthCheck{Status: "fail", Error: err, Details: details}
+}
+
+// handleLivez reports that the process is up and serving HTTP. It checks no
+// dependencies, so an unreachable marketplace never restarts the pod.
+func handleLivez(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "alive"})
+}
+
+// readinessCache keeps the last report so frequent probes do not hit the
+// consumer node on every request
+type readinessCache struct {
+	sync.Mutex
+	report *ReadinessReport
+}
+
+// readiness is the report cache for proxies created with NewProxy
+var readiness = &readinessCache{}
+
+// handleReadyz runs the dependency checks and answers 503 when any fails.
+// Anyone can probe it, so it reports only the status of each check; balances
+// and errors are in the admin report.
+func (p *Proxy) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	report := p.readinessReport(r)
+	summary := &ReadinessReport{Status: report.Status, CheckedAt: report.CheckedAt, Checks: make(map[string]HealthCheck, len(report.Checks))}
+	for name, check := range report.Checks {
+		summary.Checks[name] = HealthCheck{Status: check.Status}
+	}
+	writeReadiness(w, summary)
+}
+
+// handleAdminReadiness reports the readiness checks with their details on
+// GET /admin/readiness
+func (p *Proxy) handleAdminReadiness(w http.ResponseWriter, r *http.Request) {
+	if !p.requireAdmin(w, r) {
+		return
+	}
+	writeReadiness(w, p.readinessReport(r))
+}
+
+// readinessReport returns the cached readiness report, checking again when
+// it is older than health.cache_ttl or the request asks for ?fresh=true
+func (p *Proxy) readinessReport(r *http.Request) *ReadinessReport {
+	ttl := p.cfg().Health.CacheTTL.Duration
+	p.readiness.Lock()
+	defer p.readiness.Unlock()
+	report := p.readiness.report
+	if report == nil || time.Since(report.CheckedAt) >= ttl || r.URL.Query().Get("fresh") == "true" {
+		report = p.checkReadiness()
+		p.readiness.report = report
+	}
+	return report
+}
+
+func writeReadiness(w http.ResponseWriter, report *ReadinessReport) {
+	w.Header().Set("Content-Type", "application/json")
+	if !report.Ready() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// checkReadiness checks consumer node reachability, catalog freshness, the
+// circuit breaker and, when minimums are configured, the wallet balance
+func (p *Proxy) checkReadiness() *ReadinessReport {
+	cfg := p.cfg()
+	report := &ReadinessReport{Status: "ready", CheckedAt: time.Now(), Checks: make(map[string]HealthCheck)}
+	client := p.httpClient(cfg.Marketplace.RequestTimeout.Duration)
+
+	start := time.Now()
+	if models, err := p.fetchModels(client); err != nil {
+		report.Checks["consumer_node"] = failed(err.Error(), nil)
+	} else {
+		report.Checks["consumer_node"] = passed(map[string]interface{}{
+			"latency_ms": time.Since(start).Milliseconds(),
+			"models":     len(models),
+		})
+	}
+
+	fetchedAt, models := p.catalog.snapshot()
+	switch {
+	case fetchedAt.IsZero():
+		report.Checks["catalog"] = failed("model catalog has not been loaded", nil)
+	case time.Since(fetchedAt) > cfg.Health.CatalogMaxAge.Duration:
+		report.Checks["catalog"] = failed(fmt.Sprintf("model catalog is older than %s", cfg.Health.CatalogMaxAge), map[string]interface{}{
+			"age_seconds": int64(time.Since(fetchedAt).Seconds()),
+		})
+	case models == 0:
+		report.Checks["catalog"] = failed("consumer node lists no models", nil)
+	default:
+		report.Checks["catalog"] = passed(map[string]interface{}{
+			"age_seconds": int64(time.Since(fetchedAt).Seconds()),
+			"models":      models,
+		})
+	}
+
+	state := p.breaker.State()
+	if state == gobreaker.StateOpen {
+		report.Checks["circuit_breaker"] = failed("marketplace circuit breaker is open", map[string]interface{}{"state": state.String()})
+	} else {
+		report.Checks["circuit_breaker"] = passed(map[string]interface{}{"state": state.String()})
+	}
+
+	if cfg.Health.MinMOR != "" || cfg.Health.MinETH != "" {
+		report.Checks["balance"] = p.checkBalance(client, cfg.Health)
+	}
+
+	for _, check := range report.Checks {
+		if check.Status != "ok" {
+			report.Status = "not_ready"
+		}
+	}
+	return report
+}
+
+// checkBalance compares the wallet's /blockchain/balance with the minimums
+func (p *Proxy) checkBalance(client *http.Client, cfg HealthConfig) HealthCheck {
+	eth, mor, err := p.getWalletBalance(client)
+	if err != nil {
+		return failed(err.Error(), nil)
+	}
+	details := map[string]interface{}{"eth": formatMOR(eth), "mor": formatMOR(mor)}
+	var problems []string
+	for _, b := range []struct {
+		key, name string
+		balance   *big.Int
+		min       string
+	}{{"min_mor", "MOR", mor, cfg.MinMOR}, {"min_eth", "ETH", eth, cfg.MinETH}} {
+		min, _ := parseMOR(b.min)
+		if min == nil {
+			continue
+		}
+		details[b.key] = b.min
+		if b.balance.Cmp(min) < 0 {
+			problems = append(problems, fmt.Sprintf("%s balance %s is below %s", b.name, formatMOR(b.balance), b.min))
+		}
+	}
+	if len(problems) > 0 {
+		return failed(strings.Join(problems, "; "), details)
+	}
+	return passed(details)
+}
+
+// getWalletBalance returns the wallet's ETH and MOR balances in wei
+func (p *Proxy) getWalletBalance(client *http.Client) (eth, mor *big.Int, err error) {
+	return getNodeBalance(client, p.getMarketplaceBaseURL())
+}
+
+// getNodeBalance returns the ETH and MOR balances in wei of the wallet of the
+// consumer node at baseURL
+func getNodeBalance(client *http.Client, baseURL string) (eth, mor *big.Int, err error) {
+	resp, err := client.Get(fmt.Sprintf("%s/blockchain/balance", baseURL))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to fetch balance: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read balance: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("failed to fetch balance, status: %d", resp.StatusCode)
+	}
+
+	var result struct {
+		ETH json.RawMessage `json:"ETH"`
+		MOR json.RawMessage `json:"MOR"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode balance: %v", err)
+	}
+	eth, ok := parseWei(result.ETH)
+	if !ok {
+		return nil, nil, fmt.Errorf("invalid ETH balance: %s", string(result.ETH))
+	}
+	mor, ok = parseWei(result.MOR)
+	if !ok {
+		return nil, nil, fmt.Errorf("invalid MOR balance: %s", string(result.MOR))
+	}
+	return eth, mor, nil
+}
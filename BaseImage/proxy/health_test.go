@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// readyz returns the detailed readiness report from the admin API
+func readyz(t *testing.T, p *Proxy) (int, ReadinessReport) {
+	t.Helper()
+	t.Setenv("ADMIN_API_KEY", "admin")
+	req := httptest.NewRequest(http.MethodGet, "/admin/readiness?fresh=true", nil)
+	req.Header.Set("Authorization", "Bearer admin")
+	w := httptest.NewRecorder()
+	p.handleAdminReadiness(w, req)
+	var report ReadinessReport
+	if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+		t.Fatalf("invalid readiness body: %v", err)
+	}
+	return w.Code, report
+}
+
+func TestReadyz(t *testing.T) {
+	models := `{"models":[{"Id":"0x1","Name":"llama"}]}`
+	marketplace := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/blockchain/models":
+			w.Write([]byte(models))
+		case "/blockchain/balance":
+			w.Write([]byte(`{"ETH":"50000000000000000","MOR":"2500000000000000000"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Setenv("MARKETPLACE_URL", marketplace.URL)
+	t.Setenv("CONSUMER_NODE_URL", "")
+	t.Setenv("READY_MIN_MOR", "1")
+	t.Setenv("READY_MIN_ETH", "")
+	p := NewProxy()
+
+	code, report := readyz(t, p)
+	if code != http.StatusOK || !report.Ready() {
+		t.Fatalf("status = %d, report = %+v; want ready", code, report)
+	}
+	for _, name := range []string{"consumer_node", "catalog", "circuit_breaker", "balance"} {
+		if report.Checks[name].Status != "ok" {
+			t.Errorf("check %s = %+v", name, report.Checks[name])
+		}
+	}
+	if report.Checks["balance"].Details["mor"] != "2.5" {
+		t.Errorf("balance details = %+v", report.Checks["balance"].Details)
+	}
+
+	// A balance under the minimum makes the pod unready
+	t.Setenv("READY_MIN_ETH", "0.1")
+	code, report = readyz(t, p)
+	if code != http.StatusServiceUnavailable || report.Checks["balance"].Status != "fail" {
+		t.Errorf("status = %d, balance = %+v; want a failed balance check", code, report.Checks["balance"])
+	}
+	t.Setenv("READY_MIN_ETH", "")
+
+	// An empty catalog is not ready either
+	models = `{"models":[]}`
+	if code, report = readyz(t, p); code != http.StatusServiceUnavailable || report.Checks["catalog"].Status != "fail" {
+		t.Errorf("status = %d, catalog = %+v; want a failed catalog check", code, report.Checks["catalog"])
+	}
+
+	marketplace.Close()
+	code, report = readyz(t, p)
+	if code != http.StatusServiceUnavailable || report.Checks["consumer_node"].Status != "fail" {
+		t.Errorf("status = %d, consumer_node = %+v; want unreachable", code, report.Checks["consumer_node"])
+	}
+
+	// The public probe shows only the status of each check
+	w := httptest.NewRecorder()
+	p.handleReadyz(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	var public ReadinessReport
+	json.NewDecoder(w.Body).Decode(&public)
+	if w.Code != http.StatusServiceUnavailable || public.Checks["consumer_node"].Status != "fail" {
+		t.Errorf("status = %d, report = %+v", w.Code, public)
+	}
+	for name, check := range public.Checks {
+		if check.Error != "" || check.Details != nil {
+			t.Errorf("public check %s = %+v", name, check)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	p.handleAdminReadiness(w, httptest.NewRequest(http.MethodGet, "/admin/readiness", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("admin report without a key: status = %d", w.Code)
+	}
+}
+
+func TestReadyzStaleCatalog(t *testing.T) {
+	t.Setenv("MARKETPLACE_URL", "http://127.0.0.1:1")
+	catalog.mu.Lock()
+	catalog.fetchedAt = time.Now().Add(-time.Hour)
+	catalog.models = 3
+	catalog.mu.Unlock()
+
+	_, report := readyz(t, NewProxy())
+	if report.Checks["catalog"].Status != "fail" || report.Checks["catalog"].Details["age_seconds"] == nil {
+		t.Errorf("catalog = %+v; want stale", report.Checks["catalog"])
+	}
+	if _, ok := report.Checks["balance"]; ok {
+		t.Error("balance check should be skipped without minimums")
+	}
+}
+
+func TestLivez(t *testing.T) {
+	w := httptest.NewRecorder()
+	handleLivez(w, httptest.NewRequest(http.MethodGet, "/livez", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "{\"status\":\"alive\"}\n" {
+		t.Errorf("livez = %d %q", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,522 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Middleware inspects and modifies chat requests before they are forwarded to
+// the marketplace, and the streamed response on its way back to the caller.
+// Chains run in order for requests and responses alike.
+type Middleware interface {
+	// ProcessRequest may modify req. Returning an error rejects the request;
+	// use a *MiddlewareError to control the status code.
+	ProcessRequest(cc *ChatContext, req *ChatCompletionRequest) error
+	// ProcessResponse is called for every streamed line, then once with
+	// chunk.Final set when the stream ends. It may rewrite or drop chunk.Data,
+	// and may set Data on the final chunk to send one more line.
+	ProcessResponse(cc *ChatContext, chunk *StreamChunk) error
+}
+
+// MiddlewareFuncs adapts plain functions to Middleware. Nil funcs are skipped.
+type MiddlewareFuncs struct {
+	Request  func(cc *ChatContext, req *ChatCompletionRequest) error
+	Response func(cc *ChatContext, chunk *StreamChunk) error
+}
+
+// ProcessRequest implements Middleware
+func (m MiddlewareFuncs) ProcessRequest(cc *ChatContext, req *ChatCompletionRequest) error {
+	if m.Request == nil {
+		return nil
+	}
+	return m.Request(cc, req)
+}
+
+// ProcessResponse implements Middleware
+func (m MiddlewareFuncs) ProcessResponse(cc *ChatContext, chunk *StreamChunk) error {
+	if m.Response == nil {
+		return nil
+	}
+	return m.Response(cc, chunk)
+}
+
+// MiddlewareError rejects a request with an OpenAI-style error
+type MiddlewareError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *MiddlewareError) Error() string {
+	return e.Message
+}
+
+// ChatContext carries per-request state through a middleware chain
+type ChatContext struct {
+	Request *http.Request
+	Caller  string
+	// Model is the requested model name after alias resolution
+	Model string
+	// ModelID and SessionID are set once the request is about to be forwarded
+	ModelID   string
+	SessionID string
+	// UpstreamHeader is added to the request forwarded to the marketplace
+	UpstreamHeader http.Header
+	// ResponseHeader is the header of the response to the caller
+	ResponseHeader http.Header
+
+	values     map[string]interface{}
+	completion strings.Builder
+}
+
+// Set stores a value for later middleware calls on the same request
+func (cc *ChatContext) Set(key string, value interface{}) {
+	if cc.values == nil {
+		cc.values = make(map[string]interface{})
+	}
+	cc.values[key] = value
+}
+
+// Get returns a value stored with Set
+func (cc *ChatContext) Get(key string) interface{} {
+	return cc.values[key]
+}
+
+// Completion returns the completion text streamed so far
+func (cc *ChatContext) Completion() string {
+	return cc.completion.String()
+}
+
+// StreamChunk is one line of the upstream response, normally an SSE
+// "data: {...}" line including its trailing newline
+type StreamChunk struct {
+	Data  []byte
+	Final bool
+}
+
+// JSON decodes the chunk's SSE data payload. It reports false for [DONE],
+// comments and other non-JSON lines.
+func (c *StreamChunk) JSON() (map[string]interface{}, bool) {
+	payload := bytes.TrimSpace(bytes.TrimPrefix(bytes.TrimSpace(c.Data), []byte("data:")))
+	if len(payload) == 0 || payload[0] != '{' {
+		return nil, false
+	}
+	var v map[string]interface{}
+	if err := json.Unmarshal(payload, &v); err != nil {
+		return nil, false
+	}
+	return v, true
+}
+
+// SetJSON replaces the chunk with an SSE data line holding v
+func (c *StreamChunk) SetJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	c.Data = append(append([]byte("data: "), data...), '\n')
+	return nil
+}
+
+// MiddlewareConfig configures one middleware in a chain. Type selects the
+// middleware; the remaining keys are its options.
+type MiddlewareConfig struct {
+	Type string
+	raw  json.RawMessage
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (c *MiddlewareConfig) UnmarshalJSON(data []byte) error {
+	var t struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(data, &t); err != nil {
+		return err
+	}
+	c.Type = t.Type
+	c.raw = append(json.RawMessage(nil), data...)
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler
+func (c MiddlewareConfig) MarshalJSON() ([]byte, error) {
+	if c.raw == nil {
+		return json.Marshal(map[string]string{"type": c.Type})
+	}
+	return c.raw, nil
+}
+
+// Decode decodes the options into v, rejecting unknown keys
+func (c MiddlewareConfig) Decode(v interface{}) error {
+	options := make(map[string]json.RawMessage)
+	if c.raw != nil {
+		if err := json.Unmarshal(c.raw, &options); err != nil {
+			return err
+		}
+	}
+	delete(options, "type")
+	data, _ := json.Marshal(options)
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// MiddlewareFactory builds a middleware from its config
+type MiddlewareFactory func(cfg MiddlewareConfig) (Middleware, error)
+
+var middlewareTypes = struct {
+	sync.RWMutex
+	m map[string]MiddlewareFactory
+}{m: map[string]MiddlewareFactory{
+	"system_prompt": newSystemPromptMiddleware,
+	"max_messages":  newMaxMessagesMiddleware,
+	"header_stamp":  newHeaderStampMiddleware,
+	"pii":           newPIIMiddleware,
+}}
+
+// RegisterMiddlewareType makes a middleware type available to the middleware
+// config section. Call it before the config is loaded.
+func RegisterMiddlewareType(name string, factory MiddlewareFactory) {
+	middlewareTypes.Lock()
+	defer middlewareTypes.Unlock()
+	middlewareTypes.m[name] = factory
+}
+
+// middlewareChains maps lowercased model names, or "*" for every model, to
+// their ordered chains
+type middlewareChains map[string][]Middleware
+
+func newMiddlewareChains(cfg map[string][]MiddlewareConfig) (middlewareChains, error) {
+	chains := make(middlewareChains)
+	var errs []error
+	models := make([]string, 0, len(cfg))
+	for model := range cfg {
+		models = append(models, model)
+	}
+	sort.Strings(models)
+	for _, model := range models {
+		for i, mc := range cfg[model] {
+			middlewareTypes.RLock()
+			factory, ok := middlewareTypes.m[mc.Type]
+			middlewareTypes.RUnlock()
+			if !ok {
+				errs = append(errs, fmt.Errorf("%s[%d]: unknown middleware type %q", model, i, mc.Type))
+				continue
+			}
+			m, err := factory(mc)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s[%d] %s: %v", model, i, mc.Type, err))
+				continue
+			}
+			key := strings.ToLower(model)
+			chains[key] = append(chains[key], m)
+		}
+	}
+	return chains, errors.Join(errs...)
+}
+
+// middlewareRegistry holds the chains from config and those added with Use
+type middlewareRegistry struct {
+	configured atomic.Pointer[middlewareChains]
+	mu         sync.RWMutex
+	used       middlewareChains
+}
+
+// Use appends middleware to the chain for model, or for every model when
+// model is "*". Chains for "*" run before model specific ones, and chains
+// from config run before those added with Use.
+func (p *Proxy) Use(model string, m ...Middleware) {
+	p.middleware.mu.Lock()
+	defer p.middleware.mu.Unlock()
+	if p.middleware.used == nil {
+		p.middleware.used = make(middlewareChains)
+	}
+	key := strings.ToLower(model)
+	p.middleware.used[key] = append(p.middleware.used[key], m...)
+}
+
+func (p *Proxy) setMiddlewareConfig(chains middlewareChains) {
+	p.middleware.configured.Store(&chains)
+}
+
+// middlewareChain returns the chain that applies to model
+func (p *Proxy) middlewareChain(model string) []Middleware {
+	var configured middlewareChains
+	if c := p.middleware.configured.Load(); c != nil {
+		configured = *c
+	}
+	p.middleware.mu.RLock()
+	defer p.middleware.mu.RUnlock()
+
+	var chain []Middleware
+	for _, key := range []string{"*", strings.ToLower(model)} {
+		chain = append(chain, configured[key]...)
+		chain = append(chain, p.middleware.used[key]...)
+	}
+	return chain
+}
+
+type chatContextKey struct{}
+
+// chatPipeline runs a middleware chain over one request and its response
+type chatPipeline struct {
+	cc    *ChatContext
+	chain []Middleware
+	done  bool
+}
+
+func pipelineFrom(ctx context.Context) *chatPipeline {
+	p, _ := ctx.Value(chatContextKey{}).(*chatPipeline)
+	return p
+}
+
+func (pl *chatPipeline) processRequest(req *ChatCompletionRequest) error {
+	for _, m := range pl.chain {
+		if err := m.ProcessRequest(pl.cc, req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// processLine runs one upstream line through the chain and returns what to
+// send to the caller. The [DONE] marker triggers the final call first.
+func (pl *chatPipeline) processLine(line []byte) ([]byte, error) {
+	if pl == nil || len(pl.chain) == 0 {
+		return line, nil
+	}
+	if len(bytes.TrimSpace(line)) == 0 {
+		return line, nil
+	}
+	if bytes.Equal(bytes.TrimSpace(line), []byte("data: [DONE]")) {
+		final, err := pl.finish()
+		return append(final, line...), err
+	}
+
+	chunk := &StreamChunk{Data: line}
+	if data, ok := chunk.JSON(); ok {
+		pl.cc.completion.WriteString(chunkContent(data))
+	}
+	for _, m := range pl.chain {
+		if err := m.ProcessResponse(pl.cc, chunk); err != nil {
+			return nil, err
+		}
+		if chunk.Data == nil {
+			return nil, nil
+		}
+	}
+	return chunk.Data, nil
+}
+
+// reset prepares the pipeline to process another response to the same request
+func (pl *chatPipeline) reset() {
+	if pl == nil {
+		return
+	}
+	pl.done = false
+	pl.cc.completion.Reset()
+}
+
+// finish makes the final middleware call once and returns any extra lines,
+// each followed by the blank line that ends an SSE event
+func (pl *chatPipeline) finish() ([]byte, error) {
+	if pl == nil || pl.done || len(pl.chain) == 0 {
+		return nil, nil
+	}
+	pl.done = true
+	var out []byte
+	for _, m := range pl.chain {
+		chunk := &StreamChunk{Final: true}
+		if err := m.ProcessResponse(pl.cc, chunk); err != nil {
+			return out, err
+		}
+		if chunk.Data != nil {
+			out = append(out, chunk.Data...)
+			out = append(out, '\n')
+		}
+	}
+	return out, nil
+}
+
+// chunkContent returns the delta or message text of a decoded chunk
+func chunkContent(data map[string]interface{}) string {
+	choices, _ := data["choices"].([]interface{})
+	var sb strings.Builder
+	for _, c := range choices {
+		choice, _ := c.(map[string]interface{})
+		for _, field := range []string{"delta", "message"} {
+			if m, ok := choice[field].(map[string]interface{}); ok {
+				if s, ok := m["content"].(string); ok {
+					sb.WriteString(s)
+				}
+			}
+		}
+		if s, ok := choice["text"].(string); ok {
+			sb.WriteString(s)
+		}
+	}
+	return sb.String()
+}
+
+// SystemPromptMiddleware injects a system message
+type SystemPromptMiddleware struct {
+	Content string `json:"content"`
+	// Mode is "prepend" (default) to add a system message before the
+	// conversation, "replace" to replace any system messages, or "append" to
+	// add it to the end of an existing first system message.
+	Mode string `json:"mode"`
+}
+
+func newSystemPromptMiddleware(cfg MiddlewareConfig) (Middleware, error) {
+	m := &SystemPromptMiddleware{}
+	if err := cfg.Decode(m); err != nil {
+		return nil, err
+	}
+	if m.Content == "" {
+		return nil, errors.New("content is required")
+	}
+	switch m.Mode {
+	case "", "prepend", "replace", "append":
+	default:
+		return nil, fmt.Errorf("invalid mode %q, expected prepend, replace or append", m.Mode)
+	}
+	return m, nil
+}
+
+// ProcessRequest implements Middleware
+func (m *SystemPromptMiddleware) ProcessRequest(cc *ChatContext, req *ChatCompletionRequest) error {
+	system := Message{Role: "system", Content: m.Content}
+	switch m.Mode {
+	case "replace":
+		messages := []Message{system}
+		for _, msg := range req.Messages {
+			if msg.Role != "system" {
+				messages = append(messages, msg)
+			}
+		}
+		req.Messages = messages
+	case "append":
+		if len(req.Messages) > 0 && req.Messages[0].Role == "system" {
+			req.Messages[0].Content += "\n\n" + m.Content
+			return nil
+		}
+		req.Messages = append([]Message{system}, req.Messages...)
+	default:
+		req.Messages = append([]Message{system}, req.Messages...)
+	}
+	return nil
+}
+
+// ProcessResponse implements Middleware
+func (m *SystemPromptMiddleware) ProcessResponse(cc *ChatContext, chunk *StreamChunk) error {
+	return nil
+}
+
+// MaxMessagesMiddleware limits the number of messages in a request
+type MaxMessagesMiddleware struct {
+	Max int `json:"max"`
+	// Action is "reject" (default) or "truncate", which drops the oldest
+	// non-system messages
+	Action string `json:"action"`
+}
+
+func newMaxMessagesMiddleware(cfg MiddlewareConfig) (Middleware, error) {
+	m := &MaxMessagesMiddleware{}
+	if err := cfg.Decode(m); err != nil {
+		return nil, err
+	}
+	if m.Max < 1 {
+		return nil, errors.New("max must be at least 1")
+	}
+	if m.Action != "" && m.Action != "reject" && m.Action != "truncate" {
+		return nil, fmt.Errorf("invalid action %q, expected reject or truncate", m.Action)
+	}
+	return m, nil
+}
+
+// ProcessRequest implements Middleware
+func (m *MaxMessagesMiddleware) ProcessRequest(cc *ChatContext, req *ChatCompletionRequest) error {
+	if len(req.Messages) <= m.Max {
+		return nil
+	}
+	if m.Action != "truncate" {
+		return &MiddlewareError{
+			Status:  http.StatusBadRequest,
+			Code:    "too_many_messages",
+			Message: fmt.Sprintf("Request has %d messages, the limit for %s is %d", len(req.Messages), cc.Model, m.Max),
+		}
+	}
+
+	var system, rest []Message
+	for _, msg := range req.Messages {
+		if msg.Role == "system" {
+			system = append(system, msg)
+		} else {
+			rest = append(rest, msg)
+		}
+	}
+	keep := m.Max - len(system)
+	if keep < 1 {
+		keep = 1
+	}
+	if len(rest) > keep {
+		rest = rest[len(rest)-keep:]
+	}
+	req.Messages = append(system, rest...)
+	return nil
+}
+
+// ProcessResponse implements Middleware
+func (m *MaxMessagesMiddleware) ProcessResponse(cc *ChatContext, chunk *StreamChunk) error {
+	return nil
+}
+
+// HeaderStampMiddleware sets headers on the forwarded request and on the
+// response. Values may use {caller}, {model} and {request_id}.
+type HeaderStampMiddleware struct {
+	Upstream map[string]string `json:"upstream"`
+	Response map[string]string `json:"response"`
+}
+
+func newHeaderStampMiddleware(cfg MiddlewareConfig) (Middleware, error) {
+	m := &HeaderStampMiddleware{}
+	if err := cfg.Decode(m); err != nil {
+		return nil, err
+	}
+	if len(m.Upstream) == 0 && len(m.Response) == 0 {
+		return nil, errors.New("upstream or response headers are required")
+	}
+	return m, nil
+}
+
+func (m *HeaderStampMiddleware) expand(cc *ChatContext, value string) string {
+	return strings.NewReplacer(
+		"{caller}", cc.Caller,
+		"{model}", cc.Model,
+		"{request_id}", cc.ResponseHeader.Get("X-Request-ID"),
+	).Replace(value)
+}
+
+// ProcessRequest implements Middleware
+func (m *HeaderStampMiddleware) ProcessRequest(cc *ChatContext, req *ChatCompletionRequest) error {
+	for name, value := range m.Upstream {
+		cc.UpstreamHeader.Set(name, m.expand(cc, value))
+	}
+	for name, value := range m.Response {
+		cc.ResponseHeader.Set(name, m.expand(cc, value))
+	}
+	return nil
+}
+
+// ProcessResponse implements Middleware
+func (m *HeaderStampMiddleware) ProcessResponse(cc *ChatContext, chunk *StreamChunk) error {
+	return nil
+}
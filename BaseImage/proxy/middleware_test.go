@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMiddlewareConfig(t *testing.T) {
+	path := writeConfigFile(t, "nfa.yaml", `
+middleware:
+  "*":
+    - type: header_stamp
+      response: {X-Served-By: nfa}
+  Llama-3:
+    - type: system_prompt
+      content: Be brief.
+    - type: max_messages
+      max: 4
+      action: truncate
+`)
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+	chains, _ := newMiddlewareChains(cfg.Middleware)
+	if len(chains["*"]) != 1 || len(chains["llama-3"]) != 2 {
+		t.Errorf("unexpected chains: %+v", chains)
+	}
+	if mm, ok := chains["llama-3"][1].(*MaxMessagesMiddleware); !ok || mm.Max != 4 || mm.Action != "truncate" {
+		t.Errorf("max_messages options not decoded: %+v", chains["llama-3"][1])
+	}
+
+	tests := map[string]string{
+		"unknown type":   "middleware:\n  \"*\":\n    - type: nope\n",
+		"unknown option": "middleware:\n  \"*\":\n    - type: max_messages\n      max: 2\n      limit: 3\n",
+		"invalid option": "middleware:\n  \"*\":\n    - type: system_prompt\n",
+	}
+	for name, content := range tests {
+		t.Run(name, func(t *testing.T) {
+			cfg, err := LoadConfig(writeConfigFile(t, "nfa.yaml", content))
+			if err == nil {
+				err = cfg.Validate()
+			}
+			if err == nil || !strings.Contains(err.Error(), "middleware") {
+				t.Errorf("expected a middleware error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestMiddlewareChain(t *testing.T) {
+	var upstream struct {
+		Messages []Message `json:"messages"`
+	}
+	var upstreamHeader http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHeader = r.Header
+		json.NewDecoder(r.Body).Decode(&upstream)
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"hello\"}}]}\n\n")
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\" world\"}}]}\n\n")
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer server.Close()
+	t.Setenv("MARKETPLACE_URL", server.URL)
+
+	sessionCache.Lock()
+	sessionCache.m["mw-session"] = CachedSession{SessionID: "mw-session", ModelID: "mw-model", ExpiresAt: time.Now().Add(time.Hour)}
+	sessionCache.Unlock()
+	defer func() {
+		sessionCache.Lock()
+		delete(sessionCache.m, "mw-session")
+		sessionCache.Unlock()
+	}()
+
+	p := NewProxy()
+	chains, err := newMiddlewareChains(map[string][]MiddlewareConfig{
+		"*":       {mustMiddlewareConfig(t, `{"type":"header_stamp","upstream":{"X-Agent":"{caller}"},"response":{"X-Model":"{model}"}}`)},
+		"mw test": {mustMiddlewareConfig(t, `{"type":"system_prompt","content":"Be brief."}`)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.setMiddlewareConfig(chains)
+
+	var seen *ChatContext
+	p.Use("MW Test", MiddlewareFuncs{
+		Response: func(cc *ChatContext, chunk *StreamChunk) error {
+			seen = cc
+			if chunk.Final {
+				return chunk.SetJSON(map[string]interface{}{"summary": cc.Completion()})
+			}
+			data, ok := chunk.JSON()
+			if !ok {
+				return nil
+			}
+			delta := data["choices"].([]interface{})[0].(map[string]interface{})["delta"].(map[string]interface{})
+			delta["content"] = strings.ToUpper(delta["content"].(string))
+			return chunk.SetJSON(data)
+		},
+	})
+
+	body := `{"model":"MW Test","messages":[{"role":"user","content":"Hi"}]}`
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+	req.Header.Set("session_id", "mw-session")
+	req.Header.Set("Authorization", "Bearer agent-7")
+	w := httptest.NewRecorder()
+	p.handleChatCompletions(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+	}
+	if len(upstream.Messages) != 2 || upstream.Messages[0].Role != "system" || upstream.Messages[0].Content != "Be brief." {
+		t.Errorf("system prompt not injected: %+v", upstream.Messages)
+	}
+	if upstreamHeader.Get("X-Agent") != tokenFingerprint("agent-7") || w.Header().Get("X-Model") != "MW Test" {
+		t.Errorf("headers not stamped: upstream %v, response %v", upstreamHeader, w.Header())
+	}
+	if seen == nil || seen.ModelID != "mw-model" || seen.SessionID != "mw-session" {
+		t.Errorf("unexpected chat context: %+v", seen)
+	}
+	out := w.Body.String()
+	if !strings.Contains(out, `"content":"HELLO"`) || !strings.Contains(out, `"content":" WORLD"`) {
+		t.Errorf("chunks not rewritten: %s", out)
+	}
+	if !strings.Contains(out, "data: {\"summary\":\"hello world\"}\n\ndata: [DONE]") {
+		t.Errorf("final chunk should come before [DONE]: %s", out)
+	}
+}
+
+func TestMaxMessagesMiddleware(t *testing.T) {
+	messages := []Message{{Role: "system", Content: "s"}, {Role: "user", Content: "1"}, {Role: "assistant", Content: "2"}, {Role: "user", Content: "3"}}
+
+	reject := &MaxMessagesMiddleware{Max: 3}
+	req := &ChatCompletionRequest{Messages: messages}
+	err := reject.ProcessRequest(&ChatContext{Model: "m"}, req)
+	if mwErr, ok := err.(*MiddlewareError); !ok || mwErr.Status != http.StatusBadRequest {
+		t.Errorf("expected a 400 rejection, got %v", err)
+	}
+
+	truncate := &MaxMessagesMiddleware{Max: 3, Action: "truncate"}
+	req = &ChatCompletionRequest{Messages: append([]Message(nil), messages...)}
+	if err := truncate.ProcessRequest(&ChatContext{}, req); err != nil {
+		t.Fatal(err)
+	}
+	if len(req.Messages) != 3 || req.Messages[0].Role != "system" || req.Messages[1].Content != "2" {
+		t.Errorf("unexpected truncation: %+v", req.Messages)
+	}
+}
+
+func TestHandleChatCompletionsMiddlewareRejects(t *testing.T) {
+	p := NewProxy()
+	p.Use("*", &MaxMessagesMiddleware{Max: 1})
+	body := `{"model":"any","messages":[{"role":"user","content":"1"},{"role":"user","content":"2"}]}`
+	w := httptest.NewRecorder()
+	p.handleChatCompletions(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body)))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "too_many_messages") {
+		t.Errorf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+}
+
+func mustMiddlewareConfig(t *testing.T, raw string) MiddlewareConfig {
+	t.Helper()
+	var mc MiddlewareConfig
+	if err := json.Unmarshal([]byte(raw), &mc); err != nil {
+		t.Fatal(err)
+	}
+	return mc
+}
@@ -0,0 +1,201 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// NFTGateConfig restricts wallet-authenticated callers to holders of an NFA
+// token. With TokenIDs set the caller must own one of those tokens, otherwise
+// any token of Contract is enough.
+type NFTGateConfig struct {
+	RPCURL          string   `json:"rpc_url"`
+	Contract        string   `json:"contract"`
+	TokenIDs        []string `json:"token_ids"`
+	CacheTTLSeconds int      `json:"cache_ttl_seconds"`
+}
+
+// ErrNotTokenHolder is returned when a caller does not hold the required token
+var ErrNotTokenHolder = errors.New("caller does not hold the required NFA token")
+
+const erc721ABI = `[
+	{"type":"function","name":"ownerOf","stateMutability":"view","inputs":[{"name":"tokenId","type":"uint256"}],"outputs":[{"name":"","type":"address"}]},
+	{"type":"function","name":"balanceOf","stateMutability":"view","inputs":[{"name":"owner","type":"address"}],"outputs":[{"name":"","type":"uint256"}]}
+]`
+
+var parsedERC721ABI = func() abi.ABI {
+	parsed, err := abi.JSON(strings.NewReader(erc721ABI))
+	if err != nil {
+		panic(err)
+	}
+	return parsed
+}()
+
+type ownershipEntry struct {
+	owns    bool
+	expires time.Time
+}
+
+// NFTGate checks NFA token ownership through an Ethereum JSON-RPC endpoint and
+// caches the result per address.
+type NFTGate struct {
+	caller   ethereum.ContractCaller
+	contract common.Address
+	tokenIDs []*big.Int
+	ttl      time.Duration
+	now      func() time.Time
+
+	mu    sync.Mutex
+	cache map[common.Address]ownershipEntry
+}
+
+// NewNFTGate creates a gate that queries contract through caller
+func NewNFTGate(caller ethereum.ContractCaller, cfg NFTGateConfig) (*NFTGate, error) {
+	if !common.IsHexAddress(cfg.Contract) {
+		return nil, fmt.Errorf("invalid NFA contract address: %q", cfg.Contract)
+	}
+	g := &NFTGate{
+		caller:   caller,
+		contract: common.HexToAddress(cfg.Contract),
+		ttl:      time.Duration(cfg.CacheTTLSeconds) * time.Second,
+		now:      time.Now,
+		cache:    make(map[common.Address]ownershipEntry),
+	}
+	if g.ttl <= 0 {
+		g.ttl = time.Minute
+	}
+	for _, s := range cfg.TokenIDs {
+		id, ok := new(big.Int).SetString(s, 0)
+		if !ok || id.Sign() < 0 {
+			return nil, fmt.Errorf("invalid token ID: %q", s)
+		}
+		g.tokenIDs = append(g.tokenIDs, id)
+	}
+	return g, nil
+}
+
+// dialNFTGate connects to cfg.RPCURL, falling back to ethNode
+// (eth_node_address)
+func dialNFTGate(cfg NFTGateConfig, ethNode string) (*NFTGate, error) {
+	url := cfg.RPCURL
+	if url == "" {
+		url = ethNode
+	}
+	if url == "" {
+		return nil, errors.New("nft_gate requires rpc_url or ETH_NODE_ADDRESS")
+	}
+	client, err := ethclient.Dial(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %v", url, err)
+	}
+	return NewNFTGate(client, cfg)
+}
+
+// Owns reports whether addr holds the required token. Results, positive and
+// negative, are cached for the configured TTL; RPC failures are not cached.
+func (g *NFTGate) Owns(ctx context.Context, addr common.Address) (bool, error) {
+	now := g.now()
+	g.mu.Lock()
+	entry, ok := g.cache[addr]
+	g.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.owns, nil
+	}
+
+	owns, err := g.query(ctx, addr)
+	if err != nil {
+		return false, err
+	}
+
+	g.mu.Lock()
+	g.cache[addr] = ownershipEntry{owns: owns, expires: now.Add(g.ttl)}
+	g.mu.Unlock()
+	return owns, nil
+}
+
+func (g *NFTGate) query(ctx context.Context, addr common.Address) (bool, error) {
+	if len(g.tokenIDs) == 0 {
+		out, err := g.call(ctx, "balanceOf", addr)
+		if err != nil {
+			return false, err
+		}
+		balance, ok := out[0].(*big.Int)
+		return ok && balance.Sign() > 0, nil
+	}
+
+	for _, id := range g.tokenIDs {
+		out, err := g.call(ctx, "ownerOf", id)
+		if err != nil {
+			// ownerOf reverts for tokens that were never minted or were burned
+			if isRevert(err) {
+				continue
+			}
+			return false, err
+		}
+		if owner, ok := out[0].(common.Address); ok && owner == addr {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+var errEmptyCallResult = errors.New("empty call result")
+
+func isRevert(err error) bool {
+	return errors.Is(err, errEmptyCallResult) || strings.Contains(err.Error(), "execution reverted")
+}
+
+func (g *NFTGate) call(ctx context.Context, method string, args ...interface{}) ([]interface{}, error) {
+	input, err := parsedERC721ABI.Pack(method, args...)
+	if err != nil {
+		return nil, err
+	}
+	output, err := g.caller.CallContract(ctx, ethereum.CallMsg{To: &g.contract, Data: input}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%s call failed: %w", method, err)
+	}
+	if len(output) == 0 {
+		return nil, errEmptyCallResult
+	}
+	return parsedERC721ABI.Unpack(method, output)
+}
+
+// NFTGateAuthenticator authenticates wallet-signed requests and admits only
+// signers that hold the required NFA token.
+type NFTGateAuthenticator struct {
+	wallet *WalletAuthenticator
+	gate   *NFTGate
+}
+
+// NewNFTGateAuthenticator wraps wallet with an ownership check by gate
+func NewNFTGateAuthenticator(wallet *WalletAuthenticator, gate *NFTGate) *NFTGateAuthenticator {
+	return &NFTGateAuthenticator{wallet: wallet, gate: gate}
+}
+
+// Authenticate implements Authenticator
+func (a *NFTGateAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	id, err := a.wallet.Authenticate(r)
+	if id == nil || err != nil {
+		return id, err
+	}
+	owns, err := a.gate.Owns(r.Context(), common.HexToAddress(id.Subject))
+	if err != nil {
+		return nil, fmt.Errorf("failed to check NFA ownership: %v", err)
+	}
+	if !owns {
+		return nil, ErrNotTokenHolder
+	}
+	id.Method = "nft"
+	return id, nil
+}
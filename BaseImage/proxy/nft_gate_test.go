@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient/simulated"
+)
+
+// fakeNFACode is runtime bytecode that returns storage[calldata[4:36]], which
+// is enough to answer both ownerOf(uint256) and balanceOf(address) from
+// storage seeded in the genesis allocation.
+var fakeNFACode = hexutil.MustDecode("0x6004355460005260206000f3")
+
+var fakeNFAAddress = common.HexToAddress("0x00000000000000000000000000000000000000fa")
+
+type countingCaller struct {
+	ethereum.ContractCaller
+	calls int
+}
+
+func (c *countingCaller) CallContract(ctx context.Context, msg ethereum.CallMsg, block *big.Int) ([]byte, error) {
+	c.calls++
+	return c.ContractCaller.CallContract(ctx, msg, block)
+}
+
+// newSimulatedNFA starts a simulated chain where holder owns token 7
+func newSimulatedNFA(t *testing.T, holder common.Address) *countingCaller {
+	t.Helper()
+	backend := simulated.NewBackend(types.GenesisAlloc{
+		fakeNFAAddress: {
+			Code: fakeNFACode,
+			Storage: map[common.Hash]common.Hash{
+				common.BigToHash(big.NewInt(7)):    common.BytesToHash(holder.Bytes()),
+				common.BytesToHash(holder.Bytes()): common.BigToHash(big.NewInt(1)),
+			},
+		},
+	})
+	t.Cleanup(func() { backend.Close() })
+	return &countingCaller{ContractCaller: backend.Client()}
+}
+
+func TestNFTGateOwnership(t *testing.T) {
+	holder := common.HexToAddress("0x5B38Da6a701c568545dCfcB03FcB875f56beddC4")
+	stranger := common.HexToAddress("0xAb8483F64d9C6d1EcF9b849Ae677dD3315835cb2")
+	caller := newSimulatedNFA(t, holder)
+	ctx := context.Background()
+
+	tests := []struct {
+		name     string
+		tokenIDs []string
+	}{
+		{"any token", nil},
+		{"specific token", []string{"3", "7"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gate, err := NewNFTGate(caller, NFTGateConfig{Contract: fakeNFAAddress.Hex(), TokenIDs: tt.tokenIDs})
+			if err != nil {
+				t.Fatalf("NewNFTGate() error = %v", err)
+			}
+			if owns, err := gate.Owns(ctx, holder); err != nil || !owns {
+				t.Errorf("holder Owns() = %v, %v; want true", owns, err)
+			}
+			if owns, err := gate.Owns(ctx, stranger); err != nil || owns {
+				t.Errorf("stranger Owns() = %v, %v; want false", owns, err)
+			}
+		})
+	}
+
+	if _, err := NewNFTGate(caller, NFTGateConfig{Contract: "nope"}); err == nil {
+		t.Error("invalid contract address should be rejected")
+	}
+	if _, err := NewNFTGate(caller, NFTGateConfig{Contract: fakeNFAAddress.Hex(), TokenIDs: []string{"x"}}); err == nil {
+		t.Error("invalid token ID should be rejected")
+	}
+}
+
+func TestNFTGateCache(t *testing.T) {
+	holder := common.HexToAddress("0x5B38Da6a701c568545dCfcB03FcB875f56beddC4")
+	caller := newSimulatedNFA(t, holder)
+	gate, _ := NewNFTGate(caller, NFTGateConfig{Contract: fakeNFAAddress.Hex(), CacheTTLSeconds: 30})
+	now := time.Now()
+	gate.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		gate.Owns(context.Background(), holder)
+	}
+	if caller.calls != 1 {
+		t.Fatalf("calls = %d, want 1 while cached", caller.calls)
+	}
+
+	now = now.Add(31 * time.Second)
+	gate.Owns(context.Background(), holder)
+	if caller.calls != 2 {
+		t.Errorf("calls = %d, want 2 after the TTL expires", caller.calls)
+	}
+}
+
+func TestNFTGateAuthenticator(t *testing.T) {
+	holderKey, _ := crypto.GenerateKey()
+	strangerKey, _ := crypto.GenerateKey()
+	caller := newSimulatedNFA(t, crypto.PubkeyToAddress(holderKey.PublicKey))
+	gate, _ := NewNFTGate(caller, NFTGateConfig{Contract: fakeNFAAddress.Hex(), TokenIDs: []string{"7"}})
+	wallet, _ := NewWalletAuthenticator(WalletAuthConfig{})
+
+	p := NewProxy()
+	p.authenticators = []Authenticator{NewNFTGateAuthenticator(wallet, gate)}
+	var gotID *Identity
+	handler := p.requireScope(ScopeChat, func(w http.ResponseWriter, r *http.Request) {
+		gotID = IdentityFromContext(r.Context())
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	body := []byte(`{}`)
+	req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(body))
+	SignWalletRequest(req, body, holderKey, "", 0)
+	w := httptest.NewRecorder()
+	handler(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("holder status = %d, want %d", w.Code, http.StatusNoContent)
+	}
+	if gotID == nil || gotID.Method != "nft" || gotID.Subject != crypto.PubkeyToAddress(holderKey.PublicKey).Hex() {
+		t.Errorf("unexpected identity: %+v", gotID)
+	}
+
+	req = httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(body))
+	SignWalletRequest(req, body, strangerKey, "", 0)
+	w = httptest.NewRecorder()
+	handler(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("non-holder status = %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,321 @@
+package proxy
+
+import (
+	"context"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Consumer node balancing policies
+const (
+	BalanceRoundRobin       = "round_robin"
+	BalanceLeastOutstanding = "least_outstanding"
+	BalanceHealthWeighted   = "health_weighted"
+)
+
+// maxEjectionBackoff caps how much longer a repeatedly failing node stays out
+const maxEjectionBackoff = 8
+
+// consumerNode is one consumer node and what the proxy has observed of it
+type consumerNode struct {
+	URL string
+
+	outstanding int64
+
+	mu           sync.Mutex
+	failures     int // consecutive
+	ejections    int // consecutive
+	ejectedUntil time.Time
+	successRate  float64       // moving average, 1 is healthy
+	latency      time.Duration // moving average
+	requests     uint64
+	errors       uint64
+}
+
+// NodeStatus describes a consumer node for the admin API
+type NodeStatus struct {
+	URL          string     `json:"url"`
+	Healthy      bool       `json:"healthy"`
+	EjectedUntil *time.Time `json:"ejected_until,omitempty"`
+	Outstanding  int64      `json:"outstanding"`
+	Failures     int        `json:"consecutive_failures"`
+	SuccessRate  float64    `json:"success_rate"`
+	LatencyMs    int64      `json:"latency_ms"`
+	Requests     uint64     `json:"requests"`
+	Errors       uint64     `json:"errors"`
+}
+
+// NodePool balances sessions across consumer nodes and ejects nodes that
+// keep failing until they recover
+type NodePool struct {
+	policy     string
+	ejectAfter int
+	ejectFor   time.Duration
+	nodes      []*consumerNode
+	next       uint64
+	logger     *log.Logger
+}
+
+// NewNodePool creates a pool of the nodes in cfg
+func NewNodePool(cfg MarketplaceConfig) *NodePool {
+	np := &NodePool{policy: cfg.Balancing, ejectAfter: cfg.EjectAfter, ejectFor: cfg.EjectFor.Duration, logger: log.Default()}
+	for _, url := range cfg.Nodes {
+		np.nodes = append(np.nodes, &consumerNode{URL: strings.TrimRight(url, "/"), successRate: 1})
+	}
+	return np
+}
+
+func (n *consumerNode) healthy(now time.Time) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return !now.Before(n.ejectedUntil)
+}
+
+// weight scores a node for health-weighted balancing
+func (n *consumerNode) weight() float64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	latency := math.Max(n.latency.Seconds(), 0.01)
+	return math.Max(n.successRate*n.successRate, 0.01) / latency / float64(1+atomic.LoadInt64(&n.outstanding))
+}
+
+// Pick chooses a node for a new session. When every node is ejected, the one
+// that comes back first is used rather than failing outright.
+func (np *NodePool) Pick() *consumerNode {
+	return np.PickWhere()
+}
+
+// PickWhere chooses a node like Pick, but among the healthy nodes that pass
+// the first filter that any healthy node passes. When none does, all healthy
+// nodes are considered.
+func (np *NodePool) PickWhere(filters ...func(*consumerNode) bool) *consumerNode {
+	now := time.Now()
+	start := int(atomic.AddUint64(&np.next, 1)-1) % len(np.nodes)
+	var healthy []*consumerNode
+	for i := range np.nodes {
+		if n := np.nodes[(start+i)%len(np.nodes)]; n.healthy(now) {
+			healthy = append(healthy, n)
+		}
+	}
+	for _, filter := range filters {
+		var passed []*consumerNode
+		for _, n := range healthy {
+			if filter(n) {
+				passed = append(passed, n)
+			}
+		}
+		if len(passed) > 0 {
+			healthy = passed
+			break
+		}
+	}
+	if len(healthy) == 0 {
+		nodes := append([]*consumerNode(nil), np.nodes...)
+		sort.Slice(nodes, func(i, j int) bool {
+			nodes[i].mu.Lock()
+			a := nodes[i].ejectedUntil
+			nodes[i].mu.Unlock()
+			nodes[j].mu.Lock()
+			defer nodes[j].mu.Unlock()
+			return a.Before(nodes[j].ejectedUntil)
+		})
+		return nodes[0]
+	}
+
+	switch np.policy {
+	case BalanceLeastOutstanding:
+		best := healthy[0]
+		for _, n := range healthy[1:] {
+			if atomic.LoadInt64(&n.outstanding) < atomic.LoadInt64(&best.outstanding) {
+				best = n
+			}
+		}
+		return best
+	case BalanceHealthWeighted:
+		weights := make([]float64, len(healthy))
+		var total float64
+		for i, n := range healthy {
+			weights[i] = n.weight()
+			total += weights[i]
+		}
+		r := rand.Float64() * total
+		for i, w := range weights {
+			if r < w {
+				return healthy[i]
+			}
+			r -= w
+		}
+		return healthy[len(healthy)-1]
+	default:
+		return healthy[0]
+	}
+}
+
+// Node returns the pooled node at url, so requests on a session go through
+// the node that opened it. Unknown URLs get an untracked node.
+func (np *NodePool) Node(url string) *consumerNode {
+	url = strings.TrimRight(url, "/")
+	for _, n := range np.nodes {
+		if n.URL == url {
+			return n
+		}
+	}
+	return &consumerNode{URL: url, successRate: 1}
+}
+
+// begin counts a request against the node until the returned func reports
+// whether it succeeded
+func (np *NodePool) begin(n *consumerNode) func(ok bool) {
+	start := time.Now()
+	atomic.AddInt64(&n.outstanding, 1)
+	return func(ok bool) {
+		atomic.AddInt64(&n.outstanding, -1)
+		np.record(n, ok, time.Since(start))
+	}
+}
+
+// record updates a node's health after a request
+func (np *NodePool) record(n *consumerNode, ok bool, latency time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	const alpha = 0.2
+	n.requests++
+	if ok {
+		n.successRate += alpha * (1 - n.successRate)
+		if n.latency == 0 {
+			n.latency = latency
+		} else {
+			n.latency += time.Duration(alpha * float64(latency-n.latency))
+		}
+		if n.failures >= np.ejectAfter {
+			np.logger.Printf("Consumer node %s recovered", n.URL)
+		}
+		n.failures, n.ejections = 0, 0
+		n.ejectedUntil = time.Time{}
+		return
+	}
+
+	n.errors++
+	n.successRate -= alpha * n.successRate
+	n.failures++
+	if n.failures >= np.ejectAfter && !time.Now().Before(n.ejectedUntil) {
+		backoff := 1 << n.ejections
+		if backoff > maxEjectionBackoff {
+			backoff = maxEjectionBackoff
+		}
+		n.ejections++
+		n.ejectedUntil = time.Now().Add(np.ejectFor * time.Duration(backoff))
+		np.logger.Printf("Ejected consumer node %s after %d consecutive failures, until %s", n.URL, n.failures, n.ejectedUntil.Format(time.RFC3339))
+	}
+}
+
+// Status reports every node in the pool
+func (np *NodePool) Status() []NodeStatus {
+	now := time.Now()
+	out := make([]NodeStatus, 0, len(np.nodes))
+	for _, n := range np.nodes {
+		n.mu.Lock()
+		s := NodeStatus{
+			URL:         n.URL,
+			Healthy:     !now.Before(n.ejectedUntil),
+			Outstanding: atomic.LoadInt64(&n.outstanding),
+			Failures:    n.failures,
+			SuccessRate: math.Round(n.successRate*1000) / 1000,
+			LatencyMs:   n.latency.Milliseconds(),
+			Requests:    n.requests,
+			Errors:      n.errors,
+		}
+		if !s.Healthy {
+			until := n.ejectedUntil
+			s.EjectedUntil = &until
+		}
+		n.mu.Unlock()
+		out = append(out, s)
+	}
+	return out
+}
+
+// probe checks every node's /healthcheck each interval so ejected nodes come
+// back without waiting for traffic, until ctx is done
+func (np *NodePool) probe(ctx context.Context, client *http.Client, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, n := range np.nodes {
+			start := time.Now()
+			resp, err := client.Get(n.URL + "/healthcheck")
+			ok := err == nil && resp.StatusCode == http.StatusOK
+			if err == nil {
+				resp.Body.Close()
+			}
+			np.record(n, ok, time.Since(start))
+		}
+	}
+}
+
+// nodeOutcome reports whether a node answered well enough to count as up.
+// Client errors are the caller's problem, not the node's.
+func nodeOutcome(resp *http.Response, err error) bool {
+	return err == nil && resp.StatusCode < 500
+}
+
+// pickNode returns the node for a new session, or the single configured
+// marketplace URL when no pool is set up
+func (p *Proxy) pickNode() *consumerNode {
+	if p.nodes == nil {
+		return &consumerNode{URL: p.cfg().Marketplace.URL}
+	}
+	return p.nodes.Pick()
+}
+
+// sessionNode returns the node that opened sessionID
+func (p *Proxy) sessionNode(sessionID string) *consumerNode {
+	p.sessions.RLock()
+	session, exists := p.sessions.m[sessionID]
+	p.sessions.RUnlock()
+	if !exists || session.Node == "" {
+		return p.pickNode()
+	}
+	if p.nodes == nil {
+		return &consumerNode{URL: session.Node}
+	}
+	return p.nodes.Node(session.Node)
+}
+
+// beginNode counts a request against n; see NodePool.begin
+func (p *Proxy) beginNode(n *consumerNode) func(ok bool) {
+	if p.nodes == nil {
+		return func(bool) {}
+	}
+	return p.nodes.begin(n)
+}
+
+// handleAdminNodes reports consumer node health on GET /admin/nodes
+func (p *Proxy) handleAdminNodes(w http.ResponseWriter, r *http.Request) {
+	if !p.requireAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		respondWithAPIError(w, http.StatusMethodNotAllowed, newAPIError("invalid_request_error", "", "", "Method not allowed"))
+		return
+	}
+	nodes := []NodeStatus{}
+	policy := ""
+	if p.nodes != nil {
+		nodes = p.nodes.Status()
+		policy = p.nodes.policy
+	}
+	writeAdminJSON(w, map[string]interface{}{"balancing": policy, "nodes": nodes})
+}
@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func testNodePool(policy string, urls ...string) *NodePool {
+	return NewNodePool(MarketplaceConfig{Nodes: urls, Balancing: policy, EjectAfter: 2, EjectFor: Duration{50 * time.Millisecond}})
+}
+
+func TestNodePoolRoundRobinAndEjection(t *testing.T) {
+	np := testNodePool(BalanceRoundRobin, "http://a", "http://b/", "http://c")
+	var got []string
+	for i := 0; i < 4; i++ {
+		got = append(got, np.Pick().URL)
+	}
+	if fmt.Sprint(got) != "[http://a http://b http://c http://a]" {
+		t.Errorf("round robin order = %v", got)
+	}
+
+	b := np.Node("http://b")
+	np.record(b, false, time.Millisecond)
+	np.record(b, false, time.Millisecond)
+	for i := 0; i < 6; i++ {
+		if n := np.Pick(); n == b {
+			t.Fatal("ejected node was picked")
+		}
+	}
+	if status := np.Status(); status[1].Healthy || status[1].EjectedUntil == nil || status[1].Failures != 2 {
+		t.Errorf("unexpected status for ejected node: %+v", status[1])
+	}
+
+	// The node returns after eject_for, and a success clears its record
+	time.Sleep(60 * time.Millisecond)
+	if !b.healthy(time.Now()) {
+		t.Fatal("node should be back in rotation")
+	}
+	np.record(b, true, time.Millisecond)
+	if status := np.Status(); !status[1].Healthy || status[1].Failures != 0 {
+		t.Errorf("node did not recover: %+v", status[1])
+	}
+}
+
+func TestNodePoolAllEjected(t *testing.T) {
+	np := testNodePool(BalanceRoundRobin, "http://a", "http://b")
+	a, b := np.Node("http://a"), np.Node("http://b")
+	for i := 0; i < 2; i++ {
+		np.record(b, false, 0)
+	}
+	time.Sleep(5 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		np.record(a, false, 0)
+	}
+	if n := np.Pick(); n != b {
+		t.Errorf("Pick() = %s, want the node that returns first", n.URL)
+	}
+}
+
+func TestNodePoolLeastOutstanding(t *testing.T) {
+	np := testNodePool(BalanceLeastOutstanding, "http://a", "http://b", "http://c")
+	doneA := np.begin(np.Node("http://a"))
+	np.begin(np.Node("http://c"))
+	np.begin(np.Node("http://c"))
+	for i := 0; i < 3; i++ {
+		if n := np.Pick(); n.URL != "http://b" {
+			t.Errorf("Pick() = %s, want http://b", n.URL)
+		}
+	}
+	doneA(true)
+	np.begin(np.Node("http://b"))
+	if n := np.Pick(); n.URL != "http://a" {
+		t.Errorf("Pick() = %s, want http://a", n.URL)
+	}
+}
+
+func TestNodePoolHealthWeighted(t *testing.T) {
+	np := testNodePool(BalanceHealthWeighted, "http://fast", "http://slow")
+	np.record(np.Node("http://fast"), true, 10*time.Millisecond)
+	np.record(np.Node("http://slow"), true, 500*time.Millisecond)
+	picks := map[string]int{}
+	for i := 0; i < 500; i++ {
+		picks[np.Pick().URL]++
+	}
+	if picks["http://fast"] < 400 {
+		t.Errorf("healthy fast node should take most traffic: %v", picks)
+	}
+}
+
+func TestSessionAffinity(t *testing.T) {
+	newNode := func(name string, chats *[]string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/blockchain/models/affinity-model/session":
+				fmt.Fprintf(w, `{"sessionId":"affinity-%s"}`, name)
+			case "/v1/chat/completions":
+				*chats = append(*chats, r.Header.Get("session_id"))
+				fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\ndata: [DONE]\n\n")
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+	}
+	var chatsA, chatsB []string
+	a, b := newNode("a", &chatsA), newNode("b", &chatsB)
+	defer a.Close()
+	defer b.Close()
+	t.Setenv("MARKETPLACE_NODES", a.URL+", "+b.URL)
+	cfg, err := LoadConfig("")
+	if err != nil || cfg.Validate() != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	setConfig(cfg)
+	defer setConfig(nil)
+	defer func() {
+		sessionCache.Lock()
+		delete(sessionCache.m, "affinity-a")
+		delete(sessionCache.m, "affinity-b")
+		sessionCache.Unlock()
+	}()
+
+	p := NewProxy()
+	first, err := p.createSession("affinity-model")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := p.createSession("affinity-model")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != "affinity-a" || second != "affinity-b" {
+		t.Fatalf("sessions = %s, %s; want one per node", first, second)
+	}
+
+	for _, sessionID := range []string{second, first, second} {
+		w := httptest.NewRecorder()
+		if err := p.forwardChatRequest(w, httptest.NewRequest("POST", "/v1/chat/completions", nil), "affinity-model", ChatCompletionRequest{Model: "m"}, sessionID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fmt.Sprint(chatsA) != "[affinity-a]" || fmt.Sprint(chatsB) != "[affinity-b affinity-b]" {
+		t.Errorf("chats on node a = %v, node b = %v", chatsA, chatsB)
+	}
+	if sessions := p.activeAdminSessions(time.Now()); len(sessions) < 2 {
+		t.Errorf("admin sessions = %+v", sessions)
+	}
+	if status := p.nodes.Status(); status[0].Requests != 2 || status[1].Requests != 3 || status[0].Outstanding != 0 {
+		t.Errorf("node status = %+v", status)
+	}
+}
@@ -0,0 +1,350 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// PII actions
+const (
+	PIIMask     = "mask"
+	PIITokenize = "tokenize"
+	PIIBlock    = "block"
+	PIIOff      = "off"
+)
+
+// piiRule detects one kind of sensitive value
+type piiRule struct {
+	name string
+	// pattern matches the value, or the value in a group named "value" when
+	// the rule needs context around it
+	pattern *regexp.Regexp
+	// valid filters out pattern matches that are not real values
+	valid func(match string) bool
+	// standalone rejects matches that are part of a longer digit sequence or
+	// word, such as a hash
+	standalone bool
+}
+
+// piiRules are applied in order, so more specific rules claim a value first
+var piiRules = []piiRule{
+	// 64 hex digits are also transaction and block hashes, so a key needs a label
+	{name: "eth_private_key", pattern: regexp.MustCompile(`(?i:(?:private|priv|secret|signing)[ _-]?key|\bpk)\b[\s"'=:]*(?:is\s+)?(?P<value>\b(?:0x)?[0-9a-fA-F]{64})\b`)},
+	{name: "api_key", pattern: regexp.MustCompile(`\b(?:(?:sk|pk|rk)-[A-Za-z0-9_-]{20,}|AKIA[0-9A-Z]{16}|gh[pousr]_[A-Za-z0-9]{36,}|xox[abprs]-[A-Za-z0-9-]{10,}|AIza[0-9A-Za-z_-]{35})\b`)},
+	{name: "credit_card", pattern: regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`), valid: luhnValid, standalone: true},
+	{name: "iban", pattern: regexp.MustCompile(`\b[A-Z]{2}\d{2}(?: ?[A-Z0-9]){11,30}\b`), valid: ibanValid},
+	{name: "email", pattern: regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}`)},
+	{name: "phone", pattern: regexp.MustCompile(`(?:\+\d{1,3}[ .-]?)?(?:\(\d{1,4}\)[ .-]?|\d{2,4}[ .-]?)?\d{3,4}[ .-]?\d{3,4}`), valid: phoneValid, standalone: true},
+}
+
+func digitsOnly(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, s)
+}
+
+// luhnValid reports whether a card number passes the Luhn checksum
+func luhnValid(s string) bool {
+	digits := digitsOnly(s)
+	if len(digits) < 13 || len(digits) > 19 {
+		return false
+	}
+	sum := 0
+	for i := 0; i < len(digits); i++ {
+		d := int(digits[len(digits)-1-i] - '0')
+		if i%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
+
+// ibanValid reports whether an IBAN passes the ISO 13616 mod-97 check
+func ibanValid(s string) bool {
+	iban := strings.ReplaceAll(s, " ", "")
+	if len(iban) < 15 || len(iban) > 34 {
+		return false
+	}
+	var numeric strings.Builder
+	for _, r := range iban[4:] + iban[:4] {
+		switch {
+		case r >= '0' && r <= '9':
+			numeric.WriteRune(r)
+		case r >= 'A' && r <= 'Z':
+			numeric.WriteString(fmt.Sprint(int(r-'A') + 10))
+		default:
+			return false
+		}
+	}
+	n, ok := new(big.Int).SetString(numeric.String(), 10)
+	return ok && new(big.Int).Mod(n, big.NewInt(97)).Int64() == 1
+}
+
+// digitAdjacent reports whether text[start:end] continues a word, or a digit
+// sequence directly or across one separator
+func digitAdjacent(text string, start, end int) bool {
+	isDigit := func(i int) bool { return i >= 0 && i < len(text) && text[i] >= '0' && text[i] <= '9' }
+	isAlnum := func(i int) bool {
+		return isDigit(i) || i >= 0 && i < len(text) && (text[i]|0x20 >= 'a' && text[i]|0x20 <= 'z')
+	}
+	isSep := func(i int) bool { return i >= 0 && i < len(text) && strings.IndexByte(" .-", text[i]) >= 0 }
+	return isAlnum(start-1) || (isSep(start-1) && isDigit(start-2)) ||
+		isAlnum(end) || (isSep(end) && isDigit(end+1))
+}
+
+func phoneValid(s string) bool {
+	n := len(digitsOnly(s))
+	return n >= 9 && n <= 15
+}
+
+// PIIMiddleware detects sensitive values in outgoing messages and masks,
+// tokenizes or blocks them. Tokens are restored in the response stream, so
+// the provider never sees the raw value but the caller gets it back.
+type PIIMiddleware struct {
+	// Rules maps rule names to an action: mask, tokenize, block or off
+	Rules map[string]string `json:"rules"`
+	// Default is the action for rules not listed, mask by default
+	Default string `json:"default"`
+}
+
+func newPIIMiddleware(cfg MiddlewareConfig) (Middleware, error) {
+	m := &PIIMiddleware{}
+	if err := cfg.Decode(m); err != nil {
+		return nil, err
+	}
+	return m, m.validate()
+}
+
+func normalizePIIAction(action string) string {
+	action = strings.ToLower(action)
+	if action == "tokenise" {
+		return PIITokenize
+	}
+	return action
+}
+
+func (m *PIIMiddleware) validate() error {
+	var errs []error
+	known := make(map[string]bool)
+	for _, rule := range piiRules {
+		known[rule.name] = true
+	}
+	check := func(name, action string) {
+		switch normalizePIIAction(action) {
+		case PIIMask, PIITokenize, PIIBlock, PIIOff:
+		default:
+			errs = append(errs, fmt.Errorf("%s: invalid action %q, expected mask, tokenize, block or off", name, action))
+		}
+	}
+	for name, action := range m.Rules {
+		if !known[name] {
+			errs = append(errs, fmt.Errorf("unknown rule %q", name))
+			continue
+		}
+		check(name, action)
+	}
+	if m.Default != "" {
+		check("default", m.Default)
+	}
+	return errors.Join(errs...)
+}
+
+func (m *PIIMiddleware) action(rule string) string {
+	if action, ok := m.Rules[rule]; ok {
+		return normalizePIIAction(action)
+	}
+	if m.Default != "" {
+		return normalizePIIAction(m.Default)
+	}
+	return PIIMask
+}
+
+// piiState is the per-request token vault
+type piiState struct {
+	tokens map[string]string // token -> original
+	values map[string]string // original -> token
+	counts map[string]int
+	// pending holds streamed text per choice that may end in a partial token
+	pending map[int]string
+	last    map[string]interface{}
+}
+
+const piiStateKey = "pii"
+
+func piiStateFrom(cc *ChatContext) *piiState {
+	if st, ok := cc.Get(piiStateKey).(*piiState); ok {
+		return st
+	}
+	st := &piiState{
+		tokens:  make(map[string]string),
+		values:  make(map[string]string),
+		counts:  make(map[string]int),
+		pending: make(map[int]string),
+	}
+	cc.Set(piiStateKey, st)
+	return st
+}
+
+func (st *piiState) token(rule, value string) string {
+	if token, ok := st.values[value]; ok {
+		return token
+	}
+	st.counts[rule]++
+	token := fmt.Sprintf("<PII_%s_%d>", strings.ToUpper(rule), st.counts[rule])
+	st.tokens[token] = value
+	st.values[value] = token
+	return token
+}
+
+// redact applies every rule to text. Blocked rules are reported instead.
+func (m *PIIMiddleware) redact(st *piiState, text string, blocked map[string]bool) string {
+	for _, rule := range piiRules {
+		action := m.action(rule.name)
+		if action == PIIOff {
+			continue
+		}
+		var sb strings.Builder
+		last := 0
+		value := rule.pattern.SubexpIndex("value")
+		for _, loc := range rule.pattern.FindAllStringSubmatchIndex(text, -1) {
+			if value > 0 {
+				loc = loc[2*value : 2*value+2]
+			}
+			match := text[loc[0]:loc[1]]
+			if rule.valid != nil && !rule.valid(match) || rule.standalone && digitAdjacent(text, loc[0], loc[1]) {
+				continue
+			}
+			sb.WriteString(text[last:loc[0]])
+			switch action {
+			case PIIBlock:
+				blocked[rule.name] = true
+				sb.WriteString(match)
+			case PIITokenize:
+				sb.WriteString(st.token(rule.name, match))
+			default:
+				sb.WriteString("[" + strings.ToUpper(rule.name) + "]")
+			}
+			last = loc[1]
+		}
+		sb.WriteString(text[last:])
+		text = sb.String()
+	}
+	return text
+}
+
+// ProcessRequest implements Middleware
+func (m *PIIMiddleware) ProcessRequest(cc *ChatContext, req *ChatCompletionRequest) error {
+	st := piiStateFrom(cc)
+	blocked := make(map[string]bool)
+	for i := range req.Messages {
+		req.Messages[i].Content = m.redact(st, req.Messages[i].Content, blocked)
+	}
+	if len(blocked) > 0 {
+		names := make([]string, 0, len(blocked))
+		for name := range blocked {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return &MiddlewareError{
+			Status:  http.StatusBadRequest,
+			Code:    "pii_detected",
+			Message: fmt.Sprintf("Request contains sensitive data that may not be sent to providers: %s", strings.Join(names, ", ")),
+		}
+	}
+	return nil
+}
+
+// piiTokenPrefix matches text that could still grow into a token
+var piiTokenPrefix = regexp.MustCompile(`<(?:P(?:I(?:I(?:_[A-Z_]*\d*)?)?)?)?$`)
+
+// restore replaces tokens in text. A trailing partial token is held back
+// and returned separately so it can be completed by the next chunk.
+func (st *piiState) restore(text string) (string, string) {
+	for token, value := range st.tokens {
+		text = strings.ReplaceAll(text, token, value)
+	}
+	if loc := piiTokenPrefix.FindStringIndex(text); loc != nil {
+		return text[:loc[0]], text[loc[0]:]
+	}
+	return text, ""
+}
+
+// ProcessResponse implements Middleware
+func (m *PIIMiddleware) ProcessResponse(cc *ChatContext, chunk *StreamChunk) error {
+	st := piiStateFrom(cc)
+	if len(st.tokens) == 0 {
+		return nil
+	}
+
+	if chunk.Final {
+		// Flush text held back at the end of the stream
+		var indexes []int
+		for index, text := range st.pending {
+			if text != "" {
+				indexes = append(indexes, index)
+			}
+		}
+		if st.last == nil || len(indexes) == 0 {
+			return nil
+		}
+		sort.Ints(indexes)
+		var choices []interface{}
+		for _, index := range indexes {
+			choices = append(choices, map[string]interface{}{"index": index, "delta": map[string]interface{}{"content": st.pending[index]}})
+		}
+		st.pending = make(map[int]string)
+		st.last["choices"] = choices
+		return chunk.SetJSON(st.last)
+	}
+
+	data, ok := chunk.JSON()
+	if !ok {
+		return nil
+	}
+	choices, _ := data["choices"].([]interface{})
+	for i, c := range choices {
+		choice, ok := c.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		index := i
+		if n, ok := choice["index"].(float64); ok {
+			index = int(n)
+		}
+		finished := choice["finish_reason"] != nil
+		for _, field := range []string{"delta", "message"} {
+			part, ok := choice[field].(map[string]interface{})
+			if !ok {
+				continue
+			}
+			content, ok := part["content"].(string)
+			if !ok {
+				continue
+			}
+			text, held := st.restore(st.pending[index] + content)
+			if finished || field == "message" {
+				text, held = text+held, ""
+			}
+			st.pending[index] = held
+			part["content"] = text
+		}
+		if s, ok := choice["text"].(string); ok {
+			text, _ := st.restore(s)
+			choice["text"] = text
+		}
+	}
+	st.last = data
+	return chunk.SetJSON(data)
+}
@@ -3,29 +3,28 @@ package proxy
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math/big"
 	"net/http"
-	"os"
-	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"sort"
 
 	"github.com/sony/gobreaker"
+	"golang.org/x/sync/singleflight"
 )
 
-// Add these new environment variable getters at the top of the file
+// Marketplace endpoints are derived from the active config
 func getMarketplaceBaseURL() string {
-    baseURL := os.Getenv("MARKETPLACE_URL")
-    if baseURL == "" {
-        baseURL = "http://marketplace:9000"
-    }
-    return baseURL
+    return currentConfig().Marketplace.URL
 }
 
 func getMarketplaceModelsEndpoint() string {
@@ -37,24 +36,11 @@ func getMarketplaceSessionEndpoint(modelID string) string {
 }
 
 func getMarketplaceChatEndpoint() string {
-    marketplaceURL := os.Getenv("MARKETPLACE_URL")
-    if marketplaceURL == "" {
-        return ""
-    }
-    return fmt.Sprintf("%s/chat/completions", marketplaceURL)
+    return fmt.Sprintf("%s/chat/completions", getMarketplaceBaseURL())
 }
 
 func getSessionExpirationSeconds() int {
-	expirationStr := os.Getenv("SESSION_EXPIRATION_SECONDS")
-	if expirationStr == "" {
-		return 1800 // Default to 30 minutes
-	}
-	expiration, err := strconv.Atoi(expirationStr)
-	if err != nil || expiration < 60 { // Minimum 1 minute
-		log.Printf("Invalid SESSION_EXPIRATION_SECONDS value: %s, using default of 1800", expirationStr)
-		return 1800
-	}
-	return expiration
+	return currentConfig().Session.ExpirationSeconds
 }
 
 // Update SessionManager to track model ID
@@ -77,50 +63,46 @@ func (sm *SessionManager) UpdateSession(sessionID, modelID string) {
 // SessionManagerInstance is a global instance of SessionManager
 var SessionManagerInstance = &SessionManager{}
 
-// Add these new vars at the top of the file
-var (
-	defaultTimeout = 30 * time.Second
-	circuitBreaker *gobreaker.CircuitBreaker
-	sessionExpirationSeconds = getSessionExpirationSeconds()
+// sessionStore caches open sessions by session ID
+type sessionStore struct {
+	sync.RWMutex
+	m map[string]CachedSession
+}
 
-	// Session and model caches with mutex protection
-	sessionCache = struct {
-		sync.RWMutex
-		m map[string]CachedSession
-	}{m: make(map[string]CachedSession)}
+// modelStore caches model handle lookups
+type modelStore struct {
+	sync.RWMutex
+	m map[string]CachedModel
+}
 
-	modelCache = struct {
-		sync.RWMutex
-		m map[string]CachedModel
-	}{m: make(map[string]CachedModel)}
+func newSessionStore() *sessionStore {
+	return &sessionStore{m: make(map[string]CachedSession)}
+}
 
-	consumerNodeURL = getEnvOrDefault("CONSUMER_NODE_URL", "https://consumer-node-yalzemm5uq-uc.a.run.app")
+func newModelStore() *modelStore {
+	return &modelStore{m: make(map[string]CachedModel)}
+}
 
-	// Add a flag to control cleanup goroutine
-	enableCleanupGoroutine = true
+// Package-level state shared by proxies created with NewProxy. Servers created
+// with New have their own.
+var (
+	circuitBreaker = newCircuitBreaker(defaultConfig().CircuitBreaker, log.Default())
+	sessionCache   = newSessionStore()
+	modelCache     = newModelStore()
+	sharedTxs      = newTxQueue()
 )
 
-func init() {
-	// Configure circuit breaker
-	circuitBreaker = gobreaker.NewCircuitBreaker(gobreaker.Settings{
+// newCircuitBreaker configures the marketplace circuit breaker
+func newCircuitBreaker(cfg CircuitBreakerConfig, logger *log.Logger) *gobreaker.CircuitBreaker {
+	return gobreaker.NewCircuitBreaker(gobreaker.Settings{
 		Name:        "marketplace",
-		MaxRequests: 3,
-		Interval:    10 * time.Second,
-		Timeout:     60 * time.Second,
+		MaxRequests: cfg.MaxRequests,
+		Interval:    cfg.Interval.Duration,
+		Timeout:     cfg.Timeout.Duration,
 		OnStateChange: func(name string, from, to gobreaker.State) {
-			log.Printf("Circuit breaker state changed from %v to %v", from, to)
+			logger.Printf("Circuit breaker state changed from %v to %v", from, to)
 		},
 	})
-
-	// Add periodic cleanup of expired sessions only if enabled
-	if enableCleanupGoroutine {
-		go func() {
-			ticker := time.NewTicker(5 * time.Minute)
-			for range ticker.C {
-				cleanupExpiredSessions()
-			}
-		}()
-	}
 }
 
 // MorpheusSession represents a session with the Morpheus consumer node
@@ -135,48 +117,68 @@ type MorpheusSession struct {
 var (
 	activeSessions = make(map[string]*MorpheusSession)
 	sessionMutex   sync.Mutex
+	// sessionFlight lets concurrent requests for one model share a single
+	// session creation
+	sessionFlight singleflight.Group
 )
 
 // Remove getModelID function as modelID comes from the request
 
-// Add retry configuration constants
-const (
-	maxRetries = 3
-	baseDelay  = 1 * time.Second
-)
-
-// Modify ensureSession to be more robust with retry logic
+// ensureSession makes sure activeSessions holds an open session for modelID.
+// Concurrent calls for the same model wait for one creation, and
+// sessionMutex is only held while reading and updating the map, so requests
+// for other models are not held up by the marketplace.
 func ensureSession(modelID string) error {
+	if reuseActiveSession(modelID) {
+		return nil
+	}
+	_, err, _ := sessionFlight.Do(modelID, func() (interface{}, error) {
+		// A creation that finished while we waited is as good as a new one
+		if reuseActiveSession(modelID) {
+			return nil, nil
+		}
+		return nil, createActiveSession(modelID)
+	})
+	return err
+}
+
+// reuseActiveSession reports whether modelID has an unexpired session, and
+// marks it as just used
+func reuseActiveSession(modelID string) bool {
 	sessionMutex.Lock()
 	defer sessionMutex.Unlock()
 
 	// Clean up expired sessions first
-	cleanupExpiredSessions()
+	cleanupExpiredSessionsLocked()
 
-	// Get current session ID from SessionManagerInstance
-	currentSessionID, currentModelID := SessionManagerInstance.GetSessionInfo()
-	
-	// If we have a current session but it's for a different model, we need a new session
-	if currentSessionID != "" && currentModelID != modelID {
-		log.Printf("Current session is for different model (current: %s, requested: %s). Creating new session.", currentModelID, modelID)
-		delete(activeSessions, currentModelID)
-		SessionManagerInstance.UpdateSession("", "") // Clear the current session
+	session, exists := activeSessions[modelID]
+	if !exists || session.SessionID == "" {
+		return false
 	}
+	session.Created = time.Now() // Update last used time
+	SessionManagerInstance.UpdateSession(session.SessionID, modelID)
+	log.Printf("Using existing session for model %s: %s", modelID, session.SessionID)
+	return true
+}
 
+// activeSession returns a copy of the session held for modelID, or nil
+func activeSession(modelID string) *MorpheusSession {
+	sessionMutex.Lock()
+	defer sessionMutex.Unlock()
 	session, exists := activeSessions[modelID]
-	if exists && session.SessionID != "" {
-		// Check if session is still valid using configurable expiration
-		if time.Since(session.Created) < time.Duration(sessionExpirationSeconds)*time.Second {
-			session.Created = time.Now() // Update last used time
-			SessionManagerInstance.UpdateSession(session.SessionID, modelID)
-			log.Printf("Using existing session for model %s: %s", modelID, session.SessionID)
-			return nil
-		} else {
-			// Session expired, remove it
-			delete(activeSessions, modelID)
-			log.Printf("Removed expired session for model %s", modelID)
-		}
+	if !exists {
+		return nil
 	}
+	copied := *session
+	return &copied
+}
+
+// createActiveSession opens a session for modelID with retry logic and stores
+// it in activeSessions
+func createActiveSession(modelID string) error {
+	cfg := currentConfig()
+	maxRetries := cfg.Session.CreateRetries
+	baseDelay := cfg.Session.RetryBaseDelay.Duration
 
 	// Create new session with retry logic
 	log.Printf("Creating new session for model %s", modelID)
@@ -215,68 +217,60 @@ func ensureSession(modelID string) error {
 			time.Sleep(delay)
 		}
 
-		sessionURL := getMarketplaceSessionEndpoint(modelID)
-		resp, err := http.Post(sessionURL, "application/json", bytes.NewBuffer(reqBytes))
-		if err != nil {
-			lastErr = fmt.Errorf("failed to establish session: %v", err)
-			log.Printf("Session establishment failed (attempt %d/%d): %v", attempt+1, maxRetries, err)
-			continue
-		}
-
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		resp.Body.Close()
-
-		if resp.StatusCode != http.StatusOK {
-			// Check for nonce error in response
-			var errorResp struct {
-				Error string `json:"error"`
+		// Opening a session sends a transaction from the node's wallet
+		lastErr = sharedProxy().sendTx(getMarketplaceBaseURL(), func() error {
+			resp, err := http.Post(getMarketplaceSessionEndpoint(modelID), "application/json", bytes.NewBuffer(reqBytes))
+			if err != nil {
+				return fmt.Errorf("failed to establish session: %v", err)
 			}
-			if err := json.Unmarshal(bodyBytes, &errorResp); err == nil && strings.Contains(strings.ToLower(errorResp.Error), "nonce") {
-				lastErr = fmt.Errorf("nonce error: %s", errorResp.Error)
-				log.Printf("Nonce error detected (attempt %d/%d): %s", attempt+1, maxRetries, errorResp.Error)
-				continue
+			bodyBytes, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				return chainError("establish session", resp.StatusCode, bodyBytes)
 			}
-
-			lastErr = fmt.Errorf("failed to establish session: %s", string(bodyBytes))
-			log.Printf("Session establishment failed with status %d (attempt %d/%d): %s", resp.StatusCode, attempt+1, maxRetries, string(bodyBytes))
-			continue
-		}
-
-		if err := json.Unmarshal(bodyBytes, &result); err != nil {
-			lastErr = fmt.Errorf("failed to decode session response: %v", err)
-			log.Printf("Failed to decode session response (attempt %d/%d): %v", attempt+1, maxRetries, err)
-			continue
+			if err := json.Unmarshal(bodyBytes, &result); err != nil {
+				return fmt.Errorf("failed to decode session response: %v", err)
+			}
+			if result.Id == "" {
+				return fmt.Errorf("failed to get valid session ID from response")
+			}
+			return nil
+		})
+		if errors.Is(lastErr, ErrNonce) {
+			// sendTx already retried the conflict
+			break
 		}
-
-		if result.Id == "" {
-			lastErr = fmt.Errorf("failed to get valid session ID from response")
-			log.Printf("Empty session ID received (attempt %d/%d)", attempt+1, maxRetries)
+		if lastErr != nil {
+			log.Printf("Session establishment failed (attempt %d/%d): %v", attempt+1, maxRetries, lastErr)
 			continue
 		}
 
 		// Success! Update the session and return
+		sessionMutex.Lock()
 		activeSessions[modelID] = &MorpheusSession{
 			SessionID: result.Id,
 			ModelID:   modelID,
 			ModelName: modelName,
 			Created:   time.Now(),
 		}
-
 		// Update the global session manager
 		SessionManagerInstance.UpdateSession(result.Id, modelID)
+		sessionMutex.Unlock()
 
 		log.Printf("Successfully established new session for model %s: %s (attempt %d)", modelID, result.Id, attempt+1)
 		return nil
 	}
 
 	// If we get here, all retries failed
-	return fmt.Errorf("failed to establish session after %d attempts: %v", maxRetries, lastErr)
+	return fmt.Errorf("failed to establish session after %d attempts: %w", maxRetries, lastErr)
 }
 
 // ModelInfo represents the model information from the marketplace
 type ModelInfo struct {
 	Id   string `json:"Id"`
 	Name string `json:"Name"`
+	// ContextLength is the model's context window in tokens, when listed
+	ContextLength int `json:"ContextLength,omitempty"`
 }
 
 // ModelSearchResponse represents the marketplace API response
@@ -379,10 +373,15 @@ func min3(a, b, c int) int {
 	return c
 }
 
-// Update findModelID to be more robust
+// findModelID resolves a model handle using the package-level model cache
 func findModelID(modelHandle string) (string, error) {
+	return sharedProxy().resolveModelID(modelHandle)
+}
+
+// resolveModelID finds the marketplace model that best matches modelHandle
+func (p *Proxy) resolveModelID(modelHandle string) (string, error) {
 	// Add debug logging
-	log.Printf("Attempting to find model ID for handle: '%s'", modelHandle)
+	p.logger.Printf("Attempting to find model ID for handle: '%s'", modelHandle)
 
 	// Normalize input
 	modelHandle = strings.TrimSpace(modelHandle)
@@ -391,16 +390,16 @@ func findModelID(modelHandle string) (string, error) {
 	}
 
 	// Check cache first
-	modelCache.RLock()
-	if cached, exists := modelCache.m[modelHandle]; exists && time.Since(cached.Created) < time.Hour {
-		modelCache.RUnlock()
-		log.Printf("Found cached model ID for '%s': %s", modelHandle, cached.ModelID)
+	p.models.RLock()
+	if cached, exists := p.models.m[modelHandle]; exists && time.Since(cached.Created) < p.cfg().Session.ModelCacheTTL.Duration {
+		p.models.RUnlock()
+		p.logger.Printf("Found cached model ID for '%s': %s", modelHandle, cached.ModelID)
 		return cached.ModelID, nil
 	}
-	modelCache.RUnlock()
+	p.models.RUnlock()
 
-	endpoint := getMarketplaceModelsEndpoint()
-	log.Printf("Fetching models from: %s", endpoint)
+	endpoint := p.modelsEndpoint()
+	p.logger.Printf("Fetching models from: %s", endpoint)
 
 	// Query the marketplace API
 	resp, err := http.Get(fmt.Sprintf("%s?limit=100&order=desc", endpoint))
@@ -414,7 +413,7 @@ func findModelID(modelHandle string) (string, error) {
 	if err != nil {
 		return "", fmt.Errorf("failed to read response body: %v", err)
 	}
-	log.Printf("Marketplace response: %s", string(bodyBytes))
+	p.debugf("Marketplace response: %s", string(bodyBytes))
 
 	var searchResp ModelSearchResponse
 	if err := json.Unmarshal(bodyBytes, &searchResp); err != nil {
@@ -426,20 +425,21 @@ func findModelID(modelHandle string) (string, error) {
 	}
 
 	// Log available models
-	log.Printf("Available models:")
+	p.logger.Printf("Available models:")
 	for _, model := range searchResp.Models {
-		log.Printf("- %s (ID: %s)", model.Name, model.Id)
+		p.logger.Printf("- %s (ID: %s)", model.Name, model.Id)
 	}
 
 	// Normalize search handle
 	searchHandle := strings.ToLower(modelHandle)
-	log.Printf("Searching for model matching: '%s'", modelHandle)
+	p.logger.Printf("Searching for model matching: '%s'", modelHandle)
 
 	// Try finding a model that contains the search term
 	var matches []struct {
-		id    string
-		name  string
-		score float64
+		id      string
+		name    string
+		context int
+		score   float64
 	}
 
 	for _, model := range searchResp.Models {
@@ -449,15 +449,17 @@ func findModelID(modelHandle string) (string, error) {
 		if strings.Contains(modelName, searchHandle) || strings.Contains(searchHandle, modelName) {
 			score := calculateSimilarity(searchHandle, modelName)
 			matches = append(matches, struct {
-				id    string
-				name  string
-				score float64
+				id      string
+				name    string
+				context int
+				score   float64
 			}{
-				id:    model.Id,
-				name:  model.Name,
-				score: score,
+				id:      model.Id,
+				name:    model.Name,
+				context: model.ContextLength,
+				score:   score,
 			})
-			log.Printf("Found matching model: '%s' with score %.2f", model.Name, score)
+			p.logger.Printf("Found matching model: '%s' with score %.2f", model.Name, score)
 		}
 	}
 
@@ -469,16 +471,17 @@ func findModelID(modelHandle string) (string, error) {
 		})
 
 		bestMatch := matches[0]
-		log.Printf("Selected best match: '%s' with score %.2f", bestMatch.name, bestMatch.score)
+		p.logger.Printf("Selected best match: '%s' with score %.2f", bestMatch.name, bestMatch.score)
 
 		// Cache the result
-		modelCache.Lock()
-		modelCache.m[modelHandle] = CachedModel{
-			ModelID:   bestMatch.id,
-			ModelName: bestMatch.name,
-			Created:   time.Now(),
+		p.models.Lock()
+		p.models.m[modelHandle] = CachedModel{
+			ModelID:       bestMatch.id,
+			ModelName:     bestMatch.name,
+			ContextLength: bestMatch.context,
+			Created:       time.Now(),
 		}
-		modelCache.Unlock()
+		p.models.Unlock()
 
 		return bestMatch.id, nil
 	}
@@ -486,6 +489,7 @@ func findModelID(modelHandle string) (string, error) {
 	// If no partial matches found, try fuzzy search as a last resort
 	var bestMatch string
 	var bestScore float64
+	var bestContext int
 	const similarityThreshold = 0.3
 
 	for _, model := range searchResp.Models {
@@ -493,7 +497,8 @@ func findModelID(modelHandle string) (string, error) {
 		if score > similarityThreshold && score > bestScore {
 			bestScore = score
 			bestMatch = model.Id
-			log.Printf("Found fuzzy match: '%s' with score %.2f", model.Name, score)
+			bestContext = model.ContextLength
+			p.logger.Printf("Found fuzzy match: '%s' with score %.2f", model.Name, score)
 		}
 	}
 
@@ -502,20 +507,27 @@ func findModelID(modelHandle string) (string, error) {
 	}
 
 	// Cache the fuzzy match result
-	modelCache.Lock()
-	modelCache.m[modelHandle] = CachedModel{
-		ModelID:   bestMatch,
-		ModelName: modelHandle,
-		Created:   time.Now(),
+	p.models.Lock()
+	p.models.m[modelHandle] = CachedModel{
+		ModelID:       bestMatch,
+		ModelName:     modelHandle,
+		ContextLength: bestContext,
+		Created:       time.Now(),
 	}
-	modelCache.Unlock()
+	p.models.Unlock()
 
 	return bestMatch, nil
 }
 
-// validateModelHandle checks if the model handle is valid and returns the corresponding ID
+// validateModelHandle checks a model handle against the package-level model
+// cache
 func validateModelHandle(handle string) (string, error) {
-	modelID, err := findModelID(handle)
+	return sharedProxy().validateModelHandle(handle)
+}
+
+// validateModelHandle checks if the model handle is valid and returns the corresponding ID
+func (p *Proxy) validateModelHandle(handle string) (string, error) {
+	modelID, err := p.resolveModelID(handle)
 	if err != nil {
 		if err.Error() == "No Supported Model Has Been Registered" {
 			return "", err
@@ -555,26 +567,26 @@ func ProxyChatCompletion(w http.ResponseWriter, r *http.Request) {
 	// Convert model handle to ID
 	modelID, err := validateModelHandle(modelHandle)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, err.Error())
+		respondWithAPIError(w, http.StatusNotFound, newAPIError("invalid_request_error", "model_not_found", "model", err.Error()))
 		return
 	}
 
 	// Ensure we have an active session for this model ID
 	if err := ensureSession(modelID); err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to establish session")
+		respondWithForwardError(w, "Failed to establish session", err)
 		return
 	}
 
-	sessionId := activeSessions[modelID].SessionID
+	session := activeSession(modelID)
+	if session == nil {
+		respondWithError(w, http.StatusBadGateway, "Session expired before the request was sent")
+		return
+	}
 
 	fmt.Printf("--- Update Session with Model ID: %s\n ---", modelID)
-	fmt.Printf("------ Session ID: %s\n ------", sessionId)
-	fmt.Printf("------ Active Sessions: %+v\n ------", activeSessions)
+	fmt.Printf("------ Session ID: %s\n ------", session.SessionID)
 	fmt.Print("\n---\n\n")
 
-	// Update SessionManager with the new or existing session ID
-	SessionManagerInstance.UpdateSession(activeSessions[modelID].SessionID, modelID)
-
 	// Create a new request body with the model ID
 	newRequestBody := make(map[string]interface{})
 	for k, v := range requestBody {
@@ -612,9 +624,6 @@ func ProxyChatCompletion(w http.ResponseWriter, r *http.Request) {
 // Modify forwardRequest to accept modelID and use the correct session
 func forwardRequest(requestBody map[string]interface{}, modelID string) (*http.Response, error) {
 	marketplaceURL := getMarketplaceChatEndpoint()
-	if marketplaceURL == "" {
-		return nil, fmt.Errorf("MARKETPLACE_URL environment variable is not set")
-	}
 
 	// Add debug logging for URL
 	log.Printf("Attempting to forward request to: %s", marketplaceURL)
@@ -624,42 +633,74 @@ func forwardRequest(requestBody map[string]interface{}, modelID string) (*http.R
 		return nil, fmt.Errorf("failed to marshal request body: %v", err)
 	}
 
-	req, err := http.NewRequest("POST", marketplaceURL, bytes.NewBuffer(reqBodyBytes))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %v", err)
+	cfg := currentConfig().Marketplace
+	client := &http.Client{
+		Timeout: cfg.RequestTimeout.Duration,
 	}
 
-	req.Header.Set("Content-Type", "application/json")
+	// Retry connection errors, 5xx and closed sessions with jittered backoff
+	var resp *http.Response
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			delay := chatRetryDelay(cfg.ChatRetryBaseDelay.Duration, cfg.ChatRetryMaxDelay.Duration, attempt)
+			log.Printf("Retrying forwarded request (attempt %d/%d) after %v", attempt+1, cfg.ChatRetries+1, delay)
+			time.Sleep(delay)
+		}
 
-	log.Printf("Active session for model %s: %+v", modelID, activeSessions[modelID])
-	if session, exists := activeSessions[modelID]; exists && session.SessionID != "" {
-		// Add session ID to request headers
-		req.Header.Set("session_id", session.SessionID)
-		log.Printf("Setting session ID in request headers: %s", session.SessionID)
-	} else {
-		log.Printf("Warning: No active session ID available for model %s", modelID)
-		return nil, fmt.Errorf("no active session for model %s", modelID)
-	}
+		req, err := http.NewRequest("POST", marketplaceURL, bytes.NewBuffer(reqBodyBytes))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %v", err)
+		}
 
-	// Add debug logging for all headers
-	log.Printf("Request headers: %v", req.Header)
-	log.Printf("Request body: %s", reqBodyBytes)
+		req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{
-		Timeout: 30 * time.Second,
-	}
+		session := activeSession(modelID)
+		log.Printf("Active session for model %s: %+v", modelID, session)
+		if session != nil && session.SessionID != "" {
+			// Add session ID to request headers
+			req.Header.Set("session_id", session.SessionID)
+			log.Printf("Setting session ID in request headers: %s", session.SessionID)
+		} else {
+			log.Printf("Warning: No active session ID available for model %s", modelID)
+			return nil, fmt.Errorf("no active session for model %s", modelID)
+		}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Printf("Request failed: %v", err)
-		return nil, fmt.Errorf("failed to forward request: %v", err)
-	}
+		// Add debug logging for all headers
+		debugf("Request headers: %v", req.Header)
+		debugf("Request body: %s", reqBodyBytes)
 
-	if resp.StatusCode != http.StatusOK {
+		resp, err = client.Do(req)
+		if err != nil {
+			log.Printf("Request failed: %v", err)
+			if attempt < cfg.ChatRetries {
+				continue
+			}
+			return nil, fmt.Errorf("failed to forward request: %v", err)
+		}
+
+		if resp.StatusCode == http.StatusOK {
+			break
+		}
 		body, _ := io.ReadAll(resp.Body)
 		resp.Body.Close()
 		log.Printf("Marketplace returned error status %d: %s", resp.StatusCode, string(body))
 		resp.Body = io.NopCloser(bytes.NewBuffer(body))
+		if attempt >= cfg.ChatRetries {
+			break
+		}
+		if sessionClosed(resp.StatusCode, body) {
+			// Open a fresh session before trying again
+			sessionMutex.Lock()
+			delete(activeSessions, modelID)
+			sessionMutex.Unlock()
+			if err := ensureSession(modelID); err != nil {
+				return nil, fmt.Errorf("failed to replace closed session: %v", err)
+			}
+			continue
+		}
+		if resp.StatusCode < 500 {
+			break
+		}
 	}
 
 	// Add response logging
@@ -673,10 +714,15 @@ func forwardRequest(requestBody map[string]interface{}, modelID string) (*http.R
 func handleStreamingRequest(w http.ResponseWriter, requestBody map[string]interface{}, modelID string) {
 	resp, err := forwardRequest(requestBody, modelID)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to forward streaming request")
+		respondWithForwardError(w, "Failed to forward streaming request", err)
 		return
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		respondWithUpstreamError(w, resp.StatusCode, body)
+		return
+	}
 
 	setStreamingHeaders(w)
 
@@ -693,17 +739,22 @@ func handleStreamingRequest(w http.ResponseWriter, requestBody map[string]interf
 	}
 
 	if err := scanner.Err(); err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error reading streaming response")
+		writeStreamError(w, err)
 	}
 }
 
 func handleNonStreamingRequest(w http.ResponseWriter, requestBody map[string]interface{}, modelID string) {
 	resp, err := forwardRequest(requestBody, modelID)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to forward request")
+		respondWithForwardError(w, "Failed to forward request", err)
 		return
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		respondWithUpstreamError(w, resp.StatusCode, body)
+		return
+	}
 
 	copyHeaders(w, resp.Header)
 	w.WriteHeader(resp.StatusCode)
@@ -730,43 +781,76 @@ func copyHeaders(w http.ResponseWriter, headers http.Header) {
 
 // respondWithError sends an error response to the client
 func respondWithError(w http.ResponseWriter, statusCode int, message string) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(statusCode)
-	json.NewEncoder(w).Encode(map[string]string{"error": message})
+	respondWithAPIError(w, statusCode, newAPIError(errorTypeForStatus(statusCode), "", "", message))
 }
 
-// StartProxyServer starts the proxy server
-func StartProxyServer() {
-	proxy := NewProxy()
+// APIError is the OpenAI-compatible error object returned to clients
+type APIError struct {
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Param   *string `json:"param"`
+	Code    *string `json:"code"`
+	// Violations lists why model output failed its response_format
+	Violations []string `json:"violations,omitempty"`
+}
 
-	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(map[string]string{"status": "healthy"})
-	})
+// StartProxyServer loads the configuration from configPath (optional) and the
+// environment, then starts the proxy server. Invalid configuration is fatal.
+func StartProxyServer(configPath string) {
+	cfg, err := LoadConfig(configPath)
+	if err == nil {
+		err = cfg.Validate()
+	}
+	if err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+
+	server, reload, err := newDefaultServer(cfg)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
 
-	// Add handlers for blockchain/models endpoints
-	http.HandleFunc("/blockchain/models", proxy.handleGetModels)
-	http.HandleFunc("/blockchain/models/", proxy.handleModelOperations)
-	http.HandleFunc("/v1/chat/completions", proxy.handleChatCompletions)
+	watchConfig(configPath, 2*time.Second, reload)
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = os.Getenv("DEFAULT_PORT")
-		if port == "" {
-			port = "8081"
+	port := cfg.Server.Port
+
+	if socket := cfg.Server.UnixSocket; socket != "" {
+		listener, err := listenUnix(socket)
+		if err != nil {
+			log.Fatalf("Failed to listen on unix socket %s: %v", socket, err)
 		}
+		log.Printf("Proxy server is listening on unix socket %s", socket)
+		go func() {
+			log.Fatal(http.Serve(listener, server))
+		}()
 	}
+
+	if cfg.Server.TLS.Enabled() {
+		reloader, err := newCertReloader(cfg.Server.TLS)
+		if err != nil {
+			log.Fatalf("Invalid TLS configuration: %v", err)
+		}
+		httpServer := &http.Server{Addr: ":" + port, Handler: server, TLSConfig: reloader.TLSConfig()}
+		log.Printf("Proxy server is running with TLS on port %s", port)
+		log.Fatal(httpServer.ListenAndServeTLS("", ""))
+	}
+
 	log.Printf("Proxy server is running on port %s", port)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	log.Fatal(http.ListenAndServe(":"+port, server))
 }
 
 // Add a cleanup function for expired sessions
 func cleanupExpiredSessions() {
 	sessionMutex.Lock()
 	defer sessionMutex.Unlock()
+	cleanupExpiredSessionsLocked()
+}
 
+// cleanupExpiredSessionsLocked is cleanupExpiredSessions for callers that
+// hold sessionMutex
+func cleanupExpiredSessionsLocked() {
 	for modelID, session := range activeSessions {
-		if time.Since(session.Created) > time.Duration(sessionExpirationSeconds)*time.Second {
+		if time.Since(session.Created) > time.Duration(getSessionExpirationSeconds())*time.Second {
 			delete(activeSessions, modelID)
 			log.Printf("Cleaned up expired session for model %s", modelID)
 		}
@@ -774,78 +858,134 @@ func cleanupExpiredSessions() {
 }
 
 func (p *Proxy) handleChatCompletions(w http.ResponseWriter, r *http.Request) {
-    log.Printf("Received chat completions request from %s", r.RemoteAddr)
+    p.logger.Printf("Received chat completions request from %s", r.RemoteAddr)
     
     // Read and parse request body
     body, err := io.ReadAll(r.Body)
     if err != nil {
-        log.Printf("Error reading request body: %v", err)
-        http.Error(w, "Error reading request body", http.StatusBadRequest)
+        p.logger.Printf("Error reading request body: %v", err)
+        respondWithAPIError(w, http.StatusBadRequest, newAPIError("invalid_request_error", "", "", "Error reading request body"))
         return
     }
-    log.Printf("Raw request body: %s", string(body))
+    p.debugf("Raw request body: %s", string(body))
 
     var chatRequest ChatCompletionRequest
     if err := json.Unmarshal(body, &chatRequest); err != nil {
-        log.Printf("Error parsing chat request: %v", err)
-        http.Error(w, "Error parsing request body", http.StatusBadRequest)
+        p.logger.Printf("Error parsing chat request: %v", err)
+        respondWithAPIError(w, http.StatusBadRequest, newAPIError("invalid_request_error", "", "", fmt.Sprintf("Error parsing request body: %v", err)))
         return
     }
 
-    // Ensure stream is set to true
-    chatRequest.Stream = true
-    
     // Check for existing session ID in header using consistent header name
     sessionID := r.Header.Get("session_id")
-    log.Printf("Session ID from header: %s", sessionID)
-    
-    if sessionID != "" {
-        sessionCache.RLock()
-        if session, exists := sessionCache.m[sessionID]; exists && time.Now().Before(session.ExpiresAt) {
-            sessionCache.RUnlock()
-            log.Printf("Using existing session: %s for model %s", sessionID, session.ModelID)
-            if err := p.forwardChatRequest(w, r, session.ModelID, chatRequest, sessionID); err != nil {
-                log.Printf("Error forwarding chat request: %v", err)
-                http.Error(w, fmt.Sprintf("Error forwarding request: %v", err), http.StatusInternalServerError)
+    p.logger.Printf("Session ID from header: %s", sessionID)
+
+    p.serveChat(w, r, chatRequest, sessionID)
+}
+
+// serveChat runs a parsed chat request through middleware, rate limits and
+// the fallback chain and streams the reply to w. sessionID, if set, is used
+// for the first model. It returns the attempt that streamed, which is nil when
+// the request failed before streaming. Either way the client has been answered.
+func (p *Proxy) serveChat(w http.ResponseWriter, r *http.Request, chatRequest ChatCompletionRequest, sessionID string) (*chatAttempt, error) {
+    // Ensure stream is set to true
+    chatRequest.Stream = true
+
+    // Resolve aliases and fallback chains before rate limits and model lookup.
+    // Middleware and rate limits of the first model apply to the request.
+    candidates := chatCandidates(chatRequest.Model, p.cfg().Models)
+    chatRequest.Model = candidates[0]
+
+    // Reject a response_format that cannot be enforced before doing any work
+    format, err := chatRequest.ResponseFormat.outputFormat()
+    if err != nil {
+        respondWithAPIError(w, http.StatusBadRequest, newAPIError("invalid_request_error", "", "response_format", err.Error()))
+        return nil, err
+    }
+
+    // Run the model's middleware chain before limits see the prompt
+    pipeline := &chatPipeline{
+        cc: &ChatContext{
+            Request:        r,
+            Caller:         callerID(r),
+            Model:          chatRequest.Model,
+            UpstreamHeader: make(http.Header),
+            ResponseHeader: w.Header(),
+        },
+        chain: p.middlewareChain(chatRequest.Model),
+    }
+    if err = pipeline.processRequest(&chatRequest); err != nil {
+        p.logger.Printf("Middleware rejected request for model %s: %v", chatRequest.Model, err)
+        if mwErr, ok := err.(*MiddlewareError); ok {
+            respondWithAPIError(w, mwErr.Status, newAPIError("invalid_request_error", mwErr.Code, "", mwErr.Message))
+        } else {
+            respondWithAPIError(w, http.StatusBadRequest, newAPIError("invalid_request_error", "", "", err.Error()))
+        }
+        return nil, err
+    }
+
+    // Apply per-key and per-model rate limits before touching the marketplace.
+    // Summarizing a long prompt opens a session, so it waits for the limits too.
+    if p.limiter != nil {
+        release, err := p.limiter.Acquire(r.Context(), callerID(r), chatRequest.Model, estimatePromptTokens(chatRequest.Messages))
+        if err != nil {
+            if rlErr, ok := err.(*RateLimitError); ok {
+                p.logger.Printf("Rate limit exceeded for model %s: %s", chatRequest.Model, rlErr.Reason)
+                respondWithRateLimit(w, rlErr)
+            } else {
+                respondWithAPIError(w, http.StatusServiceUnavailable, newAPIError("server_error", "", "", "Request cancelled while queued"))
             }
-            return
+            return nil, err
         }
-        sessionCache.RUnlock()
-        log.Printf("Session %s not found or expired", sessionID)
+        defer release()
     }
 
-    // Get model ID from request
-    modelID, err := validateModelHandle(chatRequest.Model)
+    // Fit the prompt into the model's context window
+    trim, err := p.fitContext(r, &chatRequest)
     if err != nil {
-        log.Printf("Error validating model handle: %v", err)
-        http.Error(w, fmt.Sprintf("Error finding model ID: %v", err), http.StatusBadRequest)
-        return
+        p.logger.Printf("Rejecting request for model %s: %v", chatRequest.Model, err)
+        respondWithAPIError(w, http.StatusBadRequest, newAPIError("invalid_request_error", "context_length_exceeded", "messages", err.Error()))
+        return nil, err
+    }
+    if trim != nil {
+        w.Header().Set("X-NFA-Context-Trimmed", trim.header())
     }
-    log.Printf("Validated model ID: %s", modelID)
+    r = r.WithContext(context.WithValue(r.Context(), chatContextKey{}, pipeline))
 
-    // Create new session
-    sessionID, err = p.createSession(modelID)
-    if err != nil {
-        log.Printf("Error creating session: %v", err)
-        http.Error(w, fmt.Sprintf("Error creating session: %v", err), http.StatusInternalServerError)
-        return
+    // Open the first model that starts streaming, falling back down the chain
+    attempt, failure := p.openChatCandidates(r, chatRequest, candidates, sessionID)
+    if failure != nil {
+        respondWithChatFailure(w, failure)
+        return nil, failure
+    }
+    chatRequest.Model = attempt.model
+    if len(candidates) > 1 {
+        w.Header().Set("X-NFA-Model", attempt.model)
+    }
+
+    // Structured output is checked before anything is sent
+    if format != nil {
+        return p.serveStructuredChat(w, r, chatRequest, attempt, format)
     }
-    log.Printf("Created new session: %s", sessionID)
 
-    if err := p.forwardChatRequest(w, r, modelID, chatRequest, sessionID); err != nil {
-        log.Printf("Error forwarding chat request: %v", err)
-        http.Error(w, fmt.Sprintf("Error forwarding request: %v", err), http.StatusInternalServerError)
+    // The stream has started, so failures are reported as an SSE event
+    err = p.streamChat(w, r, attempt.modelID, chatRequest, attempt.sessionID, attempt.upstream)
+    attempt.sessionID = attempt.upstream.sessionID
+    if err != nil {
+        p.logger.Printf("Error forwarding chat request: %v", err)
+        writeStreamError(w, err)
     }
+    return attempt, err
 }
 
 func (p *Proxy) findModelID(modelHandle string) (string, error) {
     // Check model cache first
-    modelCache.RLock()
-    if model, exists := modelCache.m[modelHandle]; exists && time.Since(model.Created) < time.Hour {
-        modelCache.RUnlock()
+    p.models.RLock()
+    if model, exists := p.models.m[modelHandle]; exists && time.Since(model.Created) < p.cfg().Session.ModelCacheTTL.Duration {
+        p.models.RUnlock()
         return model.ModelID, nil
     }
-    modelCache.RUnlock()
+    p.models.RUnlock()
 
     // Fetch models from consumer node
     models, err := p.getMarketplaceModels()
@@ -856,26 +996,26 @@ func (p *Proxy) findModelID(modelHandle string) (string, error) {
     // Find best matching model
     var bestMatch string
     var bestScore float64
-    log.Printf("Looking for model match: %s", modelHandle)
+    p.logger.Printf("Looking for model match: %s", modelHandle)
     
     for _, model := range models {
         score := calculateSimilarity(model.Name, modelHandle)
-        log.Printf("Comparing '%s' with '%s', score: %.2f", model.Name, modelHandle, score)
+        p.logger.Printf("Comparing '%s' with '%s', score: %.2f", model.Name, modelHandle, score)
         
         if score > bestScore {
             bestScore = score
             bestMatch = model.Id
             
             // Cache the match
-            modelCache.Lock()
-            modelCache.m[modelHandle] = CachedModel{
+            p.models.Lock()
+            p.models.m[modelHandle] = CachedModel{
                 ModelID:   model.Id,
                 ModelName: model.Name,
                 Created:   time.Now(),
             }
-            modelCache.Unlock()
+            p.models.Unlock()
             
-            log.Printf("New best match: '%s' (ID: %s) with score %.2f", model.Name, model.Id, score)
+            p.logger.Printf("New best match: '%s' (ID: %s) with score %.2f", model.Name, model.Id, score)
         }
     }
 
@@ -887,73 +1027,98 @@ func (p *Proxy) findModelID(modelHandle string) (string, error) {
 }
 
 func (p *Proxy) createSession(modelID string) (string, error) {
-    log.Printf("Creating new session for model ID: %s", modelID)
+    // The session stays on the node that opens it, and is paid for by that
+    // node's wallet, so prefer a wallet that is funded and not busy
+    return p.createSessionOn(p.pickSessionNode(), modelID)
+}
+
+// createSessionOn opens a session for modelID on node
+func (p *Proxy) createSessionOn(node *consumerNode, modelID string) (string, error) {
+    p.logger.Printf("Creating new session for model ID: %s", modelID)
     
-    endpoint := fmt.Sprintf("%s/blockchain/models/%s/session", p.getMarketplaceBaseURL(), modelID)
-    log.Printf("Session creation endpoint: %s", endpoint)
+    endpoint := fmt.Sprintf("%s/blockchain/models/%s/session", node.URL, modelID)
+    p.logger.Printf("Session creation endpoint: %s", endpoint)
     
     reqBody := map[string]interface{}{
-        "sessionDuration": sessionExpirationSeconds,
+        "sessionDuration": p.cfg().Session.ExpirationSeconds,
         "failover": false,
     }
     jsonBody, err := json.Marshal(reqBody)
     if err != nil {
-        log.Printf("Error marshaling session request: %v", err)
+        p.logger.Printf("Error marshaling session request: %v", err)
         return "", err
     }
 
-    req, err := http.NewRequest("POST", endpoint, bytes.NewBuffer(jsonBody))
-    if err != nil {
-        log.Printf("Error creating session request: %v", err)
-        return "", err
-    }
+    // Opening a session sends a transaction from the node's wallet, so it
+    // waits for any other transaction of that wallet to finish
+    var respBody []byte
+    err = p.sendTx(node.URL, func() error {
+        req, err := http.NewRequest("POST", endpoint, bytes.NewBuffer(jsonBody))
+        if err != nil {
+            p.logger.Printf("Error creating session request: %v", err)
+            return err
+        }
 
-    req.Header.Set("Content-Type", "application/json")
-    req.Header.Set("Accept", "application/json")
-    log.Printf("Sending session creation request with body: %s", string(jsonBody))
-    
-    resp, err := p.client.Do(req)
-    if err != nil {
-        log.Printf("Error sending session request: %v", err)
-        return "", err
-    }
-    defer resp.Body.Close()
+        req.Header.Set("Content-Type", "application/json")
+        req.Header.Set("Accept", "application/json")
+        p.logger.Printf("Sending session creation request with body: %s", string(jsonBody))
+
+        // Fail fast while the marketplace is unreachable
+        done := p.beginNode(node)
+        out, err := p.breaker.Execute(func() (interface{}, error) {
+            resp, err := p.client.Do(req)
+            done(nodeOutcome(resp, err))
+            return resp, err
+        })
+        if err != nil {
+            p.logger.Printf("Error sending session request: %v", err)
+            return err
+        }
+        resp := out.(*http.Response)
+        defer resp.Body.Close()
 
-    respBody, err := io.ReadAll(resp.Body)
+        respBody, err = io.ReadAll(resp.Body)
+        if err != nil {
+            p.logger.Printf("Error reading response body: %v", err)
+            return err
+        }
+        p.logger.Printf("Received response with status %d: %s", resp.StatusCode, string(respBody))
+
+        if resp.StatusCode != http.StatusOK {
+            p.logger.Printf("Received non-200 status code: %d", resp.StatusCode)
+            return chainError("create session", resp.StatusCode, respBody)
+        }
+        return nil
+    })
     if err != nil {
-        log.Printf("Error reading response body: %v", err)
         return "", err
     }
-    log.Printf("Received response with status %d: %s", resp.StatusCode, string(respBody))
-
-    if resp.StatusCode != http.StatusOK {
-        log.Printf("Received non-200 status code: %d", resp.StatusCode)
-        return "", fmt.Errorf("failed to create session, status: %d, body: %s", resp.StatusCode, string(respBody))
-    }
 
     var result struct {
         SessionID string `json:"sessionId"`
     }
     if err := json.Unmarshal(respBody, &result); err != nil {
-        log.Printf("Error decoding session response: %v", err)
+        p.logger.Printf("Error decoding session response: %v", err)
         return "", err
     }
 
     if result.SessionID == "" {
-        log.Printf("No sessionId in response. Full response: %s", string(respBody))
+        p.logger.Printf("No sessionId in response. Full response: %s", string(respBody))
         return "", fmt.Errorf("no sessionId in response")
     }
     
     // Cache the session
-    sessionCache.Lock()
-    sessionCache.m[result.SessionID] = CachedSession{
+    p.sessions.Lock()
+    p.sessions.m[result.SessionID] = CachedSession{
         SessionID:  result.SessionID,
         ModelID:    modelID,
-        ExpiresAt:  time.Now().Add(time.Duration(sessionExpirationSeconds) * time.Second),
+        Node:       node.URL,
+        Created:    time.Now(),
+        ExpiresAt:  time.Now().Add(time.Duration(p.cfg().Session.ExpirationSeconds) * time.Second),
     }
-    sessionCache.Unlock()
+    p.sessions.Unlock()
     
-    log.Printf("Successfully created and cached session with ID: %s", result.SessionID)
+    p.logger.Printf("Successfully created and cached session with ID: %s", result.SessionID)
     return result.SessionID, nil
 }
 
@@ -963,27 +1128,36 @@ func (p *Proxy) cleanupSession(sessionID string, modelID string) error {
         return fmt.Errorf("invalid session ID or model ID")
     }
 
-    endpoint := fmt.Sprintf("%s/blockchain/models/%s/session/%s", p.getMarketplaceBaseURL(), modelID, sessionID)
+    node := p.sessionNode(sessionID)
+    endpoint := fmt.Sprintf("%s/blockchain/models/%s/session/%s", node.URL, modelID, sessionID)
     req, err := http.NewRequest("DELETE", endpoint, nil)
     if err != nil {
         return fmt.Errorf("error creating cleanup request: %v", err)
     }
 
-    resp, err := p.client.Do(req)
-    if err != nil {
-        return fmt.Errorf("error sending cleanup request: %v", err)
-    }
-    defer resp.Body.Close()
+    // Closing a session is a transaction from the node's wallet
+    return p.sendTx(node.URL, func() error {
+        resp, err := p.client.Do(req)
+        if err != nil {
+            return fmt.Errorf("error sending cleanup request: %v", err)
+        }
+        defer resp.Body.Close()
 
-    // Log cleanup attempt
-    log.Printf("Session cleanup for ID %s completed with status: %d", sessionID, resp.StatusCode)
-    return nil
+        // Log cleanup attempt
+        p.logger.Printf("Session cleanup for ID %s completed with status: %d", sessionID, resp.StatusCode)
+        if resp.StatusCode != http.StatusOK {
+            body, _ := io.ReadAll(resp.Body)
+            return chainError("close session", resp.StatusCode, body)
+        }
+        return nil
+    })
 }
 
 type ChatCompletionRequest struct {
-    Model    string    `json:"model"`
-    Messages []Message `json:"messages"`
-    Stream   bool      `json:"stream"`
+    Model          string          `json:"model"`
+    Messages       []Message       `json:"messages"`
+    Stream         bool            `json:"stream"`
+    ResponseFormat *ResponseFormat `json:"response_format,omitempty"`
 }
 
 type Message struct {
@@ -1011,48 +1185,131 @@ func getMatchScore(a, b string) float32 {
 }
 
 type Proxy struct {
-	client *http.Client
+	client  *http.Client
+	logger  *log.Logger
+	limiter *RateLimiter
+	budgets *BudgetTracker
+	usage   *UsageLedger
+	audit   *AuditLog
+	nodes   *NodePool
+	threads ThreadStore
+	batches *batchManager
+	async   *asyncJobs
+	wallets *walletTracker
+
+	// Runtime state. NewProxy points these at the package-level defaults;
+	// New gives each server its own.
+	config    *atomic.Pointer[Config]
+	debug     *atomic.Bool
+	sessions  *sessionStore
+	models    *modelStore
+	breaker   *gobreaker.CircuitBreaker
+	catalog   *catalogState
+	readiness *readinessCache
+	txs       *txQueue
+
+	middleware      middlewareRegistry
+	threadLocks     threadLocks
+	summarySessions sync.Map // summary model -> session ID
+
+	authenticators []Authenticator
 }
 
-func NewProxy() *Proxy {
+// sharedProxy returns a proxy on the package-level state, without the
+// optional features
+func sharedProxy() *Proxy {
 	return &Proxy{
-		client: &http.Client{},
+		client:    &http.Client{},
+		logger:    log.Default(),
+		config:    &activeConfig,
+		debug:     &debugLogging,
+		sessions:  sessionCache,
+		models:    modelCache,
+		breaker:   circuitBreaker,
+		catalog:   catalog,
+		readiness: readiness,
+		txs:       sharedTxs,
+	}
+}
+
+// NewProxy returns a proxy that shares the package-level config, caches and
+// circuit breaker. Use New for an isolated instance.
+func NewProxy() *Proxy {
+	p := sharedProxy()
+	cfg := p.cfg()
+	p.usage = NewUsageLedger(cfg.UsageLedgerFile)
+	p.threads = newThreadStore(cfg.Threads)
+	if len(cfg.Marketplace.Nodes) > 0 {
+		p.nodes = NewNodePool(cfg.Marketplace)
+	}
+	return p
+}
+
+// cfg returns the proxy's active configuration
+func (p *Proxy) cfg() *Config {
+	if cfg := p.config.Load(); cfg != nil {
+		return cfg
 	}
+	return currentConfig()
+}
+
+// setConfig installs cfg as the proxy's active configuration
+func (p *Proxy) setConfig(cfg *Config) {
+	p.config.Store(cfg)
+	p.debug.Store(cfg.LogLevel == "debug")
 }
 
+// debugf logs only when log_level is debug; see the package-level debugf
+func (p *Proxy) debugf(format string, args ...interface{}) {
+	if p.debug.Load() {
+		p.logger.Printf(format, args...)
+	}
+}
+
+// httpClient returns the proxy's HTTP client with a per-call timeout
+func (p *Proxy) httpClient(timeout time.Duration) *http.Client {
+	client := *p.client
+	client.Timeout = timeout
+	return &client
+}
+
+// getMarketplaceBaseURL returns a consumer node for requests that are not
+// tied to a session
 func (p *Proxy) getMarketplaceBaseURL() string {
-    if url := os.Getenv("MARKETPLACE_URL"); url != "" {
-        return url
-    }
-    return "https://consumer-node-yalzemm5uq-uc.a.run.app"
+    return p.pickNode().URL
+}
+
+// modelsEndpoint is the model listing on the configured marketplace URL
+func (p *Proxy) modelsEndpoint() string {
+    return fmt.Sprintf("%s/blockchain/models", p.cfg().Marketplace.URL)
 }
 
 func (p *Proxy) getMarketplaceModels() ([]MarketplaceModel, error) {
     endpoint := fmt.Sprintf("%s/blockchain/models", p.getMarketplaceBaseURL())
-    log.Printf("Fetching models from: %s", endpoint)
+    p.logger.Printf("Fetching models from: %s", endpoint)
     
     req, err := http.NewRequest("GET", endpoint, nil)
     if err != nil {
-        log.Printf("Error creating request: %v", err)
+        p.logger.Printf("Error creating request: %v", err)
         return nil, err
     }
 
     resp, err := p.client.Do(req)
     if err != nil {
-        log.Printf("Error sending request: %v", err)
+        p.logger.Printf("Error sending request: %v", err)
         return nil, err
     }
     defer resp.Body.Close()
 
     body, err := io.ReadAll(resp.Body)
     if err != nil {
-        log.Printf("Error reading response body: %v", err)
+        p.logger.Printf("Error reading response body: %v", err)
         return nil, err
     }
-    log.Printf("Raw response body: %s", string(body))
+    p.debugf("Raw response body: %s", string(body))
 
     if resp.StatusCode != http.StatusOK {
-        log.Printf("Received non-200 status code: %d", resp.StatusCode)
+        p.logger.Printf("Received non-200 status code: %d", resp.StatusCode)
         return nil, fmt.Errorf("failed to fetch models, status: %d", resp.StatusCode)
     }
 
@@ -1060,59 +1317,86 @@ func (p *Proxy) getMarketplaceModels() ([]MarketplaceModel, error) {
         Models []MarketplaceModel `json:"models"`
     }
     if err := json.Unmarshal(body, &result); err != nil {
-        log.Printf("Error parsing response: %v", err)
+        p.logger.Printf("Error parsing response: %v", err)
         return nil, err
     }
 
-    log.Printf("Successfully parsed models: %+v", result.Models)
+    p.logger.Printf("Successfully parsed models: %+v", result.Models)
     return result.Models, nil
 }
 
 func (p *Proxy) forwardChatRequest(w http.ResponseWriter, r *http.Request, modelID string, req ChatCompletionRequest, sessionID string) error {
+    annotateAudit(r.Context(), req.Model, modelID, sessionID)
+    upstream, err := p.openChatStream(r, modelID, req, sessionID)
+    if err != nil {
+        return err
+    }
+    return p.streamChat(w, r, modelID, req, sessionID, upstream)
+}
+
+// openChatStream sends the chat request upstream and returns once the
+// response stream has started, without writing to the client
+func (p *Proxy) openChatStream(r *http.Request, modelID string, req ChatCompletionRequest, sessionID string) (*chatUpstream, error) {
     // Create request body with original model name (not ID) to match consumer node expectation
     reqBody := map[string]interface{}{
         "model":    req.Model, // Use original model name
         "messages": req.Messages,
         "stream":   true, // Always set to true
     }
+    if req.ResponseFormat != nil {
+        reqBody["response_format"] = req.ResponseFormat
+    }
 
     jsonBody, err := json.Marshal(reqBody)
     if err != nil {
-        return fmt.Errorf("error marshaling request body: %v", err)
+        return nil, fmt.Errorf("error marshaling request body: %v", err)
     }
 
-    // Create the request
-    endpoint := fmt.Sprintf("%s/v1/chat/completions", p.getMarketplaceBaseURL())
-    proxyReq, err := http.NewRequest(r.Method, endpoint, bytes.NewBuffer(jsonBody))
-    if err != nil {
-        return fmt.Errorf("error creating request: %v", err)
+    // Set required headers
+    header := make(http.Header)
+    header.Set("Content-Type", "application/json")
+    header.Set("Accept", "application/json")
+
+    if pipeline := pipelineFrom(r.Context()); pipeline != nil {
+        for name, values := range pipeline.cc.UpstreamHeader {
+            header[name] = values
+        }
     }
 
-    // Set required headers
-    proxyReq.Header.Set("Content-Type", "application/json")
-    proxyReq.Header.Set("Accept", "application/json")
-    proxyReq.Header.Set("session_id", sessionID) // Use consistent session_id header
-
-    // Log request details
-    log.Printf("Forwarding request to: %s", endpoint)
-    log.Printf("Request headers: %v", proxyReq.Header)
-    log.Printf("Request body: %s", string(jsonBody))
-
-    // Send the request with increased timeout
-    client := &http.Client{
-        Timeout: time.Minute * 5,
+    // Send the request, retrying until the stream starts
+    return p.sendChatRequest(r, modelID, req.Model, sessionID, header, jsonBody)
+}
+
+// streamChat relays an open upstream stream to the client through the
+// middleware chain and records usage
+func (p *Proxy) streamChat(w http.ResponseWriter, r *http.Request, modelID string, req ChatCompletionRequest, sessionID string, upstream *chatUpstream) (err error) {
+    annotateAudit(r.Context(), req.Model, modelID, sessionID)
+
+    // A client that goes away mid-stream does not count against the node
+    defer func() { upstream.close(err == nil || r.Context().Err() != nil) }()
+    if upstream.sessionID != sessionID {
+        // Let the client continue on the replacement session
+        sessionID = upstream.sessionID
+        w.Header().Set("session_id", sessionID)
+        annotateAudit(r.Context(), req.Model, modelID, sessionID)
     }
-    resp, err := client.Do(proxyReq)
-    if err != nil {
-        return fmt.Errorf("error sending request: %v", err)
+
+    pipeline := pipelineFrom(r.Context())
+    if pipeline != nil {
+        pipeline.cc.ModelID = modelID
+        pipeline.cc.SessionID = sessionID
     }
-    defer resp.Body.Close()
 
-    // Check response status
-    if resp.StatusCode != http.StatusOK {
-        body, _ := io.ReadAll(resp.Body)
-        return fmt.Errorf("marketplace request failed, status: %d, response: %s", resp.StatusCode, string(body))
+    // Count the request against the session for the admin API
+    p.sessions.Lock()
+    if session, exists := p.sessions.m[sessionID]; exists {
+        session.Requests++
+        if session.ModelName == "" {
+            session.ModelName = req.Model
+        }
+        p.sessions.m[sessionID] = session
     }
+    p.sessions.Unlock()
 
     // Set streaming headers
     w.Header().Set("Content-Type", "text/event-stream")
@@ -1120,38 +1404,75 @@ func (p *Proxy) forwardChatRequest(w http.ResponseWriter, r *http.Request, model
     w.Header().Set("Connection", "keep-alive")
     w.WriteHeader(http.StatusOK)
 
-    // Stream the response
-    reader := bufio.NewReader(resp.Body)
+    // Record token usage for whatever was streamed, even if the stream breaks
+    usage := newUsageCollector(req.Messages)
+    defer func() {
+        rec := usage.record()
+        rec.Caller = callerID(r)
+        rec.Model = req.Model
+        rec.ModelID = modelID
+        rec.SessionID = sessionID
+        p.usage.Record(rec)
+    }()
+
+    // Stream the response through the middleware chain
+    write := func(data []byte) error {
+        if len(data) == 0 {
+            return nil
+        }
+        if _, err := w.Write(data); err != nil {
+            return fmt.Errorf("error writing stream: %v", err)
+        }
+        if f, ok := w.(http.Flusher); ok {
+            f.Flush()
+        }
+        return nil
+    }
+    reader := upstream.reader
     for {
         line, err := reader.ReadBytes('\n')
+        if len(line) > 0 {
+            usage.observe(line)
+        }
         if err != nil {
             if err == io.EOF {
                 break
             }
             return fmt.Errorf("error reading stream: %v", err)
         }
-        if _, err := w.Write(line); err != nil {
-            return fmt.Errorf("error writing stream: %v", err)
+        out, mwErr := pipeline.processLine(line)
+        if mwErr != nil {
+            return fmt.Errorf("middleware error: %w", mwErr)
         }
-        if f, ok := w.(http.Flusher); ok {
-            f.Flush()
+        if err := write(out); err != nil {
+            return err
         }
     }
 
-    return nil
+    // Streams that end without [DONE] still get the final middleware call
+    final, err := pipeline.finish()
+    if err != nil {
+        return fmt.Errorf("middleware error: %w", err)
+    }
+    return write(final)
 }
 
 // Add these new types for better model and session management
 type CachedSession struct {
     SessionID  string
     ModelID    string
+    ModelName  string
+    Node       string // consumer node that opened the session
+    Created    time.Time
     ExpiresAt  time.Time
+    Requests   int
 }
 
 type CachedModel struct {
-    ModelID   string
-    ModelName string
-    Created   time.Time
+    ModelID       string
+    ModelName     string
+    ContextLength int
+    Created       time.Time
 }
 
 // Model represents a model from the consumer node
@@ -1162,8 +1483,14 @@ type Model struct {
 
 // getModels fetches the list of available models from the consumer node
 func getModels() ([]Model, error) {
-	modelsURL := fmt.Sprintf("%s/blockchain/models", consumerNodeURL)
-	resp, err := http.Get(modelsURL)
+	return sharedProxy().fetchModels(http.DefaultClient)
+}
+
+// fetchModels lists the consumer node's models and records the catalog for
+// readiness checks
+func (p *Proxy) fetchModels(client *http.Client) ([]Model, error) {
+	modelsURL := fmt.Sprintf("%s/blockchain/models", p.cfg().Marketplace.ModelsURL())
+	resp, err := client.Get(modelsURL)
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch models: %v", err)
 	}
@@ -1181,38 +1508,36 @@ func getModels() ([]Model, error) {
 		return nil, fmt.Errorf("failed to decode models response: %v", err)
 	}
 
+	p.catalog.record(len(result.Models))
 	return result.Models, nil
 }
 
-// getEnvOrDefault returns the value of an environment variable or a default value
-func getEnvOrDefault(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
-		return value
-	}
-	return defaultValue
-}
-
 // Add handler for getting models
 func (p *Proxy) handleGetModels(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		respondWithAPIError(w, http.StatusMethodNotAllowed, newAPIError("invalid_request_error", "", "", "Method not allowed"))
 		return
 	}
 
-	marketplaceURL := getMarketplaceModelsEndpoint()
+	marketplaceURL := p.modelsEndpoint()
 	req, err := http.NewRequest(http.MethodGet, marketplaceURL, nil)
 	if err != nil {
-		http.Error(w, "Failed to create request", http.StatusInternalServerError)
+		respondWithAPIError(w, http.StatusInternalServerError, newAPIError("server_error", "", "", "Failed to create request"))
 		return
 	}
 
-	client := &http.Client{Timeout: 10 * time.Second}
+	client := p.httpClient(p.cfg().Marketplace.ModelsTimeout.Duration)
 	resp, err := client.Do(req)
 	if err != nil {
-		http.Error(w, "Failed to fetch models", http.StatusInternalServerError)
+		respondWithForwardError(w, "Failed to fetch models", err)
 		return
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		body, _ := io.ReadAll(resp.Body)
+		respondWithUpstreamError(w, resp.StatusCode, body)
+		return
+	}
 
 	copyHeaders(w, resp.Header)
 	w.WriteHeader(resp.StatusCode)
@@ -1221,48 +1546,168 @@ func (p *Proxy) handleGetModels(w http.ResponseWriter, r *http.Request) {
 
 // Add handler for model operations (session creation/deletion)
 func (p *Proxy) handleModelOperations(w http.ResponseWriter, r *http.Request) {
-	log.Printf("Handling model operation: %s %s", r.Method, r.URL.Path)
+	p.logger.Printf("Handling model operation: %s %s", r.Method, r.URL.Path)
 	pathParts := strings.Split(strings.TrimPrefix(r.URL.Path, "/blockchain/models/"), "/")
 	if len(pathParts) < 1 {
-		log.Printf("Invalid path: %s", r.URL.Path)
-		http.Error(w, "Invalid path", http.StatusBadRequest)
+		p.logger.Printf("Invalid path: %s", r.URL.Path)
+		respondWithAPIError(w, http.StatusBadRequest, newAPIError("invalid_request_error", "", "", "Invalid path"))
 		return
 	}
 
-	marketplaceURL := fmt.Sprintf("%s/%s", getMarketplaceModelsEndpoint(), strings.Join(pathParts, "/"))
-	log.Printf("Forwarding to marketplace URL: %s", marketplaceURL)
+	// Sessions opened here are placed like the proxy's own and stay on their
+	// node; closing one goes to the node that holds it
+	isSessionCreate := r.Method == http.MethodPost && len(pathParts) == 2 && pathParts[1] == "session"
+	isSessionClose := r.Method == http.MethodDelete && len(pathParts) == 3 && pathParts[1] == "session"
+	var node *consumerNode
+	switch {
+	case isSessionCreate:
+		node = p.pickSessionNode()
+	case isSessionClose:
+		node = p.sessionNode(pathParts[2])
+	default:
+		node = p.pickNode()
+	}
+	marketplaceURL := fmt.Sprintf("%s/blockchain/models/%s", node.URL, strings.Join(pathParts, "/"))
+	p.logger.Printf("Forwarding to marketplace URL: %s", marketplaceURL)
+
+	// Session creation through the passthrough is charged against budgets too
+	var sessionCost *big.Int
+	duration := p.cfg().Session.ExpirationSeconds
+	caller := callerID(r)
+	if isSessionCreate {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			respondWithAPIError(w, http.StatusBadRequest, newAPIError("invalid_request_error", "", "", "Failed to read request body"))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewBuffer(body))
+
+		var sessionReq struct {
+			SessionDuration json.Number `json:"sessionDuration"`
+		}
+		if err := json.Unmarshal(body, &sessionReq); err == nil {
+			if d, err := sessionReq.SessionDuration.Int64(); err == nil && d > 0 {
+				duration = int(d)
+			}
+		}
+	}
+	if isSessionCreate && p.budgets != nil {
+		var err error
+		sessionCost, err = p.reserveSessionBudget(node.URL, caller, pathParts[0], "", duration)
+		if err != nil {
+			p.logger.Printf("Refusing session for model %s: %v", pathParts[0], err)
+			respondWithBudgetError(w, err)
+			return
+		}
+	}
 
 	// Forward the request to the marketplace
-	req, err := http.NewRequest(r.Method, marketplaceURL, r.Body)
+	reqBody, err := io.ReadAll(r.Body)
 	if err != nil {
-		log.Printf("Failed to create request: %v", err)
-		http.Error(w, "Failed to create request", http.StatusInternalServerError)
+		if sessionCost != nil {
+			p.budgets.Refund(caller, pathParts[0], "", sessionCost)
+		}
+		respondWithAPIError(w, http.StatusBadRequest, newAPIError("invalid_request_error", "", "", "Failed to read request body"))
 		return
 	}
+	client := p.httpClient(p.cfg().Marketplace.ModelsTimeout.Duration)
+	var resp *http.Response
+	var body []byte
+	forward := func() error {
+		req, err := http.NewRequest(r.Method, marketplaceURL, bytes.NewReader(reqBody))
+		if err != nil {
+			return err
+		}
+		// Copy headers from original request, except the caller's credentials
+		for key, values := range r.Header {
+			if strings.EqualFold(key, "Authorization") {
+				continue
+			}
+			for _, value := range values {
+				req.Header.Add(key, value)
+			}
+		}
+		p.debugf("Request headers: %v", req.Header)
 
-	// Copy headers from original request
-	for key, values := range r.Header {
-		for _, value := range values {
-			req.Header.Add(key, value)
+		done := p.beginNode(node)
+		resp, err = client.Do(req)
+		done(nodeOutcome(resp, err))
+		if err != nil {
+			return err
 		}
+		defer resp.Body.Close()
+		body, _ = io.ReadAll(resp.Body)
+		return nil
 	}
-	log.Printf("Request headers: %v", req.Header)
 
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Printf("Failed to forward request: %v", err)
-		http.Error(w, "Failed to forward request", http.StatusInternalServerError)
+	if isSessionCreate || isSessionClose {
+		// Opening or closing a session sends a transaction from the node's
+		// wallet, so it waits for the wallet's other transactions
+		op := "create session"
+		if isSessionClose {
+			op = "close session"
+		}
+		err = p.sendTx(node.URL, func() error {
+			if err := forward(); err != nil {
+				return err
+			}
+			if resp.StatusCode >= 400 {
+				return chainError(op, resp.StatusCode, body)
+			}
+			return nil
+		})
+	} else {
+		err = forward()
+	}
+	if sessionCost != nil && (err != nil || resp.StatusCode != http.StatusOK) {
+		p.budgets.Refund(caller, pathParts[0], "", sessionCost)
+	}
+	var upErr *upstreamError
+	if err != nil && !errors.As(err, &upErr) {
+		p.logger.Printf("Failed to forward request: %v", err)
+		respondWithForwardError(w, "Failed to forward request", err)
 		return
 	}
-	defer resp.Body.Close()
 
 	// Log response details
-	body, _ := io.ReadAll(resp.Body)
-	log.Printf("Response status: %d", resp.StatusCode)
-	log.Printf("Response body: %s", string(body))
+	p.logger.Printf("Response status: %d", resp.StatusCode)
+	p.debugf("Response body: %s", string(body))
 
+	if resp.StatusCode >= 400 {
+		respondWithUpstreamError(w, resp.StatusCode, body)
+		return
+	}
+	if resp.StatusCode == http.StatusOK {
+		switch {
+		case isSessionCreate:
+			p.cachePassthroughSession(pathParts[0], node.URL, duration, body)
+		case isSessionClose:
+			p.sessions.Lock()
+			delete(p.sessions.m, pathParts[2])
+			p.sessions.Unlock()
+		}
+	}
 	copyHeaders(w, resp.Header)
 	w.WriteHeader(resp.StatusCode)
 	w.Write(body)
 }
+
+// cachePassthroughSession records a session opened through the passthrough,
+// so requests on it go to the node that opened it
+func (p *Proxy) cachePassthroughSession(modelID, node string, duration int, body []byte) {
+	var result struct {
+		SessionID string `json:"sessionId"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil || result.SessionID == "" {
+		return
+	}
+	p.sessions.Lock()
+	p.sessions.m[result.SessionID] = CachedSession{
+		SessionID: result.SessionID,
+		ModelID:   modelID,
+		Node:      node,
+		Created:   time.Now(),
+		ExpiresAt: time.Now().Add(time.Duration(duration) * time.Second),
+	}
+	p.sessions.Unlock()
+}
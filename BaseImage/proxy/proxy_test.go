@@ -13,11 +13,6 @@ import (
 	"time"
 )
 
-func init() {
-	// Disable cleanup goroutine during tests
-	enableCleanupGoroutine = false
-}
-
 func TestGetMarketplaceBaseURL(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -274,6 +269,29 @@ func TestCleanupExpiredSessions(t *testing.T) {
 	}
 }
 
+func TestCleanupSessionReportsFailedClose(t *testing.T) {
+	status := http.StatusInternalServerError
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete || r.URL.Path != "/blockchain/models/m/session/s" {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(status)
+		fmt.Fprint(w, `{"error":"session is still open"}`)
+	}))
+	defer server.Close()
+	t.Setenv("MARKETPLACE_URL", server.URL)
+
+	p := NewProxy()
+	if err := p.cleanupSession("s", "m"); err == nil || !strings.Contains(err.Error(), "500") {
+		t.Errorf("cleanupSession() error = %v, want the failed close", err)
+	}
+	status = http.StatusOK
+	if err := p.cleanupSession("s", "m"); err != nil {
+		t.Errorf("cleanupSession() error = %v", err)
+	}
+}
+
 func TestValidateModelHandle(t *testing.T) {
 	// Setup test server
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -329,6 +347,7 @@ func TestGetSessionExpirationSeconds(t *testing.T) {
 		envValue  string
 		expected  int
 		shouldSet bool
+		wantErr   bool
 	}{
 		{
 			name:      "default value",
@@ -345,14 +364,14 @@ func TestGetSessionExpirationSeconds(t *testing.T) {
 		{
 			name:      "invalid value",
 			envValue:  "invalid",
-			expected:  1800,
 			shouldSet: true,
+			wantErr:   true,
 		},
 		{
 			name:      "too small value",
 			envValue:  "30",
-			expected:  1800,
 			shouldSet: true,
+			wantErr:   true,
 		},
 	}
 
@@ -365,8 +384,18 @@ func TestGetSessionExpirationSeconds(t *testing.T) {
 				os.Unsetenv("SESSION_EXPIRATION_SECONDS")
 			}
 
-			got := getSessionExpirationSeconds()
-			if got != tt.expected {
+			// Invalid values are rejected at startup instead of silently replaced
+			cfg, err := LoadConfig("")
+			if err == nil {
+				err = cfg.Validate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("config error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got := getSessionExpirationSeconds(); got != tt.expected {
 				t.Errorf("getSessionExpirationSeconds() = %v, want %v", got, tt.expected)
 			}
 		})
@@ -0,0 +1,436 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit describes the limits applied to one scope of traffic. Zero values
+// mean "unlimited" for that dimension.
+type RateLimit struct {
+	RequestsPerSecond   float64 `json:"requests_per_second"`
+	Burst               int     `json:"burst"`
+	TokensPerMinute     int     `json:"tokens_per_minute"`
+	MaxConcurrent       int     `json:"max_concurrent"`
+	QueueSize           int     `json:"queue_size"`
+	QueueTimeoutSeconds int     `json:"queue_timeout_seconds"`
+}
+
+// RateLimitConfig holds the default limits plus per API key and per model
+// overrides. Key limits apply to all of a caller's traffic; model limits apply
+// to each caller's traffic for that model.
+type RateLimitConfig struct {
+	Default RateLimit            `json:"default"`
+	Keys    map[string]RateLimit `json:"keys"`
+	Models  map[string]RateLimit `json:"models"`
+}
+
+func (l RateLimit) isZero() bool {
+	return l.RequestsPerSecond <= 0 && l.TokensPerMinute <= 0 && l.MaxConcurrent <= 0
+}
+
+func (l RateLimit) queueTimeout() time.Duration {
+	if l.QueueSize <= 0 {
+		return 0
+	}
+	if l.QueueTimeoutSeconds <= 0 {
+		return 30 * time.Second
+	}
+	return time.Duration(l.QueueTimeoutSeconds) * time.Second
+}
+
+// tokenBucket is a classic token bucket refilled continuously at rate tokens
+// per second up to capacity.
+type tokenBucket struct {
+	capacity float64
+	rate     float64
+	tokens   float64
+	last     time.Time
+}
+
+func newTokenBucket(capacity, rate float64, now time.Time) *tokenBucket {
+	return &tokenBucket{capacity: capacity, rate: rate, tokens: capacity, last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(b.capacity, b.tokens+elapsed*b.rate)
+	}
+	b.last = now
+}
+
+// wait returns how long until n tokens are available. Requests larger than the
+// bucket only need a full bucket so they are never rejected forever.
+func (b *tokenBucket) wait(n float64, now time.Time) time.Duration {
+	b.refill(now)
+	n = math.Min(n, b.capacity)
+	if b.tokens >= n {
+		return 0
+	}
+	return time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+}
+
+func (b *tokenBucket) take(n float64) {
+	b.tokens -= math.Min(n, b.capacity)
+}
+
+func (b *tokenBucket) refund(n float64) {
+	b.tokens = math.Min(b.capacity, b.tokens+math.Min(n, b.capacity))
+}
+
+// limitScope tracks the buckets, concurrency slots and queue for one caller or
+// caller/model pair.
+type limitScope struct {
+	mu       sync.Mutex
+	limit    RateLimit
+	requests *tokenBucket
+	tokens   *tokenBucket
+	active   int           // concurrency slots held
+	freed    chan struct{} // closed when a slot is released or the limit changes
+	queued   int
+	lastUsed time.Time
+}
+
+func newLimitScope(limit RateLimit, now time.Time) *limitScope {
+	s := &limitScope{limit: limit, freed: make(chan struct{}), lastUsed: now}
+	if limit.RequestsPerSecond > 0 {
+		burst := float64(limit.Burst)
+		if burst <= 0 {
+			burst = math.Max(1, math.Ceil(limit.RequestsPerSecond))
+		}
+		s.requests = newTokenBucket(burst, limit.RequestsPerSecond, now)
+	}
+	if limit.TokensPerMinute > 0 {
+		s.tokens = newTokenBucket(float64(limit.TokensPerMinute), float64(limit.TokensPerMinute)/60, now)
+	}
+	return s
+}
+
+// setLimit applies a new limit to the scope. Buckets keep their level, up to
+// the new capacity, and requests in flight keep their slots.
+func (s *limitScope) setLimit(limit RateLimit, now time.Time) {
+	fresh := newLimitScope(limit, now)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limit = limit
+	s.requests = carryBucket(s.requests, fresh.requests, now)
+	s.tokens = carryBucket(s.tokens, fresh.tokens, now)
+	s.wake()
+}
+
+// carryBucket returns fresh filled to the level of old
+func carryBucket(old, fresh *tokenBucket, now time.Time) *tokenBucket {
+	if old == nil || fresh == nil {
+		return fresh
+	}
+	old.refill(now)
+	fresh.tokens = math.Min(fresh.capacity, old.tokens)
+	return fresh
+}
+
+// RateLimitError is returned when a request exceeds its limits.
+type RateLimitError struct {
+	Reason     string
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("rate limit exceeded: %s", e.Reason)
+}
+
+// takeBuckets takes one request and n tokens if both are available, otherwise
+// it returns how long the caller would have to wait.
+func (s *limitScope) takeBuckets(n float64, now time.Time) (time.Duration, string) {
+	var wait time.Duration
+	reason := ""
+	if s.requests != nil {
+		if d := s.requests.wait(1, now); d > wait {
+			wait, reason = d, "requests per second"
+		}
+	}
+	if s.tokens != nil && n > 0 {
+		if d := s.tokens.wait(n, now); d > wait {
+			wait, reason = d, "tokens per minute"
+		}
+	}
+	if wait > 0 {
+		return wait, reason
+	}
+	if s.requests != nil {
+		s.requests.take(1)
+	}
+	if s.tokens != nil {
+		s.tokens.take(n)
+	}
+	return 0, ""
+}
+
+func (s *limitScope) refundBuckets(n float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.requests != nil {
+		s.requests.refund(1)
+	}
+	if s.tokens != nil {
+		s.tokens.refund(n)
+	}
+}
+
+// acquire admits one request costing n tokens. When the scope has a queue the
+// request waits up to the queue timeout instead of being rejected outright.
+func (s *limitScope) acquire(ctx context.Context, n float64) (func(), error) {
+	timeout := s.limit.queueTimeout()
+	deadline := time.Now().Add(timeout)
+
+	s.mu.Lock()
+	s.lastUsed = time.Now()
+	queued := false
+	for {
+		wait, reason := s.takeBuckets(n, time.Now())
+		if wait == 0 {
+			break
+		}
+		if timeout == 0 || time.Now().Add(wait).After(deadline) || (!queued && s.queued >= s.limit.QueueSize) {
+			if queued {
+				s.queued--
+			}
+			s.mu.Unlock()
+			return nil, &RateLimitError{Reason: reason, RetryAfter: wait}
+		}
+		if !queued {
+			s.queued++
+			queued = true
+		}
+		s.mu.Unlock()
+		if err := sleepContext(ctx, wait); err != nil {
+			s.mu.Lock()
+			s.queued--
+			s.mu.Unlock()
+			return nil, err
+		}
+		s.mu.Lock()
+	}
+
+	for s.limit.MaxConcurrent > 0 && s.active >= s.limit.MaxConcurrent {
+		if timeout == 0 || time.Now().After(deadline) || (!queued && s.queued >= s.limit.QueueSize) {
+			if queued {
+				s.queued--
+			}
+			s.mu.Unlock()
+			s.refundBuckets(n)
+			return nil, &RateLimitError{Reason: "max concurrent requests", RetryAfter: time.Second}
+		}
+		if !queued {
+			s.queued++
+			queued = true
+		}
+		freed := s.freed
+		s.mu.Unlock()
+
+		timer := time.NewTimer(time.Until(deadline))
+		var err error
+		select {
+		case <-freed:
+		case <-timer.C:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		timer.Stop()
+		s.mu.Lock()
+		if err != nil {
+			s.queued--
+			s.mu.Unlock()
+			s.refundBuckets(n)
+			return nil, err
+		}
+	}
+
+	if queued {
+		s.queued--
+	}
+	s.active++
+	s.mu.Unlock()
+	return s.releaseSlot, nil
+}
+
+func (s *limitScope) releaseSlot() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active--
+	s.wake()
+}
+
+// wake signals the requests waiting for a slot. s.mu must be held.
+func (s *limitScope) wake() {
+	close(s.freed)
+	s.freed = make(chan struct{})
+}
+
+func (s *limitScope) idle(now time.Time, maxIdle time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.queued == 0 && s.active == 0 && now.Sub(s.lastUsed) > maxIdle
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// RateLimiter enforces request, token and concurrency limits per API key and
+// per model.
+type RateLimiter struct {
+	cfg       RateLimitConfig
+	mu        sync.Mutex
+	scopes    map[string]*limitScope
+	lastSweep time.Time
+}
+
+// NewRateLimiter creates a rate limiter from the given configuration.
+func NewRateLimiter(cfg RateLimitConfig) *RateLimiter {
+	rl := &RateLimiter{lastSweep: time.Now()}
+	rl.UpdateConfig(cfg)
+	return rl
+}
+
+// UpdateConfig replaces the limits. Existing scopes keep their bucket levels
+// and the concurrency slots of requests in flight, so a reload does not reset
+// anyone's limits.
+func (rl *RateLimiter) UpdateConfig(cfg RateLimitConfig) {
+	models := make(map[string]RateLimit, len(cfg.Models))
+	for name, limit := range cfg.Models {
+		models[strings.ToLower(name)] = limit
+	}
+	cfg.Models = models
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.cfg = cfg
+	if rl.scopes == nil {
+		rl.scopes = make(map[string]*limitScope)
+	}
+	now := time.Now()
+	for name, s := range rl.scopes {
+		if caller, ok := strings.CutPrefix(name, "key:"); ok {
+			keyLimit, _, _ := rl.limitsLocked(caller, "")
+			s.setLimit(keyLimit, now)
+		} else if pair, ok := strings.CutPrefix(name, "model:"); ok {
+			i := strings.LastIndex(pair, "|")
+			_, modelLimit, _ := rl.limitsLocked(pair[:i], pair[i+1:])
+			s.setLimit(modelLimit, now)
+		}
+	}
+}
+
+func (rl *RateLimiter) limits(caller, model string) (RateLimit, RateLimit, bool) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.limitsLocked(caller, model)
+}
+
+func (rl *RateLimiter) limitsLocked(caller, model string) (RateLimit, RateLimit, bool) {
+	keyLimit, ok := rl.cfg.Keys[configuredCaller(rl.cfg.Keys, caller)]
+	if !ok {
+		keyLimit = rl.cfg.Default
+	}
+	modelLimit, ok := rl.cfg.Models[strings.ToLower(model)]
+	return keyLimit, modelLimit, ok
+}
+
+func (rl *RateLimiter) scope(name string, limit RateLimit) *limitScope {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(rl.lastSweep) > 5*time.Minute {
+		for key, s := range rl.scopes {
+			if s.idle(now, 10*time.Minute) {
+				delete(rl.scopes, key)
+			}
+		}
+		rl.lastSweep = now
+	}
+
+	s, ok := rl.scopes[name]
+	if !ok {
+		s = newLimitScope(limit, now)
+		rl.scopes[name] = s
+	}
+	return s
+}
+
+// Acquire admits a request from caller for model that is estimated to use
+// tokens prompt tokens. The returned release func must be called when the
+// request completes.
+func (rl *RateLimiter) Acquire(ctx context.Context, caller, model string, tokens int) (func(), error) {
+	keyLimit, modelLimit, hasModelLimit := rl.limits(caller, model)
+	var scopes []*limitScope
+	if !keyLimit.isZero() {
+		scopes = append(scopes, rl.scope("key:"+caller, keyLimit))
+	}
+	if hasModelLimit && !modelLimit.isZero() {
+		scopes = append(scopes, rl.scope("model:"+caller+"|"+strings.ToLower(model), modelLimit))
+	}
+
+	var releases []func()
+	release := func() {
+		for _, r := range releases {
+			r()
+		}
+	}
+	for i, s := range scopes {
+		r, err := s.acquire(ctx, float64(tokens))
+		if err != nil {
+			release()
+			for _, prev := range scopes[:i] {
+				prev.refundBuckets(float64(tokens))
+			}
+			return nil, err
+		}
+		releases = append(releases, r)
+	}
+	return release, nil
+}
+
+// estimateTokens approximates the token count of text at four characters per
+// token, which is close enough for budgeting without a model tokenizer.
+func estimateTokens(text string) int {
+	n := len([]rune(text))
+	if n == 0 {
+		return 0
+	}
+	return (n + 3) / 4
+}
+
+// estimatePromptTokens estimates the prompt size of a chat request, including
+// the per-message framing overhead.
+func estimatePromptTokens(messages []Message) int {
+	total := 0
+	for _, m := range messages {
+		total += 4 + estimateTokens(m.Role) + estimateTokens(m.Content)
+	}
+	return total
+}
+
+// respondWithRateLimit writes an OpenAI-style 429 response with Retry-After.
+func respondWithRateLimit(w http.ResponseWriter, err *RateLimitError) {
+	seconds := int(math.Ceil(err.RetryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	respondWithAPIError(w, http.StatusTooManyRequests, newAPIError("requests", "rate_limit_exceeded", "",
+		fmt.Sprintf("Rate limit reached (%s). Please try again in %ds.", err.Reason, seconds)))
+}
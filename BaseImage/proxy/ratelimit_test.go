@@ -0,0 +1,217 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(2, 1, now)
+
+	if d := b.wait(2, now); d != 0 {
+		t.Fatalf("full bucket should not wait, got %v", d)
+	}
+	b.take(2)
+	if d := b.wait(1, now); d != time.Second {
+		t.Errorf("empty bucket wait = %v, want 1s", d)
+	}
+	if d := b.wait(1, now.Add(time.Second)); d != 0 {
+		t.Errorf("bucket should refill after 1s, wait = %v", d)
+	}
+	if d := b.wait(10, now.Add(10*time.Second)); d != 0 {
+		t.Errorf("oversized request should only need a full bucket, wait = %v", d)
+	}
+}
+
+func TestRateLimiterRequestsPerSecond(t *testing.T) {
+	rl := NewRateLimiter(RateLimitConfig{
+		Default: RateLimit{RequestsPerSecond: 1, Burst: 1},
+	})
+
+	release, err := rl.Acquire(context.Background(), "key-a", "model", 0)
+	if err != nil {
+		t.Fatalf("first request should pass: %v", err)
+	}
+	release()
+
+	_, err = rl.Acquire(context.Background(), "key-a", "model", 0)
+	rlErr, ok := err.(*RateLimitError)
+	if !ok {
+		t.Fatalf("second request should be rate limited, got %v", err)
+	}
+	if rlErr.RetryAfter <= 0 || rlErr.RetryAfter > time.Second {
+		t.Errorf("RetryAfter = %v, want (0, 1s]", rlErr.RetryAfter)
+	}
+
+	if _, err := rl.Acquire(context.Background(), "key-b", "model", 0); err != nil {
+		t.Errorf("other keys should have their own bucket: %v", err)
+	}
+}
+
+func TestRateLimiterPerKeyAndModel(t *testing.T) {
+	rl := NewRateLimiter(RateLimitConfig{
+		Keys:   map[string]RateLimit{"batch": {TokensPerMinute: 100}},
+		Models: map[string]RateLimit{"Llama-3": {MaxConcurrent: 1}},
+	})
+
+	if _, err := rl.Acquire(context.Background(), "batch", "other", 80); err != nil {
+		t.Fatalf("request within token budget should pass: %v", err)
+	}
+	if _, err := rl.Acquire(context.Background(), "batch", "other", 80); err == nil {
+		t.Error("request over tokens per minute should be rejected")
+	}
+	if _, err := rl.Acquire(context.Background(), "anyone", "other", 1000); err != nil {
+		t.Errorf("keys without limits should not be limited: %v", err)
+	}
+
+	release, err := rl.Acquire(context.Background(), "anyone", "llama-3", 0)
+	if err != nil {
+		t.Fatalf("first stream should pass: %v", err)
+	}
+	if _, err := rl.Acquire(context.Background(), "anyone", "llama-3", 0); err == nil {
+		t.Error("second concurrent stream should be rejected")
+	}
+	release()
+	if _, err := rl.Acquire(context.Background(), "anyone", "llama-3", 0); err != nil {
+		t.Errorf("stream should be admitted after release: %v", err)
+	}
+}
+
+func TestRateLimiterQueue(t *testing.T) {
+	rl := NewRateLimiter(RateLimitConfig{
+		Default: RateLimit{MaxConcurrent: 1, QueueSize: 1, QueueTimeoutSeconds: 5},
+	})
+
+	release, err := rl.Acquire(context.Background(), "key", "", 0)
+	if err != nil {
+		t.Fatalf("first request should pass: %v", err)
+	}
+
+	admitted := make(chan error, 1)
+	go func() {
+		r, err := rl.Acquire(context.Background(), "key", "", 0)
+		if err == nil {
+			r()
+		}
+		admitted <- err
+	}()
+
+	// Wait for the second request to occupy the queue
+	deadline := time.Now().Add(time.Second)
+	for {
+		s := rl.scope("key:key", RateLimit{})
+		s.mu.Lock()
+		queued := s.queued
+		s.mu.Unlock()
+		if queued == 1 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if _, err := rl.Acquire(context.Background(), "key", "", 0); err == nil {
+		t.Error("request should be rejected when the queue is full")
+	}
+
+	release()
+	select {
+	case err := <-admitted:
+		if err != nil {
+			t.Errorf("queued request should be admitted after release: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("queued request was not admitted")
+	}
+}
+
+func TestRateLimiterUpdateConfigKeepsState(t *testing.T) {
+	cfg := RateLimitConfig{Default: RateLimit{RequestsPerSecond: 0.1, Burst: 1, MaxConcurrent: 1}}
+	rl := NewRateLimiter(cfg)
+	release, err := rl.Acquire(context.Background(), "key", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A reload does not refill the bucket or free the slot in use
+	rl.UpdateConfig(cfg)
+	if _, err := rl.Acquire(context.Background(), "key", "", 0); err == nil {
+		t.Fatal("reload reset the rate limit")
+	}
+
+	// New limits apply to the scope, and the held slot still counts
+	rl.UpdateConfig(RateLimitConfig{Default: RateLimit{MaxConcurrent: 1}})
+	if _, err := rl.Acquire(context.Background(), "key", "", 0); err == nil {
+		t.Fatal("reload freed the slot in use")
+	}
+	release()
+	if _, err := rl.Acquire(context.Background(), "key", "", 0); err != nil {
+		t.Errorf("slot was not released after reload: %v", err)
+	}
+}
+
+func TestLoadRateLimitConfig(t *testing.T) {
+	t.Setenv("RATE_LIMITS_FILE", "")
+	if cfg, err := LoadConfig(""); err != nil || cfg.RateLimits != nil {
+		t.Errorf("expected no rate limits when unset, got %+v, %v", cfg.RateLimits, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "limits.json")
+	os.WriteFile(path, []byte(`{"default":{"requests_per_second":2},"keys":{"k":{"max_concurrent":3}}}`), 0600)
+	t.Setenv("RATE_LIMITS_FILE", path)
+
+	cfg, err := LoadConfig("")
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	if cfg.RateLimits.Default.RequestsPerSecond != 2 || cfg.RateLimits.Keys["k"].MaxConcurrent != 3 {
+		t.Errorf("unexpected config: %+v", cfg.RateLimits)
+	}
+	if got := cfg.Source("rate_limits.default.requests_per_second"); got != "env RATE_LIMITS_FILE="+path {
+		t.Errorf("Source() = %q", got)
+	}
+}
+
+func TestHandleChatCompletionsRateLimited(t *testing.T) {
+	p := NewProxy()
+	p.limiter = NewRateLimiter(RateLimitConfig{
+		Default: RateLimit{RequestsPerSecond: 0.5, Burst: 1},
+	})
+	if _, err := p.limiter.Acquire(context.Background(), tokenFingerprint("sk-test"), "Test Model", 0); err != nil {
+		t.Fatalf("priming request failed: %v", err)
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"model":    "Test Model",
+		"messages": []map[string]string{{"role": "user", "content": "Hello"}},
+	})
+	req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewBuffer(body))
+	req.Header.Set("Authorization", "Bearer sk-test")
+	w := httptest.NewRecorder()
+
+	p.handleChatCompletions(w, req)
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want 429", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Retry-After"); got != "2" {
+		t.Errorf("Retry-After = %q, want 2", got)
+	}
+	var payload struct {
+		Error APIError `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		t.Fatalf("failed to decode error: %v", err)
+	}
+	if payload.Error.Code == nil || *payload.Error.Code != "rate_limit_exceeded" {
+		t.Errorf("unexpected error body: %+v", payload.Error)
+	}
+}
@@ -0,0 +1,181 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math/big"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// chatRetryDelay returns the jittered exponential backoff before the given
+// retry attempt (1 for the first retry)
+func chatRetryDelay(base, limit time.Duration, attempt int) time.Duration {
+	delay := base
+	for i := 1; i < attempt && delay < limit; i++ {
+		delay *= 2
+	}
+	if delay > limit {
+		delay = limit
+	}
+	if delay <= 0 {
+		return 0
+	}
+	// Wait between half and the full delay so callers retrying together spread out
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// sessionClosed reports whether an upstream error response means the session
+// is no longer open on chain, so a new one is needed
+func sessionClosed(status int, body []byte) bool {
+	if status < 400 || status >= 500 || status == http.StatusTooManyRequests {
+		return false
+	}
+	text := strings.ToLower(string(body))
+	if !strings.Contains(text, "session") {
+		return false
+	}
+	for _, reason := range []string{"closed", "expired", "not found", "invalid", "ended", "does not exist"} {
+		if strings.Contains(text, reason) {
+			return true
+		}
+	}
+	return false
+}
+
+// chatUpstream is an accepted upstream chat response that has not been
+// streamed to the client yet
+type chatUpstream struct {
+	resp      *http.Response
+	reader    *bufio.Reader
+	sessionID string
+	done      func(ok bool)
+}
+
+// close releases the upstream stream and reports the node's outcome
+func (u *chatUpstream) close(ok bool) {
+	u.resp.Body.Close()
+	if u.done != nil {
+		u.done(ok)
+		u.done = nil
+	}
+}
+
+// sendChatRequest posts a chat request to the marketplace, retrying with
+// backoff on connection errors, 5xx responses, streams that fail before their
+// first byte, and sessions that were closed on chain. Nothing has been written
+// to the client while this runs, so every attempt is safe to repeat.
+func (p *Proxy) sendChatRequest(r *http.Request, modelID, model, sessionID string, header http.Header, body []byte) (*chatUpstream, error) {
+	cfg := p.cfg().Marketplace
+	client := p.httpClient(cfg.ChatTimeout.Duration)
+
+	var lastErr error
+	for attempt := 0; attempt <= cfg.ChatRetries; attempt++ {
+		if attempt > 0 {
+			delay := chatRetryDelay(cfg.ChatRetryBaseDelay.Duration, cfg.ChatRetryMaxDelay.Duration, attempt)
+			p.logger.Printf("Retrying chat request (attempt %d/%d) after %v: %v", attempt+1, cfg.ChatRetries+1, delay, lastErr)
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return nil, fmt.Errorf("request cancelled before retry: %w", lastErr)
+			}
+		}
+
+		// Requests on a session must go through the node that opened it
+		node := p.sessionNode(sessionID)
+		endpoint := fmt.Sprintf("%s/v1/chat/completions", node.URL)
+		proxyReq, err := http.NewRequestWithContext(r.Context(), r.Method, endpoint, bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("error creating request: %v", err)
+		}
+		for name, values := range header {
+			proxyReq.Header[name] = values
+		}
+		proxyReq.Header.Set("session_id", sessionID)
+
+		p.logger.Printf("Forwarding request to: %s", endpoint)
+		p.debugf("Request headers: %v", proxyReq.Header)
+		p.debugf("Request body: %s", string(body))
+
+		done := p.beginNode(node)
+		resp, err := client.Do(proxyReq)
+		if err != nil {
+			lastErr = fmt.Errorf("error sending request: %v", err)
+			if r.Context().Err() != nil {
+				// Cancelled by the client or a hedge, not the node's fault
+				done(true)
+				return nil, lastErr
+			}
+			done(false)
+			continue
+		}
+
+		if resp.StatusCode == http.StatusOK {
+			// A stream that breaks before its first byte can still be retried
+			reader := bufio.NewReader(resp.Body)
+			if _, err := reader.Peek(1); err != nil && err != io.EOF {
+				resp.Body.Close()
+				done(r.Context().Err() != nil)
+				lastErr = fmt.Errorf("error reading stream: %v", err)
+				continue
+			}
+			// The node stays busy until the stream is closed
+			return &chatUpstream{resp: resp, reader: reader, sessionID: sessionID, done: done}, nil
+		}
+
+		respBody, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		done(nodeOutcome(resp, nil))
+		lastErr = &upstreamError{op: "marketplace request", status: resp.StatusCode, body: respBody}
+		switch {
+		case sessionClosed(resp.StatusCode, respBody):
+			p.logger.Printf("Session %s for model %s is no longer open: %s", sessionID, modelID, string(respBody))
+			if attempt >= cfg.ChatRetries {
+				// No attempt is left to use a new session
+				break
+			}
+			newID, err := p.replaceSession(r, modelID, model, sessionID)
+			if err != nil {
+				return nil, fmt.Errorf("opening a new session failed: %w", err)
+			}
+			sessionID = newID
+		case resp.StatusCode >= 500:
+			p.logger.Printf("Marketplace returned error status %d: %s", resp.StatusCode, string(respBody))
+		default:
+			return nil, lastErr
+		}
+	}
+	return nil, lastErr
+}
+
+// replaceSession drops a session that was closed on chain and opens a new one
+// for the same model, charging it to the caller's budget like the first
+func (p *Proxy) replaceSession(r *http.Request, modelID, model, oldSessionID string) (string, error) {
+	p.sessions.Lock()
+	delete(p.sessions.m, oldSessionID)
+	p.sessions.Unlock()
+
+	caller := callerID(r)
+	node := p.pickSessionNode()
+	var cost *big.Int
+	if p.budgets != nil {
+		var err error
+		cost, err = p.reserveSessionBudget(node.URL, caller, modelID, model, p.cfg().Session.ExpirationSeconds)
+		if err != nil {
+			return "", err
+		}
+	}
+	sessionID, err := p.createSessionOn(node, modelID)
+	if err != nil {
+		if cost != nil {
+			p.budgets.Refund(caller, modelID, model, cost)
+		}
+		return "", err
+	}
+	p.logger.Printf("Replaced closed session %s with %s for model %s", oldSessionID, sessionID, modelID)
+	return sessionID, nil
+}
@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestChatRetryDelay(t *testing.T) {
+	for attempt, want := range map[int]time.Duration{1: 100 * time.Millisecond, 2: 200 * time.Millisecond, 3: 400 * time.Millisecond, 6: time.Second} {
+		for i := 0; i < 20; i++ {
+			got := chatRetryDelay(100*time.Millisecond, time.Second, attempt)
+			if got < want/2 || got > want {
+				t.Fatalf("attempt %d: delay %v outside [%v, %v]", attempt, got, want/2, want)
+			}
+		}
+	}
+	if got := chatRetryDelay(0, 0, 3); got != 0 {
+		t.Errorf("zero base delay = %v", got)
+	}
+}
+
+func TestSessionClosed(t *testing.T) {
+	tests := []struct {
+		status int
+		body   string
+		want   bool
+	}{
+		{http.StatusBadRequest, `{"error":"session expired"}`, true},
+		{http.StatusNotFound, `{"error":"Session not found"}`, true},
+		{http.StatusBadRequest, `{"error":"session is closed"}`, true},
+		{http.StatusBadRequest, `{"error":"invalid messages"}`, false},
+		{http.StatusTooManyRequests, `{"error":"session rate limit, invalid"}`, false},
+		{http.StatusInternalServerError, `{"error":"session closed"}`, false},
+	}
+	for _, tt := range tests {
+		if got := sessionClosed(tt.status, []byte(tt.body)); got != tt.want {
+			t.Errorf("sessionClosed(%d, %s) = %v, want %v", tt.status, tt.body, got, tt.want)
+		}
+	}
+}
+
+func setRetryConfig(t *testing.T, url string, retries int) *Config {
+	t.Helper()
+	t.Setenv("MARKETPLACE_URL", url)
+	cfg, err := LoadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Marketplace.ChatRetries = retries
+	cfg.Marketplace.ChatRetryBaseDelay = Duration{time.Millisecond}
+	cfg.Marketplace.ChatRetryMaxDelay = Duration{5 * time.Millisecond}
+	setConfig(cfg)
+	t.Cleanup(func() { setConfig(nil) })
+	return cfg
+}
+
+func TestForwardChatRequestRetries(t *testing.T) {
+	var attempts int32
+	var sessions []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/blockchain/models/retry-model/session":
+			fmt.Fprint(w, `{"sessionId":"retry-new"}`)
+		case "/v1/chat/completions":
+			sessions = append(sessions, r.Header.Get("session_id"))
+			switch atomic.AddInt32(&attempts, 1) {
+			case 1:
+				http.Error(w, `{"error":"provider unavailable"}`, http.StatusBadGateway)
+			case 2:
+				http.Error(w, `{"error":"session expired"}`, http.StatusBadRequest)
+			default:
+				fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"ok\"}}]}\n\ndata: [DONE]\n\n")
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	setRetryConfig(t, server.URL, 2)
+	defer func() {
+		sessionCache.Lock()
+		delete(sessionCache.m, "retry-old")
+		delete(sessionCache.m, "retry-new")
+		sessionCache.Unlock()
+	}()
+
+	p := NewProxy()
+	r := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+	w := httptest.NewRecorder()
+	req := ChatCompletionRequest{Model: "Retry Model", Messages: []Message{{Role: "user", Content: "Hi"}}}
+	if err := p.forwardChatRequest(w, r, "retry-model", req, "retry-old"); err != nil {
+		t.Fatalf("forwardChatRequest() error = %v", err)
+	}
+	if strings.Join(sessions, ",") != "retry-old,retry-old,retry-new" {
+		t.Errorf("sessions used = %v", sessions)
+	}
+	if w.Code != http.StatusOK || w.Header().Get("session_id") != "retry-new" || StreamCompletion(w.Body.Bytes()) != "ok" {
+		t.Errorf("status = %d, session = %q, body = %s", w.Code, w.Header().Get("session_id"), w.Body.String())
+	}
+}
+
+func TestForwardChatRequestClosedSessionOnLastAttempt(t *testing.T) {
+	var opened, attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/blockchain/models/retry-model/session":
+			atomic.AddInt32(&opened, 1)
+			fmt.Fprint(w, `{"sessionId":"retry-last"}`)
+		case "/v1/chat/completions":
+			atomic.AddInt32(&attempts, 1)
+			http.Error(w, `{"error":"session expired"}`, http.StatusBadRequest)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	setRetryConfig(t, server.URL, 1)
+	defer func() {
+		sessionCache.Lock()
+		delete(sessionCache.m, "retry-last")
+		sessionCache.Unlock()
+	}()
+
+	w := httptest.NewRecorder()
+	req := ChatCompletionRequest{Model: "Retry Model", Messages: []Message{{Role: "user", Content: "Hi"}}}
+	if err := NewProxy().forwardChatRequest(w, httptest.NewRequest("POST", "/v1/chat/completions", nil), "retry-model", req, "retry-old"); err == nil {
+		t.Fatal("expected an error once retries ran out")
+	}
+	// Only the first closed session is replaced; the last attempt opens none
+	if attempts != 2 || opened != 1 {
+		t.Errorf("attempts = %d, sessions opened = %d; want 2 and 1", attempts, opened)
+	}
+}
+
+func TestForwardChatRequestNoRetry(t *testing.T) {
+	tests := map[string]struct {
+		status   int
+		retries  int
+		attempts int32
+	}{
+		"client error":      {http.StatusBadRequest, 2, 1},
+		"retries exhausted": {http.StatusServiceUnavailable, 1, 2},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			var attempts int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&attempts, 1)
+				http.Error(w, `{"error":"bad request"}`, tt.status)
+			}))
+			defer server.Close()
+			setRetryConfig(t, server.URL, tt.retries)
+
+			w := httptest.NewRecorder()
+			err := NewProxy().forwardChatRequest(w, httptest.NewRequest("POST", "/v1/chat/completions", nil), "m", ChatCompletionRequest{Model: "m"}, "s")
+			if err == nil || !strings.Contains(err.Error(), fmt.Sprint(tt.status)) {
+				t.Errorf("expected a %d error, got %v", tt.status, err)
+			}
+			if attempts != tt.attempts || w.Body.Len() != 0 {
+				t.Errorf("attempts = %d, want %d; body = %q", attempts, tt.attempts, w.Body.String())
+			}
+		})
+	}
+}
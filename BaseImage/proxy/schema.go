@@ -0,0 +1,351 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// JSONSchema validates decoded JSON values against the subset of JSON Schema
+// used for structured outputs: type, enum, const, properties, required,
+// additionalProperties, items, min/maxItems, min/maxLength, pattern,
+// minimum, maximum, exclusiveMinimum, exclusiveMaximum, anyOf, oneOf, allOf
+// and local $ref into $defs or definitions. Other keywords are ignored.
+type JSONSchema struct {
+	root     map[string]interface{}
+	patterns map[string]*regexp.Regexp
+}
+
+var schemaTypes = map[string]bool{
+	"object": true, "array": true, "string": true, "number": true,
+	"integer": true, "boolean": true, "null": true,
+}
+
+// CompileJSONSchema parses a schema, checking its types, patterns and refs
+func CompileJSONSchema(data []byte) (*JSONSchema, error) {
+	var root map[string]interface{}
+	if err := json.Unmarshal(data, &root); err != nil || root == nil {
+		return nil, fmt.Errorf("schema must be a JSON object")
+	}
+	s := &JSONSchema{root: root, patterns: make(map[string]*regexp.Regexp)}
+	if err := s.check(root, "#"); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// check walks a schema and reports the first problem found
+func (s *JSONSchema) check(node interface{}, at string) error {
+	schema, ok := node.(map[string]interface{})
+	if !ok {
+		if _, isBool := node.(bool); isBool {
+			return nil
+		}
+		return fmt.Errorf("%s: schema must be an object", at)
+	}
+	for _, t := range schemaTypeList(schema["type"]) {
+		if !schemaTypes[t] {
+			return fmt.Errorf("%s: unknown type %q", at, t)
+		}
+	}
+	if pattern, ok := schema["pattern"].(string); ok {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("%s: invalid pattern: %v", at, err)
+		}
+		s.patterns[pattern] = re
+	}
+	if ref, ok := schema["$ref"].(string); ok {
+		if _, err := s.resolve(ref); err != nil {
+			return fmt.Errorf("%s: %v", at, err)
+		}
+	}
+	for _, key := range []string{"properties", "$defs", "definitions"} {
+		children, _ := schema[key].(map[string]interface{})
+		for name, child := range children {
+			if err := s.check(child, at+"/"+key+"/"+name); err != nil {
+				return err
+			}
+		}
+	}
+	for _, key := range []string{"items", "additionalProperties"} {
+		if child, ok := schema[key]; ok {
+			if err := s.check(child, at+"/"+key); err != nil {
+				return err
+			}
+		}
+	}
+	for _, key := range []string{"anyOf", "oneOf", "allOf"} {
+		children, _ := schema[key].([]interface{})
+		for i, child := range children {
+			if err := s.check(child, fmt.Sprintf("%s/%s/%d", at, key, i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// resolve follows a local JSON pointer ref such as "#/$defs/item"
+func (s *JSONSchema) resolve(ref string) (interface{}, error) {
+	if !strings.HasPrefix(ref, "#") {
+		return nil, fmt.Errorf("only local $ref is supported, got %q", ref)
+	}
+	var node interface{} = s.root
+	for _, part := range strings.Split(strings.TrimPrefix(strings.TrimPrefix(ref, "#"), "/"), "/") {
+		if part == "" {
+			continue
+		}
+		part = strings.ReplaceAll(strings.ReplaceAll(part, "~1", "/"), "~0", "~")
+		m, ok := node.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("unresolvable $ref %q", ref)
+		}
+		if node, ok = m[part]; !ok {
+			return nil, fmt.Errorf("unresolvable $ref %q", ref)
+		}
+	}
+	return node, nil
+}
+
+// Validate returns the violations of value, which must be decoded with
+// encoding/json, or nil when it is valid
+func (s *JSONSchema) Validate(value interface{}) []string {
+	visits := 0
+	errs := s.validate(s.root, value, "$", 0, &visits)
+	if visits > maxSchemaVisits {
+		return []string{"$: schema is too complex to validate"}
+	}
+	return errs
+}
+
+// maxSchemaDepth stops recursive $refs from looping forever
+const maxSchemaDepth = 64
+
+// maxSchemaVisits caps the schema nodes one validation visits. Branching
+// anyOf and oneOf with recursive $refs can otherwise take exponential time.
+const maxSchemaVisits = 100000
+
+func (s *JSONSchema) validate(node interface{}, value interface{}, path string, depth int, visits *int) []string {
+	if *visits++; *visits > maxSchemaVisits {
+		return []string{path + ": schema is too complex to validate"}
+	}
+	if depth > maxSchemaDepth {
+		return []string{path + ": schema nesting is too deep"}
+	}
+	schema, ok := node.(map[string]interface{})
+	if !ok {
+		if allowed, isBool := node.(bool); isBool && !allowed {
+			return []string{path + ": no value is allowed here"}
+		}
+		return nil
+	}
+	if ref, ok := schema["$ref"].(string); ok {
+		target, err := s.resolve(ref)
+		if err != nil {
+			return []string{path + ": " + err.Error()}
+		}
+		return s.validate(target, value, path, depth+1, visits)
+	}
+
+	var errs []string
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, path+": "+fmt.Sprintf(format, args...))
+	}
+
+	if types := schemaTypeList(schema["type"]); len(types) > 0 && !matchesType(value, types) {
+		fail("expected %s, got %s", strings.Join(types, " or "), jsonTypeOf(value))
+		return errs
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok && !containsJSON(enum, value) {
+		fail("must be one of %s", compactJSON(enum))
+	}
+	if c, ok := schema["const"]; ok && !equalJSON(c, value) {
+		fail("must be %s", compactJSON(c))
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		props, _ := schema["properties"].(map[string]interface{})
+		required, _ := schema["required"].([]interface{})
+		for _, name := range required {
+			if name, ok := name.(string); ok {
+				if _, present := v[name]; !present {
+					fail("missing required property %q", name)
+				}
+			}
+		}
+		for _, name := range sortedKeys(v) {
+			child := propertyPath(path, name)
+			if prop, ok := props[name]; ok {
+				errs = append(errs, s.validate(prop, v[name], child, depth+1, visits)...)
+			} else if extra, ok := schema["additionalProperties"]; ok {
+				if allowed, isBool := extra.(bool); isBool && !allowed {
+					errs = append(errs, child+": property is not allowed")
+				} else {
+					errs = append(errs, s.validate(extra, v[name], child, depth+1, visits)...)
+				}
+			}
+		}
+	case []interface{}:
+		if n, ok := schemaNumber(schema, "minItems"); ok && float64(len(v)) < n {
+			fail("must have at least %v items", n)
+		}
+		if n, ok := schemaNumber(schema, "maxItems"); ok && float64(len(v)) > n {
+			fail("must have at most %v items", n)
+		}
+		if items, ok := schema["items"]; ok {
+			for i, item := range v {
+				errs = append(errs, s.validate(items, item, fmt.Sprintf("%s[%d]", path, i), depth+1, visits)...)
+			}
+		}
+	case string:
+		length := float64(len([]rune(v)))
+		if n, ok := schemaNumber(schema, "minLength"); ok && length < n {
+			fail("must be at least %v characters", n)
+		}
+		if n, ok := schemaNumber(schema, "maxLength"); ok && length > n {
+			fail("must be at most %v characters", n)
+		}
+		if pattern, ok := schema["pattern"].(string); ok && s.patterns[pattern] != nil && !s.patterns[pattern].MatchString(v) {
+			fail("must match pattern %q", pattern)
+		}
+	case float64:
+		if n, ok := schemaNumber(schema, "minimum"); ok && v < n {
+			fail("must be at least %v", n)
+		}
+		if n, ok := schemaNumber(schema, "maximum"); ok && v > n {
+			fail("must be at most %v", n)
+		}
+		if n, ok := schemaNumber(schema, "exclusiveMinimum"); ok && v <= n {
+			fail("must be greater than %v", n)
+		}
+		if n, ok := schemaNumber(schema, "exclusiveMaximum"); ok && v >= n {
+			fail("must be less than %v", n)
+		}
+	}
+
+	if allOf, ok := schema["allOf"].([]interface{}); ok {
+		for _, sub := range allOf {
+			errs = append(errs, s.validate(sub, value, path, depth+1, visits)...)
+		}
+	}
+	if anyOf, ok := schema["anyOf"].([]interface{}); ok {
+		matched := false
+		for _, sub := range anyOf {
+			if len(s.validate(sub, value, path, depth+1, visits)) == 0 {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			fail("does not match any of the allowed schemas")
+		}
+	}
+	if oneOf, ok := schema["oneOf"].([]interface{}); ok {
+		matched := 0
+		for _, sub := range oneOf {
+			if len(s.validate(sub, value, path, depth+1, visits)) == 0 {
+				matched++
+			}
+		}
+		if matched != 1 {
+			fail("must match exactly one of the allowed schemas, matched %d", matched)
+		}
+	}
+	return errs
+}
+
+func schemaTypeList(v interface{}) []string {
+	switch t := v.(type) {
+	case string:
+		return []string{t}
+	case []interface{}:
+		var types []string
+		for _, item := range t {
+			if s, ok := item.(string); ok {
+				types = append(types, s)
+			}
+		}
+		return types
+	}
+	return nil
+}
+
+func schemaNumber(schema map[string]interface{}, key string) (float64, bool) {
+	n, ok := schema[key].(float64)
+	return n, ok
+}
+
+func matchesType(value interface{}, types []string) bool {
+	actual := jsonTypeOf(value)
+	for _, t := range types {
+		if t == actual || (t == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonTypeOf names the JSON Schema type of a decoded value
+func jsonTypeOf(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if v == math.Trunc(v) && !math.IsInf(v, 0) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+func compactJSON(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+func equalJSON(a, b interface{}) bool {
+	return compactJSON(a) == compactJSON(b)
+}
+
+func containsJSON(values []interface{}, value interface{}) bool {
+	for _, v := range values {
+		if equalJSON(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var plainPropertyName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// propertyPath appends a property to a "$.a.b" style path
+func propertyPath(path, name string) string {
+	if plainPropertyName.MatchString(name) {
+		return path + "." + name
+	}
+	return path + "[" + strconv.Quote(name) + "]"
+}
@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+const personSchema = `{
+	"type": "object",
+	"properties": {
+		"name": {"type": "string", "minLength": 1},
+		"age": {"type": "integer", "minimum": 0},
+		"email": {"type": ["string", "null"], "pattern": "^[^@]+@[^@]+$"},
+		"role": {"enum": ["admin", "user"]},
+		"tags": {"type": "array", "items": {"type": "string"}, "maxItems": 2},
+		"address": {"$ref": "#/$defs/address"}
+	},
+	"required": ["name", "age"],
+	"additionalProperties": false,
+	"$defs": {
+		"address": {
+			"type": "object",
+			"properties": {"city": {"type": "string"}},
+			"required": ["city"]
+		}
+	}
+}`
+
+func TestJSONSchemaValidate(t *testing.T) {
+	schema, err := CompileJSONSchema([]byte(personSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		doc  string
+		want []string
+	}{
+		{`{"name":"Ada","age":36,"email":null,"role":"admin","tags":["a"],"address":{"city":"London"}}`, nil},
+		{`{"name":"Ada"}`, []string{`$: missing required property "age"`}},
+		{`{"name":"","age":1.5}`, []string{"$.age: expected integer, got number", "$.name: must be at least 1 characters"}},
+		{`{"name":"Ada","age":-1,"nick":"A"}`, []string{"$.age: must be at least 0", "$.nick: property is not allowed"}},
+		{`{"name":"Ada","age":1,"email":"nope","role":"root"}`, []string{`$.email: must match pattern "^[^@]+@[^@]+$"`, `$.role: must be one of ["admin","user"]`}},
+		{`{"name":"Ada","age":1,"tags":["a",2,"c"]}`, []string{"$.tags: must have at most 2 items", "$.tags[1]: expected string, got integer"}},
+		{`{"name":"Ada","age":1,"address":{}}`, []string{`$.address: missing required property "city"`}},
+		{`[]`, []string{"$: expected object, got array"}},
+	}
+	for _, tt := range tests {
+		var value interface{}
+		if err := json.Unmarshal([]byte(tt.doc), &value); err != nil {
+			t.Fatal(err)
+		}
+		got := schema.Validate(value)
+		if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+			t.Errorf("Validate(%s) = %q, want %q", tt.doc, got, tt.want)
+		}
+	}
+}
+
+func TestJSONSchemaCombinators(t *testing.T) {
+	schema, err := CompileJSONSchema([]byte(`{
+		"type": "object",
+		"properties": {
+			"id": {"anyOf": [{"type": "string"}, {"type": "integer"}]},
+			"kind": {"oneOf": [{"const": "a"}, {"type": "string", "maxLength": 1}]}
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := map[string]interface{}{"id": "x", "kind": "b"}
+	if got := schema.Validate(valid); got != nil {
+		t.Errorf("Validate(valid) = %q", got)
+	}
+	invalid := map[string]interface{}{"id": true, "kind": "a"}
+	got := strings.Join(schema.Validate(invalid), "\n")
+	if !strings.Contains(got, "$.id: does not match any") || !strings.Contains(got, "$.kind: must match exactly one of the allowed schemas, matched 2") {
+		t.Errorf("Validate(invalid) = %s", got)
+	}
+}
+
+func TestCompileJSONSchemaErrors(t *testing.T) {
+	for schema, want := range map[string]string{
+		`[]`:                                  "schema must be a JSON object",
+		`{"type":"text"}`:                     `unknown type "text"`,
+		`{"type":"string","pattern":"("}`:     "invalid pattern",
+		`{"$ref":"#/$defs/missing"}`:          "unresolvable $ref",
+		`{"$ref":"https://example.com/s"}`:    "only local $ref",
+		`{"properties":{"a":{"type":"int"}}}`: `#/properties/a: unknown type "int"`,
+	} {
+		if _, err := CompileJSONSchema([]byte(schema)); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("CompileJSONSchema(%s) error = %v, want %q", schema, err, want)
+		}
+	}
+}
+
+func TestJSONSchemaBranchingRefsFinishQuickly(t *testing.T) {
+	schema, err := CompileJSONSchema([]byte(`{"oneOf":[{"$ref":"#"},{"$ref":"#"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	got := schema.Validate(map[string]interface{}{"a": 1.0})
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("validation took %v", elapsed)
+	}
+	if len(got) != 1 || !strings.Contains(got[0], "too complex") {
+		t.Errorf("violations = %v", got)
+	}
+}
@@ -0,0 +1,278 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sessionSweepInterval is how often a Server drops expired sessions
+const sessionSweepInterval = 5 * time.Minute
+
+// Server is an NFA proxy that can be mounted in another program. It holds its
+// own config, session and model caches, circuit breaker, logger and HTTP
+// client, so several can run in one process.
+type Server struct {
+	*Proxy
+	mux *http.ServeMux
+
+	cancel    context.CancelFunc
+	workers   sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// Option customises a Server created by New
+type Option func(*Proxy)
+
+// WithLogger sends the server's logs to logger instead of the standard logger
+func WithLogger(logger *log.Logger) Option {
+	return func(p *Proxy) { p.logger = logger }
+}
+
+// WithHTTPClient makes the server reach consumer nodes with client. Per-call
+// timeouts from the config still apply.
+func WithHTTPClient(client *http.Client) Option {
+	return func(p *Proxy) { p.client = client }
+}
+
+// WithThreadStore keeps the server's conversation threads in store instead of
+// the store named by the threads config
+func WithThreadStore(store ThreadStore) Option {
+	return func(p *Proxy) { p.threads = store }
+}
+
+// New creates a proxy server for cfg, which is validated first. A nil cfg is
+// loaded from defaults and the environment. Background workers run until
+// Close.
+func New(cfg *Config, opts ...Option) (*Server, error) {
+	if cfg == nil {
+		var err error
+		if cfg, err = LoadConfig(""); err != nil {
+			return nil, err
+		}
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	p := &Proxy{
+		client:    &http.Client{},
+		logger:    log.Default(),
+		config:    new(atomic.Pointer[Config]),
+		debug:     new(atomic.Bool),
+		sessions:  newSessionStore(),
+		models:    newModelStore(),
+		catalog:   &catalogState{},
+		readiness: &readinessCache{},
+		txs:       newTxQueue(),
+		wallets:   newWalletTracker(),
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	p.setConfig(cfg)
+	p.breaker = newCircuitBreaker(cfg.CircuitBreaker, p.logger)
+	p.usage = NewUsageLedger(cfg.UsageLedgerFile)
+	p.usage.logger = p.logger
+	if p.threads == nil {
+		p.threads = newThreadStore(cfg.Threads)
+	}
+
+	var err error
+	if cfg.RateLimits != nil {
+		p.limiter = NewRateLimiter(*cfg.RateLimits)
+		p.logger.Printf("Rate limiting enabled from %s", cfg.Source("rate_limits"))
+	}
+
+	if cfg.Budgets != nil {
+		if p.budgets, err = NewBudgetTracker(*cfg.Budgets); err != nil {
+			return nil, fmt.Errorf("invalid budget configuration: %w", err)
+		}
+		p.budgets.logger = p.logger
+		p.logger.Printf("MOR budgets enabled from %s", cfg.Source("budgets"))
+	}
+
+	chains, err := newMiddlewareChains(cfg.Middleware)
+	if err != nil {
+		return nil, fmt.Errorf("invalid middleware configuration: %w", err)
+	}
+	p.setMiddlewareConfig(chains)
+
+	if len(cfg.Marketplace.Nodes) > 0 {
+		p.nodes = NewNodePool(cfg.Marketplace)
+		p.nodes.logger = p.logger
+		p.logger.Printf("Balancing sessions across %d consumer nodes (%s)", len(cfg.Marketplace.Nodes), cfg.Marketplace.Balancing)
+	}
+
+	if cfg.Audit.File != "" {
+		p.audit = NewAuditLog(cfg.Audit)
+		p.audit.logger = p.logger
+		p.logger.Printf("Audit log enabled at %s", cfg.Audit.File)
+	}
+
+	authConfig := cfg.Auth
+	// When every TCP client must present a verified certificate, it identifies
+	// the caller even without auth config. With optional client certificates,
+	// certificate auth is only used when auth.client_cert is configured, so
+	// clients without one are not shut out.
+	if cfg.Server.TLS.ClientCAFile != "" && strings.ToLower(cfg.Server.TLS.ClientAuth) != "optional" {
+		if authConfig == nil {
+			authConfig = &AuthConfig{}
+		}
+		if authConfig.ClientCert == nil {
+			withCert := *authConfig
+			withCert.ClientCert = &ClientCertConfig{}
+			authConfig = &withCert
+		}
+	}
+	if authConfig != nil {
+		if p.authenticators, err = newAuthenticators(*authConfig, cfg.AdminAPIKey, cfg.EthNodeAddress); err != nil {
+			return nil, fmt.Errorf("invalid auth configuration: %w", err)
+		}
+		p.logger.Printf("Inbound authentication enabled")
+	} else {
+		p.logger.Printf("Warning: auth is not configured, proxy endpoints are unauthenticated")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p.async = newAsyncJobs(ctx)
+	if cfg.Batches.Dir != "" {
+		if p.batches, err = newBatchManager(ctx, cfg.Batches, p.logger); err != nil {
+			cancel()
+			return nil, fmt.Errorf("invalid batch configuration: %w", err)
+		}
+		p.logger.Printf("Batch API enabled with files in %s", cfg.Batches.Dir)
+		p.batches.resume(p)
+	}
+
+	s := &Server{Proxy: p, mux: p.routes(), cancel: cancel}
+	s.start(func() { p.sweepSessions(ctx, sessionSweepInterval) })
+	s.start(func() {
+		p.async.sweep(ctx, asyncSweepInterval, func() time.Duration { return p.cfg().Async.JobTTL.Duration })
+	})
+	if p.nodes != nil {
+		if interval := cfg.Marketplace.HealthCheckInterval.Duration; interval > 0 {
+			s.start(func() { p.nodes.probe(ctx, p.httpClient(interval), interval) })
+		}
+	}
+	if interval := cfg.Wallets.CheckInterval.Duration; interval > 0 {
+		s.start(func() { p.watchWallets(ctx, interval) })
+	}
+	return s, nil
+}
+
+// newDefaultServer creates the server run by StartProxyServer. Its config,
+// and the result of each call to reload, is also installed as the package's
+// active config, which the package-level API such as NewProxy reads.
+func newDefaultServer(cfg *Config) (*Server, func(*Config), error) {
+	s, err := New(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	setConfig(s.cfg())
+	reload := func(next *Config) {
+		s.Reload(next)
+		setConfig(s.cfg())
+	}
+	return s, reload, nil
+}
+
+// start runs a background worker until Close
+func (s *Server) start(worker func()) {
+	s.workers.Add(1)
+	go func() {
+		defer s.workers.Done()
+		worker()
+	}()
+}
+
+// ServeHTTP implements http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// Reload applies the hot-reloadable settings of cfg and logs the settings
+// that need a new server
+func (s *Server) Reload(cfg *Config) {
+	s.reloadConfig(cfg)
+}
+
+// Close stops the background workers and waits for them to exit. Requests in
+// flight are not interrupted, except those of batches, which resume when a
+// server is next created on the same batch directory, and async jobs, which
+// fail. Close is safe to call more than once.
+func (s *Server) Close() error {
+	s.closeOnce.Do(func() {
+		s.cancel()
+		s.workers.Wait()
+		if s.batches != nil {
+			s.batches.wait()
+		}
+		s.async.wait()
+	})
+	return nil
+}
+
+// routes registers the proxy endpoints on a new mux
+func (p *Proxy) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{"status": "healthy"})
+	})
+	mux.HandleFunc("/livez", handleLivez)
+	mux.HandleFunc("/readyz", p.handleReadyz)
+
+	// Add handlers for blockchain/models endpoints
+	mux.HandleFunc("/blockchain/models", p.requireScope(ScopeChat, p.handleGetModels))
+	mux.HandleFunc("/blockchain/models/", p.requireScope(ScopeSessions, p.handleModelOperations))
+	mux.HandleFunc("/v1/chat/completions", p.requireScope(ScopeChat, p.withAudit(p.handleChatCompletions)))
+	mux.HandleFunc("/v1/threads", p.requireScope(ScopeChat, p.withAudit(p.handleThreads)))
+	mux.HandleFunc("/v1/threads/", p.requireScope(ScopeChat, p.withAudit(p.handleThreads)))
+	mux.HandleFunc("/v1/files", p.requireScope(ScopeChat, p.handleFiles))
+	mux.HandleFunc("/v1/files/", p.requireScope(ScopeChat, p.handleFiles))
+	mux.HandleFunc("/v1/batches", p.requireScope(ScopeChat, p.handleBatches))
+	mux.HandleFunc("/v1/batches/", p.requireScope(ScopeChat, p.handleBatches))
+	mux.HandleFunc("/v1/async/chat/completions", p.requireScope(ScopeChat, p.withAudit(p.handleAsyncChatCompletions)))
+	mux.HandleFunc("/v1/async/jobs", p.requireScope(ScopeChat, p.handleAsyncJobs))
+	mux.HandleFunc("/v1/async/jobs/", p.requireScope(ScopeChat, p.handleAsyncJobs))
+	mux.HandleFunc("/admin/budgets", p.requireScope(ScopeAdmin, p.handleAdminBudgets))
+	mux.HandleFunc("/admin/usage", p.requireScope(ScopeAdmin, p.handleAdminUsage))
+	mux.HandleFunc("/admin/sessions", p.requireScope(ScopeAdmin, p.handleAdminSessions))
+	mux.HandleFunc("/admin/sessions/", p.requireScope(ScopeAdmin, p.handleAdminSessions))
+	mux.HandleFunc("/admin/models/cache", p.requireScope(ScopeAdmin, p.handleAdminModelCache))
+	mux.HandleFunc("/admin/circuit-breaker", p.requireScope(ScopeAdmin, p.handleAdminCircuitBreaker))
+	mux.HandleFunc("/admin/log-level", p.requireScope(ScopeAdmin, p.handleAdminLogLevel))
+	mux.HandleFunc("/admin/nodes", p.requireScope(ScopeAdmin, p.handleAdminNodes))
+	mux.HandleFunc("/admin/wallets", p.requireScope(ScopeAdmin, p.handleAdminWallets))
+	mux.HandleFunc("/admin/readiness", p.requireScope(ScopeAdmin, p.handleAdminReadiness))
+	mux.HandleFunc("/admin/async/dead-letters", p.requireScope(ScopeAdmin, p.handleAdminDeadLetters))
+	return mux
+}
+
+// sweepSessions drops expired sessions from the cache each interval until
+// ctx is done
+func (p *Proxy) sweepSessions(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			p.sessions.Lock()
+			for id, session := range p.sessions.m {
+				if !now.Before(session.ExpiresAt) {
+					delete(p.sessions.m, id)
+				}
+			}
+			p.sessions.Unlock()
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestServer(t *testing.T, name string, logs *bytes.Buffer) *Server {
+	t.Helper()
+	marketplace := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/blockchain/models":
+			fmt.Fprint(w, `{"models":[{"Id":"0xllama","Name":"Llama"}]}`)
+		case "/blockchain/models/0xllama/session":
+			fmt.Fprintf(w, `{"sessionId":"%s-session"}`, name)
+		case "/v1/chat/completions":
+			fmt.Fprintf(w, "data: {\"choices\":[{\"delta\":{\"content\":\"%s\"}}]}\n\ndata: [DONE]\n\n", name)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(marketplace.Close)
+
+	cfg, err := LoadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Marketplace.URL = marketplace.URL
+	s, err := New(cfg, WithLogger(log.New(logs, "", 0)))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestServerInstancesAreIsolated(t *testing.T) {
+	var logsA, logsB bytes.Buffer
+	a := newTestServer(t, "a", &logsA)
+	b := newTestServer(t, "b", &logsB)
+
+	for name, s := range map[string]*Server{"a": a, "b": b} {
+		w := httptest.NewRecorder()
+		body := `{"model":"Llama","messages":[{"role":"user","content":"Hi"}]}`
+		s.ServeHTTP(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body)))
+		if w.Code != http.StatusOK || StreamCompletion(w.Body.Bytes()) != name {
+			t.Errorf("server %s: status = %d, body = %s", name, w.Code, w.Body.String())
+		}
+	}
+
+	if _, ok := a.sessions.m["b-session"]; ok || len(a.sessions.m) != 1 {
+		t.Errorf("server a sessions = %v", a.sessions.m)
+	}
+	if _, ok := b.sessions.m["b-session"]; !ok || len(b.sessions.m) != 1 {
+		t.Errorf("server b sessions = %v", b.sessions.m)
+	}
+	sessionCache.RLock()
+	_, leaked := sessionCache.m["a-session"]
+	sessionCache.RUnlock()
+	if leaked {
+		t.Error("server session leaked into the package-level cache")
+	}
+	if !strings.Contains(logsA.String(), "a-session") || strings.Contains(logsA.String(), "b-session") {
+		t.Errorf("server a logs = %s", logsA.String())
+	}
+
+	w := httptest.NewRecorder()
+	a.ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("/health status = %d", w.Code)
+	}
+}
+
+func TestServerClose(t *testing.T) {
+	s := newTestServer(t, "close", &bytes.Buffer{})
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Closing again is a no-op
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewRejectsInvalidConfig(t *testing.T) {
+	cfg, err := LoadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Marketplace.ChatRetries = -1
+	if _, err := New(cfg); err == nil || !strings.Contains(err.Error(), "chat_retries") {
+		t.Errorf("New() error = %v, want a chat_retries validation error", err)
+	}
+}
+
+func TestDefaultServerInstallsActiveConfig(t *testing.T) {
+	cfg, err := LoadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Marketplace.URL = "http://consumer.example:8082"
+	s, reload, err := newDefaultServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		s.Close()
+		setConfig(nil)
+	})
+
+	if got := NewProxy().cfg().Marketplace.URL; got != cfg.Marketplace.URL {
+		t.Errorf("package-level marketplace URL = %q", got)
+	}
+
+	next := *cfg
+	next.LogLevel = "debug"
+	reload(&next)
+	if currentConfig() != s.cfg() || currentConfig().LogLevel != "debug" || !debugLogging.Load() {
+		t.Errorf("reload did not reach the package-level config: %+v", currentConfig().LogLevel)
+	}
+}
@@ -0,0 +1,216 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// StructuredOutputConfig configures response_format enforcement
+type StructuredOutputConfig struct {
+	// Retries is how many times output that fails its schema is sent back to
+	// the model with a list of what was wrong
+	Retries int `json:"retries" env:"STRUCTURED_OUTPUT_RETRIES"`
+}
+
+// ResponseFormat is the OpenAI response_format of a chat request
+type ResponseFormat struct {
+	// Type is text, json_object or json_schema
+	Type       string            `json:"type"`
+	JSONSchema *JSONSchemaFormat `json:"json_schema,omitempty"`
+}
+
+// JSONSchemaFormat names the schema a json_schema response must match
+type JSONSchemaFormat struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Schema      json.RawMessage `json:"schema"`
+	Strict      *bool           `json:"strict,omitempty"`
+}
+
+// outputFormat is a response_format the proxy enforces
+type outputFormat struct {
+	name   string
+	schema *JSONSchema // nil for json_object
+}
+
+// outputFormat compiles the request's response_format. It returns nil when
+// the output is free text.
+func (f *ResponseFormat) outputFormat() (*outputFormat, error) {
+	if f == nil {
+		return nil, nil
+	}
+	switch f.Type {
+	case "", "text":
+		return nil, nil
+	case "json_object":
+		return &outputFormat{name: "json_object"}, nil
+	case "json_schema":
+		if f.JSONSchema == nil || len(f.JSONSchema.Schema) == 0 {
+			return nil, errors.New("json_schema.schema is required")
+		}
+		schema, err := CompileJSONSchema(f.JSONSchema.Schema)
+		if err != nil {
+			return nil, fmt.Errorf("invalid json_schema.schema: %v", err)
+		}
+		return &outputFormat{name: f.JSONSchema.Name, schema: schema}, nil
+	}
+	return nil, fmt.Errorf("unsupported type %q, expected text, json_object or json_schema", f.Type)
+}
+
+// check extracts a JSON object from output and validates it. Code fences and
+// text around the object are removed first. It returns the compacted object,
+// or the violations found.
+func (f *outputFormat) check(output string) (string, []string) {
+	text := strings.TrimSpace(output)
+	if start, end := strings.Index(text, "{"), strings.LastIndex(text, "}"); start >= 0 && end > start {
+		text = text[start : end+1]
+	}
+	var value interface{}
+	if err := json.Unmarshal([]byte(text), &value); err != nil {
+		return "", []string{fmt.Sprintf("$: output is not valid JSON: %v", err)}
+	}
+	if _, ok := value.(map[string]interface{}); !ok {
+		return "", []string{fmt.Sprintf("$: expected a JSON object, got %s", jsonTypeOf(value))}
+	}
+	if f.schema != nil {
+		if violations := f.schema.Validate(value); len(violations) > 0 {
+			return "", violations
+		}
+	}
+	var compact bytes.Buffer
+	json.Compact(&compact, []byte(text))
+	return compact.String(), nil
+}
+
+// repairPrompt asks the model to correct output that failed its format
+func (f *outputFormat) repairPrompt(violations []string) string {
+	target := "a single JSON object"
+	if f.schema != nil {
+		target = "a single JSON object that matches the JSON schema " + f.name
+	}
+	return fmt.Sprintf("Your previous reply was not %s. Problems:\n- %s\nReply again with only the corrected JSON object, without code fences or other text.",
+		target, strings.Join(violations, "\n- "))
+}
+
+// OutputValidationError reports output that still failed its response_format
+// after every retry
+type OutputValidationError struct {
+	Attempts   int
+	Violations []string
+}
+
+func (e *OutputValidationError) Error() string {
+	return fmt.Sprintf("model output did not match response_format after %d attempts: %s", e.Attempts, strings.Join(e.Violations, "; "))
+}
+
+// responseBuffer collects a response instead of sending it
+type responseBuffer struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *responseBuffer) Header() http.Header { return b.header }
+
+func (b *responseBuffer) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.body.Write(p)
+}
+
+func (b *responseBuffer) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+// serveStructuredChat buffers the model's reply, checks it against format and
+// sends it back with the problems found until it passes or the retries run
+// out. Only a valid object, or an error listing the violations, reaches the
+// caller.
+func (p *Proxy) serveStructuredChat(w http.ResponseWriter, r *http.Request, req ChatCompletionRequest, attempt *chatAttempt, format *outputFormat) (*chatAttempt, error) {
+	retries := p.cfg().StructuredOutput.Retries
+	pipeline := pipelineFrom(r.Context())
+	for try := 0; ; try++ {
+		buf := &responseBuffer{header: make(http.Header)}
+		err := p.streamChat(buf, r, attempt.modelID, req, attempt.sessionID, attempt.upstream)
+		attempt.sessionID = attempt.upstream.sessionID
+		if err != nil {
+			p.logger.Printf("Error forwarding chat request: %v", err)
+			var mwErr *MiddlewareError
+			if errors.As(err, &mwErr) {
+				respondWithAPIError(w, mwErr.Status, newAPIError(errorTypeForStatus(mwErr.Status), mwErr.Code, "", mwErr.Message))
+			} else {
+				respondWithForwardError(w, "Error forwarding request", err)
+			}
+			return attempt, err
+		}
+
+		output := StreamCompletion(buf.body.Bytes())
+		object, violations := format.check(output)
+		if violations == nil {
+			for name, values := range buf.header {
+				w.Header()[name] = values
+			}
+			writeStructuredCompletion(w, attempt.model, object)
+			return attempt, nil
+		}
+
+		if try == retries {
+			err := &OutputValidationError{Attempts: try + 1, Violations: violations}
+			p.logger.Printf("Giving up on structured output from model %s: %v", attempt.model, err)
+			apiErr := newAPIError("server_error", "response_format_violation", "response_format", err.Error())
+			apiErr.Violations = violations
+			respondWithAPIError(w, http.StatusBadGateway, apiErr)
+			return attempt, err
+		}
+		p.logger.Printf("Output of model %s failed response_format (attempt %d/%d): %s", attempt.model, try+1, retries+1, strings.Join(violations, "; "))
+
+		// Ask again on the same session with the problems listed. The reply is
+		// repeated as the model sent it, since response middleware such as pii
+		// may have put the caller's raw values back into output.
+		reply := output
+		if pipeline != nil && len(pipeline.chain) > 0 {
+			reply = pipeline.cc.Completion()
+		}
+		req.Messages = append(req.Messages,
+			Message{Role: "assistant", Content: reply},
+			Message{Role: "user", Content: format.repairPrompt(violations)})
+		pipeline.reset()
+		upstream, err := p.openChatStream(r, attempt.modelID, req, attempt.sessionID)
+		if err != nil {
+			p.logger.Printf("Error forwarding chat request: %v", err)
+			respondWithForwardError(w, "Error forwarding request", err)
+			return attempt, err
+		}
+		attempt.upstream = upstream
+	}
+}
+
+// writeStructuredCompletion sends a validated object as a one-chunk stream
+func writeStructuredCompletion(w http.ResponseWriter, model, object string) {
+	chunk := map[string]interface{}{
+		"id":      newObjectID("chatcmpl-"),
+		"object":  "chat.completion.chunk",
+		"created": time.Now().Unix(),
+		"model":   model,
+		"choices": []map[string]interface{}{{
+			"index":         0,
+			"delta":         map[string]string{"role": "assistant", "content": object},
+			"finish_reason": "stop",
+		}},
+	}
+	data, _ := json.Marshal(chunk)
+	w.Header().Del("Content-Length")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "data: %s\n\ndata: [DONE]\n\n", data)
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
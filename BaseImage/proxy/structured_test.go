@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newStructuredServer returns a proxy whose model answers each chat with the
+// next reply in turn, and the requests it received
+func newStructuredServer(t *testing.T, replies ...string) (*Server, func() []ChatCompletionRequest) {
+	t.Helper()
+	var mu sync.Mutex
+	var received []ChatCompletionRequest
+	marketplace := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/blockchain/models":
+			fmt.Fprint(w, `{"models":[{"Id":"0xllama","Name":"Llama"}]}`)
+		case "/blockchain/models/0xllama/session":
+			fmt.Fprint(w, `{"sessionId":"s"}`)
+		case "/v1/chat/completions":
+			var req ChatCompletionRequest
+			json.NewDecoder(r.Body).Decode(&req)
+			mu.Lock()
+			received = append(received, req)
+			reply := replies[(len(received)-1)%len(replies)]
+			mu.Unlock()
+			content, _ := json.Marshal(reply)
+			fmt.Fprintf(w, "data: {\"choices\":[{\"delta\":{\"content\":%s}}]}\n\ndata: [DONE]\n\n", content)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(marketplace.Close)
+
+	cfg, err := LoadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Marketplace.URL = marketplace.URL
+	s, err := New(cfg, WithLogger(log.New(io.Discard, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s, func() []ChatCompletionRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return received
+	}
+}
+
+const structuredRequest = `{"model":"Llama","messages":[{"role":"user","content":"Who?"}],
+	"response_format":{"type":"json_schema","json_schema":{"name":"person","schema":{
+		"type":"object","properties":{"name":{"type":"string"}},"required":["name"]}}}}`
+
+func TestStructuredOutputRepairsInvalidReplies(t *testing.T) {
+	s, received := newStructuredServer(t, `I think it is {"nom": "Ada"}`, "```json\n{\"name\": \"Ada\"}\n```")
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(structuredRequest)))
+	if w.Code != http.StatusOK || StreamCompletion(w.Body.Bytes()) != `{"name":"Ada"}` {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if strings.Contains(w.Body.String(), "nom") {
+		t.Error("invalid output reached the caller")
+	}
+
+	reqs := received()
+	if len(reqs) != 2 {
+		t.Fatalf("upstream requests = %d, want 2", len(reqs))
+	}
+	if reqs[0].ResponseFormat == nil || reqs[0].ResponseFormat.Type != "json_schema" {
+		t.Errorf("response_format was not forwarded: %+v", reqs[0].ResponseFormat)
+	}
+	repair := reqs[1].Messages
+	if len(repair) != 3 || repair[1].Role != "assistant" || !strings.Contains(repair[2].Content, `missing required property "name"`) {
+		t.Errorf("repair messages = %+v", repair)
+	}
+}
+
+func TestStructuredOutputRepairKeepsPIITokenized(t *testing.T) {
+	s, received := newStructuredServer(t, `{"nom": "<PII_EMAIL_1>"}`, `{"name": "<PII_EMAIL_1>"}`)
+	s.Use("*", &PIIMiddleware{Default: PIITokenize})
+
+	body := strings.Replace(structuredRequest, "Who?", "Who is ada@example.com?", 1)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body)))
+	if w.Code != http.StatusOK || StreamCompletion(w.Body.Bytes()) != `{"name":"ada@example.com"}` {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	reqs := received()
+	if len(reqs) != 2 {
+		t.Fatalf("upstream requests = %d, want 2", len(reqs))
+	}
+	for _, m := range reqs[1].Messages {
+		if strings.Contains(m.Content, "ada@example.com") {
+			t.Errorf("repair request leaked PII: %+v", m)
+		}
+	}
+	if reqs[1].Messages[1].Content != `{"nom": "<PII_EMAIL_1>"}` {
+		t.Errorf("assistant repair turn = %q", reqs[1].Messages[1].Content)
+	}
+}
+
+func TestStructuredOutputReportsViolations(t *testing.T) {
+	s, received := newStructuredServer(t, `{"name": 7}`)
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(structuredRequest)))
+	var body struct {
+		Error APIError `json:"error"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if w.Code != http.StatusBadGateway || body.Error.Code == nil || *body.Error.Code != "response_format_violation" {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if len(body.Error.Violations) != 1 || body.Error.Violations[0] != "$.name: expected string, got integer" {
+		t.Errorf("violations = %q", body.Error.Violations)
+	}
+	// The first attempt plus the default two retries
+	if n := len(received()); n != 3 {
+		t.Errorf("upstream requests = %d, want 3", n)
+	}
+}
+
+func TestStructuredOutputRejectsBadFormat(t *testing.T) {
+	s, received := newStructuredServer(t, `{}`)
+	for _, format := range []string{
+		`{"type":"xml"}`,
+		`{"type":"json_schema","json_schema":{"name":"x"}}`,
+		`{"type":"json_schema","json_schema":{"name":"x","schema":{"type":"thing"}}}`,
+	} {
+		body := `{"model":"Llama","messages":[{"role":"user","content":"Hi"}],"response_format":` + format + `}`
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"param":"response_format"`) {
+			t.Errorf("%s: status = %d, body = %s", format, w.Code, w.Body.String())
+		}
+	}
+	if n := len(received()); n != 0 {
+		t.Errorf("upstream requests = %d, want 0", n)
+	}
+}
+
+func TestStructuredOutputJSONObject(t *testing.T) {
+	s, _ := newStructuredServer(t, "not json", `{"ok": true}`)
+	body := `{"model":"Llama","messages":[{"role":"user","content":"Hi"}],"response_format":{"type":"json_object"}}`
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body)))
+	if got := StreamCompletion(w.Body.Bytes()); got != `{"ok":true}` {
+		t.Errorf("completion = %q", got)
+	}
+}
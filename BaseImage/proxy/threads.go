@@ -0,0 +1,515 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ThreadsConfig configures conversation thread storage
+type ThreadsConfig struct {
+	// Dir keeps one JSON file per thread; empty keeps threads in memory
+	Dir string `json:"dir" env:"THREADS_DIR"`
+}
+
+// Thread is a conversation whose history is kept by the proxy, so agents
+// send only new messages with each run
+type Thread struct {
+	ID        string            `json:"id"`
+	CreatedAt int64             `json:"created_at"`
+	Model     string            `json:"model,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	Messages  []ThreadMessage   `json:"messages"`
+
+	// Owner is the hashed caller that created the thread
+	Owner string `json:"owner"`
+	// SessionID is the session the last run used for SessionModel. Runs on
+	// that model reuse it so the provider can reuse its cache.
+	SessionID    string `json:"session_id,omitempty"`
+	SessionModel string `json:"session_model,omitempty"`
+}
+
+// ThreadMessage is one message in a thread
+type ThreadMessage struct {
+	ID        string `json:"id"`
+	Object    string `json:"object"`
+	CreatedAt int64  `json:"created_at"`
+	Role      string `json:"role"`
+	Content   string `json:"content"`
+	// Model is set on assistant replies
+	Model string `json:"model,omitempty"`
+}
+
+// ErrThreadNotFound is returned by a ThreadStore for unknown thread IDs
+var ErrThreadNotFound = errors.New("thread not found")
+
+// ThreadStore persists threads. Implementations must be safe for concurrent
+// use; the proxy serializes updates to a thread itself.
+type ThreadStore interface {
+	Get(id string) (*Thread, error)
+	Put(thread *Thread) error
+	Delete(id string) error
+}
+
+// newThreadStore returns a file store when cfg names a directory and a memory
+// store otherwise
+func newThreadStore(cfg ThreadsConfig) ThreadStore {
+	if cfg.Dir != "" {
+		return NewFileThreadStore(cfg.Dir)
+	}
+	return NewMemoryThreadStore()
+}
+
+// MemoryThreadStore keeps threads in memory until the process exits
+type MemoryThreadStore struct {
+	mu      sync.RWMutex
+	threads map[string][]byte
+}
+
+// NewMemoryThreadStore creates an empty in-memory store
+func NewMemoryThreadStore() *MemoryThreadStore {
+	return &MemoryThreadStore{threads: make(map[string][]byte)}
+}
+
+// Get implements ThreadStore
+func (s *MemoryThreadStore) Get(id string) (*Thread, error) {
+	s.mu.RLock()
+	data, ok := s.threads[id]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, ErrThreadNotFound
+	}
+	var thread Thread
+	if err := json.Unmarshal(data, &thread); err != nil {
+		return nil, err
+	}
+	return &thread, nil
+}
+
+// Put implements ThreadStore
+func (s *MemoryThreadStore) Put(thread *Thread) error {
+	// Stored encoded so callers cannot change a thread without Put
+	data, err := json.Marshal(thread)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.threads[thread.ID] = data
+	s.mu.Unlock()
+	return nil
+}
+
+// Delete implements ThreadStore
+func (s *MemoryThreadStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.threads[id]; !ok {
+		return ErrThreadNotFound
+	}
+	delete(s.threads, id)
+	return nil
+}
+
+// FileThreadStore keeps each thread in dir as <id>.json. Message content is
+// stored as sent, so the directory should be protected like the audit log.
+type FileThreadStore struct {
+	dir string
+}
+
+// NewFileThreadStore creates a store in dir, which is created on first write
+func NewFileThreadStore(dir string) *FileThreadStore {
+	return &FileThreadStore{dir: dir}
+}
+
+func (s *FileThreadStore) path(id string) (string, error) {
+	if !threadIDPattern.MatchString(id) {
+		return "", ErrThreadNotFound
+	}
+	return filepath.Join(s.dir, id+".json"), nil
+}
+
+// Get implements ThreadStore
+func (s *FileThreadStore) Get(id string) (*Thread, error) {
+	path, err := s.path(id)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, ErrThreadNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	var thread Thread
+	if err := json.Unmarshal(data, &thread); err != nil {
+		return nil, fmt.Errorf("failed to parse thread %s: %v", id, err)
+	}
+	return &thread, nil
+}
+
+// Put implements ThreadStore. The file is replaced atomically.
+func (s *FileThreadStore) Put(thread *Thread) error {
+	path, err := s.path(thread.ID)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(thread)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.dir, 0o700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(s.dir, thread.ID+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Delete implements ThreadStore
+func (s *FileThreadStore) Delete(id string) error {
+	path, err := s.path(id)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); os.IsNotExist(err) {
+		return ErrThreadNotFound
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+var threadIDPattern = regexp.MustCompile(`^thread_[0-9a-f]{24}$`)
+
+// newObjectID returns prefix followed by 24 random hex digits
+func newObjectID(prefix string) string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return prefix + hex.EncodeToString(b)
+}
+
+// threadLocks serializes changes to each thread, so concurrent appends and
+// runs do not overwrite each other
+type threadLocks struct {
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+func (l *threadLocks) lock(id string) func() {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*sync.Mutex)
+	}
+	m, ok := l.locks[id]
+	if !ok {
+		m = &sync.Mutex{}
+		l.locks[id] = m
+	}
+	l.mu.Unlock()
+	m.Lock()
+	return m.Unlock
+}
+
+// threadResponse is a thread as returned by the API, without its messages
+type threadResponse struct {
+	ID        string            `json:"id"`
+	Object    string            `json:"object"`
+	CreatedAt int64             `json:"created_at"`
+	Model     string            `json:"model,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	Messages  int               `json:"message_count"`
+}
+
+func (t *Thread) response() threadResponse {
+	return threadResponse{ID: t.ID, Object: "thread", CreatedAt: t.CreatedAt, Model: t.Model, Metadata: t.Metadata, Messages: len(t.Messages)}
+}
+
+// appendMessages adds messages to the thread, returning the stored copies
+func (t *Thread) appendMessages(messages []Message, model string) []ThreadMessage {
+	now := time.Now().Unix()
+	added := make([]ThreadMessage, 0, len(messages))
+	for _, m := range messages {
+		tm := ThreadMessage{ID: newObjectID("msg_"), Object: "thread.message", CreatedAt: now, Role: m.Role, Content: m.Content, Model: model}
+		t.Messages = append(t.Messages, tm)
+		added = append(added, tm)
+	}
+	return added
+}
+
+// history returns the thread as chat messages
+func (t *Thread) history() []Message {
+	messages := make([]Message, len(t.Messages))
+	for i, m := range t.Messages {
+		messages[i] = Message{Role: m.Role, Content: m.Content}
+	}
+	return messages
+}
+
+func validateThreadMessages(messages []Message) error {
+	for i, m := range messages {
+		switch m.Role {
+		case "system", "user", "assistant", "tool":
+		default:
+			return fmt.Errorf("messages[%d].role must be system, user, assistant or tool", i)
+		}
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// handleThreads serves the threads API:
+//
+//	POST   /v1/threads                 create a thread
+//	GET    /v1/threads/{id}            get a thread
+//	DELETE /v1/threads/{id}            delete a thread
+//	GET    /v1/threads/{id}/messages   list messages
+//	POST   /v1/threads/{id}/messages   append messages
+//	POST   /v1/threads/{id}/runs       run a chat completion on the thread
+func (p *Proxy) handleThreads(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/threads"), "/"), "/")
+	if parts[0] == "" {
+		if r.Method != http.MethodPost {
+			respondWithAPIError(w, http.StatusMethodNotAllowed, newAPIError("invalid_request_error", "", "", "Method not allowed"))
+			return
+		}
+		p.createThread(w, r)
+		return
+	}
+	if len(parts) > 2 {
+		respondWithAPIError(w, http.StatusNotFound, newAPIError("not_found_error", "", "", "Unknown threads endpoint"))
+		return
+	}
+
+	id := parts[0]
+	action := ""
+	if len(parts) == 2 {
+		action = parts[1]
+	}
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		if thread := p.loadThread(w, r, id); thread != nil {
+			writeJSON(w, thread.response())
+		}
+	case action == "" && r.Method == http.MethodDelete:
+		p.deleteThread(w, r, id)
+	case action == "messages" && r.Method == http.MethodGet:
+		if thread := p.loadThread(w, r, id); thread != nil {
+			writeJSON(w, map[string]interface{}{"object": "list", "data": thread.Messages})
+		}
+	case action == "messages" && r.Method == http.MethodPost:
+		p.appendThreadMessages(w, r, id)
+	case action == "runs" && r.Method == http.MethodPost:
+		p.runThread(w, r, id)
+	case action == "" || action == "messages" || action == "runs":
+		respondWithAPIError(w, http.StatusMethodNotAllowed, newAPIError("invalid_request_error", "", "", "Method not allowed"))
+	default:
+		respondWithAPIError(w, http.StatusNotFound, newAPIError("not_found_error", "", "", "Unknown threads endpoint"))
+	}
+}
+
+// threadRequest is the body of thread create, append and run requests
+type threadRequest struct {
+	Model    string            `json:"model"`
+	Metadata map[string]string `json:"metadata"`
+	Messages []Message         `json:"messages"`
+	// Role and Content append a single message
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+func decodeThreadRequest(w http.ResponseWriter, r *http.Request) (*threadRequest, bool) {
+	var req threadRequest
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		respondWithAPIError(w, http.StatusBadRequest, newAPIError("invalid_request_error", "", "", "Error reading request body"))
+		return nil, false
+	}
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &req); err != nil {
+			respondWithAPIError(w, http.StatusBadRequest, newAPIError("invalid_request_error", "", "", fmt.Sprintf("Error parsing request body: %v", err)))
+			return nil, false
+		}
+	}
+	if req.Role != "" || req.Content != "" {
+		req.Messages = append(req.Messages, Message{Role: req.Role, Content: req.Content})
+	}
+	if err := validateThreadMessages(req.Messages); err != nil {
+		respondWithAPIError(w, http.StatusBadRequest, newAPIError("invalid_request_error", "", "messages", err.Error()))
+		return nil, false
+	}
+	return &req, true
+}
+
+// loadThread returns the caller's thread, or writes a 404 and returns nil.
+// Threads of other callers are reported as missing.
+func (p *Proxy) loadThread(w http.ResponseWriter, r *http.Request, id string) *Thread {
+	thread, err := p.threads.Get(id)
+	if err == nil && thread.Owner != HashAPIKey(callerID(r)) {
+		err = ErrThreadNotFound
+	}
+	if err != nil {
+		if errors.Is(err, ErrThreadNotFound) {
+			respondWithAPIError(w, http.StatusNotFound, newAPIError("invalid_request_error", "thread_not_found", "thread_id", fmt.Sprintf("No thread found with id %s", id)))
+		} else {
+			p.logger.Printf("Error loading thread %s: %v", id, err)
+			respondWithAPIError(w, http.StatusInternalServerError, newAPIError("server_error", "", "", "Failed to load thread"))
+		}
+		return nil
+	}
+	return thread
+}
+
+func (p *Proxy) saveThread(w http.ResponseWriter, thread *Thread) bool {
+	if err := p.threads.Put(thread); err != nil {
+		p.logger.Printf("Error saving thread %s: %v", thread.ID, err)
+		respondWithAPIError(w, http.StatusInternalServerError, newAPIError("server_error", "", "", "Failed to save thread"))
+		return false
+	}
+	return true
+}
+
+func (p *Proxy) createThread(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeThreadRequest(w, r)
+	if !ok {
+		return
+	}
+	thread := &Thread{
+		ID:        newObjectID("thread_"),
+		CreatedAt: time.Now().Unix(),
+		Model:     req.Model,
+		Metadata:  req.Metadata,
+		Messages:  []ThreadMessage{},
+		Owner:     HashAPIKey(callerID(r)),
+	}
+	thread.appendMessages(req.Messages, "")
+	if !p.saveThread(w, thread) {
+		return
+	}
+	p.logger.Printf("Created thread %s with %d messages", thread.ID, len(thread.Messages))
+	writeJSON(w, thread.response())
+}
+
+func (p *Proxy) deleteThread(w http.ResponseWriter, r *http.Request, id string) {
+	defer p.threadLocks.lock(id)()
+	if p.loadThread(w, r, id) == nil {
+		return
+	}
+	if err := p.threads.Delete(id); err != nil && !errors.Is(err, ErrThreadNotFound) {
+		p.logger.Printf("Error deleting thread %s: %v", id, err)
+		respondWithAPIError(w, http.StatusInternalServerError, newAPIError("server_error", "", "", "Failed to delete thread"))
+		return
+	}
+	writeJSON(w, map[string]interface{}{"id": id, "object": "thread.deleted", "deleted": true})
+}
+
+func (p *Proxy) appendThreadMessages(w http.ResponseWriter, r *http.Request, id string) {
+	req, ok := decodeThreadRequest(w, r)
+	if !ok {
+		return
+	}
+	if len(req.Messages) == 0 {
+		respondWithAPIError(w, http.StatusBadRequest, newAPIError("invalid_request_error", "", "messages", "No messages to append"))
+		return
+	}
+	defer p.threadLocks.lock(id)()
+	thread := p.loadThread(w, r, id)
+	if thread == nil {
+		return
+	}
+	added := thread.appendMessages(req.Messages, "")
+	if !p.saveThread(w, thread) {
+		return
+	}
+	writeJSON(w, map[string]interface{}{"object": "list", "data": added})
+}
+
+// runThread appends any messages in the request, streams a chat completion
+// over the whole thread and stores the reply. The thread's session is reused
+// while the model stays the same.
+func (p *Proxy) runThread(w http.ResponseWriter, r *http.Request, id string) {
+	req, ok := decodeThreadRequest(w, r)
+	if !ok {
+		return
+	}
+
+	unlock := p.threadLocks.lock(id)
+	thread := p.loadThread(w, r, id)
+	if thread == nil {
+		unlock()
+		return
+	}
+	model := req.Model
+	if model == "" {
+		model = thread.Model
+	}
+	if model == "" {
+		unlock()
+		respondWithAPIError(w, http.StatusBadRequest, newAPIError("invalid_request_error", "", "model", "model is required when the thread has no default model"))
+		return
+	}
+	thread.appendMessages(req.Messages, "")
+	if len(thread.Messages) == 0 {
+		unlock()
+		respondWithAPIError(w, http.StatusBadRequest, newAPIError("invalid_request_error", "", "messages", "The thread has no messages to run"))
+		return
+	}
+	if len(req.Messages) > 0 && !p.saveThread(w, thread) {
+		unlock()
+		return
+	}
+	sessionID := ""
+	if thread.SessionModel == model {
+		sessionID = thread.SessionID
+	}
+	history := thread.history()
+	// The thread is not held while the reply streams
+	unlock()
+
+	w.Header().Set("X-NFA-Thread-ID", id)
+	capture := &auditWriter{ResponseWriter: w}
+	attempt, err := p.serveChat(capture, r, ChatCompletionRequest{Model: model, Messages: history}, sessionID)
+	if attempt == nil {
+		return
+	}
+
+	defer p.threadLocks.lock(id)()
+	thread, loadErr := p.threads.Get(id)
+	if loadErr != nil {
+		p.logger.Printf("Thread %s went away during a run: %v", id, loadErr)
+		return
+	}
+	// Only a reply from the requested model keeps the session for next time
+	if attempt.index == 0 {
+		thread.SessionID, thread.SessionModel = attempt.sessionID, model
+	}
+	if reply := StreamCompletion(capture.body.Bytes()); err == nil && reply != "" {
+		thread.appendMessages([]Message{{Role: "assistant", Content: reply}}, attempt.model)
+	}
+	if err := p.threads.Put(thread); err != nil {
+		p.logger.Printf("Error saving reply to thread %s: %v", id, err)
+	}
+}
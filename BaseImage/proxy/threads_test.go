@@ -0,0 +1,197 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// threadMarketplace answers chats with the number of messages it was sent and
+// records the session of each chat
+type threadMarketplace struct {
+	mu       sync.Mutex
+	sessions int
+	chats    []string
+}
+
+func newThreadServer(t *testing.T, store ThreadStore) (*Server, *threadMarketplace) {
+	t.Helper()
+	m := &threadMarketplace{}
+	marketplace := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		switch r.URL.Path {
+		case "/blockchain/models":
+			fmt.Fprint(w, `{"models":[{"Id":"0xllama","Name":"Llama"},{"Id":"0xmistral","Name":"Mistral"}]}`)
+		case "/blockchain/models/0xllama/session", "/blockchain/models/0xmistral/session":
+			m.sessions++
+			fmt.Fprintf(w, `{"sessionId":"session-%d"}`, m.sessions)
+		case "/v1/chat/completions":
+			var req ChatCompletionRequest
+			json.NewDecoder(r.Body).Decode(&req)
+			m.chats = append(m.chats, r.Header.Get("session_id"))
+			fmt.Fprintf(w, "data: {\"choices\":[{\"delta\":{\"content\":\"saw %d\"}}]}\n\ndata: [DONE]\n\n", len(req.Messages))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(marketplace.Close)
+
+	cfg, err := LoadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Marketplace.URL = marketplace.URL
+	s, err := New(cfg, WithLogger(log.New(io.Discard, "", 0)), WithThreadStore(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s, m
+}
+
+func threadCall(t *testing.T, s *Server, method, path, body, key string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+key)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+func TestThreadRunsKeepHistoryAndSession(t *testing.T) {
+	s, m := newThreadServer(t, NewMemoryThreadStore())
+
+	w := threadCall(t, s, "POST", "/v1/threads", `{"model":"Llama","messages":[{"role":"system","content":"Be brief"}]}`, "key-a")
+	var thread threadResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &thread); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("create: status = %d, body = %s", w.Code, w.Body.String())
+	}
+
+	w = threadCall(t, s, "POST", "/v1/threads/"+thread.ID+"/runs", `{"messages":[{"role":"user","content":"Hi"}]}`, "key-a")
+	if got := StreamCompletion(w.Body.Bytes()); w.Code != http.StatusOK || got != "saw 2" {
+		t.Fatalf("first run: status = %d, completion = %q", w.Code, got)
+	}
+	w = threadCall(t, s, "POST", "/v1/threads/"+thread.ID+"/messages", `{"role":"user","content":"And again"}`, "key-a")
+	if w.Code != http.StatusOK {
+		t.Fatalf("append: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	w = threadCall(t, s, "POST", "/v1/threads/"+thread.ID+"/runs", "", "key-a")
+	if got := StreamCompletion(w.Body.Bytes()); got != "saw 4" {
+		t.Fatalf("second run completion = %q, want the full history", got)
+	}
+
+	if m.sessions != 1 || len(m.chats) != 2 || m.chats[0] != "session-1" || m.chats[1] != "session-1" {
+		t.Errorf("sessions opened = %d, chat sessions = %v; want both runs on one session", m.sessions, m.chats)
+	}
+
+	w = threadCall(t, s, "GET", "/v1/threads/"+thread.ID+"/messages", "", "key-a")
+	var list struct {
+		Data []ThreadMessage `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &list)
+	var roles []string
+	for _, msg := range list.Data {
+		roles = append(roles, msg.Role)
+	}
+	if got := strings.Join(roles, ","); got != "system,user,assistant,user,assistant" {
+		t.Errorf("roles = %s", got)
+	}
+	if last := list.Data[len(list.Data)-1]; last.Content != "saw 4" || last.Model != "Llama" {
+		t.Errorf("last message = %+v", last)
+	}
+
+	// A different model starts a new session
+	threadCall(t, s, "POST", "/v1/threads/"+thread.ID+"/runs", `{"model":"Mistral"}`, "key-a")
+	if m.sessions != 2 {
+		t.Errorf("sessions opened = %d after switching model, want 2", m.sessions)
+	}
+}
+
+func TestThreadsAreScopedToCaller(t *testing.T) {
+	s, _ := newThreadServer(t, NewMemoryThreadStore())
+	w := threadCall(t, s, "POST", "/v1/threads", `{}`, "key-a")
+	var thread threadResponse
+	json.Unmarshal(w.Body.Bytes(), &thread)
+
+	for _, req := range []struct{ method, path string }{
+		{"GET", "/v1/threads/" + thread.ID},
+		{"POST", "/v1/threads/" + thread.ID + "/runs"},
+		{"DELETE", "/v1/threads/" + thread.ID},
+	} {
+		if w := threadCall(t, s, req.method, req.path, `{"model":"Llama"}`, "key-b"); w.Code != http.StatusNotFound {
+			t.Errorf("%s %s by another caller: status = %d", req.method, req.path, w.Code)
+		}
+	}
+
+	if w := threadCall(t, s, "DELETE", "/v1/threads/"+thread.ID, "", "key-a"); w.Code != http.StatusOK {
+		t.Fatalf("delete: status = %d", w.Code)
+	}
+	if w := threadCall(t, s, "GET", "/v1/threads/"+thread.ID, "", "key-a"); w.Code != http.StatusNotFound {
+		t.Errorf("get after delete: status = %d", w.Code)
+	}
+}
+
+func TestThreadRunValidation(t *testing.T) {
+	s, _ := newThreadServer(t, NewMemoryThreadStore())
+	w := threadCall(t, s, "POST", "/v1/threads", `{"messages":[{"role":"user","content":"Hi"}]}`, "key-a")
+	var thread threadResponse
+	json.Unmarshal(w.Body.Bytes(), &thread)
+
+	w = threadCall(t, s, "POST", "/v1/threads/"+thread.ID+"/runs", "", "key-a")
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"param":"model"`) {
+		t.Errorf("run without model: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	w = threadCall(t, s, "POST", "/v1/threads/"+thread.ID+"/messages", `{"role":"wizard","content":"Hi"}`, "key-a")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("append with bad role: status = %d", w.Code)
+	}
+	if w := threadCall(t, s, "GET", "/v1/threads/thread_missing", "", "key-a"); w.Code != http.StatusNotFound {
+		t.Errorf("missing thread: status = %d", w.Code)
+	}
+}
+
+func TestFileThreadStore(t *testing.T) {
+	dir := t.TempDir()
+	store := NewFileThreadStore(dir)
+	thread := &Thread{ID: newObjectID("thread_"), Owner: "o", Messages: []ThreadMessage{{Role: "user", Content: "Hi"}}}
+	if err := store.Put(thread); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new store on the same directory sees the thread
+	got, err := NewFileThreadStore(dir).Get(thread.ID)
+	if err != nil || len(got.Messages) != 1 || got.Messages[0].Content != "Hi" {
+		t.Fatalf("Get() = %+v, %v", got, err)
+	}
+	if err := store.Delete(thread.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(thread.ID); err != ErrThreadNotFound {
+		t.Errorf("Get() after Delete error = %v", err)
+	}
+	// IDs are checked so they cannot name files outside the directory
+	if _, err := store.Get("../secrets"); err != ErrThreadNotFound {
+		t.Errorf("Get(../secrets) error = %v", err)
+	}
+}
+
+func TestMemoryThreadStoreCopies(t *testing.T) {
+	store := NewMemoryThreadStore()
+	thread := &Thread{ID: "thread_1", Messages: []ThreadMessage{{Content: "a"}}}
+	store.Put(thread)
+	thread.Messages[0].Content = "changed"
+
+	got, _ := store.Get("thread_1")
+	got.Messages = append(got.Messages, ThreadMessage{})
+	again, _ := store.Get("thread_1")
+	if len(again.Messages) != 1 || again.Messages[0].Content != "a" {
+		t.Errorf("stored thread = %+v", again)
+	}
+}
@@ -0,0 +1,227 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ServerTLSConfig configures HTTPS termination and client certificates
+type ServerTLSConfig struct {
+	CertFile     string `json:"cert_file" env:"TLS_CERT_FILE"`
+	KeyFile      string `json:"key_file" env:"TLS_KEY_FILE"`
+	ClientCAFile string `json:"client_ca_file" env:"TLS_CLIENT_CA_FILE"`
+	// ClientAuth is "require" (the default when a CA is set) or "optional"
+	ClientAuth string `json:"client_auth" env:"TLS_CLIENT_AUTH"`
+}
+
+// Enabled reports whether TLS is configured
+func (c ServerTLSConfig) Enabled() bool {
+	return c.CertFile != "" || c.KeyFile != ""
+}
+
+func (c ServerTLSConfig) validate() error {
+	if !c.Enabled() {
+		if c.ClientCAFile != "" {
+			return errors.New("client_ca_file requires cert_file and key_file")
+		}
+		return nil
+	}
+	if c.CertFile == "" || c.KeyFile == "" {
+		return errors.New("cert_file and key_file must be set together")
+	}
+	switch strings.ToLower(c.ClientAuth) {
+	case "", "require", "optional":
+	default:
+		return fmt.Errorf("invalid client_auth %q, expected require or optional", c.ClientAuth)
+	}
+	return nil
+}
+
+// certReloader serves the certificate, key and client CA bundle from disk and
+// reloads them when the files change, so rotated certificates are picked up
+// without a restart.
+type certReloader struct {
+	cfg ServerTLSConfig
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  map[string]time.Time
+	lastCheck time.Time
+}
+
+func newCertReloader(cfg ServerTLSConfig) (*certReloader, error) {
+	r := &certReloader{cfg: cfg}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) files() []string {
+	files := []string{r.cfg.CertFile, r.cfg.KeyFile}
+	if r.cfg.ClientCAFile != "" {
+		files = append(files, r.cfg.ClientCAFile)
+	}
+	return files
+}
+
+func (r *certReloader) load() error {
+	modTimes := make(map[string]time.Time)
+	for _, f := range r.files() {
+		info, err := os.Stat(f)
+		if err != nil {
+			return err
+		}
+		modTimes[f] = info.ModTime()
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %v", err)
+	}
+	var pool *x509.CertPool
+	if r.cfg.ClientCAFile != "" {
+		pem, err := os.ReadFile(r.cfg.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read client CA file: %v", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", r.cfg.ClientCAFile)
+		}
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.clientCAs = pool
+	r.modTimes = modTimes
+	r.mu.Unlock()
+	return nil
+}
+
+// maybeReload reloads the files if any of them changed. Checks are throttled
+// to once per second; a failed reload keeps serving the previous certificate.
+func (r *certReloader) maybeReload() {
+	r.mu.Lock()
+	if time.Since(r.lastCheck) < time.Second {
+		r.mu.Unlock()
+		return
+	}
+	r.lastCheck = time.Now()
+	changed := false
+	for _, f := range r.files() {
+		if info, err := os.Stat(f); err == nil && !info.ModTime().Equal(r.modTimes[f]) {
+			changed = true
+		}
+	}
+	r.mu.Unlock()
+
+	if !changed {
+		return
+	}
+	if err := r.load(); err != nil {
+		log.Printf("Failed to reload TLS certificates, keeping the previous ones: %v", err)
+		return
+	}
+	log.Printf("Reloaded TLS certificates from %s", r.cfg.CertFile)
+}
+
+// TLSConfig returns a tls.Config that always uses the current certificate and
+// client CA bundle.
+func (r *certReloader) TLSConfig() *tls.Config {
+	clientAuth := tls.NoClientCert
+	if r.cfg.ClientCAFile != "" {
+		clientAuth = tls.RequireAndVerifyClientCert
+		if strings.ToLower(r.cfg.ClientAuth) == "optional" {
+			clientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+	nextProtos := []string{"h2", "http/1.1"}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: nextProtos,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+			return r.cert, nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.maybeReload()
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				NextProtos:   nextProtos,
+				Certificates: []tls.Certificate{*r.cert},
+				ClientAuth:   clientAuth,
+				ClientCAs:    r.clientCAs,
+			}, nil
+		},
+	}
+}
+
+// ClientCertConfig assigns scopes to callers authenticated by a verified
+// client certificate. Subjects maps a certificate common name to its scopes.
+type ClientCertConfig struct {
+	Scopes   []string            `json:"scopes"`
+	Subjects map[string][]string `json:"subjects"`
+}
+
+// ClientCertAuthenticator authenticates requests by their verified TLS client
+// certificate. The certificate's common name, or its full subject when the
+// common name is empty, becomes the caller identity.
+type ClientCertAuthenticator struct {
+	cfg ClientCertConfig
+}
+
+// NewClientCertAuthenticator creates a client certificate authenticator
+func NewClientCertAuthenticator(cfg ClientCertConfig) *ClientCertAuthenticator {
+	return &ClientCertAuthenticator{cfg: cfg}
+}
+
+// Authenticate implements Authenticator
+func (a *ClientCertAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, nil
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	subject := cert.Subject.CommonName
+	if subject == "" {
+		subject = cert.Subject.String()
+	}
+	scopes, ok := a.cfg.Subjects[subject]
+	if !ok {
+		scopes = a.cfg.Scopes
+	}
+	if len(scopes) == 0 {
+		scopes = []string{ScopeChat}
+	}
+	return &Identity{Subject: subject, Scopes: scopes, Method: "mtls"}, nil
+}
+
+// listenUnix listens on a Unix domain socket, replacing a stale socket file
+// left behind by a previous run.
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0660); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
@@ -0,0 +1,218 @@
+package proxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCert(t *testing.T, cn string, serial int64, parent *testCert, isCA bool) *testCert {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	parentCert, parentKey := tmpl, key
+	if parent != nil {
+		parentCert, parentKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parentCert, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCert{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+func (c *testCert) write(t *testing.T, certFile, keyFile string) {
+	t.Helper()
+	der, _ := x509.MarshalECPrivateKey(c.key)
+	os.WriteFile(certFile, c.pem, 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}
+}
+
+func TestTLSServerWithClientCerts(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "Test CA", 1, nil, true)
+	server := newTestCert(t, "proxy", 2, ca, false)
+	client := newTestCert(t, "agent-42", 3, ca, false)
+
+	certFile, keyFile, caFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), filepath.Join(dir, "ca.crt")
+	server.write(t, certFile, keyFile)
+	os.WriteFile(caFile, ca.pem, 0600)
+
+	reloader, err := newCertReloader(ServerTLSConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile})
+	if err != nil {
+		t.Fatalf("newCertReloader() error = %v", err)
+	}
+
+	p := NewProxy()
+	p.authenticators = []Authenticator{NewClientCertAuthenticator(ClientCertConfig{})}
+	srv := &http.Server{
+		Handler: p.requireScope(ScopeChat, func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, callerID(r))
+		}),
+		TLSConfig: reloader.TLSConfig(),
+	}
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	go srv.ServeTLS(listener, "", "")
+	defer srv.Close()
+	url := "https://" + listener.Addr().String() + "/"
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	newClient := func(certs ...tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs}}}
+	}
+
+	resp, err := newClient(client.tlsCertificate()).Get(url)
+	if err != nil {
+		t.Fatalf("mTLS request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "agent-42" {
+		t.Errorf("caller = %q, want the certificate subject", body)
+	}
+	if resp.TLS.PeerCertificates[0].SerialNumber.Int64() != 2 {
+		t.Errorf("unexpected server certificate serial %v", resp.TLS.PeerCertificates[0].SerialNumber)
+	}
+
+	if _, err := newClient().Get(url); err == nil {
+		t.Error("request without a client certificate should be rejected")
+	}
+
+	// Rotate the server certificate on disk
+	rotated := newTestCert(t, "proxy", 4, ca, false)
+	rotated.write(t, certFile, keyFile)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	os.Chtimes(keyFile, future, future)
+	reloader.lastCheck = time.Time{}
+
+	resp, err = newClient(client.tlsCertificate()).Get(url)
+	if err != nil {
+		t.Fatalf("request after rotation failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.TLS.PeerCertificates[0].SerialNumber.Int64() != 4 {
+		t.Errorf("server still presents serial %v after rotation", resp.TLS.PeerCertificates[0].SerialNumber)
+	}
+}
+
+func TestServerTLSConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     ServerTLSConfig
+		wantErr bool
+	}{
+		{"disabled", ServerTLSConfig{}, false},
+		{"cert and key", ServerTLSConfig{CertFile: "a", KeyFile: "b"}, false},
+		{"missing key", ServerTLSConfig{CertFile: "a"}, true},
+		{"CA without cert", ServerTLSConfig{ClientCAFile: "c"}, true},
+		{"bad client auth", ServerTLSConfig{CertFile: "a", KeyFile: "b", ClientAuth: "maybe"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.cfg.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestOptionalClientCertsKeepOtherCallers(t *testing.T) {
+	newServer := func(clientAuth string) *Server {
+		cfg, err := LoadConfig("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.Server.TLS = ServerTLSConfig{CertFile: "tls.crt", KeyFile: "tls.key", ClientCAFile: "ca.crt", ClientAuth: clientAuth}
+		s, err := New(cfg, WithLogger(log.New(io.Discard, "", 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		return s
+	}
+
+	// Callers without a certificate, such as those on the Unix socket, are
+	// not rejected when client certificates are optional
+	s := newServer("optional")
+	req := httptest.NewRequest("GET", "/v1/threads", nil)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	if w.Code == http.StatusUnauthorized || len(s.authenticators) != 0 {
+		t.Errorf("optional: status = %d, authenticators = %d", w.Code, len(s.authenticators))
+	}
+
+	if s := newServer("require"); len(s.authenticators) != 1 {
+		t.Errorf("require: authenticators = %d, want the client certificate", len(s.authenticators))
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "nfa.sock")
+	for i := 0; i < 2; i++ {
+		// The second iteration replaces the socket file left by the first
+		listener, err := listenUnix(socket)
+		if err != nil {
+			t.Fatalf("listenUnix() error = %v", err)
+		}
+		srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "ok")
+		})}
+		go srv.Serve(listener)
+
+		client := &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			},
+		}}
+		resp, err := client.Get("http://unix/health")
+		if err != nil {
+			t.Fatalf("request over unix socket failed: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "ok" {
+			t.Errorf("body = %q", body)
+		}
+		// Simulate an unclean shutdown that leaves the socket file behind
+		listener.(*net.UnixListener).SetUnlinkOnClose(false)
+		srv.Close()
+	}
+}
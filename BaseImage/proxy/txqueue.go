@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNonce marks a transaction that a consumer node's wallet could not send
+// because its nonce was already used or out of order. Sending it again once
+// the pending transaction is mined usually works.
+var ErrNonce = errors.New("transaction nonce conflict")
+
+// nonceConflicts are the errors Ethereum clients give for a transaction whose
+// nonce collides with another from the same wallet
+var nonceConflicts = []string{
+	"nonce too low",
+	"nonce too high",
+	"invalid nonce",
+	"replacement transaction underpriced",
+	"already known",
+}
+
+// chainError describes a failed blockchain call to a consumer node. Nonce
+// conflicts wrap ErrNonce.
+func chainError(op string, status int, body []byte) error {
+	err := &upstreamError{op: op, status: status, body: body}
+	message := strings.ToLower(upstreamMessage(body))
+	for _, conflict := range nonceConflicts {
+		if strings.Contains(message, conflict) {
+			return fmt.Errorf("%w: %w", ErrNonce, err)
+		}
+	}
+	return err
+}
+
+// txQueue serializes the calls that send a transaction from a wallet. A node
+// given two such calls at once can assign both the same nonce, and one fails.
+type txQueue struct {
+	mu      sync.Mutex
+	wallets map[string]*sync.Mutex
+	waiting map[string]int // calls holding or waiting for each wallet
+}
+
+func newTxQueue() *txQueue {
+	return &txQueue{wallets: make(map[string]*sync.Mutex), waiting: make(map[string]int)}
+}
+
+// lock returns the mutex of wallet
+func (q *txQueue) lock(wallet string) *sync.Mutex {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	lock, ok := q.wallets[wallet]
+	if !ok {
+		lock = &sync.Mutex{}
+		q.wallets[wallet] = lock
+	}
+	return lock
+}
+
+// pending returns how many transactions wallet is sending or has queued
+func (q *txQueue) pending(wallet string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.waiting[wallet]
+}
+
+func (q *txQueue) add(wallet string, n int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.waiting[wallet] += n
+	if q.waiting[wallet] == 0 {
+		delete(q.waiting, wallet)
+	}
+}
+
+// sendTx runs send while no other transaction from wallet is in flight. A
+// nonce conflict is sent again with exponential backoff, up to
+// session.create_retries attempts in all, before the wallet is released.
+func (p *Proxy) sendTx(wallet string, send func() error) error {
+	p.txs.add(wallet, 1)
+	defer p.txs.add(wallet, -1)
+	lock := p.txs.lock(wallet)
+	lock.Lock()
+	defer lock.Unlock()
+
+	cfg := p.cfg().Session
+	for attempt := 1; ; attempt++ {
+		err := send()
+		if err == nil || !errors.Is(err, ErrNonce) || attempt >= cfg.CreateRetries {
+			return err
+		}
+		delay := cfg.RetryBaseDelay.Duration * time.Duration(1<<uint(attempt-1))
+		p.logger.Printf("Nonce conflict on wallet of %s (attempt %d/%d), retrying after %v: %v", wallet, attempt, cfg.CreateRetries, delay, err)
+		time.Sleep(delay)
+	}
+}
@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestChainErrorDetectsNonceConflicts(t *testing.T) {
+	tests := []struct {
+		body  string
+		nonce bool
+	}{
+		{`{"error":"nonce too low"}`, true},
+		{`{"error":{"message":"replacement transaction underpriced"}}`, true},
+		{`{"error":"failed to send: Nonce too high: address 0xabc"}`, true},
+		{`{"error":"insufficient funds for gas"}`, false},
+		{`{"error":"session not found"}`, false},
+	}
+	for _, tt := range tests {
+		err := chainError("create session", http.StatusInternalServerError, []byte(tt.body))
+		if errors.Is(err, ErrNonce) != tt.nonce {
+			t.Errorf("chainError(%s) = %v, nonce = %v", tt.body, err, !tt.nonce)
+		}
+		var upErr *upstreamError
+		if !errors.As(err, &upErr) || upErr.status != http.StatusInternalServerError {
+			t.Errorf("chainError(%s) does not carry the upstream error", tt.body)
+		}
+	}
+}
+
+func TestCreateSessionSerializesWalletTransactions(t *testing.T) {
+	var inFlight, maxInFlight, calls atomic.Int32
+	marketplace := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			max := maxInFlight.Load()
+			if n <= max || maxInFlight.CompareAndSwap(max, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		// The first transaction collides with one the node sent earlier
+		if calls.Add(1) == 1 {
+			http.Error(w, `{"error":"nonce too low"}`, http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, `{"sessionId":"s%d"}`, calls.Load())
+	}))
+	defer marketplace.Close()
+
+	cfg, err := LoadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Marketplace.URL = marketplace.URL
+	cfg.Session.RetryBaseDelay = Duration{time.Millisecond}
+	s, err := New(cfg, WithLogger(log.New(io.Discard, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for _, model := range []string{"a", "b", "c", "d"} {
+		wg.Add(1)
+		go func(model string) {
+			defer wg.Done()
+			if _, err := s.createSession(model); err != nil {
+				errs <- err
+			}
+		}(model)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("createSession: %v", err)
+	}
+	if n := maxInFlight.Load(); n != 1 {
+		t.Errorf("concurrent session transactions = %d, want 1", n)
+	}
+	if n := calls.Load(); n != 5 {
+		t.Errorf("session requests = %d, want 5", n)
+	}
+}
+
+func TestEnsureSessionSharesConcurrentCreation(t *testing.T) {
+	release := make(chan struct{})
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/blockchain/models/flight-model/session" {
+			calls.Add(1)
+			<-release
+			json.NewEncoder(w).Encode(map[string]string{"sessionID": "flight-session"})
+		}
+	}))
+	defer server.Close()
+	os.Setenv("MARKETPLACE_URL", server.URL)
+	defer os.Unsetenv("MARKETPLACE_URL")
+
+	sessionMutex.Lock()
+	delete(activeSessions, "flight-model")
+	activeSessions["other-model"] = &MorpheusSession{SessionID: "other-session", ModelID: "other-model", Created: time.Now()}
+	sessionMutex.Unlock()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := ensureSession("flight-model"); err != nil {
+				t.Errorf("ensureSession: %v", err)
+			}
+		}()
+	}
+
+	// A model with a session is served while the creation is in flight
+	done := make(chan error)
+	go func() { done <- ensureSession("other-model") }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("ensureSession(other-model): %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("ensureSession for another model waited on the creation")
+	}
+
+	close(release)
+	wg.Wait()
+	if n := calls.Load(); n != 1 {
+		t.Errorf("session requests = %d, want 1", n)
+	}
+	if session := activeSession("flight-model"); session == nil || session.SessionID != "flight-session" {
+		t.Errorf("session = %+v", session)
+	}
+}
+
+func TestPassthroughAndAdminTransactionsRetryNonceConflicts(t *testing.T) {
+	var creates, closes atomic.Int32
+	marketplace := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/blockchain/models/m/session":
+			if creates.Add(1) == 1 {
+				http.Error(w, `{"error":"nonce too low"}`, http.StatusInternalServerError)
+				return
+			}
+			fmt.Fprint(w, `{"sessionId":"passthrough"}`)
+		case "/blockchain/sessions/passthrough/close":
+			if closes.Add(1) == 1 {
+				http.Error(w, `{"error":"replacement transaction underpriced"}`, http.StatusInternalServerError)
+				return
+			}
+			fmt.Fprint(w, `{"result":true}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer marketplace.Close()
+
+	cfg, err := LoadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Marketplace.URL = marketplace.URL
+	cfg.AdminAPIKey = "admin"
+	cfg.Session.RetryBaseDelay = Duration{time.Millisecond}
+	s, err := New(cfg, WithLogger(log.New(io.Discard, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/blockchain/models/m/session", strings.NewReader(`{"sessionDuration":600}`)))
+	if w.Code != http.StatusOK || creates.Load() != 2 {
+		t.Fatalf("create: status = %d, attempts = %d, body = %s", w.Code, creates.Load(), w.Body.String())
+	}
+
+	req := httptest.NewRequest("DELETE", "/admin/sessions/passthrough", nil)
+	req.Header.Set("Authorization", "Bearer admin")
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || closes.Load() != 2 {
+		t.Errorf("close: status = %d, attempts = %d, body = %s", w.Code, closes.Load(), w.Body.String())
+	}
+}
@@ -0,0 +1,319 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxInMemoryUsageRecords bounds the ledger when no ledger file is configured
+const maxInMemoryUsageRecords = 10000
+
+// UsageRecord is the token usage of one completion request
+type UsageRecord struct {
+	Timestamp        time.Time `json:"timestamp"`
+	Caller           string    `json:"caller"`
+	Model            string    `json:"model"`
+	ModelID          string    `json:"model_id"`
+	SessionID        string    `json:"session_id"`
+	PromptTokens     int       `json:"prompt_tokens"`
+	CompletionTokens int       `json:"completion_tokens"`
+	TotalTokens      int       `json:"total_tokens"`
+	Estimated        bool      `json:"estimated"`
+}
+
+// UsageLedger stores usage records in memory or, when a file is configured,
+// appends them to a JSONL file that exports are read from.
+type UsageLedger struct {
+	mu      sync.Mutex
+	file    string
+	records []UsageRecord
+	logger  *log.Logger
+}
+
+// NewUsageLedger creates a ledger. An empty path keeps the most recent
+// records in memory only.
+func NewUsageLedger(path string) *UsageLedger {
+	return &UsageLedger{file: path, logger: log.Default()}
+}
+
+// Record appends a usage record to the ledger
+func (l *UsageLedger) Record(rec UsageRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == "" {
+		l.records = append(l.records, rec)
+		if len(l.records) > maxInMemoryUsageRecords {
+			l.records = l.records[len(l.records)-maxInMemoryUsageRecords:]
+		}
+		return
+	}
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		l.logger.Printf("Failed to encode usage record: %v", err)
+		return
+	}
+	f, err := os.OpenFile(l.file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		l.logger.Printf("Failed to open usage ledger: %v", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		l.logger.Printf("Failed to write usage record: %v", err)
+	}
+}
+
+// UsageFilter selects ledger records for export
+type UsageFilter struct {
+	Caller string
+	Model  string
+	Since  time.Time
+	Until  time.Time
+}
+
+func (f UsageFilter) match(rec UsageRecord) bool {
+	if f.Caller != "" && rec.Caller != f.Caller {
+		return false
+	}
+	if f.Model != "" && !strings.EqualFold(rec.Model, f.Model) && !strings.EqualFold(rec.ModelID, f.Model) {
+		return false
+	}
+	if !f.Since.IsZero() && rec.Timestamp.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !rec.Timestamp.Before(f.Until) {
+		return false
+	}
+	return true
+}
+
+// Records returns the records matching filter in the order they were written
+func (l *UsageLedger) Records(filter UsageFilter) ([]UsageRecord, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var out []UsageRecord
+	if l.file == "" {
+		for _, rec := range l.records {
+			if filter.match(rec) {
+				out = append(out, rec)
+			}
+		}
+		return out, nil
+	}
+
+	f, err := os.Open(l.file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to open usage ledger: %v", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec UsageRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			l.logger.Printf("Skipping malformed usage record: %v", err)
+			continue
+		}
+		if filter.match(rec) {
+			out = append(out, rec)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read usage ledger: %v", err)
+	}
+	return out, nil
+}
+
+// UsageSummary totals usage for one caller and model
+type UsageSummary struct {
+	Caller           string `json:"caller"`
+	Model            string `json:"model"`
+	ModelID          string `json:"model_id"`
+	Requests         int    `json:"requests"`
+	PromptTokens     int    `json:"prompt_tokens"`
+	CompletionTokens int    `json:"completion_tokens"`
+	TotalTokens      int    `json:"total_tokens"`
+}
+
+func summarizeUsage(records []UsageRecord) []UsageSummary {
+	totals := make(map[string]*UsageSummary)
+	for _, rec := range records {
+		key := rec.Caller + "|" + rec.ModelID
+		s, ok := totals[key]
+		if !ok {
+			s = &UsageSummary{Caller: rec.Caller, Model: rec.Model, ModelID: rec.ModelID}
+			totals[key] = s
+		}
+		s.Requests++
+		s.PromptTokens += rec.PromptTokens
+		s.CompletionTokens += rec.CompletionTokens
+		s.TotalTokens += rec.TotalTokens
+	}
+	summaries := make([]UsageSummary, 0, len(totals))
+	for _, s := range totals {
+		summaries = append(summaries, *s)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		if summaries[i].Caller != summaries[j].Caller {
+			return summaries[i].Caller < summaries[j].Caller
+		}
+		return summaries[i].ModelID < summaries[j].ModelID
+	})
+	return summaries
+}
+
+// usageCollector observes a streamed completion and works out its token usage
+type usageCollector struct {
+	promptEstimate int
+	completion     strings.Builder
+	usage          *struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+		TotalTokens      int `json:"total_tokens"`
+	}
+}
+
+func newUsageCollector(messages []Message) *usageCollector {
+	return &usageCollector{promptEstimate: estimatePromptTokens(messages)}
+}
+
+// observe inspects one line of the upstream response. Both SSE chunks and
+// single-line JSON bodies are understood.
+func (c *usageCollector) observe(line []byte) {
+	line = bytes.TrimSpace(line)
+	line = bytes.TrimSpace(bytes.TrimPrefix(line, []byte("data:")))
+	if len(line) == 0 || line[0] != '{' {
+		return
+	}
+
+	var chunk struct {
+		Choices []struct {
+			Delta struct {
+				Content string `json:"content"`
+			} `json:"delta"`
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+			Text string `json:"text"`
+		} `json:"choices"`
+		Usage *struct {
+			PromptTokens     int `json:"prompt_tokens"`
+			CompletionTokens int `json:"completion_tokens"`
+			TotalTokens      int `json:"total_tokens"`
+		} `json:"usage"`
+	}
+	if err := json.Unmarshal(line, &chunk); err != nil {
+		return
+	}
+	for _, choice := range chunk.Choices {
+		c.completion.WriteString(choice.Delta.Content)
+		c.completion.WriteString(choice.Message.Content)
+		c.completion.WriteString(choice.Text)
+	}
+	if chunk.Usage != nil && chunk.Usage.TotalTokens+chunk.Usage.PromptTokens+chunk.Usage.CompletionTokens > 0 {
+		c.usage = chunk.Usage
+	}
+}
+
+// record builds the usage record, preferring upstream usage over estimates
+func (c *usageCollector) record() UsageRecord {
+	rec := UsageRecord{Timestamp: time.Now().UTC()}
+	if c.usage != nil {
+		rec.PromptTokens = c.usage.PromptTokens
+		rec.CompletionTokens = c.usage.CompletionTokens
+		rec.TotalTokens = c.usage.TotalTokens
+		if rec.TotalTokens == 0 {
+			rec.TotalTokens = rec.PromptTokens + rec.CompletionTokens
+		}
+		return rec
+	}
+	rec.Estimated = true
+	rec.PromptTokens = c.promptEstimate
+	rec.CompletionTokens = estimateTokens(c.completion.String())
+	rec.TotalTokens = rec.PromptTokens + rec.CompletionTokens
+	return rec
+}
+
+// handleAdminUsage exports the usage ledger as JSON or CSV. Records can be
+// filtered by caller, model and time range, and summed per caller and model.
+func (p *Proxy) handleAdminUsage(w http.ResponseWriter, r *http.Request) {
+	if !p.requireAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		respondWithAPIError(w, http.StatusMethodNotAllowed, newAPIError("invalid_request_error", "", "", "Method not allowed"))
+		return
+	}
+
+	q := r.URL.Query()
+	filter := UsageFilter{Caller: q.Get("caller"), Model: q.Get("model")}
+	for param, dst := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if v := q.Get(param); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				respondWithAPIError(w, http.StatusBadRequest, newAPIError("invalid_request_error", "", "", fmt.Sprintf("%s must be an RFC 3339 timestamp", param)))
+				return
+			}
+			*dst = t
+		}
+	}
+
+	records, err := p.usage.Records(filter)
+	if err != nil {
+		p.logger.Printf("Error exporting usage: %v", err)
+		respondWithAPIError(w, http.StatusInternalServerError, newAPIError("server_error", "", "", "Failed to read usage ledger"))
+		return
+	}
+
+	summary := q.Get("summary") == "true"
+	switch q.Get("format") {
+	case "", "json":
+		w.Header().Set("Content-Type", "application/json")
+		if summary {
+			json.NewEncoder(w).Encode(map[string]interface{}{"object": "list", "data": summarizeUsage(records)})
+		} else {
+			if records == nil {
+				records = []UsageRecord{}
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"object": "list", "data": records})
+		}
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="usage.csv"`)
+		cw := csv.NewWriter(w)
+		if summary {
+			cw.Write([]string{"caller", "model", "model_id", "requests", "prompt_tokens", "completion_tokens", "total_tokens"})
+			for _, s := range summarizeUsage(records) {
+				cw.Write([]string{s.Caller, s.Model, s.ModelID, strconv.Itoa(s.Requests),
+					strconv.Itoa(s.PromptTokens), strconv.Itoa(s.CompletionTokens), strconv.Itoa(s.TotalTokens)})
+			}
+		} else {
+			cw.Write([]string{"timestamp", "caller", "model", "model_id", "session_id", "prompt_tokens", "completion_tokens", "total_tokens", "estimated"})
+			for _, rec := range records {
+				cw.Write([]string{rec.Timestamp.Format(time.RFC3339), rec.Caller, rec.Model, rec.ModelID, rec.SessionID,
+					strconv.Itoa(rec.PromptTokens), strconv.Itoa(rec.CompletionTokens), strconv.Itoa(rec.TotalTokens),
+					strconv.FormatBool(rec.Estimated)})
+			}
+		}
+		cw.Flush()
+	default:
+		respondWithAPIError(w, http.StatusBadRequest, newAPIError("invalid_request_error", "", "", "format must be json or csv"))
+	}
+}
@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUsageCollector(t *testing.T) {
+	messages := []Message{{Role: "user", Content: "Hello there"}}
+
+	c := newUsageCollector(messages)
+	c.observe([]byte(`data: {"choices":[{"delta":{"content":"Hello"}}]}` + "\n"))
+	c.observe([]byte(`data: {"choices":[{"delta":{"content":" world, how are you?"}}]}` + "\n"))
+	c.observe([]byte("data: [DONE]\n"))
+	rec := c.record()
+	if !rec.Estimated {
+		t.Error("usage without upstream counts should be estimated")
+	}
+	if rec.PromptTokens != estimatePromptTokens(messages) || rec.CompletionTokens != estimateTokens("Hello world, how are you?") {
+		t.Errorf("unexpected estimate: %+v", rec)
+	}
+	if rec.TotalTokens != rec.PromptTokens+rec.CompletionTokens {
+		t.Errorf("total tokens = %d, want %d", rec.TotalTokens, rec.PromptTokens+rec.CompletionTokens)
+	}
+
+	c = newUsageCollector(messages)
+	c.observe([]byte(`data: {"choices":[{"delta":{"content":"Hi"}}]}`))
+	c.observe([]byte(`data: {"choices":[],"usage":{"prompt_tokens":12,"completion_tokens":3,"total_tokens":15}}`))
+	rec = c.record()
+	if rec.Estimated || rec.PromptTokens != 12 || rec.CompletionTokens != 3 || rec.TotalTokens != 15 {
+		t.Errorf("upstream usage should be used as-is, got %+v", rec)
+	}
+}
+
+func TestUsageLedgerFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.jsonl")
+	ledger := NewUsageLedger(path)
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	ledger.Record(UsageRecord{Timestamp: start, Caller: "a", Model: "llama", ModelID: "0x1", TotalTokens: 10})
+	ledger.Record(UsageRecord{Timestamp: start.Add(time.Hour), Caller: "b", Model: "llama", ModelID: "0x1", TotalTokens: 20})
+	ledger.Record(UsageRecord{Timestamp: start.Add(2 * time.Hour), Caller: "a", Model: "mistral", ModelID: "0x2", TotalTokens: 30})
+
+	// A fresh ledger on the same file sees the earlier records
+	records, err := NewUsageLedger(path).Records(UsageFilter{Caller: "a"})
+	if err != nil {
+		t.Fatalf("Records() error = %v", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("got %d records for caller a, want 2", len(records))
+	}
+
+	records, _ = ledger.Records(UsageFilter{Model: "0x1", Since: start.Add(30 * time.Minute)})
+	if len(records) != 1 || records[0].Caller != "b" {
+		t.Errorf("unexpected filtered records: %+v", records)
+	}
+
+	all, _ := ledger.Records(UsageFilter{})
+	summary := summarizeUsage(all)
+	if len(summary) != 3 || summary[0].Caller != "a" || summary[0].TotalTokens != 10 {
+		t.Errorf("unexpected summary: %+v", summary)
+	}
+}
+
+func TestForwardChatRequestRecordsUsage(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"Hi\"}}]}\n\n")
+		fmt.Fprint(w, "data: {\"choices\":[],\"usage\":{\"prompt_tokens\":7,\"completion_tokens\":1,\"total_tokens\":8}}\n\n")
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer server.Close()
+	os.Setenv("MARKETPLACE_URL", server.URL)
+	defer os.Unsetenv("MARKETPLACE_URL")
+
+	sessionCache.Lock()
+	sessionCache.m["usage-session"] = CachedSession{SessionID: "usage-session", ModelID: "usage-model", ExpiresAt: time.Now().Add(time.Hour)}
+	sessionCache.Unlock()
+	defer func() {
+		sessionCache.Lock()
+		delete(sessionCache.m, "usage-session")
+		sessionCache.Unlock()
+	}()
+
+	p := NewProxy()
+	body, _ := json.Marshal(map[string]interface{}{
+		"model":    "Usage Model",
+		"messages": []map[string]string{{"role": "user", "content": "Hello"}},
+	})
+	req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewBuffer(body))
+	req.Header.Set("session_id", "usage-session")
+	req.Header.Set("Authorization", "Bearer team-a")
+	w := httptest.NewRecorder()
+
+	p.handleChatCompletions(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+	records, _ := p.usage.Records(UsageFilter{})
+	if len(records) != 1 {
+		t.Fatalf("got %d usage records, want 1", len(records))
+	}
+	rec := records[0]
+	if rec.Caller != tokenFingerprint("team-a") || rec.ModelID != "usage-model" || rec.SessionID != "usage-session" || rec.TotalTokens != 8 {
+		t.Errorf("unexpected usage record: %+v", rec)
+	}
+}
+
+func TestHandleAdminUsageCSV(t *testing.T) {
+	os.Setenv("ADMIN_API_KEY", "secret")
+	defer os.Unsetenv("ADMIN_API_KEY")
+
+	p := NewProxy()
+	p.usage.Record(UsageRecord{Timestamp: time.Now(), Caller: "a", Model: "llama", ModelID: "0x1", PromptTokens: 4, CompletionTokens: 6, TotalTokens: 10})
+	p.usage.Record(UsageRecord{Timestamp: time.Now(), Caller: "a", Model: "llama", ModelID: "0x1", PromptTokens: 1, CompletionTokens: 1, TotalTokens: 2})
+
+	req := httptest.NewRequest("GET", "/admin/usage?format=csv&summary=true", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	p.handleAdminUsage(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+	rows, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("invalid CSV: %v", err)
+	}
+	if len(rows) != 2 || rows[1][0] != "a" || rows[1][3] != "2" || rows[1][6] != "12" {
+		t.Errorf("unexpected CSV rows: %v", rows)
+	}
+
+	req = httptest.NewRequest("GET", "/admin/usage?since=yesterday", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	p.handleAdminUsage(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("invalid since should be rejected, got %d", w.Code)
+	}
+}
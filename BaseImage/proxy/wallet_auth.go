@@ -0,0 +1,274 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// Headers carrying a wallet-signed request
+const (
+	HeaderWalletAddress   = "X-NFA-Address"
+	HeaderWalletTimestamp = "X-NFA-Timestamp"
+	HeaderWalletNonce     = "X-NFA-Nonce"
+	HeaderWalletSignature = "X-NFA-Signature"
+	HeaderWalletSigType   = "X-NFA-Signature-Type"
+)
+
+// Signature types accepted in the X-NFA-Signature-Type header
+const (
+	SignatureTypeEIP191 = "eip191"
+	SignatureTypeEIP712 = "eip712"
+)
+
+// WalletAuthConfig configures wallet-signature authentication
+type WalletAuthConfig struct {
+	AllowedAddresses []string `json:"allowed_addresses"`
+	Scopes           []string `json:"scopes"`
+	MaxSkewSeconds   int      `json:"max_skew_seconds"`
+	ChainID          int64    `json:"chain_id"`
+}
+
+// WalletRequest is the data covered by a wallet request signature. Query is
+// the raw query string, without the leading "?".
+type WalletRequest struct {
+	Address   common.Address
+	Method    string
+	Path      string
+	Query     string
+	Timestamp int64
+	Nonce     string
+	BodyHash  common.Hash
+}
+
+// EIP191Message returns the text signed with personal_sign
+func (wr WalletRequest) EIP191Message() string {
+	return fmt.Sprintf("NFA Proxy Request\naddress: %s\nmethod: %s\npath: %s\nquery: %s\ntimestamp: %d\nnonce: %s\nbody: %s",
+		wr.Address.Hex(), wr.Method, wr.Path, wr.Query, wr.Timestamp, wr.Nonce, wr.BodyHash.Hex())
+}
+
+var (
+	eip712DomainTypeHash  = crypto.Keccak256Hash([]byte("EIP712Domain(string name,string version,uint256 chainId)"))
+	eip712RequestTypeHash = crypto.Keccak256Hash([]byte("Request(address address,string method,string path,string query,uint256 timestamp,string nonce,bytes32 bodyHash)"))
+)
+
+// EIP712Hash returns the typed-data hash of the request for the "NFA Proxy"
+// domain on chainID
+func (wr WalletRequest) EIP712Hash(chainID int64) common.Hash {
+	domain := crypto.Keccak256(
+		eip712DomainTypeHash.Bytes(),
+		crypto.Keccak256([]byte("NFA Proxy")),
+		crypto.Keccak256([]byte("1")),
+		math.U256Bytes(big.NewInt(chainID)),
+	)
+	message := crypto.Keccak256(
+		eip712RequestTypeHash.Bytes(),
+		common.LeftPadBytes(wr.Address.Bytes(), 32),
+		crypto.Keccak256([]byte(wr.Method)),
+		crypto.Keccak256([]byte(wr.Path)),
+		crypto.Keccak256([]byte(wr.Query)),
+		math.U256Bytes(big.NewInt(wr.Timestamp)),
+		crypto.Keccak256([]byte(wr.Nonce)),
+		wr.BodyHash.Bytes(),
+	)
+	return crypto.Keccak256Hash([]byte("\x19\x01"), domain, message)
+}
+
+func (wr WalletRequest) digest(sigType string, chainID int64) (common.Hash, error) {
+	switch sigType {
+	case "", SignatureTypeEIP191:
+		return common.BytesToHash(accounts.TextHash([]byte(wr.EIP191Message()))), nil
+	case SignatureTypeEIP712:
+		return wr.EIP712Hash(chainID), nil
+	default:
+		return common.Hash{}, fmt.Errorf("unsupported signature type %q", sigType)
+	}
+}
+
+// SignWalletRequest signs req with key and sets the wallet authentication
+// headers. It is the agent-side counterpart of WalletAuthenticator.
+func SignWalletRequest(req *http.Request, body []byte, key *ecdsa.PrivateKey, sigType string, chainID int64) error {
+	nonce := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	wr := WalletRequest{
+		Address:   crypto.PubkeyToAddress(key.PublicKey),
+		Method:    req.Method,
+		Path:      req.URL.Path,
+		Query:     req.URL.RawQuery,
+		Timestamp: time.Now().Unix(),
+		Nonce:     hex.EncodeToString(nonce),
+		BodyHash:  crypto.Keccak256Hash(body),
+	}
+	digest, err := wr.digest(sigType, chainID)
+	if err != nil {
+		return err
+	}
+	sig, err := crypto.Sign(digest.Bytes(), key)
+	if err != nil {
+		return fmt.Errorf("failed to sign request: %v", err)
+	}
+
+	req.Header.Set(HeaderWalletAddress, wr.Address.Hex())
+	req.Header.Set(HeaderWalletTimestamp, strconv.FormatInt(wr.Timestamp, 10))
+	req.Header.Set(HeaderWalletNonce, wr.Nonce)
+	req.Header.Set(HeaderWalletSignature, fmt.Sprintf("0x%x", sig))
+	if sigType != "" {
+		req.Header.Set(HeaderWalletSigType, sigType)
+	}
+	return nil
+}
+
+// WalletAuthenticator authenticates requests signed by an Ethereum wallet.
+// The recovered address becomes the caller identity.
+type WalletAuthenticator struct {
+	allowed map[common.Address]bool
+	scopes  []string
+	maxSkew time.Duration
+	chainID int64
+	now     func() time.Time
+
+	mu        sync.Mutex
+	nonces    map[string]time.Time
+	lastSweep time.Time
+}
+
+// NewWalletAuthenticator creates a wallet authenticator from cfg
+func NewWalletAuthenticator(cfg WalletAuthConfig) (*WalletAuthenticator, error) {
+	a := &WalletAuthenticator{
+		scopes:  cfg.Scopes,
+		maxSkew: time.Duration(cfg.MaxSkewSeconds) * time.Second,
+		chainID: cfg.ChainID,
+		now:     time.Now,
+		nonces:  make(map[string]time.Time),
+	}
+	if len(a.scopes) == 0 {
+		a.scopes = []string{ScopeChat}
+	}
+	if a.maxSkew <= 0 {
+		a.maxSkew = 5 * time.Minute
+	}
+	if len(cfg.AllowedAddresses) > 0 {
+		a.allowed = make(map[common.Address]bool)
+		for _, addr := range cfg.AllowedAddresses {
+			if !common.IsHexAddress(addr) {
+				return nil, fmt.Errorf("invalid allowed address: %q", addr)
+			}
+			a.allowed[common.HexToAddress(addr)] = true
+		}
+	}
+	return a, nil
+}
+
+// Authenticate implements Authenticator
+func (a *WalletAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	sigHex := r.Header.Get(HeaderWalletSignature)
+	if sigHex == "" {
+		return nil, nil
+	}
+
+	addrHex := r.Header.Get(HeaderWalletAddress)
+	if !common.IsHexAddress(addrHex) {
+		return nil, errors.New("missing or invalid " + HeaderWalletAddress + " header")
+	}
+	timestamp, err := strconv.ParseInt(r.Header.Get(HeaderWalletTimestamp), 10, 64)
+	if err != nil {
+		return nil, errors.New("missing or invalid " + HeaderWalletTimestamp + " header")
+	}
+	nonce := r.Header.Get(HeaderWalletNonce)
+	if nonce == "" || len(nonce) > 128 {
+		return nil, errors.New("missing or invalid " + HeaderWalletNonce + " header")
+	}
+	now := a.now()
+	if skew := now.Sub(time.Unix(timestamp, 0)); skew > a.maxSkew || skew < -a.maxSkew {
+		return nil, errors.New("request timestamp is outside the allowed window")
+	}
+
+	// The body is hashed and then restored for the handler
+	var body []byte
+	if r.Body != nil {
+		if body, err = io.ReadAll(r.Body); err != nil {
+			return nil, fmt.Errorf("failed to read request body: %v", err)
+		}
+		r.Body.Close()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	wr := WalletRequest{
+		Address:   common.HexToAddress(addrHex),
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		Query:     r.URL.RawQuery,
+		Timestamp: timestamp,
+		Nonce:     nonce,
+		BodyHash:  crypto.Keccak256Hash(body),
+	}
+	digest, err := wr.digest(strings.ToLower(r.Header.Get(HeaderWalletSigType)), a.chainID)
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := hex.DecodeString(strings.TrimPrefix(sigHex, "0x"))
+	if err != nil || len(sig) != crypto.SignatureLength {
+		return nil, errors.New("malformed wallet signature")
+	}
+	// Wallets commonly produce V as 27/28; go-ethereum expects 0/1
+	if sig[crypto.RecoveryIDOffset] >= 27 {
+		sig[crypto.RecoveryIDOffset] -= 27
+	}
+	pub, err := crypto.SigToPub(digest.Bytes(), sig)
+	if err != nil {
+		return nil, errors.New("invalid wallet signature")
+	}
+	recovered := crypto.PubkeyToAddress(*pub)
+	if recovered != wr.Address {
+		return nil, errors.New("wallet signature does not match address")
+	}
+	if a.allowed != nil && !a.allowed[recovered] {
+		return nil, fmt.Errorf("address %s is not allowed", recovered.Hex())
+	}
+	if !a.useNonce(recovered, nonce, now) {
+		return nil, errors.New("nonce has already been used")
+	}
+
+	return &Identity{Subject: recovered.Hex(), Scopes: a.scopes, Method: "wallet"}, nil
+}
+
+// useNonce records a nonce and reports whether it was fresh. Nonces are kept
+// for twice the skew window, after which the timestamp check rejects replays.
+func (a *WalletAuthenticator) useNonce(addr common.Address, nonce string, now time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if now.Sub(a.lastSweep) > a.maxSkew {
+		for key, expires := range a.nonces {
+			if now.After(expires) {
+				delete(a.nonces, key)
+			}
+		}
+		a.lastSweep = now
+	}
+
+	key := addr.Hex() + "|" + nonce
+	if _, seen := a.nonces[key]; seen {
+		return false
+	}
+	a.nonces[key] = now.Add(2 * a.maxSkew)
+	return true
+}
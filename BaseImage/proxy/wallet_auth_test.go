@@ -0,0 +1,222 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+)
+
+func TestEIP712HashMatchesTypedData(t *testing.T) {
+	wr := WalletRequest{
+		Address:   common.HexToAddress("0x5B38Da6a701c568545dCfcB03FcB875f56beddC4"),
+		Method:    "POST",
+		Path:      "/v1/chat/completions",
+		Query:     "fresh=true",
+		Timestamp: 1700000000,
+		Nonce:     "abc123",
+		BodyHash:  crypto.Keccak256Hash([]byte(`{"model":"llama"}`)),
+	}
+	typedData := apitypes.TypedData{
+		Types: apitypes.Types{
+			"EIP712Domain": {
+				{Name: "name", Type: "string"},
+				{Name: "version", Type: "string"},
+				{Name: "chainId", Type: "uint256"},
+			},
+			"Request": {
+				{Name: "address", Type: "address"},
+				{Name: "method", Type: "string"},
+				{Name: "path", Type: "string"},
+				{Name: "query", Type: "string"},
+				{Name: "timestamp", Type: "uint256"},
+				{Name: "nonce", Type: "string"},
+				{Name: "bodyHash", Type: "bytes32"},
+			},
+		},
+		PrimaryType: "Request",
+		Domain: apitypes.TypedDataDomain{
+			Name:    "NFA Proxy",
+			Version: "1",
+			ChainId: math.NewHexOrDecimal256(421614),
+		},
+		Message: apitypes.TypedDataMessage{
+			"address":   wr.Address.Hex(),
+			"method":    wr.Method,
+			"path":      wr.Path,
+			"query":     wr.Query,
+			"timestamp": "1700000000",
+			"nonce":     wr.Nonce,
+			"bodyHash":  hexutil.Encode(wr.BodyHash.Bytes()),
+		},
+	}
+	want, _, err := apitypes.TypedDataAndHash(typedData)
+	if err != nil {
+		t.Fatalf("TypedDataAndHash() error = %v", err)
+	}
+	if got := wr.EIP712Hash(421614); !bytes.Equal(got.Bytes(), want) {
+		t.Errorf("EIP712Hash() = %x, want %x", got, want)
+	}
+}
+
+func TestWalletAuthenticator(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	other, _ := crypto.GenerateKey()
+	address := crypto.PubkeyToAddress(key.PublicKey)
+
+	a, err := NewWalletAuthenticator(WalletAuthConfig{
+		AllowedAddresses: []string{address.Hex()},
+		ChainID:          421614,
+	})
+	if err != nil {
+		t.Fatalf("NewWalletAuthenticator() error = %v", err)
+	}
+
+	body := []byte(`{"model":"llama","messages":[]}`)
+	signed := func(sigType string) *http.Request {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(body))
+		if err := SignWalletRequest(req, body, key, sigType, 421614); err != nil {
+			t.Fatalf("SignWalletRequest() error = %v", err)
+		}
+		return req
+	}
+
+	for _, sigType := range []string{"", SignatureTypeEIP191, SignatureTypeEIP712} {
+		req := signed(sigType)
+		id, err := a.Authenticate(req)
+		if err != nil || id == nil {
+			t.Fatalf("%q signature rejected: %v", sigType, err)
+		}
+		if id.Subject != address.Hex() || !id.HasScope(ScopeChat) {
+			t.Errorf("unexpected identity: %+v", id)
+		}
+		if restored, _ := io.ReadAll(req.Body); !bytes.Equal(restored, body) {
+			t.Error("request body should be restored for the handler")
+		}
+
+		// The same signed request cannot be replayed
+		replay := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(body))
+		replay.Header = req.Header.Clone()
+		if _, err := a.Authenticate(replay); err == nil {
+			t.Errorf("%q replay should be rejected", sigType)
+		}
+	}
+
+	t.Run("tampered body", func(t *testing.T) {
+		req := signed("")
+		req.Body = io.NopCloser(bytes.NewReader([]byte(`{"model":"expensive"}`)))
+		if _, err := a.Authenticate(req); err == nil {
+			t.Error("tampered body should be rejected")
+		}
+	})
+
+	t.Run("tampered query", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/v1/async/jobs?limit=1", nil)
+		SignWalletRequest(req, nil, key, "", 421614)
+		req.URL.RawQuery = "limit=1000"
+		if _, err := a.Authenticate(req); err == nil {
+			t.Error("tampered query should be rejected")
+		}
+	})
+
+	t.Run("stale timestamp", func(t *testing.T) {
+		req := signed("")
+		a.now = func() time.Time { return time.Now().Add(10 * time.Minute) }
+		defer func() { a.now = time.Now }()
+		if _, err := a.Authenticate(req); err == nil {
+			t.Error("stale request should be rejected")
+		}
+	})
+
+	t.Run("address not allowed", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(body))
+		SignWalletRequest(req, body, other, "", 421614)
+		if _, err := a.Authenticate(req); err == nil {
+			t.Error("address outside the allow-list should be rejected")
+		}
+	})
+
+	t.Run("spoofed address", func(t *testing.T) {
+		req := signed("")
+		req.Header.Set(HeaderWalletAddress, crypto.PubkeyToAddress(other.PublicKey).Hex())
+		if _, err := a.Authenticate(req); err == nil {
+			t.Error("signature for a different address should be rejected")
+		}
+	})
+
+	t.Run("legacy V value", func(t *testing.T) {
+		req := signed("")
+		sig, _ := hexutil.Decode(req.Header.Get(HeaderWalletSignature))
+		sig[crypto.RecoveryIDOffset] += 27
+		req.Header.Set(HeaderWalletSignature, hexutil.Encode(sig))
+		if _, err := a.Authenticate(req); err != nil {
+			t.Errorf("V of 27/28 should be accepted: %v", err)
+		}
+	})
+
+	if id, err := a.Authenticate(httptest.NewRequest("GET", "/", nil)); id != nil || err != nil {
+		t.Errorf("unsigned requests should be left to other authenticators, got %+v, %v", id, err)
+	}
+}
+
+func TestWalletAuthenticatorNonceExpiry(t *testing.T) {
+	a, _ := NewWalletAuthenticator(WalletAuthConfig{MaxSkewSeconds: 60})
+	addr := common.HexToAddress("0x01")
+	now := time.Unix(1700000000, 0)
+
+	if !a.useNonce(addr, "n1", now) {
+		t.Fatal("fresh nonce rejected")
+	}
+	if a.useNonce(addr, "n1", now.Add(time.Minute)) {
+		t.Error("nonce reused inside the window should be rejected")
+	}
+	if !a.useNonce(common.HexToAddress("0x02"), "n1", now) {
+		t.Error("nonces are scoped per address")
+	}
+	a.useNonce(addr, "n2", now.Add(3*time.Minute))
+	if _, ok := a.nonces[addr.Hex()+"|n1"]; ok {
+		t.Error("expired nonces should be swept")
+	}
+}
+
+func TestRequireScopeWalletCaller(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	a, _ := NewWalletAuthenticator(WalletAuthConfig{})
+	p := NewProxy()
+	p.authenticators = []Authenticator{a}
+
+	var gotCaller string
+	handler := p.requireScope(ScopeChat, func(w http.ResponseWriter, r *http.Request) {
+		gotCaller = callerID(r)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	body := []byte(`{}`)
+	req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(body))
+	SignWalletRequest(req, body, key, SignatureTypeEIP712, 0)
+	w := httptest.NewRecorder()
+	handler(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusNoContent)
+	}
+	if want := crypto.PubkeyToAddress(key.PublicKey).Hex(); gotCaller != want {
+		t.Errorf("caller = %q, want %q", gotCaller, want)
+	}
+
+	// A replayed request is rejected as an invalid credential
+	replay := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(body))
+	replay.Header = req.Header.Clone()
+	w = httptest.NewRecorder()
+	handler(w, replay)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("replay status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
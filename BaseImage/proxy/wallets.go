@@ -0,0 +1,400 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// WalletsConfig tracks the wallet behind each consumer node, so new sessions
+// go to wallets that can pay for them, and can keep those wallets funded
+type WalletsConfig struct {
+	// CheckInterval is how often each wallet's balances and allowance are
+	// read. 0 turns wallet tracking off.
+	CheckInterval Duration `json:"check_interval" env:"WALLET_CHECK_INTERVAL"`
+	// MinMOR and MinETH mark a wallet as low. New sessions avoid low wallets
+	// while another wallet has enough.
+	MinMOR string `json:"min_mor" env:"WALLET_MIN_MOR"`
+	MinETH string `json:"min_eth" env:"WALLET_MIN_ETH"`
+	// AllowanceSpender is the contract whose MOR allowance is tracked,
+	// usually the Morpheus diamond. A wallet whose allowance is below
+	// MinAllowance is low.
+	AllowanceSpender string      `json:"allowance_spender" env:"WALLET_ALLOWANCE_SPENDER"`
+	MinAllowance     string      `json:"min_allowance" env:"WALLET_MIN_ALLOWANCE"`
+	TopUp            TopUpConfig `json:"top_up"`
+}
+
+// TopUpConfig sends MOR from a treasury wallet to wallets that run low
+type TopUpConfig struct {
+	// Treasury is the consumer node whose wallet sends the MOR. Empty turns
+	// top-ups off.
+	Treasury string `json:"treasury" env:"WALLET_TOPUP_TREASURY"`
+	// Below is the MOR balance under which a wallet is topped up
+	Below string `json:"below" env:"WALLET_TOPUP_BELOW"`
+	// Amount is the MOR sent by each top-up
+	Amount string `json:"amount" env:"WALLET_TOPUP_AMOUNT"`
+	// Cooldown is the least time between top-ups of one wallet, so that a
+	// top-up is mined and seen before another is sent
+	Cooldown Duration `json:"cooldown" env:"WALLET_TOPUP_COOLDOWN"`
+}
+
+func (c WalletsConfig) validate() error {
+	var errs []error
+	if c.CheckInterval.Duration < 0 {
+		errs = append(errs, errors.New("check_interval must not be negative"))
+	}
+	for _, amount := range []struct{ name, value string }{
+		{"min_mor", c.MinMOR}, {"min_eth", c.MinETH}, {"min_allowance", c.MinAllowance},
+		{"top_up.below", c.TopUp.Below}, {"top_up.amount", c.TopUp.Amount},
+	} {
+		if _, err := parseMOR(amount.value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", amount.name, err))
+		}
+	}
+	if c.AllowanceSpender != "" && !common.IsHexAddress(c.AllowanceSpender) {
+		errs = append(errs, fmt.Errorf("allowance_spender: invalid address %q", c.AllowanceSpender))
+	}
+	if c.MinAllowance != "" && c.AllowanceSpender == "" {
+		errs = append(errs, errors.New("min_allowance needs allowance_spender"))
+	}
+	if c.TopUp.Treasury != "" {
+		if !validHTTPURL(c.TopUp.Treasury) {
+			errs = append(errs, fmt.Errorf("top_up.treasury: invalid URL %q", c.TopUp.Treasury))
+		}
+		if below, _ := parseMOR(c.TopUp.Below); below == nil || below.Sign() == 0 {
+			errs = append(errs, errors.New("top_up.below must be positive"))
+		}
+		if amount, _ := parseMOR(c.TopUp.Amount); amount == nil || amount.Sign() == 0 {
+			errs = append(errs, errors.New("top_up.amount must be positive"))
+		}
+		if c.TopUp.Cooldown.Duration <= 0 {
+			errs = append(errs, errors.New("top_up.cooldown must be positive"))
+		}
+		if c.CheckInterval.Duration <= 0 {
+			errs = append(errs, errors.New("top_up needs a positive check_interval"))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// WalletStatus is what the proxy last read of a consumer node's wallet
+type WalletStatus struct {
+	Node      string `json:"node"`
+	Address   string `json:"address,omitempty"`
+	ETH       string `json:"eth,omitempty"`
+	MOR       string `json:"mor,omitempty"`
+	Allowance string `json:"allowance,omitempty"`
+	// Low is set when the wallet is below a minimum, for the reasons listed
+	Low                 bool       `json:"low"`
+	Problems            []string   `json:"problems,omitempty"`
+	PendingTransactions int        `json:"pending_transactions"`
+	CheckedAt           *time.Time `json:"checked_at,omitempty"`
+	Error               string     `json:"error,omitempty"`
+	LastTopUp           *time.Time `json:"last_top_up,omitempty"`
+	TopUpError          string     `json:"top_up_error,omitempty"`
+}
+
+// walletState is the tracked state of one wallet
+type walletState struct {
+	address             string
+	eth, mor, allowance *big.Int
+	problems            []string
+	checkedAt           time.Time
+	err                 string
+	lastTopUp           time.Time
+	topUpErr            string
+}
+
+// walletTracker holds the last reading of each consumer node's wallet
+type walletTracker struct {
+	mu      sync.Mutex
+	wallets map[string]*walletState // by node URL
+}
+
+func newWalletTracker() *walletTracker {
+	return &walletTracker{wallets: make(map[string]*walletState)}
+}
+
+func (t *walletTracker) state(node string) *walletState {
+	w, ok := t.wallets[node]
+	if !ok {
+		w = &walletState{}
+		t.wallets[node] = w
+	}
+	return w
+}
+
+// low reports whether the node's wallet was below a minimum when last read.
+// Wallets that have not been read are not low.
+func (t *walletTracker) low(node string) bool {
+	if t == nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	w, ok := t.wallets[node]
+	return ok && len(w.problems) > 0
+}
+
+// walletNodes lists the consumer nodes whose wallets make up the pool
+func (p *Proxy) walletNodes() []string {
+	if p.nodes == nil {
+		return []string{p.pickNode().URL}
+	}
+	nodes := make([]string, len(p.nodes.nodes))
+	for i, n := range p.nodes.nodes {
+		nodes[i] = n.URL
+	}
+	return nodes
+}
+
+// pickSessionNode returns the node to open a new session on. Healthy nodes
+// whose wallet is not low and has no transaction in flight come first, then
+// any whose wallet is not low, then any node.
+func (p *Proxy) pickSessionNode() *consumerNode {
+	if p.nodes == nil {
+		return p.pickNode()
+	}
+	return p.nodes.PickWhere(
+		func(n *consumerNode) bool { return !p.wallets.low(n.URL) && p.txs.pending(n.URL) == 0 },
+		func(n *consumerNode) bool { return !p.wallets.low(n.URL) },
+	)
+}
+
+// watchWallets reads every wallet each interval, and tops up those that run
+// low, until ctx is done
+func (p *Proxy) watchWallets(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		p.checkWallets(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkWallets reads the address, balances and allowance of each wallet
+func (p *Proxy) checkWallets(ctx context.Context) {
+	cfg := p.cfg().Wallets
+	client := p.httpClient(p.cfg().Marketplace.RequestTimeout.Duration)
+	minMOR, _ := parseMOR(cfg.MinMOR)
+	minETH, _ := parseMOR(cfg.MinETH)
+	minAllowance, _ := parseMOR(cfg.MinAllowance)
+
+	for _, node := range p.walletNodes() {
+		if ctx.Err() != nil {
+			return
+		}
+		p.wallets.mu.Lock()
+		address := p.wallets.state(node).address
+		p.wallets.mu.Unlock()
+
+		var err error
+		if address == "" {
+			address, err = getWalletAddress(client, node)
+		}
+		var eth, mor, allowance *big.Int
+		if err == nil {
+			eth, mor, err = getNodeBalance(client, node)
+		}
+		if err == nil && cfg.AllowanceSpender != "" {
+			allowance, err = getAllowance(client, node, cfg.AllowanceSpender)
+		}
+
+		var problems []string
+		if err == nil {
+			for _, b := range []struct {
+				name     string
+				value    *big.Int
+				min      *big.Int
+				minValue string
+			}{{"MOR balance", mor, minMOR, cfg.MinMOR}, {"ETH balance", eth, minETH, cfg.MinETH}, {"MOR allowance", allowance, minAllowance, cfg.MinAllowance}} {
+				if b.min != nil && b.value != nil && b.value.Cmp(b.min) < 0 {
+					problems = append(problems, fmt.Sprintf("%s %s is below %s", b.name, formatMOR(b.value), b.minValue))
+				}
+			}
+		}
+
+		p.wallets.mu.Lock()
+		w := p.wallets.state(node)
+		w.address = address
+		w.checkedAt = time.Now()
+		if err != nil {
+			// Keep the last reading, so one failed read does not move sessions
+			w.err = err.Error()
+		} else {
+			wasLow := len(w.problems) > 0
+			w.eth, w.mor, w.allowance, w.problems, w.err = eth, mor, allowance, problems, ""
+			if len(problems) > 0 && !wasLow {
+				p.logger.Printf("Wallet of consumer node %s is low: %s", node, strings.Join(problems, "; "))
+			} else if len(problems) == 0 && wasLow {
+				p.logger.Printf("Wallet of consumer node %s is funded again", node)
+			}
+		}
+		p.wallets.mu.Unlock()
+		if err != nil {
+			p.logger.Printf("Error reading wallet of consumer node %s: %v", node, err)
+			continue
+		}
+
+		if cfg.TopUp.Treasury != "" {
+			p.maybeTopUp(client, node, address, mor, cfg.TopUp)
+		}
+	}
+}
+
+// maybeTopUp sends MOR from the treasury to a wallet below the top-up level
+func (p *Proxy) maybeTopUp(client *http.Client, node, address string, mor *big.Int, cfg TopUpConfig) {
+	treasury := strings.TrimRight(cfg.Treasury, "/")
+	below, _ := parseMOR(cfg.Below)
+	amount, _ := parseMOR(cfg.Amount)
+	if node == treasury || mor.Cmp(below) >= 0 {
+		return
+	}
+	p.wallets.mu.Lock()
+	w := p.wallets.state(node)
+	if time.Since(w.lastTopUp) < cfg.Cooldown.Duration {
+		p.wallets.mu.Unlock()
+		return
+	}
+	w.lastTopUp = time.Now()
+	p.wallets.mu.Unlock()
+
+	p.logger.Printf("Topping up wallet %s of consumer node %s with %s MOR from the treasury", address, node, formatMOR(amount))
+	err := p.sendTx(treasury, func() error { return sendMOR(client, treasury, address, amount) })
+
+	p.wallets.mu.Lock()
+	if err != nil {
+		w.topUpErr = err.Error()
+	} else {
+		w.topUpErr = ""
+	}
+	p.wallets.mu.Unlock()
+	if err != nil {
+		p.logger.Printf("Error topping up wallet of consumer node %s: %v", node, err)
+	}
+}
+
+// getWalletAddress returns the address of a consumer node's wallet
+func getWalletAddress(client *http.Client, node string) (string, error) {
+	var result struct {
+		Address string `json:"address"`
+	}
+	if err := getNodeJSON(client, node+"/wallet", "wallet address", &result); err != nil {
+		return "", err
+	}
+	if !common.IsHexAddress(result.Address) {
+		return "", fmt.Errorf("invalid wallet address %q", result.Address)
+	}
+	return result.Address, nil
+}
+
+// getAllowance returns how much MOR spender may spend from the node's wallet
+func getAllowance(client *http.Client, node, spender string) (*big.Int, error) {
+	var result struct {
+		Allowance json.RawMessage `json:"allowance"`
+	}
+	if err := getNodeJSON(client, node+"/blockchain/allowance?spender="+url.QueryEscape(spender), "allowance", &result); err != nil {
+		return nil, err
+	}
+	allowance, ok := parseWei(result.Allowance)
+	if !ok {
+		return nil, fmt.Errorf("invalid allowance: %s", string(result.Allowance))
+	}
+	return allowance, nil
+}
+
+func getNodeJSON(client *http.Client, endpoint, what string, v interface{}) error {
+	resp, err := client.Get(endpoint)
+	if err != nil {
+		return fmt.Errorf("failed to fetch %s: %v", what, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", what, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch %s, status: %d", what, resp.StatusCode)
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("failed to decode %s: %v", what, err)
+	}
+	return nil
+}
+
+// sendMOR transfers amount wei of MOR from the node's wallet to address
+func sendMOR(client *http.Client, node, address string, amount *big.Int) error {
+	body, _ := json.Marshal(map[string]string{"to": address, "amount": amount.String()})
+	resp, err := client.Post(node+"/blockchain/send/mor", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to send MOR: %v", err)
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return chainError("send MOR", resp.StatusCode, respBody)
+	}
+	return nil
+}
+
+// walletStatus reports every wallet in the pool
+func (p *Proxy) walletStatus() []WalletStatus {
+	if p.wallets == nil {
+		return []WalletStatus{}
+	}
+	p.wallets.mu.Lock()
+	defer p.wallets.mu.Unlock()
+	out := []WalletStatus{}
+	for _, node := range p.walletNodes() {
+		w := p.wallets.state(node)
+		s := WalletStatus{
+			Node:                node,
+			Address:             w.address,
+			ETH:                 formatMOR(w.eth),
+			MOR:                 formatMOR(w.mor),
+			Allowance:           formatMOR(w.allowance),
+			Low:                 len(w.problems) > 0,
+			Problems:            w.problems,
+			PendingTransactions: p.txs.pending(node),
+			Error:               w.err,
+			TopUpError:          w.topUpErr,
+		}
+		if !w.checkedAt.IsZero() {
+			checked := w.checkedAt
+			s.CheckedAt = &checked
+		}
+		if !w.lastTopUp.IsZero() {
+			topUp := w.lastTopUp
+			s.LastTopUp = &topUp
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+// handleAdminWallets reports the wallet pool on GET /admin/wallets
+func (p *Proxy) handleAdminWallets(w http.ResponseWriter, r *http.Request) {
+	if !p.requireAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		respondWithAPIError(w, http.StatusMethodNotAllowed, newAPIError("invalid_request_error", "", "", "Method not allowed"))
+		return
+	}
+	writeAdminJSON(w, map[string]interface{}{"wallets": p.walletStatus()})
+}
@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// walletNode is a consumer node with a wallet holding mor wei of MOR
+type walletNode struct {
+	*httptest.Server
+	address string
+
+	mu       sync.Mutex
+	mor      *big.Int
+	sessions int
+	sent     []map[string]string
+}
+
+func newWalletNode(t *testing.T, address, mor string) *walletNode {
+	t.Helper()
+	n := &walletNode{address: address}
+	n.mor, _ = parseMOR(mor)
+	n.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		switch {
+		case r.URL.Path == "/wallet":
+			json.NewEncoder(w).Encode(map[string]string{"address": n.address})
+		case r.URL.Path == "/blockchain/balance":
+			json.NewEncoder(w).Encode(map[string]string{"ETH": "1000000000000000000", "MOR": n.mor.String()})
+		case r.URL.Path == "/blockchain/allowance":
+			json.NewEncoder(w).Encode(map[string]string{"allowance": "5000000000000000000"})
+		case r.URL.Path == "/blockchain/send/mor":
+			var body map[string]string
+			json.NewDecoder(r.Body).Decode(&body)
+			n.sent = append(n.sent, body)
+		case strings.HasSuffix(r.URL.Path, "/session"):
+			n.sessions++
+			json.NewEncoder(w).Encode(map[string]string{"sessionID": "s"})
+		}
+	}))
+	t.Cleanup(n.Close)
+	return n
+}
+
+func newWalletServer(t *testing.T, configure func(*Config), nodes ...*walletNode) *Server {
+	t.Helper()
+	cfg, err := LoadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Marketplace.URL = nodes[0].URL
+	for _, n := range nodes {
+		cfg.Marketplace.Nodes = append(cfg.Marketplace.Nodes, n.URL)
+	}
+	cfg.Wallets.MinMOR = "1"
+	if configure != nil {
+		configure(cfg)
+	}
+	s, err := New(cfg, WithLogger(log.New(io.Discard, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestSessionsAvoidLowAndBusyWallets(t *testing.T) {
+	funded := newWalletNode(t, "0x1111111111111111111111111111111111111111", "10")
+	low := newWalletNode(t, "0x2222222222222222222222222222222222222222", "0.5")
+	s := newWalletServer(t, nil, low, funded)
+	s.checkWallets(context.Background())
+
+	for i := 0; i < 4; i++ {
+		if _, err := s.createSession("model"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if funded.sessions != 4 || low.sessions != 0 {
+		t.Errorf("sessions on funded = %d, low = %d", funded.sessions, low.sessions)
+	}
+
+	// While the funded wallet is sending a transaction, a second funded
+	// wallet takes the session
+	other := newWalletNode(t, "0x3333333333333333333333333333333333333333", "10")
+	s = newWalletServer(t, nil, funded, other)
+	s.txs.add(funded.URL, 1)
+	if n := s.pickSessionNode(); n.URL != other.URL {
+		t.Errorf("pickSessionNode() = %s, want the idle wallet %s", n.URL, other.URL)
+	}
+	s.txs.add(funded.URL, -1)
+
+	// With every wallet low, sessions still go somewhere
+	funded.mu.Lock()
+	funded.mor.SetInt64(0)
+	funded.mu.Unlock()
+	s = newWalletServer(t, nil, low, funded)
+	s.checkWallets(context.Background())
+	if n := s.pickSessionNode(); n == nil {
+		t.Error("no node picked when every wallet is low")
+	}
+}
+
+func TestPassthroughSessionsArePlacedOnPool(t *testing.T) {
+	funded := newWalletNode(t, "0x1111111111111111111111111111111111111111", "10")
+	low := newWalletNode(t, "0x2222222222222222222222222222222222222222", "0.5")
+	s := newWalletServer(t, nil, low, funded)
+	s.checkWallets(context.Background())
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/blockchain/models/model/session", strings.NewReader(`{"sessionDuration":600}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if funded.sessions != 1 || low.sessions != 0 {
+		t.Errorf("sessions on funded = %d, low = %d", funded.sessions, low.sessions)
+	}
+	if n := s.sessionNode("s"); n.URL != funded.URL {
+		t.Errorf("session node = %s, want %s", n.URL, funded.URL)
+	}
+	if status := s.nodes.Status(); status[1].Requests != 1 || status[1].Outstanding != 0 {
+		t.Errorf("node status = %+v", status)
+	}
+}
+
+func TestWalletTopUpFromTreasury(t *testing.T) {
+	treasury := newWalletNode(t, "0x1111111111111111111111111111111111111111", "100")
+	low := newWalletNode(t, "0x2222222222222222222222222222222222222222", "0.5")
+	s := newWalletServer(t, func(cfg *Config) {
+		cfg.AdminAPIKey = "admin"
+		cfg.Wallets.CheckInterval = Duration{time.Hour}
+		cfg.Wallets.TopUp = TopUpConfig{Treasury: treasury.URL, Below: "2", Amount: "5", Cooldown: Duration{time.Hour}}
+	}, treasury, low)
+
+	// The first check runs when the server starts; a second one inside the
+	// cooldown sends nothing more
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		treasury.mu.Lock()
+		sent := len(treasury.sent)
+		treasury.mu.Unlock()
+		if sent > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no top-up was sent")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	s.checkWallets(context.Background())
+	treasury.mu.Lock()
+	if len(treasury.sent) != 1 || treasury.sent[0]["to"] != low.address || treasury.sent[0]["amount"] != "5000000000000000000" {
+		t.Errorf("top-ups = %v", treasury.sent)
+	}
+	treasury.mu.Unlock()
+
+	req := httptest.NewRequest("GET", "/admin/wallets", nil)
+	req.Header.Set("Authorization", "Bearer admin")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	var got struct {
+		Wallets []WalletStatus `json:"wallets"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || len(got.Wallets) != 2 {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if status := got.Wallets[1]; status.Address != low.address || status.MOR != "0.5" || !status.Low || status.LastTopUp == nil || status.TopUpError != "" {
+		t.Errorf("low wallet = %+v", status)
+	}
+	if status := got.Wallets[0]; status.Low || status.LastTopUp != nil {
+		t.Errorf("treasury = %+v", status)
+	}
+}
+
+func TestWalletsConfigValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  WalletsConfig
+		ok   bool
+	}{
+		{"disabled", WalletsConfig{}, true},
+		{"minimums", WalletsConfig{CheckInterval: Duration{time.Minute}, MinMOR: "1.5", MinETH: "0.01"}, true},
+		{"bad amount", WalletsConfig{MinMOR: "lots"}, false},
+		{"bad spender", WalletsConfig{AllowanceSpender: "diamond", MinAllowance: "1"}, false},
+		{"allowance without spender", WalletsConfig{MinAllowance: "1"}, false},
+		{"top-up", WalletsConfig{CheckInterval: Duration{time.Minute}, TopUp: TopUpConfig{Treasury: "http://treasury:8082", Below: "1", Amount: "5", Cooldown: Duration{time.Hour}}}, true},
+		{"top-up without checks", WalletsConfig{TopUp: TopUpConfig{Treasury: "http://treasury:8082", Below: "1", Amount: "5", Cooldown: Duration{time.Hour}}}, false},
+		{"top-up without amount", WalletsConfig{CheckInterval: Duration{time.Minute}, TopUp: TopUpConfig{Treasury: "http://treasury:8082", Below: "1", Cooldown: Duration{time.Hour}}}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.cfg.validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: validate() = %v", tt.name, err)
+		}
+	}
+}